@@ -6,13 +6,15 @@ import (
 	"os"
 
 	driver "github.com/Datera/datera-csi/pkg/driver"
+	host "github.com/Datera/datera-csi/pkg/host"
 	log "github.com/sirupsen/logrus"
 
 	udc "github.com/Datera/go-udc/pkg/udc"
 )
 
 var (
-	version = flag.Bool("version", false, "Show version information")
+	version    = flag.Bool("version", false, "Show version information")
+	configFile = flag.String("config", "", "Path to a YAML or JSON driver config file.  DAT_* environment variables override its values")
 )
 
 func Main() int {
@@ -22,13 +24,20 @@ func Main() int {
 		fmt.Printf("Datera CSI Plugin Version: %s-%s\n", driver.Version, driver.Githash)
 		os.Exit(0)
 	}
-	conf, err := udc.GetConfig()
+	conf, err := driver.LoadConfig(*configFile)
 	if err != nil {
 		log.Fatal(err)
 	}
-	log.Info("Using Universal Datera Config")
-	udc.PrintConfig()
-	d, err := driver.NewDateraDriver(conf)
+	if conf.Backend == nil {
+		log.Info("No backend in driver config, using Universal Datera Config")
+		if conf.Backend, err = udc.GetConfig(); err != nil && conf.NodeOnly() {
+			log.Info("No Datera API credentials, running the node plugin without them")
+			conf.Backend = &udc.UDC{Tenant: "/root", ApiVersion: "2.2"}
+		} else if err != nil {
+			log.Fatal(err)
+		}
+	}
+	d, err := driver.NewDateraDriverWithConfig(conf, nil, host.NewHost())
 	if err != nil {
 		log.Fatal(err)
 	}
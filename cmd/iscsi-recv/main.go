@@ -10,8 +10,8 @@ import (
 	"path/filepath"
 	"strings"
 
-	dc "github.com/Datera/datera-csi/pkg/client"
 	co "github.com/Datera/datera-csi/pkg/common"
+	host "github.com/Datera/datera-csi/pkg/host"
 	pb "github.com/Datera/datera-csi/pkg/iscsi-rpc"
 	"google.golang.org/grpc"
 	codes "google.golang.org/grpc/codes"
@@ -37,7 +37,7 @@ func (s *server) SendArgs(ctx context.Context, in *pb.SendArgsRequest) (*pb.Send
 	ctxt := co.WithCtxt(ctx, "iscsi-recv SendArgs", "")
 	co.Debugf(ctxt, "Recieved message, %#v", in)
 	cmd := strings.Split(in.Args, " ")
-	result, err := co.RunCmd(ctxt, cmd...)
+	result, err := host.NewExecutor().Run(ctxt, cmd...)
 	if err != nil {
 		return nil, status.Errorf(codes.Unknown, err.Error())
 	}
@@ -46,7 +46,7 @@ func (s *server) SendArgs(ctx context.Context, in *pb.SendArgsRequest) (*pb.Send
 
 func (s *server) GetInitiatorName(ctx context.Context, in *pb.GetInitiatorNameRequest) (*pb.GetInitiatorNameReply, error) {
 	ctxt := co.WithCtxt(ctx, "iscsi-recv GetInitiatorName", "")
-	iqn, err := dc.GetClientIqn(ctxt)
+	iqn, err := host.NewHost().InitiatorName(ctxt)
 	if err != nil {
 		return nil, status.Errorf(codes.Unknown, err.Error())
 	}
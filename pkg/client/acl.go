@@ -3,45 +3,54 @@ package client
 import (
 	"context"
 	"fmt"
-	"io/ioutil"
-	"strings"
 
 	co "github.com/Datera/datera-csi/pkg/common"
 	dsdk "github.com/Datera/go-sdk/pkg/dsdk"
 )
 
-var (
-	initiatorFile = "/etc/iscsi/initiatorname.iscsi"
-)
-
 type Initiator struct {
-	ctxt context.Context
-	dc   *DateraClient
-	Init *dsdk.Initiator
-	Name string
-	Path string
-	Iqn  string
+	dc     *DateraClient
+	Init   *dsdk.Initiator
+	Tenant string
+	Name   string
+	Path   string
+	Iqn    string
 }
 
-// Gets an Initiator path based on IQN.  If that initiator does not exist it creates the Initiator
-// then returns the path to the newly created Initiator
-func (r *DateraClient) CreateGetInitiator() (*Initiator, error) {
-	ctxt := context.WithValue(r.ctxt, co.ReqName, "CreateGetInitiator")
+// Requests for an initiator are made in its tenant
+func (r *Initiator) reqCtxt(ctxt context.Context, reqName string) context.Context {
+	return r.dc.reqCtxt(co.WithTenant(ctxt, r.Tenant), reqName)
+}
+
+// Gets an Initiator path based on the IQN of the local host.  If that initiator does not exist it
+// creates the Initiator then returns the path to the newly created Initiator
+func (r *DateraClient) CreateGetInitiator(ctxt context.Context) (*Initiator, error) {
+	ctxt = r.reqCtxt(ctxt, "CreateGetInitiator")
 	co.Debugf(ctxt, "CreateGetInitiator invoked")
-	iqn, err := GetClientIqn(ctxt)
+	iqn, err := r.host.InitiatorName(ctxt)
 	if err != nil {
 		co.Error(ctxt, err)
 		return nil, err
 	}
-	co.Debugf(ctxt, "CreateGetInitiator invoked for %s", iqn)
+	return r.CreateGetInitiatorFromIqn(ctxt, iqn)
+}
+
+// Same as CreateGetInitiator, but for an arbitrary IQN.  This is used by the
+// controller which registers initiators on behalf of the nodes
+func (r *DateraClient) CreateGetInitiatorFromIqn(ctxt context.Context, iqn string) (*Initiator, error) {
+	ctxt = r.reqCtxt(ctxt, "CreateGetInitiatorFromIqn")
+	co.Debugf(ctxt, "CreateGetInitiatorFromIqn invoked for %s", iqn)
+	if iqn == "" {
+		return nil, fmt.Errorf("Initiator IQN cannot be an empty string")
+	}
 	init, apierr, err := r.sdk.Initiators.Get(&dsdk.InitiatorsGetRequest{
 		Ctxt: ctxt,
 		Id:   iqn,
 	})
 	if apierr != nil {
 		if apierr.Name != "NotFoundError" {
-			co.Error(ctxt, err)
-			return nil, err
+			co.Errorf(ctxt, "%s, %s", dsdk.Pretty(apierr), err)
+			return nil, co.ErrTranslator(apierr)
 		}
 		init, apierr, err = r.sdk.Initiators.Create(&dsdk.InitiatorsCreateRequest{
 			Ctxt:  ctxt,
@@ -59,17 +68,43 @@ func (r *DateraClient) CreateGetInitiator() (*Initiator, error) {
 
 	}
 	return &Initiator{
-		ctxt: ctxt,
-		dc:   r,
-		Init: init,
-		Name: init.Name,
-		Path: init.Path,
-		Iqn:  init.Id,
+		dc:     r,
+		Init:   init,
+		Tenant: r.Tenant(ctxt),
+		Name:   init.Name,
+		Path:   init.Path,
+		Iqn:    init.Id,
+	}, nil
+}
+
+// Gets an Initiator based on IQN without creating it.  Returns a NotFound
+// error if the initiator has not been registered with the backend
+func (r *DateraClient) GetInitiator(ctxt context.Context, iqn string) (*Initiator, error) {
+	ctxt = r.reqCtxt(ctxt, "GetInitiator")
+	co.Debugf(ctxt, "GetInitiator invoked for %s", iqn)
+	init, apierr, err := r.sdk.Initiators.Get(&dsdk.InitiatorsGetRequest{
+		Ctxt: ctxt,
+		Id:   iqn,
+	})
+	if err != nil {
+		co.Error(ctxt, err)
+		return nil, err
+	} else if apierr != nil {
+		co.Errorf(ctxt, "%s, %s", dsdk.Pretty(apierr), err)
+		return nil, co.ErrTranslator(apierr)
+	}
+	return &Initiator{
+		dc:     r,
+		Init:   init,
+		Tenant: r.Tenant(ctxt),
+		Name:   init.Name,
+		Path:   init.Path,
+		Iqn:    init.Id,
 	}, nil
 }
 
-func (r *Initiator) Delete(quiet bool) error {
-	ctxt := context.WithValue(r.ctxt, co.ReqName, "Initiator Delete")
+func (r *Initiator) Delete(ctxt context.Context, quiet bool) error {
+	ctxt = r.reqCtxt(ctxt, "Initiator Delete")
 	co.Debugf(ctxt, "Initiator Delete invoked")
 	_, apierr, err := r.Init.Delete(&dsdk.InitiatorDeleteRequest{
 		Ctxt: ctxt,
@@ -91,8 +126,8 @@ func (r *Initiator) Delete(quiet bool) error {
 	return nil
 }
 
-func (r *Volume) RegisterAcl(cinit *Initiator) error {
-	ctxt := context.WithValue(r.ctxt, co.ReqName, "RegisterAcl")
+func (r *Volume) RegisterAcl(ctxt context.Context, cinit *Initiator) error {
+	ctxt = r.reqCtxt(ctxt, "RegisterAcl")
 	co.Debugf(ctxt, "RegisterAcl invoked for %s with initiator %s", r.Name, cinit.Name)
 	// Update existing AclPolicy if it exists
 	si := r.Ai.StorageInstances[0]
@@ -104,19 +139,26 @@ func (r *Volume) RegisterAcl(cinit *Initiator) error {
 		co.Errorf(ctxt, "%s, %s", dsdk.Pretty(apierr), err)
 		return co.ErrTranslator(apierr)
 	}
-	acl.Initiators = append(acl.Initiators, &dsdk.Initiator{
-		Path: cinit.Path,
-	})
-	// copy the acl.Initiators to another list and remove
-	// initiator entries which has 'Tenant' in them since
-	// Datera API expects only 'Path' to be present
+	// Registering the same initiator twice is a no-op, this keeps
+	// ControllerPublishVolume idempotent
+	for _, init := range acl.Initiators {
+		if init.Path == cinit.Path {
+			co.Debugf(ctxt, "Initiator %s already registered with %s", cinit.Path, r.Name)
+			return nil
+		}
+	}
+	// The Datera API expects only 'Path' to be present.  Initiators of other
+	// tenants, eg: /root ones shared with this tenant, are listed with their
+	// 'Tenant' and must be kept
 	initiators := []*dsdk.Initiator{}
 	for _, initiator := range acl.Initiators {
-		if initiator.Tenant == "" {
-			initiators = append(initiators, initiator)
-		}
+		initiators = append(initiators, &dsdk.Initiator{
+			Path: initiator.Path,
+		})
 	}
-	acl.Initiators = initiators
+	acl.Initiators = append(initiators, &dsdk.Initiator{
+		Path: cinit.Path,
+	})
 
 	if _, apierr, err = acl.Set(&dsdk.AclPolicySetRequest{
 		Ctxt:       ctxt,
@@ -131,8 +173,8 @@ func (r *Volume) RegisterAcl(cinit *Initiator) error {
 	return nil
 }
 
-func (r *Volume) UnregisterAcl(cinit *Initiator) error {
-	ctxt := context.WithValue(r.ctxt, co.ReqName, "UnregisterAcl")
+func (r *Volume) UnregisterAcl(ctxt context.Context, cinit *Initiator) error {
+	ctxt = r.reqCtxt(ctxt, "UnregisterAcl")
 	co.Debugf(ctxt, "UnregisterAcl invoked for %s with initiator %s", r.Name, cinit.Name)
 	// Update existing AclPolicy if it exists
 	si := r.Ai.StorageInstances[0]
@@ -146,14 +188,21 @@ func (r *Volume) UnregisterAcl(cinit *Initiator) error {
 	}
 
 	// Remove the matching initiator from the initiators list
+	found := false
 	newInits := []*dsdk.Initiator{}
 	for _, init := range acl.Initiators {
 		if init.Path != cinit.Path {
 			newInits = append(newInits, &dsdk.Initiator{
-				Path: cinit.Path,
+				Path: init.Path,
 			})
+		} else {
+			found = true
 		}
 	}
+	if !found {
+		co.Debugf(ctxt, "Initiator %s not registered with %s", cinit.Path, r.Name)
+		return nil
+	}
 	acl.Initiators = newInits
 
 	if _, apierr, err = acl.Set(&dsdk.AclPolicySetRequest{
@@ -168,16 +217,3 @@ func (r *Volume) UnregisterAcl(cinit *Initiator) error {
 	}
 	return nil
 }
-
-func GetClientIqn(ctxt context.Context) (string, error) {
-	// Parse InitiatorName
-	dat, err := ioutil.ReadFile(initiatorFile)
-	if err != nil {
-		co.Debugf(ctxt, "Could not read file %s", initiatorFile)
-		return "", err
-	}
-	iqn := strings.Split(strings.TrimSpace(string(dat)), "=")[1]
-	co.Debugf(ctxt, "Obtained client iqn: %s", iqn)
-
-	return iqn, nil
-}
@@ -2,7 +2,14 @@ package client
 
 import (
 	"context"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
 
+	co "github.com/Datera/datera-csi/pkg/common"
+	host "github.com/Datera/datera-csi/pkg/host"
+	metrics "github.com/Datera/datera-csi/pkg/metrics"
 	dsdk "github.com/Datera/go-sdk/pkg/dsdk"
 	udc "github.com/Datera/go-udc/pkg/udc"
 )
@@ -10,12 +17,26 @@ import (
 type DateraClient struct {
 	sdk           *dsdk.SDK
 	udc           *udc.UDC
-	ctxt          context.Context
+	host          host.Host
 	vendorVersion string
+
+	// Connections to tenants other than the udc one, by tenant.  Each logs
+	// in on its own, the SDK sends the tenant of a connection with every
+	// request
+	httpClient *http.Client
+	connLock   *sync.Mutex
+	conns      map[string]*dsdk.ApiConnection
 }
 
 func NewDateraClient(udc *udc.UDC, healthcheck bool, driver string) (*DateraClient, error) {
-	sdk, err := dsdk.NewSDK(udc, true)
+	return NewDateraClientWithHTTPClient(udc, healthcheck, driver, nil)
+}
+
+// Same as NewDateraClient, but all requests are sent through the provided
+// http.Client.  This is how tests point the client at a fake Datera backend
+func NewDateraClientWithHTTPClient(udc *udc.UDC, healthcheck bool, driver string, client *http.Client) (*DateraClient, error) {
+	client = instrument(client)
+	sdk, err := dsdk.NewSDKWithHTTPClient(udc, true, client)
 	if err != nil {
 		return nil, err
 	}
@@ -26,27 +47,101 @@ func NewDateraClient(udc *udc.UDC, healthcheck bool, driver string) (*DateraClie
 		}
 	}
 	return &DateraClient{
-		sdk: sdk,
-		udc: udc,
+		sdk:        sdk,
+		udc:        udc,
+		host:       host.NewHost(),
+		httpClient: client,
+		connLock:   &sync.Mutex{},
+		conns:      map[string]*dsdk.ApiConnection{},
 	}, nil
 }
 
-func (r *DateraClient) NewContext() context.Context {
-	r.ctxt = r.sdk.NewContext()
-	return r.ctxt
+// Replaces the Host used by every Volume returned from this client for node
+// operations such as logins, formatting and mounting
+func (r *DateraClient) SetHost(h host.Host) {
+	r.host = h
 }
 
-func (r *DateraClient) WithContext(ctxt context.Context) context.Context {
-	r.ctxt = r.sdk.WithContext(ctxt)
-	return r.ctxt
+// Returns a child of ctxt carrying the SDK connection and the name of the
+// client operation for logging.  The client holds no per-request state, so
+// concurrent RPCs each pass their own ctxt and its deadline applies to every
+// backend request made with it.  Requests are made in the tenant set on ctxt
+// with co.WithTenant
+func (r *DateraClient) reqCtxt(ctxt context.Context, reqName string) context.Context {
+	if r != nil {
+		ctxt = r.sdk.WithContext(ctxt)
+		if tenant := r.Tenant(ctxt); tenant != "" {
+			ctxt = context.WithValue(ctxt, "conn", r.conn(tenant))
+		}
+	}
+	return context.WithValue(ctxt, co.ReqName, reqName)
+}
+
+// Tenant returns the tenant requests with ctxt are made in, or "" for the
+// tenant the client was configured with
+func (r *DateraClient) Tenant(ctxt context.Context) string {
+	tenant := strings.TrimSuffix(co.GetTenant(ctxt), "/")
+	def := strings.TrimSuffix(r.udc.Tenant, "/")
+	if def == "" {
+		def = "/root"
+	}
+	if tenant == def {
+		return ""
+	}
+	return tenant
+}
+
+func (r *DateraClient) conn(tenant string) *dsdk.ApiConnection {
+	r.connLock.Lock()
+	defer r.connLock.Unlock()
+	if c, ok := r.conns[tenant]; ok {
+		return c
+	}
+	u := *r.udc
+	u.Tenant = tenant
+	c := dsdk.NewApiConnectionWithHTTPClient(&u, true, r.httpClient)
+	r.conns[tenant] = c
+	return c
 }
 
 func (r *DateraClient) HealthCheck(ctxt context.Context) (*Manifest, error) {
-	r.ctxt = r.WithContext(ctxt)
-	return r.GetManifest()
+	return r.GetManifest(ctxt)
 }
 
 func (r *DateraClient) LogPush(ctxt context.Context, rule, rotated string) error {
-	ctxt = r.WithContext(ctxt)
+	ctxt = r.reqCtxt(ctxt, "LogPush")
 	return r.sdk.LogsUpload.RotateUploadRemove(ctxt, rule, rotated)
 }
+
+// Records the latency and outcome of every Datera API request, labelled with
+// the client operation carried by the request context
+type metricsTransport struct {
+	next http.RoundTripper
+}
+
+func (t *metricsTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	op, ok := req.Context().Value(co.ReqName).(string)
+	if !ok {
+		op = "unknown"
+	}
+	start := time.Now()
+	resp, err := t.next.RoundTrip(req)
+	metrics.ObserveBackend(op, req.Method, time.Since(start), err != nil || resp.StatusCode >= 400)
+	return resp, err
+}
+
+// Returns a copy of client whose requests are recorded by metricsTransport.
+// A nil client is what the SDK would have used on its own, the default
+// http.Client
+func instrument(client *http.Client) *http.Client {
+	c := http.Client{}
+	if client != nil {
+		c = *client
+	}
+	next := c.Transport
+	if next == nil {
+		next = http.DefaultTransport
+	}
+	c.Transport = &metricsTransport{next: next}
+	return &c
+}
@@ -1,41 +1,49 @@
 package client
 
 import (
+	"context"
 	"fmt"
 	"reflect"
+	"strings"
+	"sync"
 	"testing"
 	"time"
 
+	codes "google.golang.org/grpc/codes"
+	status "google.golang.org/grpc/status"
+
+	co "github.com/Datera/datera-csi/pkg/common"
+	fake "github.com/Datera/datera-csi/pkg/fake"
+	host "github.com/Datera/datera-csi/pkg/host"
 	dsdk "github.com/Datera/go-sdk/pkg/dsdk"
-	udc "github.com/Datera/go-udc/pkg/udc"
 )
 
 const WIM = 500
 
 func createVolume(t *testing.T, client *DateraClient, v *VolOpts) (string, *Volume, func()) {
 	name := "my-test-vol-" + dsdk.RandString(5)
-	vol, err := client.CreateVolume(name, v, true)
+	vol, err := client.CreateVolume(getCtxt(), name, v, true, nil)
 	if err != nil {
 		t.Fatal(err)
 	}
 	return name, vol, func() {
-		if err = client.DeleteVolume(name, true); err != nil {
+		if err = client.DeleteVolume(getCtxt(), name, true); err != nil {
 			t.Fatal(err)
 		}
 	}
 
 }
 
-func createRegisterInitiator(t *testing.T, client *DateraClient, vol *Volume) func() {
-	init, err := client.CreateGetInitiator()
+func createRegisterInitiator(t *testing.T, client *DateraClient, vol *Volume, iqn string) func() {
+	init, err := client.CreateGetInitiatorFromIqn(getCtxt(), iqn)
 	if err != nil {
 		t.Fatal(err)
 	}
-	if err = vol.RegisterAcl(init); err != nil {
+	if err = vol.RegisterAcl(getCtxt(), init); err != nil {
 		t.Fatal(err)
 	}
 	return func() {
-		if err = init.Delete(false); err != nil {
+		if err = init.Delete(getCtxt(), false); err != nil {
 			t.Fatal(err)
 		}
 	}
@@ -43,13 +51,13 @@ func createRegisterInitiator(t *testing.T, client *DateraClient, vol *Volume) fu
 
 func createSnapshot(t *testing.T, client *DateraClient, vol *Volume) (*Snapshot, func()) {
 	name := "my-test-snap-" + dsdk.RandString(5)
-	snap, err := vol.CreateSnapshot(name)
+	snap, err := vol.CreateSnapshot(getCtxt(), name, &SnapOpts{})
 	if err != nil {
 		t.Fatal(err)
 	}
 	timeout := 20
 	for {
-		if err = snap.Reload(); err != nil {
+		if err = snap.Reload(getCtxt()); err != nil {
 			t.Fatal(err)
 		}
 		if snap.Status == "available" {
@@ -62,28 +70,45 @@ func createSnapshot(t *testing.T, client *DateraClient, vol *Volume) (*Snapshot,
 		time.Sleep(time.Second * 1)
 	}
 	return snap, func() {
-		if err = vol.DeleteSnapshot(snap.Id); err != nil {
+		if err = vol.DeleteSnapshot(getCtxt(), snap.Id); err != nil {
 			t.Fatal(err)
 		}
 	}
 }
 
 func getClient(t *testing.T) *DateraClient {
-	conf, err := udc.GetConfig()
-	if err != nil {
-		t.Fatal(err)
-	}
-	client, err := NewDateraClient(conf, true, "csi-client-test")
+	client, _ := getFakeClient(t)
+	return client
+}
+
+func getFakeClient(t *testing.T) (*DateraClient, *fake.Datera) {
+	fd := fake.NewDatera()
+	client, err := NewDateraClientWithHTTPClient(fd.UDC(), true, "csi-client-test", fd.HTTPClient())
 	if err != nil {
 		t.Fatal(err)
 	}
-	client.NewContext()
-	return client
+	return client, fd
+}
+
+func getCtxt() context.Context {
+	return co.WithCtxt(context.Background(), "client-test", "")
+}
+
+// Same as getFakeClient, but node operations are also served by a fake host
+func getHostClient(t *testing.T) (*DateraClient, *fake.Host) {
+	client, _ := getFakeClient(t)
+	fh := fake.NewHost()
+	client.SetHost(fh)
+	return client, fh
+}
+
+func testIqn() string {
+	return "iqn.1993-08.org.debian:01:" + strings.ToLower(dsdk.RandString(12))
 }
 
 func TestVendorVersion(t *testing.T) {
 	client := getClient(t)
-	if vv, err := client.VendorVersion(); err != nil {
+	if vv, err := client.VendorVersion(getCtxt()); err != nil {
 		t.Fatalf("Failed VendorVersion request: [%s]", err)
 	} else {
 		t.Logf("VendorVersion: [%s]", vv)
@@ -92,7 +117,7 @@ func TestVendorVersion(t *testing.T) {
 
 func TestCapacity(t *testing.T) {
 	client := getClient(t)
-	if sys, err := client.GetCapacity(); err != nil {
+	if sys, err := client.GetCapacity(getCtxt()); err != nil {
 		t.Fatalf("Failed Capacity request: [%s]", err)
 	} else {
 		t.Logf("Capacity: [%#v]", sys)
@@ -101,7 +126,7 @@ func TestCapacity(t *testing.T) {
 
 func TestManifest(t *testing.T) {
 	client := getClient(t)
-	if mf, err := client.GetManifest(); err != nil {
+	if mf, err := client.GetManifest(getCtxt()); err != nil {
 		t.Fatalf("Failed GetManifest request: [%s]", err)
 	} else {
 		t.Logf("Manifest: [%#v]", mf)
@@ -125,6 +150,29 @@ func TestVolumeCreate(t *testing.T) {
 	}
 }
 
+func TestVolumeDynamicQoS(t *testing.T) {
+	client := getClient(t)
+	v := &VolOpts{
+		Size:              5,
+		Replica:           1,
+		IopsPerGb:         100,
+		BandwidthPerGb:    1000,
+		TotalBandwidthMax: 2000,
+	}
+	_, vol, cleanf := createVolume(t, client, v)
+	defer cleanf()
+	if vol.TotalIopsMax != 500 || vol.TotalBandwidthMax != 2000 {
+		t.Fatalf("Unexpected dynamic QoS at 5 GiB: %v", vol.QoS)
+	}
+	v.Size = 10
+	if err := vol.SetPerformancePolicy(getCtxt(), v); err != nil {
+		t.Fatal(err)
+	}
+	if vol.TotalIopsMax != 1000 || vol.TotalBandwidthMax != 2000 {
+		t.Fatalf("Unexpected dynamic QoS at 10 GiB: %v", vol.QoS)
+	}
+}
+
 func TestListVolumes(t *testing.T) {
 	client := getClient(t)
 	v := &VolOpts{
@@ -138,7 +186,7 @@ func TestListVolumes(t *testing.T) {
 		names = append(names, name)
 		defer cleanf()
 	}
-	vols, err := client.ListVolumes(0, 0)
+	vols, err := client.ListVolumes(getCtxt(), 0, 0)
 	lv := len(vols)
 	if err != nil {
 		t.Fatal(err)
@@ -155,7 +203,7 @@ func TestListVolumes(t *testing.T) {
 		}
 	}
 
-	vols, err = client.ListVolumes(1, 0)
+	vols, err = client.ListVolumes(getCtxt(), 1, 0)
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -174,7 +222,7 @@ func TestVolumeMetadata(t *testing.T) {
 	_, vol, cleanf := createVolume(t, client, v)
 	defer cleanf()
 	m := VolMetadata{"my-test": "metadata"}
-	m2, err := vol.SetMetadata(&m)
+	m2, err := vol.SetMetadata(getCtxt(), &m)
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -182,7 +230,7 @@ func TestVolumeMetadata(t *testing.T) {
 		t.Fatalf("metadata sent and metadata recieved are unequal: [%#v] != [%#v]\n", m, m2)
 	}
 
-	m3, err := vol.GetMetadata()
+	m3, err := vol.GetMetadata(getCtxt())
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -199,9 +247,125 @@ func TestACL(t *testing.T) {
 		WriteIopsMax: WIM,
 	}
 	_, vol, cleanv := createVolume(t, client, v)
-	cleani := createRegisterInitiator(t, client, vol)
+	cleani := createRegisterInitiator(t, client, vol, testIqn())
 	defer cleani()
 	defer cleanv()
+	if err := vol.Reload(getCtxt(), false, false); err != nil {
+		t.Fatal(err)
+	}
+	if len(vol.Initiators) != 1 {
+		t.Fatalf("Unexpected number of registered initiators: 1 != %d", len(vol.Initiators))
+	}
+}
+
+func createTenantVolume(t *testing.T, client *DateraClient, tenant string) (*Volume, func()) {
+	vol, err := client.CreateVolume(getCtxt(), "my-test-vol-"+dsdk.RandString(5), &VolOpts{
+		Size:    5,
+		Replica: 1,
+		Tenant:  tenant,
+	}, false, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return vol, func() {
+		if err = client.DeleteVolume(getCtxt(), vol.Id, true); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestTenants(t *testing.T) {
+	client, fd := getFakeClient(t)
+	fd.AddTenant("/root/team-a")
+	vol, cleanv := createTenantVolume(t, client, "/root/team-a")
+	defer cleanv()
+	if vol.Id != "/root/team-a/"+vol.Name || vol.Tenant != "/root/team-a" {
+		t.Fatalf("Unexpected volume id %s in tenant %s", vol.Id, vol.Tenant)
+	}
+	if ais := fd.AppInstances("/root/team-a"); len(ais) != 1 || ais[0] != vol.Name {
+		t.Fatalf("Expected the app instance in /root/team-a, found %s", ais)
+	}
+	if ais := fd.AppInstances(fake.Tenant); len(ais) != 0 {
+		t.Fatalf("Expected no app instances in %s, found %s", fake.Tenant, ais)
+	}
+	// Requests are routed by the tenant in the volume id
+	if _, err := client.GetVolume(getCtxt(), vol.Name, false, false); status.Code(err) != codes.NotFound {
+		t.Fatalf("Expected the volume to be missing from %s, got %v", fake.Tenant, err)
+	}
+	if _, err := vol.SetMetadata(getCtxt(), &VolMetadata{"fs_type": "xfs"}); err != nil {
+		t.Fatal(err)
+	}
+	found, err := client.GetVolume(getCtxt(), vol.Id, false, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if found.Id != vol.Id || found.FsType != "xfs" {
+		t.Fatalf("Unexpected volume %s with fs_type %s", found.Id, found.FsType)
+	}
+	snap, cleans := createSnapshot(t, client, vol)
+	defer cleans()
+	if _, err = client.SnapshotPathFromCsiId(getCtxt(), co.MkSnapId(vol.Id, snap.Id)); err != nil {
+		t.Fatal(err)
+	}
+	vols, err := client.ListVolumes(co.WithTenant(getCtxt(), "/root/team-a"), 0, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(vols) != 1 || vols[0].Id != vol.Id {
+		t.Fatalf("Expected only %s in /root/team-a, got %d volumes", vol.Id, len(vols))
+	}
+	if vols, err = client.ListVolumes(getCtxt(), 0, 0); err != nil || len(vols) != 0 {
+		t.Fatalf("Expected no volumes in %s, got %d: %v", fake.Tenant, len(vols), err)
+	}
+	// The configured tenant is never part of volume ids
+	if _, err = client.GetVolume(co.WithTenant(getCtxt(), "/root/team-a"), fake.Tenant+"/"+vol.Name, false, false); status.Code(err) != codes.NotFound {
+		t.Fatalf("Expected the volume to be missing from %s, got %v", fake.Tenant, err)
+	}
+}
+
+func TestACLSharedInitiator(t *testing.T) {
+	client, fd := getFakeClient(t)
+	fd.AddTenant("/root/team-a")
+	vol, cleanv := createTenantVolume(t, client, "/root/team-a")
+	defer cleanv()
+	// Initiators of the root tenant are listed in the acl_policy of
+	// subtenant volumes with their tenant, registering another initiator
+	// must keep them
+	shared, err := client.CreateGetInitiatorFromIqn(getCtxt(), testIqn())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = vol.RegisterAcl(getCtxt(), shared); err != nil {
+		t.Fatal(err)
+	}
+	own, err := client.CreateGetInitiatorFromIqn(co.WithTenant(getCtxt(), vol.Tenant), testIqn())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if own.Tenant != vol.Tenant {
+		t.Fatalf("Expected the initiator in %s, got %s", vol.Tenant, own.Tenant)
+	}
+	if err = vol.RegisterAcl(getCtxt(), own); err != nil {
+		t.Fatal(err)
+	}
+	if err = vol.Reload(getCtxt(), false, false); err != nil {
+		t.Fatal(err)
+	}
+	if len(vol.Initiators) != 2 {
+		t.Fatalf("Expected both initiators registered, got %s", vol.Initiators)
+	}
+	if err = vol.UnregisterAcl(getCtxt(), own); err != nil {
+		t.Fatal(err)
+	}
+	if err = vol.Reload(getCtxt(), false, false); err != nil {
+		t.Fatal(err)
+	}
+	if len(vol.Initiators) != 1 || vol.Initiators[0] != shared.Iqn {
+		t.Fatalf("Expected only %s registered, got %s", shared.Iqn, vol.Initiators)
+	}
+	if err = own.Delete(getCtxt(), false); err != nil {
+		t.Fatal(err)
+	}
 }
 
 func TestIpPools(t *testing.T) {
@@ -212,11 +376,11 @@ func TestIpPools(t *testing.T) {
 		WriteIopsMax: WIM,
 	}
 	_, vol, cleanv := createVolume(t, client, v)
-	ipp, err := client.GetIpPoolFromName("default")
+	ipp, err := client.GetIpPoolFromName(getCtxt(), "default")
 	if err != nil {
 		t.Fatal(err)
 	}
-	err = vol.RegisterIpPool(ipp)
+	err = vol.RegisterIpPool(getCtxt(), ipp)
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -224,80 +388,504 @@ func TestIpPools(t *testing.T) {
 }
 
 func TestLoginLogout(t *testing.T) {
-	client := getClient(t)
+	client, fh := getHostClient(t)
 	v := &VolOpts{
 		Size:         5,
 		Replica:      1,
 		WriteIopsMax: WIM,
 	}
 	_, vol, cleanv := createVolume(t, client, v)
-	cleani := createRegisterInitiator(t, client, vol)
+	cleani := createRegisterInitiator(t, client, vol, fh.Iqn)
 	defer cleani()
 	defer cleanv()
-	vol.Login(false, false)
+	if err := vol.Login(getCtxt(), false, false, nil); err != nil {
+		t.Fatal(err)
+	}
 	if vol.DevicePath == "" {
 		t.Fatal("Device Path not populated")
 	}
 	t.Logf("Device Path: %s", vol.DevicePath)
-	vol.Logout()
+	if err := vol.Logout(getCtxt()); err != nil {
+		t.Fatal(err)
+	}
+	if vol.DevicePath != "" {
+		t.Fatalf("Device Path not cleared after Logout: %s", vol.DevicePath)
+	}
+	if calls := fh.CallsTo("Disconnect"); len(calls) != 1 || calls[0].Args[0] != vol.Iqn {
+		t.Fatalf("Expected a single Disconnect from %s, got %s", vol.Iqn, calls)
+	}
+}
+
+func TestLoginMultipath(t *testing.T) {
+	client, fh := getHostClient(t)
+	_, vol, cleanv := createVolume(t, client, &VolOpts{Size: 5, Replica: 1})
+	defer cleanv()
+	if err := vol.Login(getCtxt(), true, false, nil); err != nil {
+		t.Fatal(err)
+	}
+	calls := fh.CallsTo("Connect")
+	if len(calls) != 1 || len(calls[0].Args) != len(vol.Ips) {
+		t.Fatalf("Expected a single Connect to %d portals, got %s", len(vol.Ips), calls)
+	}
+	if !strings.HasPrefix(vol.DevicePath, "/dev/dm-") {
+		t.Fatalf("Expected the multipath device as device path, got %s", vol.DevicePath)
+	}
+	if paths, _ := fh.MultipathPaths(getCtxt(), vol.DevicePath); len(paths) != len(vol.Ips) {
+		t.Fatalf("Expected %d paths, got %s", len(vol.Ips), paths)
+	}
+	if err := vol.Logout(getCtxt()); err != nil {
+		t.Fatal(err)
+	}
+	ops := []string{}
+	for _, c := range fh.Calls() {
+		if c.Op == "FlushMultipath" || c.Op == "Disconnect" {
+			ops = append(ops, c.Op)
+		}
+	}
+	if strings.Join(ops, " ") != "FlushMultipath Disconnect" {
+		t.Fatalf("Expected the multipath device to be flushed before logout, got %s", ops)
+	}
+}
+
+func TestLoginMultipathDegraded(t *testing.T) {
+	multipathRetryInterval = time.Millisecond
+	client, fh := getHostClient(t)
+	_, vol, cleanv := createVolume(t, client, &VolOpts{Size: 5, Replica: 1})
+	defer cleanv()
+	fh.SetPortalDown(vol.Ips[1], true)
+	if err := vol.Login(getCtxt(), true, false, nil); err != nil {
+		t.Fatal(err)
+	}
+	// Waited for the missing path before settling for a degraded device
+	if calls := fh.CallsTo("MultipathPaths"); len(calls) != multipathRetries+1 {
+		t.Fatalf("Expected %d path checks, got %d", multipathRetries+1, len(calls))
+	}
+	paths, err := fh.MultipathPaths(getCtxt(), vol.DevicePath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if RunningPaths(paths) != 1 {
+		t.Fatalf("Expected a single running path, got %s", paths)
+	}
+}
+
+func TestLoginMultipathNoDevice(t *testing.T) {
+	multipathRetryInterval = time.Millisecond
+	client, fh := getHostClient(t)
+	_, vol, cleanv := createVolume(t, client, &VolOpts{Size: 5, Replica: 1})
+	defer cleanv()
+	for i := 0; i <= multipathRetries; i++ {
+		fh.Script("MultipathDevice", fake.Result{Err: fmt.Errorf("not part of a multipath device")})
+	}
+	if err := vol.Login(getCtxt(), true, false, nil); err == nil {
+		t.Fatal("Expected Login to fail without a multipath device")
+	}
+	if vol.DevicePath != "" {
+		t.Fatalf("Device Path set after a failed login: %s", vol.DevicePath)
+	}
+	if calls := fh.CallsTo("Disconnect"); len(calls) != 1 {
+		t.Fatalf("Expected the sessions to be logged out, got %s", calls)
+	}
+}
+
+func TestLogoutFlushFailure(t *testing.T) {
+	client, fh := getHostClient(t)
+	_, vol, cleanv := createVolume(t, client, &VolOpts{Size: 5, Replica: 1})
+	defer cleanv()
+	if err := vol.Login(getCtxt(), true, false, nil); err != nil {
+		t.Fatal(err)
+	}
+	fh.Script("FlushMultipath", fake.Result{Err: fmt.Errorf("map in use")})
+	if err := vol.Logout(getCtxt()); err == nil {
+		t.Fatal("Expected Logout to fail when the multipath device is in use")
+	}
+	if calls := fh.CallsTo("Disconnect"); len(calls) != 0 {
+		t.Fatalf("Expected no logout while the multipath device is in use, got %s", calls)
+	}
 }
 
 func TestMountUnmount(t *testing.T) {
-	client := getClient(t)
+	client, fh := getHostClient(t)
 	v := &VolOpts{
 		Size:         5,
 		Replica:      1,
 		WriteIopsMax: WIM,
 	}
 	_, vol, cleanv := createVolume(t, client, v)
-	cleani := createRegisterInitiator(t, client, vol)
+	cleani := createRegisterInitiator(t, client, vol, fh.Iqn)
 	defer cleani()
 	defer cleanv()
-	vol.Login(false, false)
-	defer vol.Logout()
+	if err := vol.Login(getCtxt(), false, false, nil); err != nil {
+		t.Fatal(err)
+	}
+	defer vol.Logout(getCtxt())
 
-	if err := vol.Format("xfs", []string{}, 5); err != nil {
+	if _, err := vol.Format(getCtxt(), "xfs", []string{}, 5, false); err != nil {
 		t.Fatal(err)
 	}
-	if err := vol.Mount(fmt.Sprintf("/mnt/my-dir-%s", dsdk.RandString(5)), []string{}); err != nil {
+	dest := fmt.Sprintf("/mnt/my-dir-%s", dsdk.RandString(5))
+	if err := vol.Mount(getCtxt(), dest, []string{}, "xfs"); err != nil {
 		t.Fatal(err)
 	}
-	if err := vol.Unmount(); err != nil {
+	if dev := fh.Mounts()[dest]; dev != vol.DevicePath {
+		t.Fatalf("Expected %s mounted at %s, found %s", vol.DevicePath, dest, dev)
+	}
+	if err := vol.Unmount(getCtxt()); err != nil {
 		t.Fatal(err)
 	}
+	if _, ok := fh.Mounts()[dest]; ok {
+		t.Fatalf("%s still mounted after Unmount", dest)
+	}
 }
 
 func TestBindMountUnBindMount(t *testing.T) {
-	client := getClient(t)
+	client, fh := getHostClient(t)
 	v := &VolOpts{
 		Size:         5,
 		Replica:      1,
 		WriteIopsMax: WIM,
 	}
 	_, vol, cleanv := createVolume(t, client, v)
-	cleani := createRegisterInitiator(t, client, vol)
+	cleani := createRegisterInitiator(t, client, vol, fh.Iqn)
 	defer cleani()
 	defer cleanv()
-	vol.Login(false, false)
-	defer vol.Logout()
+	if err := vol.Login(getCtxt(), false, false, nil); err != nil {
+		t.Fatal(err)
+	}
+	defer vol.Logout(getCtxt())
 
-	if err := vol.Format("ext4", []string{}, 5); err != nil {
+	if _, err := vol.Format(getCtxt(), "ext4", []string{}, 5, false); err != nil {
 		t.Fatal(err)
 	}
 	r := dsdk.RandString(5)
-	if err := vol.Mount(fmt.Sprintf("/mnt/my-dir-%s", r), []string{}); err != nil {
+	if err := vol.Mount(getCtxt(), fmt.Sprintf("/mnt/my-dir-%s", r), []string{}, "ext4"); err != nil {
 		t.Fatal(err)
 	}
-	defer vol.Unmount()
+	defer vol.Unmount(getCtxt())
 
-	if err := vol.BindMount(fmt.Sprintf("/mnt/my-bind-dir-%s", r)); err != nil {
+	bind := fmt.Sprintf("/mnt/my-bind-dir-%s", r)
+	if err := vol.BindMount(getCtxt(), bind, "ext4", false); err != nil {
 		t.Fatal(err)
 	}
+	if dev := fh.Mounts()[bind]; dev != vol.DevicePath {
+		t.Fatalf("Expected %s bind-mounted at %s, found %s", vol.DevicePath, bind, dev)
+	}
 
-	if err := vol.UnBindMount(fmt.Sprintf("/mnt/my-bind-dir-%s", r)); err != nil {
+	if err := vol.UnBindMount(getCtxt(), bind); err != nil {
 		t.Fatal(err)
 	}
 
+	if err := vol.BindMount(getCtxt(), bind, "ext4", true); err != nil {
+		t.Fatal(err)
+	}
+	if opts, _ := fh.MountOptions(getCtxt(), bind); opts[0] != "ro" {
+		t.Fatalf("Expected a read-only bind mount, got %s", opts)
+	}
+	if err := vol.UnBindMount(getCtxt(), bind); err != nil {
+		t.Fatal(err)
+	}
+
+	// A failed remount must not leave a writable mount behind
+	fh.Script("MakeReadOnly", fake.Result{Err: fmt.Errorf("mount: %s not mounted", bind)})
+	if err := vol.BindMount(getCtxt(), bind, "ext4", true); err == nil {
+		t.Fatal("Expected BindMount to fail when the read-only remount fails")
+	}
+	if _, ok := fh.Mounts()[bind]; ok {
+		t.Fatalf("%s still mounted after a failed read-only bind mount", bind)
+	}
+}
+
+func TestFormatRetry(t *testing.T) {
+	formatRetryInterval = time.Millisecond
+	client, fh := getHostClient(t)
+	_, vol, cleanv := createVolume(t, client, &VolOpts{Size: 5, Replica: 1})
+	defer cleanv()
+	if err := vol.Login(getCtxt(), false, false, nil); err != nil {
+		t.Fatal(err)
+	}
+	// The device often isn't ready immediately after login
+	notReady := fake.Result{Err: fmt.Errorf("exit status 1")}
+	fh.Script("Format", notReady, notReady)
+	if _, err := vol.Format(getCtxt(), "ext4", []string{"-F"}, 5, false); err != nil {
+		t.Fatal(err)
+	}
+	if calls := fh.CallsTo("Format"); len(calls) != 3 {
+		t.Fatalf("Expected 3 format attempts, got %d: %s", len(calls), calls)
+	}
+	if vol.FsType != "ext4" {
+		t.Fatalf("FsType not set after Format: %s", vol.FsType)
+	}
+}
+
+func TestFormatTimeout(t *testing.T) {
+	formatRetryInterval = time.Millisecond
+	client, fh := getHostClient(t)
+	_, vol, cleanv := createVolume(t, client, &VolOpts{Size: 5, Replica: 1})
+	defer cleanv()
+	if err := vol.Login(getCtxt(), false, false, nil); err != nil {
+		t.Fatal(err)
+	}
+	notReady := fake.Result{Err: fmt.Errorf("exit status 1")}
+	fh.Script("Format", notReady, notReady, notReady, notReady)
+	if _, err := vol.Format(getCtxt(), "ext4", []string{}, 2, false); err == nil {
+		t.Fatal("Expected Format to fail once the timeout was reached")
+	}
+	if calls := fh.CallsTo("Format"); len(calls) != 4 {
+		t.Fatalf("Expected 4 format attempts, got %d: %s", len(calls), calls)
+	}
+}
+
+func TestFormatMountedDevice(t *testing.T) {
+	client, fh := getHostClient(t)
+	_, vol, cleanv := createVolume(t, client, &VolOpts{Size: 5, Replica: 1})
+	defer cleanv()
+	if err := vol.Login(getCtxt(), false, false, nil); err != nil {
+		t.Fatal(err)
+	}
+	fh.Script("Format", fake.Result{
+		Out: vol.DevicePath + " is mounted; will not make a filesystem here!",
+		Err: fmt.Errorf("exit status 1"),
+	})
+	if _, err := vol.Format(getCtxt(), "ext4", []string{}, 5, false); err == nil {
+		t.Fatal("Expected Format of a mounted device to fail")
+	}
+	if calls := fh.CallsTo("Format"); len(calls) != 1 {
+		t.Fatalf("Expected a single format attempt, got %d", len(calls))
+	}
+}
+
+func TestFormatExisting(t *testing.T) {
+	client, fh := getHostClient(t)
+	_, vol, cleanv := createVolume(t, client, &VolOpts{Size: 5, Replica: 1})
+	defer cleanv()
+	if err := vol.Login(getCtxt(), false, false, nil); err != nil {
+		t.Fatal(err)
+	}
+	fh.SetFsType(vol.DevicePath, "xfs")
+	if _, err := vol.Format(getCtxt(), "ext4", []string{}, 5, false); err != nil {
+		t.Fatal(err)
+	}
+	if calls := fh.CallsTo("Format"); len(calls) != 0 {
+		t.Fatalf("Existing filesystem was reformatted: %s", calls)
+	}
+	if vol.FsType != "xfs" {
+		t.Fatalf("Expected existing filesystem xfs, got %s", vol.FsType)
+	}
+}
+
+func TestFormatNotEmpty(t *testing.T) {
+	for _, sig := range []host.Signature{
+		{Type: "LVM2_member", Usage: "raid"},
+		{PtType: "gpt"},
+	} {
+		client, fh := getHostClient(t)
+		_, vol, cleanv := createVolume(t, client, &VolOpts{Size: 5, Replica: 1})
+		if err := vol.Login(getCtxt(), false, false, nil); err != nil {
+			t.Fatal(err)
+		}
+		fh.SetSignature(vol.DevicePath, sig)
+		if _, err := vol.Format(getCtxt(), "ext4", []string{}, 5, false); err == nil || !strings.Contains(err.Error(), "refusing") {
+			t.Fatalf("Expected Format to refuse a device with %s, got %v", sig.String(), err)
+		}
+		if calls := fh.CallsTo("Format"); len(calls) != 0 {
+			t.Fatalf("Device with %s was formatted: %s", sig.String(), calls)
+		}
+		// Unless the volume was created empty
+		created, err := vol.Format(getCtxt(), "ext4", []string{}, 5, true)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if calls := fh.CallsTo("Format"); !created || len(calls) != 1 {
+			t.Fatalf("Expected a new volume with %s to be formatted, got %s", sig.String(), calls)
+		}
+		cleanv()
+	}
+}
+
+func TestFormatProbe(t *testing.T) {
+	formatRetryInterval = time.Millisecond
+	client, fh := getHostClient(t)
+	_, vol, cleanv := createVolume(t, client, &VolOpts{Size: 5, Replica: 1})
+	defer cleanv()
+	if err := vol.Login(getCtxt(), false, false, nil); err != nil {
+		t.Fatal(err)
+	}
+	// The device node shows up late, then blkid fails once
+	missing := fake.Result{Err: fmt.Errorf("blockdev: cannot open %s", vol.DevicePath)}
+	fh.Script("Size", missing, missing)
+	fh.Script("Probe", fake.Result{Err: fmt.Errorf("exit status 4")})
+	created, err := vol.Format(getCtxt(), "ext4", []string{}, 5, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if calls := fh.CallsTo("Probe"); !created || len(calls) != 2 {
+		t.Fatalf("Expected the device to be probed twice and formatted, got %s", calls)
+	}
+
+	// Never format a device that couldn't be probed
+	vol.Formatted = false
+	fh.SetFsType(vol.DevicePath, "")
+	failed := fake.Result{Err: fmt.Errorf("exit status 4")}
+	fh.Script("Probe", failed, failed, failed)
+	if _, err = vol.Format(getCtxt(), "ext4", []string{}, 2, false); err == nil {
+		t.Fatal("Expected Format to fail when the device can't be probed")
+	}
+	if calls := fh.CallsTo("Format"); len(calls) != 1 {
+		t.Fatalf("Expected no further format, got %s", calls)
+	}
+}
+
+func TestCheckFs(t *testing.T) {
+	client, fh := getHostClient(t)
+	_, vol, cleanv := createVolume(t, client, &VolOpts{Size: 5, Replica: 1})
+	defer cleanv()
+	if err := vol.Login(getCtxt(), false, false, nil); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := vol.Format(getCtxt(), "xfs", []string{}, 5, false); err != nil {
+		t.Fatal(err)
+	}
+	if err := vol.CheckFs(getCtxt(), "xfs"); err != nil {
+		t.Fatal(err)
+	}
+	fh.Script("CheckFs", fake.Result{Out: "agf_freeblks 25, counted 24 in ag 0", Err: fmt.Errorf("exit status 1")})
+	if err := vol.CheckFs(getCtxt(), "xfs"); err == nil || !strings.Contains(err.Error(), "agf_freeblks") {
+		t.Fatalf("Expected the checker output in the error, got %v", err)
+	}
+	// Mounted filesystems aren't checked
+	dest := fmt.Sprintf("/mnt/my-dir-%s", dsdk.RandString(5))
+	if err := vol.Mount(getCtxt(), dest, []string{}, "xfs"); err != nil {
+		t.Fatal(err)
+	}
+	defer vol.Unmount(getCtxt())
+	if err := vol.CheckFs(getCtxt(), "xfs"); err != nil {
+		t.Fatal(err)
+	}
+	if calls := fh.CallsTo("CheckFs"); len(calls) != 2 {
+		t.Fatalf("Expected 2 checks, got %s", calls)
+	}
+}
+
+func TestExpandFs(t *testing.T) {
+	client, fh := getHostClient(t)
+	_, vol, cleanv := createVolume(t, client, &VolOpts{Size: 5, Replica: 1})
+	defer cleanv()
+	if err := vol.Login(getCtxt(), false, false, nil); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := vol.Format(getCtxt(), "ext4", []string{}, 5, false); err != nil {
+		t.Fatal(err)
+	}
+	dest := fmt.Sprintf("/mnt/my-dir-%s", dsdk.RandString(5))
+	if err := vol.Mount(getCtxt(), dest, []string{}, "ext4"); err != nil {
+		t.Fatal(err)
+	}
+	fh.SetDeviceSize(vol.DevicePath, 10*1024*1024*1024)
+	if err := vol.ExpandFs(getCtxt(), dest, "ext4", 10); err != nil {
+		t.Fatal(err)
+	}
+	calls := fh.CallsTo("ExpandFs")
+	expected := []string{vol.DevicePath, "resize2fs", vol.DevicePath}
+	if len(calls) != 1 || !reflect.DeepEqual(calls[0].Args, expected) {
+		t.Fatalf("Expected a single ExpandFs of %s, got %s", vol.DevicePath, calls)
+	}
+}
+
+func TestExpandBlockWaitsForResize(t *testing.T) {
+	resizeRetryInterval = 10 * time.Millisecond
+	client, fh := getHostClient(t)
+	_, vol, cleanv := createVolume(t, client, &VolOpts{Size: 5, Replica: 1})
+	defer cleanv()
+	if err := vol.Login(getCtxt(), false, false, nil); err != nil {
+		t.Fatal(err)
+	}
+	fh.SetDeviceSize(vol.DevicePath, 10*1024*1024*1024)
+	// The device reports its old size until rescanned twice
+	for i := 0; i < 2; i++ {
+		fh.Script("Size", fake.Result{Out: fmt.Sprintf("%d", 5*1024*1024*1024)})
+	}
+	start := time.Now()
+	if err := vol.ExpandBlock(getCtxt(), vol.DevicePath, 10); err != nil {
+		t.Fatal(err)
+	}
+	if calls := fh.CallsTo("Size"); len(calls) != 3 {
+		t.Fatalf("Expected 3 size checks, got %d", len(calls))
+	}
+	if d := time.Since(start); d < 2*resizeRetryInterval {
+		t.Fatalf("Expected a pause between size checks, took %s", d)
+	}
+}
+
+func TestExpandFsOffline(t *testing.T) {
+	client, fh := getHostClient(t)
+	_, vol, cleanv := createVolume(t, client, &VolOpts{Size: 5, Replica: 1})
+	defer cleanv()
+	if err := vol.Login(getCtxt(), false, false, nil); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := vol.Format(getCtxt(), "ext4", []string{}, 5, false); err != nil {
+		t.Fatal(err)
+	}
+	fh.SetDeviceSize(vol.DevicePath, 10*1024*1024*1024)
+	if err := vol.ExpandFsOffline(getCtxt(), "ext4", 10); err != nil {
+		t.Fatal(err)
+	}
+	cmds := []string{}
+	for _, c := range fh.CallsTo("ExpandFs") {
+		cmds = append(cmds, c.Args[1])
+	}
+	if !reflect.DeepEqual(cmds, []string{"e2fsck", "resize2fs"}) {
+		t.Fatalf("Expected e2fsck then resize2fs, got %s", cmds)
+	}
+	// xfs can only be grown while mounted
+	if err := vol.ExpandFsOffline(getCtxt(), "xfs", 10); err == nil {
+		t.Fatal("Expected an error growing xfs offline")
+	}
+}
+
+func TestFormatUnsupported(t *testing.T) {
+	client, fh := getHostClient(t)
+	_, vol, cleanv := createVolume(t, client, &VolOpts{Size: 5, Replica: 1})
+	defer cleanv()
+	if err := vol.Login(getCtxt(), false, false, nil); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := vol.Format(getCtxt(), "zfs", []string{}, 5, false); err == nil {
+		t.Fatal("Expected an error formatting an unregistered filesystem")
+	}
+	if _, err := vol.Format(getCtxt(), "ext4", []string{}, 5, false); err != nil {
+		t.Fatal(err)
+	}
+	calls := fh.CallsTo("Format")
+	if len(calls) != 1 || !reflect.DeepEqual(calls[0].Args[2:], []string{"-E", "lazy_itable_init=0,lazy_journal_init=0,nodiscard", "-F"}) {
+		t.Fatalf("Expected a single format with the ext4 defaults, got %s", calls)
+	}
+}
+
+func TestExpandFsMultipath(t *testing.T) {
+	client, fh := getHostClient(t)
+	_, vol, cleanv := createVolume(t, client, &VolOpts{Size: 5, Replica: 1})
+	defer cleanv()
+	if err := vol.Login(getCtxt(), true, false, nil); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := vol.Format(getCtxt(), "ext4", []string{}, 5, false); err != nil {
+		t.Fatal(err)
+	}
+	dest := fmt.Sprintf("/mnt/my-dir-%s", dsdk.RandString(5))
+	if err := vol.Mount(getCtxt(), dest, []string{}, "ext4"); err != nil {
+		t.Fatal(err)
+	}
+	fh.SetDeviceSize(vol.DevicePath, 10*1024*1024*1024)
+	if err := vol.ExpandFs(getCtxt(), dest, "ext4", 10); err != nil {
+		t.Fatal(err)
+	}
+	if calls := fh.CallsTo("Rescan"); len(calls) != 1 || calls[0].Args[0] != vol.Iqn {
+		t.Fatalf("Expected a single rescan of %s, got %s", vol.Iqn, calls)
+	}
+	if calls := fh.CallsTo("ResizeMultipath"); len(calls) != 1 || calls[0].Args[0] != vol.DevicePath {
+		t.Fatalf("Expected a single resize of %s, got %s", vol.DevicePath, calls)
+	}
 }
 
 func TestCreateDeleteSnapshot(t *testing.T) {
@@ -325,7 +913,7 @@ func TestListSnapshotsSingle(t *testing.T) {
 	snap, cleans := createSnapshot(t, client, vol)
 	defer cleans()
 
-	snaps, err := vol.ListSnapshots(snap.Id)
+	snaps, err := vol.ListSnapshots(getCtxt(), snap.Id)
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -351,7 +939,7 @@ func TestListSnapshotsMany(t *testing.T) {
 	_, cleans3 := createSnapshot(t, client, vol)
 	defer cleans3()
 
-	snaps, err := vol.ListSnapshots("")
+	snaps, err := vol.ListSnapshots(getCtxt(), "")
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -378,13 +966,144 @@ func TestCreateFromSnapshot(t *testing.T) {
 	v2 := &VolOpts{
 		CloneSnapSrc: snap.Snap.Path,
 	}
-	vol, err := client.CreateVolume(name, v2, true)
+	vol, err := client.CreateVolume(getCtxt(), name, v2, true, nil)
 	if err != nil {
 		t.Fatal(err)
 	}
 	defer func() {
-		if err = client.DeleteVolume(name, true); err != nil {
+		if err = client.DeleteVolume(getCtxt(), name, true); err != nil {
 			t.Fatal(err)
 		}
 	}()
 }
+
+func TestGetVolumeNotFound(t *testing.T) {
+	client := getClient(t)
+	_, err := client.GetVolume(getCtxt(), "my-test-missing-"+dsdk.RandString(5), false, false)
+	if status.Code(err) != codes.NotFound {
+		t.Fatalf("Unexpected error for missing volume: [%v]", err)
+	}
+}
+
+func TestSnapshotOpState(t *testing.T) {
+	client, fd := getFakeClient(t)
+	fd.SnapshotReadyAfter = 2
+	v := &VolOpts{
+		Size:    5,
+		Replica: 1,
+	}
+	_, vol, cleanv := createVolume(t, client, v)
+	defer cleanv()
+	snap, err := vol.CreateSnapshot(getCtxt(), "my-test-snap-"+dsdk.RandString(5), &SnapOpts{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer vol.DeleteSnapshot(getCtxt(), snap.Id)
+	if snap.Ready() {
+		t.Fatalf("Snapshot was ready immediately after creation: [%s]", snap.Status)
+	}
+	for i, expected := range []bool{false, true} {
+		if err = snap.Reload(getCtxt()); err != nil {
+			t.Fatal(err)
+		}
+		if snap.Ready() != expected {
+			t.Fatalf("Unexpected snapshot readiness after %d reads: [%t != %t]", i+1, snap.Ready(), expected)
+		}
+	}
+}
+
+func TestCreateSnapshotDuplicate(t *testing.T) {
+	client, fd := getFakeClient(t)
+	v := &VolOpts{
+		Size:    5,
+		Replica: 1,
+	}
+	_, vol, cleanv := createVolume(t, client, v)
+	defer cleanv()
+	name := "my-test-snap-" + dsdk.RandString(5)
+	snap, err := vol.CreateSnapshot(getCtxt(), name, &SnapOpts{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer vol.DeleteSnapshot(getCtxt(), snap.Id)
+	// Hide the existing snapshot from the lookup so the create request is
+	// sent and rejected as a duplicate
+	fd.InjectError("GET", vol.Path+"/snapshots", &dsdk.ApiErrorResponse{
+		Name: "InternalError",
+		Http: 500,
+	})
+	snap2, err := vol.CreateSnapshot(getCtxt(), name, &SnapOpts{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if snap2.Id != snap.Id {
+		t.Fatalf("Duplicate snapshot create returned a different snapshot: [%s != %s]", snap2.Id, snap.Id)
+	}
+}
+
+func TestGetSnapshotByName(t *testing.T) {
+	client := getClient(t)
+	v := &VolOpts{
+		Size:    5,
+		Replica: 1,
+	}
+	_, vol, cleanv := createVolume(t, client, v)
+	defer cleanv()
+	name := "my-test-snap-" + dsdk.RandString(5)
+	snap, err := vol.CreateSnapshot(getCtxt(), name, &SnapOpts{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer vol.DeleteSnapshot(getCtxt(), snap.Id)
+	found, err := client.GetSnapshotByName(getCtxt(), name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if found == nil || found.Id != snap.Id || found.Vol.Name != vol.Name {
+		t.Fatalf("Expected snapshot %s of volume %s, got %#v", snap.Id, vol.Name, found)
+	}
+	if found, err = client.GetSnapshotByName(getCtxt(), "my-missing-snap"); err != nil || found != nil {
+		t.Fatalf("Expected no snapshot, got %#v, %v", found, err)
+	}
+}
+
+func TestDeleteVolumeWithSnapshots(t *testing.T) {
+	client := getClient(t)
+	v := &VolOpts{
+		Size:    5,
+		Replica: 1,
+	}
+	name, vol, cleanv := createVolume(t, client, v)
+	defer cleanv()
+	_, cleans := createSnapshot(t, client, vol)
+	defer cleans()
+	if err := client.DeleteVolume(getCtxt(), name, true); err == nil {
+		t.Fatal("Volume with snapshots was deleted")
+	}
+}
+
+func TestConcurrentContexts(t *testing.T) {
+	client := getClient(t)
+	name, _, cleanf := createVolume(t, client, &VolOpts{Size: 5, Replica: 1})
+	defer cleanf()
+	cancelled, cancel := context.WithCancel(getCtxt())
+	cancel()
+	wg := sync.WaitGroup{}
+	for i := 0; i < 10; i++ {
+		wg.Add(2)
+		// A cancelled request must not affect requests running alongside it
+		go func() {
+			defer wg.Done()
+			if _, err := client.GetVolume(cancelled, name, false, false); err == nil {
+				t.Error("Expected GetVolume to fail with a cancelled context")
+			}
+		}()
+		go func() {
+			defer wg.Done()
+			if _, err := client.GetVolume(getCtxt(), name, false, false); err != nil {
+				t.Error(err)
+			}
+		}()
+	}
+	wg.Wait()
+}
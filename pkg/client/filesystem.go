@@ -0,0 +1,294 @@
+package client
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	co "github.com/Datera/datera-csi/pkg/common"
+)
+
+// Filesystem describes how a filesystem type is created, mounted, grown and
+// checked on the node.  Command functions return nil when the filesystem
+// doesn't support the operation
+type Filesystem struct {
+	Name string
+	// mkfs.<Name> arguments used when a StorageClass sets none
+	MkfsArgs []string
+	// Options every mount of the filesystem gets
+	MountOptions []string
+	// Longest label mkfs accepts
+	MaxLabel int
+	// mkfs arguments setting the label and UUID of the new filesystem
+	LabelArgs func(label string) []string
+	UuidArgs  func(uuid string) []string
+	// Grows the filesystem on device while it is mounted at path
+	GrowOnline func(device, path string) []string
+	// Commands run in order to grow the filesystem on device while it isn't
+	// mounted
+	GrowOffline func(device string) [][]string
+	// Checks the filesystem on device without repairing anything
+	Check func(device string) []string
+	// Block sizes mkfs accepts, in bytes, and the arguments setting one
+	MinBlockSize  int
+	MaxBlockSize  int
+	BlockSizeArgs func(size int) []string
+	// mkfs arguments setting the bytes per inode and the percentage of
+	// blocks reserved for root
+	InodeRatioArgs func(ratio int) []string
+	ReservedArgs   func(percent int) []string
+}
+
+// MkfsOpts are the StorageClass choices for creating a filesystem.  Zero
+// values leave the mkfs default
+type MkfsOpts struct {
+	// Replace the registry MkfsArgs when not empty
+	Args            []string
+	BlockSize       int
+	InodeRatio      int
+	ReservedPercent *int
+	Label           string
+	Uuid            string
+}
+
+// Options mount handles itself or the driver decides on, they can't be
+// StorageClass defaults
+var reservedMountOptions = map[string]bool{
+	"ro":      true,
+	"rw":      true,
+	"bind":    true,
+	"rbind":   true,
+	"remount": true,
+	"move":    true,
+}
+
+// CanGrowOnline is true when the filesystem can be grown while mounted
+func (fs *Filesystem) CanGrowOnline() bool {
+	return fs.GrowOnline != nil
+}
+
+// Args returns the mkfs arguments for creating the filesystem with opts
+func (fs *Filesystem) Args(opts *MkfsOpts) ([]string, error) {
+	args := opts.Args
+	if len(args) == 0 {
+		args = fs.MkfsArgs
+	}
+	result := append([]string{}, args...)
+	if opts.BlockSize != 0 {
+		if fs.BlockSizeArgs == nil {
+			return nil, fmt.Errorf("Filesystem %s does not support setting the block size", fs.Name)
+		}
+		if bs := opts.BlockSize; bs < fs.MinBlockSize || bs > fs.MaxBlockSize || bs&(bs-1) != 0 {
+			return nil, fmt.Errorf("Block size %d must be a power of 2 between %d and %d for %s", bs, fs.MinBlockSize, fs.MaxBlockSize, fs.Name)
+		}
+		result = append(result, fs.BlockSizeArgs(opts.BlockSize)...)
+	}
+	if opts.InodeRatio != 0 {
+		if fs.InodeRatioArgs == nil {
+			return nil, fmt.Errorf("Filesystem %s does not support setting the inode ratio", fs.Name)
+		}
+		if opts.InodeRatio < 1024 || opts.InodeRatio < opts.BlockSize {
+			return nil, fmt.Errorf("Inode ratio %d must be at least 1024 and the block size", opts.InodeRatio)
+		}
+		result = append(result, fs.InodeRatioArgs(opts.InodeRatio)...)
+	}
+	if rp := opts.ReservedPercent; rp != nil {
+		if fs.ReservedArgs == nil {
+			return nil, fmt.Errorf("Filesystem %s does not support reserving blocks", fs.Name)
+		}
+		if *rp < 0 || *rp > 50 {
+			return nil, fmt.Errorf("Reserved blocks percentage %d must be between 0 and 50", *rp)
+		}
+		result = append(result, fs.ReservedArgs(*rp)...)
+	}
+	if opts.Label != "" {
+		if fs.LabelArgs == nil {
+			return nil, fmt.Errorf("Filesystem %s does not support labels", fs.Name)
+		}
+		if len(opts.Label) > fs.MaxLabel {
+			return nil, fmt.Errorf("Label %q is longer than the %d characters %s allows", opts.Label, fs.MaxLabel, fs.Name)
+		}
+		result = append(result, fs.LabelArgs(opts.Label)...)
+	}
+	if opts.Uuid != "" {
+		if fs.UuidArgs == nil {
+			return nil, fmt.Errorf("Filesystem %s does not support setting a UUID", fs.Name)
+		}
+		result = append(result, fs.UuidArgs(opts.Uuid)...)
+	}
+	return result, nil
+}
+
+// CheckMountOptions validates StorageClass mount options for the filesystem
+func (fs *Filesystem) CheckMountOptions(opts []string) error {
+	for _, o := range opts {
+		if o == "" || strings.ContainsAny(o, " \t,") {
+			return fmt.Errorf("Invalid mount option %q", o)
+		}
+		if reservedMountOptions[o] {
+			return fmt.Errorf("Mount option %s is managed by the driver and cannot be set for %s", o, fs.Name)
+		}
+	}
+	return nil
+}
+
+// ParseMountOptions splits comma separated mount options, dropping empty ones
+func ParseMountOptions(opts string) []string {
+	result := []string{}
+	for _, o := range strings.Split(opts, ",") {
+		if o = strings.TrimSpace(o); o != "" {
+			result = append(result, o)
+		}
+	}
+	return result
+}
+
+// MergeMountOptions appends the options in defaults missing from options
+func MergeMountOptions(options, defaults []string) []string {
+	result := append([]string{}, options...)
+	for _, d := range defaults {
+		found := false
+		for _, o := range options {
+			if o == d {
+				found = true
+				break
+			}
+		}
+		if !found {
+			result = append(result, d)
+		}
+	}
+	return result
+}
+
+var (
+	fsLock      = &sync.Mutex{}
+	filesystems = map[string]*Filesystem{}
+)
+
+// RegisterFilesystem adds fs to the filesystems volumes can be formatted
+// with, replacing any filesystem of the same name
+func RegisterFilesystem(fs *Filesystem) {
+	fsLock.Lock()
+	defer fsLock.Unlock()
+	filesystems[fs.Name] = fs
+}
+
+// GetFilesystem returns the registered filesystem name
+func GetFilesystem(name string) (*Filesystem, error) {
+	fsLock.Lock()
+	defer fsLock.Unlock()
+	if fs, ok := filesystems[name]; ok {
+		return fs, nil
+	}
+	return nil, fmt.Errorf("Unsupported filesystem type: %s, supported types are %s", name, filesystemNames())
+}
+
+// Filesystems returns the names of every registered filesystem, sorted
+func Filesystems() []string {
+	fsLock.Lock()
+	defer fsLock.Unlock()
+	return filesystemNames()
+}
+
+func filesystemNames() []string {
+	names := []string{}
+	for name := range filesystems {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+func extFilesystem(name string) *Filesystem {
+	return &Filesystem{
+		Name:     name,
+		MkfsArgs: []string{"-E", "lazy_itable_init=0,lazy_journal_init=0,nodiscard", "-F"},
+		MaxLabel: 16,
+		LabelArgs: func(label string) []string {
+			return []string{"-L", label}
+		},
+		UuidArgs: func(uuid string) []string {
+			return []string{"-U", uuid}
+		},
+		GrowOnline: func(device, path string) []string {
+			return []string{"resize2fs", device}
+		},
+		// resize2fs refuses to grow an unmounted filesystem that hasn't
+		// just been checked
+		GrowOffline: func(device string) [][]string {
+			return [][]string{
+				{"e2fsck", "-f", "-p", device},
+				{"resize2fs", device},
+			}
+		},
+		Check: func(device string) []string {
+			return []string{"e2fsck", "-n", device}
+		},
+		MinBlockSize: 1024,
+		MaxBlockSize: 65536,
+		BlockSizeArgs: func(size int) []string {
+			return []string{"-b", strconv.Itoa(size)}
+		},
+		InodeRatioArgs: func(ratio int) []string {
+			return []string{"-i", strconv.Itoa(ratio)}
+		},
+		ReservedArgs: func(percent int) []string {
+			return []string{"-m", strconv.Itoa(percent)}
+		},
+	}
+}
+
+func init() {
+	RegisterFilesystem(extFilesystem(co.Ext3))
+	RegisterFilesystem(extFilesystem(co.Ext4))
+	RegisterFilesystem(&Filesystem{
+		Name:     co.Xfs,
+		MkfsArgs: []string{},
+		// Clones share the UUID of their source, which xfs otherwise refuses
+		// to mount twice on the same node
+		MountOptions: []string{"nouuid"},
+		MaxLabel:     12,
+		LabelArgs: func(label string) []string {
+			return []string{"-L", label}
+		},
+		UuidArgs: func(uuid string) []string {
+			return []string{"-m", "uuid=" + uuid}
+		},
+		GrowOnline: func(device, path string) []string {
+			return []string{"xfs_growfs", path}
+		},
+		Check: func(device string) []string {
+			return []string{"xfs_repair", "-n", device}
+		},
+		MinBlockSize: 512,
+		MaxBlockSize: 65536,
+		BlockSizeArgs: func(size int) []string {
+			return []string{"-b", "size=" + strconv.Itoa(size)}
+		},
+	})
+	RegisterFilesystem(&Filesystem{
+		Name:     co.Btrfs,
+		MkfsArgs: []string{"-f"},
+		MaxLabel: 255,
+		LabelArgs: func(label string) []string {
+			return []string{"-L", label}
+		},
+		UuidArgs: func(uuid string) []string {
+			return []string{"-U", uuid}
+		},
+		GrowOnline: func(device, path string) []string {
+			return []string{"btrfs", "filesystem", "resize", "max", path}
+		},
+		Check: func(device string) []string {
+			return []string{"btrfs", "check", "--readonly", device}
+		},
+		MinBlockSize: 4096,
+		MaxBlockSize: 65536,
+		BlockSizeArgs: func(size int) []string {
+			return []string{"--sectorsize", strconv.Itoa(size)}
+		},
+	})
+}
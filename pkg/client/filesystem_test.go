@@ -0,0 +1,112 @@
+package client
+
+import (
+	"reflect"
+	"testing"
+
+	co "github.com/Datera/datera-csi/pkg/common"
+)
+
+func TestFilesystems(t *testing.T) {
+	for _, name := range []string{co.Btrfs, co.Ext3, co.Ext4, co.Xfs} {
+		fs, err := GetFilesystem(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !fs.CanGrowOnline() || fs.Check == nil {
+			t.Fatalf("Expected %s to support online grow and checks", name)
+		}
+	}
+	if _, err := GetFilesystem("zfs"); err == nil {
+		t.Fatal("Expected an error for an unregistered filesystem")
+	}
+	fs, _ := GetFilesystem(co.Xfs)
+	if cmd := fs.GrowOnline("/dev/sdb", "/mnt/sdb"); !reflect.DeepEqual(cmd, []string{"xfs_growfs", "/mnt/sdb"}) {
+		t.Fatalf("Expected xfs to be grown through its mount point, got %s", cmd)
+	}
+	fs, _ = GetFilesystem(co.Ext4)
+	if cmds := fs.GrowOffline("/dev/sdb"); len(cmds) != 2 || cmds[0][0] != "e2fsck" {
+		t.Fatalf("Expected a forced check before an offline resize2fs, got %s", cmds)
+	}
+}
+
+func TestFilesystemArgs(t *testing.T) {
+	fs, _ := GetFilesystem(co.Ext4)
+	args, err := fs.Args(&MkfsOpts{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(args, fs.MkfsArgs) {
+		t.Fatalf("Expected default args %s, got %s", fs.MkfsArgs, args)
+	}
+	reserved := 0
+	args, err = fs.Args(&MkfsOpts{
+		Args:            []string{"-F"},
+		BlockSize:       4096,
+		InodeRatio:      16384,
+		ReservedPercent: &reserved,
+		Label:           "data",
+		Uuid:            "0b0c5e8b-6f6e-4b3a-9a3d-1f5c2f0c9b7e",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []string{"-F", "-b", "4096", "-i", "16384", "-m", "0", "-L", "data", "-U", "0b0c5e8b-6f6e-4b3a-9a3d-1f5c2f0c9b7e"}
+	if !reflect.DeepEqual(args, expected) {
+		t.Fatalf("Expected %s, got %s", expected, args)
+	}
+	reserved = 60
+	for _, opts := range []*MkfsOpts{
+		{BlockSize: 3000},
+		{BlockSize: 512},
+		{InodeRatio: 512},
+		{ReservedPercent: &reserved},
+	} {
+		if _, err = fs.Args(opts); err == nil {
+			t.Fatalf("Expected an error for %+v", *opts)
+		}
+	}
+
+	fs, _ = GetFilesystem(co.Xfs)
+	args, err = fs.Args(&MkfsOpts{BlockSize: 512, Uuid: "0b0c5e8b-6f6e-4b3a-9a3d-1f5c2f0c9b7e"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected = []string{"-b", "size=512", "-m", "uuid=0b0c5e8b-6f6e-4b3a-9a3d-1f5c2f0c9b7e"}
+	if !reflect.DeepEqual(args, expected) {
+		t.Fatalf("Expected %s, got %s", expected, args)
+	}
+	reserved = 5
+	for _, opts := range []*MkfsOpts{
+		{Label: "label-too-long"},
+		{InodeRatio: 16384},
+		{ReservedPercent: &reserved},
+	} {
+		if _, err = fs.Args(opts); err == nil {
+			t.Fatalf("Expected an error for %+v on xfs", *opts)
+		}
+	}
+}
+
+func TestMountOptions(t *testing.T) {
+	opts := ParseMountOptions(" noatime,,discard ")
+	if !reflect.DeepEqual(opts, []string{"noatime", "discard"}) {
+		t.Fatalf("Expected [noatime discard], got %s", opts)
+	}
+	fs, _ := GetFilesystem(co.Ext4)
+	if err := fs.CheckMountOptions(opts); err != nil {
+		t.Fatal(err)
+	}
+	for _, o := range []string{"ro", "bind", "no atime"} {
+		if err := fs.CheckMountOptions([]string{o}); err == nil {
+			t.Fatalf("Expected an error for mount option %q", o)
+		}
+	}
+}
+
+func TestMergeOptions(t *testing.T) {
+	opts := MergeMountOptions([]string{"noatime", "nouuid"}, []string{"nouuid", "discard"})
+	if !reflect.DeepEqual(opts, []string{"noatime", "nouuid", "discard"}) {
+		t.Fatalf("Expected [noatime nouuid discard], got %s", opts)
+	}
+}
@@ -8,15 +8,14 @@ import (
 )
 
 type IpPool struct {
-	ctxt   context.Context
 	dc     *DateraClient
 	IpPool *dsdk.AccessNetworkIpPool
 	Name   string
 	Path   string
 }
 
-func (r *DateraClient) GetIpPoolFromName(name string) (*IpPool, error) {
-	ctxt := context.WithValue(r.ctxt, co.ReqName, "GetIpPoolFromName")
+func (r *DateraClient) GetIpPoolFromName(ctxt context.Context, name string) (*IpPool, error) {
+	ctxt = r.reqCtxt(ctxt, "GetIpPoolFromName")
 	co.Debugf(ctxt, "GetIpPoolFromName invoked. Name: %s", name)
 	ipp, apierr, err := r.sdk.AccessNetworkIpPools.Get(&dsdk.AccessNetworkIpPoolsGetRequest{
 		Ctxt: ctxt,
@@ -30,7 +29,6 @@ func (r *DateraClient) GetIpPoolFromName(name string) (*IpPool, error) {
 		return nil, co.ErrTranslator(apierr)
 	}
 	return &IpPool{
-		ctxt:   ctxt,
 		dc:     r,
 		IpPool: ipp,
 		Name:   ipp.Name,
@@ -38,8 +36,8 @@ func (r *DateraClient) GetIpPoolFromName(name string) (*IpPool, error) {
 	}, nil
 }
 
-func (r *Volume) RegisterIpPool(ipPool *IpPool) error {
-	ctxt := context.WithValue(r.ctxt, co.ReqName, "RegisterIpPool")
+func (r *Volume) RegisterIpPool(ctxt context.Context, ipPool *IpPool) error {
+	ctxt = r.reqCtxt(ctxt, "RegisterIpPool")
 	co.Debugf(ctxt, "RegisterIpPool invoked for %s with ipPool %s", r.Name, ipPool)
 	si := r.Ai.StorageInstances[0]
 	_, apierr, err := si.Set(&dsdk.StorageInstanceSetRequest{
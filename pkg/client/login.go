@@ -4,12 +4,19 @@ import (
 	"context"
 	"fmt"
 	"math/rand"
-	"os"
 	"time"
 
 	iscsi "github.com/kubernetes-csi/csi-lib-iscsi/iscsi"
 
 	co "github.com/Datera/datera-csi/pkg/common"
+	host "github.com/Datera/datera-csi/pkg/host"
+	metrics "github.com/Datera/datera-csi/pkg/metrics"
+)
+
+var (
+	// Attempts to find all paths of a multipath device after login
+	multipathRetries       = 10
+	multipathRetryInterval = time.Second
 )
 
 func robin() int {
@@ -19,8 +26,8 @@ func robin() int {
 	return r.Intn(2)
 }
 
-func (v *Volume) Login(multipath, round_robin bool, chapParams map[string]string) error {
-	ctxt := context.WithValue(v.ctxt, co.ReqName, "Login")
+func (v *Volume) Login(ctxt context.Context, multipath, round_robin bool, chapParams map[string]string) error {
+	ctxt = v.dc.reqCtxt(ctxt, "Login")
 	co.Debugf(ctxt, "Login invoked for %s.  Multipath: %t", v.Name, multipath)
 	var ips []string
 	if multipath {
@@ -37,11 +44,11 @@ func (v *Volume) Login(multipath, round_robin bool, chapParams map[string]string
 	}
 	var targets []iscsi.TargetInfo
 	for _, Ip := range ips {
-		targets = append(targets, iscsi.TargetInfo{v.Iqn, Ip, "3260"})
+		targets = append(targets, iscsi.TargetInfo{Iqn: v.Iqn, Portal: Ip, Port: "3260"})
 	}
 
 	secrets := iscsi.Secrets{}
-	c := iscsi.Connector{}
+	c := host.Connector{}
 
 	c.Targets = targets
 	c.Lun = 0
@@ -84,7 +91,9 @@ func (v *Volume) Login(multipath, round_robin bool, chapParams map[string]string
 	}
 
 	co.Debugf(ctxt, "ISCSI Connector: %#v", iscsi_conn)
-	path, err := iscsi.Connect(c)
+	start := time.Now()
+	path, err := v.host.Connect(ctxt, &c)
+	metrics.ObserveNode("login", start, err)
 	if err != nil {
 		co.Error(ctxt, err)
 		return err
@@ -94,15 +103,81 @@ func (v *Volume) Login(multipath, round_robin bool, chapParams map[string]string
 		co.Error(ctxt, err)
 		return err
 	}
+	if multipath {
+		if path, err = v.multipathDevice(ctxt, path, len(ips)); err != nil {
+			co.Error(ctxt, err)
+			if derr := v.host.Disconnect(ctxt, v.Iqn, ips); derr != nil {
+				co.Warning(ctxt, derr)
+			}
+			return err
+		}
+	}
 	v.DevicePath = path
 	co.Debugf(ctxt, "DevicePath for volume %s: %s", v.Name, v.DevicePath)
 	return nil
 }
 
-func (v *Volume) Logout() error {
-	ctxt := context.WithValue(v.ctxt, co.ReqName, "Logout")
+// Resolves the multipath device assembled from the sessions to device and
+// waits for all expected paths to join it.  A device missing paths is used
+// anyway, but won't survive a controller failover, so it is logged loudly
+func (v *Volume) multipathDevice(ctxt context.Context, device string, expected int) (string, error) {
+	var (
+		dm    string
+		paths map[string]string
+		err   error
+	)
+	for i := 0; ; i++ {
+		if dm, err = v.host.MultipathDevice(ctxt, device); err == nil {
+			if paths, err = v.host.MultipathPaths(ctxt, dm); err == nil && RunningPaths(paths) >= expected {
+				co.Infof(ctxt, "Multipath device %s for volume %s has %d paths: %s", dm, v.Name, len(paths), paths)
+				return dm, nil
+			}
+		}
+		if i >= multipathRetries {
+			break
+		}
+		time.Sleep(multipathRetryInterval)
+	}
+	if dm == "" {
+		// multipathd may be configured to skip single path devices
+		if expected == 1 {
+			co.Warningf(ctxt, "No multipath device for volume %s, using single path %s", v.Name, device)
+			return device, nil
+		}
+		return "", fmt.Errorf("No multipath device was assembled for volume %s from %s, is multipathd running?  Set disable_multipath to log in through a single path: %s", v.Name, device, err)
+	}
+	co.Warningf(ctxt, "Multipath device %s for volume %s is degraded, %d of %d expected paths running: %s", dm, v.Name, RunningPaths(paths), expected, paths)
+	return dm, nil
+}
+
+// RunningPaths returns the number of paths in the running state
+func RunningPaths(paths map[string]string) int {
+	n := 0
+	for _, state := range paths {
+		if state == "running" {
+			n++
+		}
+	}
+	return n
+}
+
+func (v *Volume) Logout(ctxt context.Context) error {
+	ctxt = v.dc.reqCtxt(ctxt, "Logout")
 	co.Debugf(ctxt, "Logout invoked for %s", v.Name)
-	err := iscsi.Disconnect(v.Iqn, v.Ips)
+	// Pulling the paths out from under a multipath device leaves it queueing
+	// I/O forever, so it has to go first
+	if v.DevicePath != "" {
+		if dm, err := v.host.MultipathDevice(ctxt, v.DevicePath); err == nil {
+			if err = v.host.FlushMultipath(ctxt, dm); err != nil {
+				err = fmt.Errorf("Could not flush multipath device %s for volume %s, not logging out: %s", dm, v.Name, err)
+				co.Error(ctxt, err)
+				return err
+			}
+		}
+	}
+	start := time.Now()
+	err := v.host.Disconnect(ctxt, v.Iqn, v.Ips)
+	metrics.ObserveNode("logout", start, err)
 	if err != nil {
 		co.Error(ctxt, err)
 		return err
@@ -110,7 +185,3 @@ func (v *Volume) Logout() error {
 	v.DevicePath = ""
 	return nil
 }
-
-func init() {
-	iscsi.EnableDebugLogging(os.Stdout)
-}
@@ -2,52 +2,151 @@ package client
 
 import (
 	"context"
-	"encoding/json"
 	"fmt"
-	"os"
 	"regexp"
-	"strconv"
 	"strings"
 	"time"
 
 	units "github.com/docker/go-units"
 	co "github.com/Datera/datera-csi/pkg/common"
+	host "github.com/Datera/datera-csi/pkg/host"
+	metrics "github.com/Datera/datera-csi/pkg/metrics"
 	dsdk "github.com/Datera/go-sdk/pkg/dsdk"
-	unix "golang.org/x/sys/unix"
 )
 
 var (
 	fsTypeDetect = regexp.MustCompile(`TYPE="(?P<fs>.*?)"`)
+
+	// Time between mkfs attempts while a freshly logged in device settles
+	formatRetryInterval = time.Second
+	// Time between rescans while waiting for a device to grow
+	resizeRetryInterval = time.Second
 )
 
-func (v *Volume) Format(fsType string, fsArgs []string, timeout int) error {
-	ctxt := context.WithValue(v.ctxt, co.ReqName, "Format")
+// Format creates a filesystem on the volume unless it already has one.  The
+// device is probed first, and anything on it other than a filesystem (a
+// partition table, an LVM physical volume) is only formatted over when
+// isNew says the volume was created empty by the driver.  If the device can't
+// be probed before the timeout it is never formatted.  Empty fsArgs use the
+// registry defaults for fsType.  Returns true if a filesystem was created
+func (v *Volume) Format(ctxt context.Context, fsType string, fsArgs []string, timeout int, isNew bool) (bool, error) {
+	ctxt = v.reqCtxt(ctxt, "Format")
 	co.Debugf(ctxt, "Format invoked for %s", v.Name)
 	if v.Formatted {
 		co.Warningf(ctxt, "Volume %s already formatted: %s, %s", v.Name, v.FsType, v.FsArgs)
-		return nil
-	} else if fs, err := findFs(ctxt, v.DevicePath); err == nil {
+		return false, nil
+	}
+	fs, err := GetFilesystem(fsType)
+	if err != nil {
+		co.Error(ctxt, err)
+		return false, err
+	}
+	if fsArgs, err = fs.Args(&MkfsOpts{Args: fsArgs}); err != nil {
+		co.Error(ctxt, err)
+		return false, err
+	}
+	sig, err := probe(ctxt, v.host, v.DevicePath, timeout)
+	if err != nil {
+		err = fmt.Errorf("Could not determine whether device %s of volume %s is empty, refusing to format it: %s", v.DevicePath, v.Name, err)
+		co.Error(ctxt, err)
+		return false, err
+	}
+	if sig.IsFilesystem() {
 		v.Formatted = true
-		v.FsType = fs
+		v.FsType = sig.Type
 		co.Warningf(ctxt, "Volume %s already formatted: %s", v.Name, v.FsType)
-		return nil
-	} else if mnt, err := findMnt(ctxt, v.DevicePath); err == nil {
+		return false, nil
+	} else if mnt, err := v.host.FindMount(ctxt, v.DevicePath); err == nil {
 		v.Formatted = true
 		co.Warningf(ctxt, "Volume %s already formatted and mounted: %s", v.Name, mnt)
-		return nil
+		return false, nil
 	}
-	if err := format(ctxt, v.DevicePath, fsType, fsArgs, timeout); err != nil {
-		return err
+	if !sig.Empty() {
+		if !isNew {
+			err = fmt.Errorf("Device %s of volume %s is not empty (%s), refusing to format it", v.DevicePath, v.Name, sig)
+			co.Error(ctxt, err)
+			return false, err
+		}
+		co.Warningf(ctxt, "Formatting over %s on new volume %s", sig, v.Name)
+	}
+	start := time.Now()
+	err = format(ctxt, v.host, v.DevicePath, fsType, fsArgs, timeout)
+	metrics.ObserveNode("format", start, err)
+	if err != nil {
+		return false, err
 	}
+	v.Formatted = true
 	v.FsType = fsType
 	v.FsArgs = fsArgs
+	return true, nil
+}
+
+// Filesystem returns the type of filesystem on the volume, "" if its device
+// holds none.  Nothing is written to the device
+func (v *Volume) Filesystem(ctxt context.Context, timeout int) (string, error) {
+	ctxt = v.reqCtxt(ctxt, "Filesystem")
+	sig, err := probe(ctxt, v.host, v.DevicePath, timeout)
+	if err != nil {
+		return "", err
+	}
+	if !sig.IsFilesystem() {
+		return "", nil
+	}
+	return sig.Type, nil
+}
+
+// Waits for a freshly logged in device to become readable, then probes it
+func probe(ctxt context.Context, h host.Host, device string, timeout int) (*host.Signature, error) {
+	for {
+		_, err := h.Size(ctxt, device)
+		if err == nil {
+			var sig *host.Signature
+			if sig, err = h.Probe(ctxt, device); err == nil {
+				co.Debugf(ctxt, "Device %s has %s", device, sig)
+				return sig, nil
+			}
+		}
+		co.Info(ctxt, err)
+		if timeout <= 0 {
+			return nil, err
+		}
+		timeout--
+		time.Sleep(formatRetryInterval)
+	}
+}
+
+// CheckFs runs a read-only consistency check of the filesystem on the
+// volume.  Devices that are already mounted are skipped since the result
+// can't be trusted
+func (v *Volume) CheckFs(ctxt context.Context, fsType string) error {
+	ctxt = v.reqCtxt(ctxt, "CheckFs")
+	co.Debugf(ctxt, "CheckFs invoked for %s", v.Name)
+	fs, err := GetFilesystem(fsType)
+	if err != nil {
+		return err
+	}
+	if fs.Check == nil {
+		co.Infof(ctxt, "Skipping filesystem check of volume %s, %s has no checker", v.Name, fsType)
+		return nil
+	}
+	if mnt, err := v.host.FindMount(ctxt, v.DevicePath); err == nil {
+		co.Infof(ctxt, "Skipping filesystem check of volume %s, already mounted at %s", v.Name, mnt)
+		return nil
+	}
+	start := time.Now()
+	out, err := v.host.CheckFs(ctxt, v.DevicePath, fs.Check(v.DevicePath))
+	metrics.ObserveNode("fsck", start, err)
+	if err != nil {
+		err = fmt.Errorf("Filesystem check of %s on volume %s failed: %s: %s", fsType, v.Name, err, strings.TrimSpace(out))
+		co.Error(ctxt, err)
+		return err
+	}
 	return nil
 }
 
-func format(ctxt context.Context, device, fsType string, fsArgs []string, timeout int) error {
-	cmd := append(append([]string{fmt.Sprintf("mkfs.%s", fsType)}, fsArgs...), device)
+func format(ctxt context.Context, h host.Host, device, fsType string, fsArgs []string, timeout int) error {
 	for {
-		if out, err := co.RunCmd(ctxt, cmd...); err != nil {
+		if out, err := h.Format(ctxt, device, fsType, fsArgs); err != nil {
 			co.Info(ctxt, err)
 			if out != "" && strings.Contains(out, "will not make a filesystem here") {
 				co.Warningf(ctxt, "Device %s is already mounted", device)
@@ -58,7 +157,7 @@ func format(ctxt context.Context, device, fsType string, fsArgs []string, timeou
 				return err
 			}
 			timeout--
-			time.Sleep(time.Second)
+			time.Sleep(formatRetryInterval)
 		} else {
 			break
 		}
@@ -66,13 +165,16 @@ func format(ctxt context.Context, device, fsType string, fsArgs []string, timeou
 	return nil
 }
 
-func (v *Volume) Mount(dest string, options []string, fs string) error {
-	ctxt := context.WithValue(v.ctxt, co.ReqName, "Mount")
+func (v *Volume) Mount(ctxt context.Context, dest string, options []string, fs string) error {
+	ctxt = v.reqCtxt(ctxt, "Mount")
 	co.Debugf(ctxt, "Mount invoked for %s", v.Name)
 	if v.DevicePath == "" {
 		return fmt.Errorf("No device path found for volume %s.  Is the volume logged in?", v.Name)
 	}
-	if err := mount(ctxt, v.DevicePath, dest, options, fs); err != nil {
+	start := time.Now()
+	err := v.host.Mount(ctxt, v.DevicePath, dest, fs, options)
+	metrics.ObserveNode("mount", start, err)
+	if err != nil {
 		co.Error(ctxt, err)
 		return err
 	}
@@ -80,15 +182,43 @@ func (v *Volume) Mount(dest string, options []string, fs string) error {
 	return nil
 }
 
-func (v *Volume) BindMount(dest, fs string) error {
-	ctxt := context.WithValue(v.ctxt, co.ReqName, "BindMount")
+// Bind mounts the staged volume at dest.  With readOnly the bind mount is
+// remounted read-only, the staging mount stays writable
+func (v *Volume) BindMount(ctxt context.Context, dest, fs string, readOnly bool) error {
+	ctxt = v.reqCtxt(ctxt, "BindMount")
 	co.Debugf(ctxt, "BindMount invoked for %s", v.Name)
 	if v.DevicePath == "" {
 		return fmt.Errorf("No device path found for volume %s.  Is the volume logged in?", v.Name)
 	} else if v.MountPath == "" {
 		return fmt.Errorf("Mount path doesn't exist for volume %s, cannot bind-mount an unmounted volume", v.Name)
 	}
-	if err := mount(ctxt, v.MountPath, dest, []string{"--bind"}, fs); err != nil {
+	return v.bindMount(ctxt, v.MountPath, dest, fs, readOnly)
+}
+
+// Bind mounts the raw device of a block volume onto the file dest, which is
+// created if needed
+func (v *Volume) BindMountDevice(ctxt context.Context, dest string, readOnly bool) error {
+	ctxt = v.reqCtxt(ctxt, "BindMountDevice")
+	co.Debugf(ctxt, "BindMountDevice invoked for %s", v.Name)
+	if v.DevicePath == "" {
+		return fmt.Errorf("No device path found for volume %s.  Is the volume logged in?", v.Name)
+	}
+	return v.bindMount(ctxt, v.DevicePath, dest, "", readOnly)
+}
+
+func (v *Volume) bindMount(ctxt context.Context, source, dest, fs string, readOnly bool) error {
+	start := time.Now()
+	err := v.host.Mount(ctxt, source, dest, fs, []string{"--bind"})
+	if err == nil && readOnly {
+		if err = v.host.MakeReadOnly(ctxt, dest); err != nil {
+			// Never leave a writable mount behind for a read-only request
+			if uerr := v.host.Unmount(ctxt, dest); uerr != nil {
+				co.Warning(ctxt, uerr)
+			}
+		}
+	}
+	metrics.ObserveNode("bind_mount", start, err)
+	if err != nil {
 		co.Error(ctxt, err)
 		return err
 	}
@@ -100,10 +230,10 @@ func (v *Volume) BindMount(dest, fs string) error {
 	return nil
 }
 
-func (v *Volume) UnBindMount(path string) error {
-	ctxt := context.WithValue(v.ctxt, co.ReqName, "UnBindMount")
+func (v *Volume) UnBindMount(ctxt context.Context, path string) error {
+	ctxt = v.reqCtxt(ctxt, "UnBindMount")
 	co.Debugf(ctxt, "UnBindMount invoked for %s", v.Name)
-	if err := unmount(ctxt, path); err != nil {
+	if err := v.host.Unmount(ctxt, path); err != nil {
 		co.Info(ctxt, err)
 		return nil
 	}
@@ -111,13 +241,16 @@ func (v *Volume) UnBindMount(path string) error {
 	return nil
 }
 
-func (v *Volume) Unmount() error {
-	ctxt := context.WithValue(v.ctxt, co.ReqName, "Unmount")
+func (v *Volume) Unmount(ctxt context.Context) error {
+	ctxt = v.reqCtxt(ctxt, "Unmount")
 	co.Debugf(ctxt, "Unmount invoked for %s", v.Name)
 	if v.MountPath == "" {
 		return fmt.Errorf("Volume is already unmounted")
 	}
-	if err := unmount(ctxt, v.MountPath); err != nil {
+	start := time.Now()
+	err := v.host.Unmount(ctxt, v.MountPath)
+	metrics.ObserveNode("unmount", start, err)
+	if err != nil {
 		co.Error(ctxt, err)
 		return err
 	}
@@ -125,230 +258,92 @@ func (v *Volume) Unmount() error {
 	return nil
 }
 
-func (v *Volume) ExpandFs(path, fs string, size int64) error {
-	ctxt := context.WithValue(v.ctxt, co.ReqName, "ExpandFs")
+// ExpandFs grows the filesystem mounted at path once the device has reached
+// size GiB
+func (v *Volume) ExpandFs(ctxt context.Context, path, fs string, size int64) error {
+	ctxt = v.reqCtxt(ctxt, "ExpandFs")
 	co.Debugf(ctxt, "ExpandFs invoked for %s", v.Name)
-	device, err := deviceFromMount(ctxt, path)
+	f, err := GetFilesystem(fs)
 	if err != nil {
 		return err
 	}
-	co.Debugf(ctxt, "Expand to size requested = %d", size * units.GiB)
-	if err := checkDeviceSize(ctxt, device, size); err != nil {
-		return err
-	}
-	return expandFs(ctxt, device, fs)
-}
-
-func getMajorMinor(device string) (uint32, uint32, error) {
-	s := unix.Stat_t{}
-	if err := unix.Stat(device, &s); err != nil {
-		return 0, 0, err
+	if !f.CanGrowOnline() {
+		return fmt.Errorf("Filesystem %s cannot be grown while mounted", fs)
 	}
-
-	dev := uint64(s.Rdev)
-	return unix.Major(dev), unix.Minor(dev), nil
-}
-
-// This function is for linking a block device to a new location.  This is for raw block-mode support in kubernetes
-func devLink(ctxt context.Context, device, dest string) error {
-	major, minor, err := getMajorMinor(device)
+	device, err := v.host.DeviceFromMount(ctxt, path)
 	if err != nil {
 		return err
 	}
-	cmd := []string{"mknod", dest, "b", strconv.FormatUint(uint64(major), 10), strconv.FormatUint(uint64(minor), 10)}
-	_, err = co.RunCmd(ctxt, cmd...)
-	if err != nil {
+	co.Debugf(ctxt, "Expand to size requested = %d", size * units.GiB)
+	if err := checkDeviceSize(ctxt, v.host, v.Iqn, device, size); err != nil {
 		return err
 	}
-	return nil
-}
-
-type LsBlk struct {
-	BlockDevices []*LsBlkEntry
+	return v.host.ExpandFs(ctxt, device, f.GrowOnline(device, path))
 }
 
-type LsBlkEntry struct {
-	Name       string
-	FsType     string
-	Label      string
-	Uuid       string
-	MountPoint string
-}
-
-func findFs(ctxt context.Context, device string) (string, error) {
-	cmd := []string{"lsblk", "-f", device, "--json"}
-	out, err := co.RunCmd(ctxt, cmd...)
+// ExpandFsOffline grows the filesystem on the unmounted volume once the
+// device has reached size GiB
+func (v *Volume) ExpandFsOffline(ctxt context.Context, fs string, size int64) error {
+	ctxt = v.reqCtxt(ctxt, "ExpandFsOffline")
+	co.Debugf(ctxt, "ExpandFsOffline invoked for %s", v.Name)
+	f, err := GetFilesystem(fs)
 	if err != nil {
-		return "", err
-	}
-	co.Debugf(ctxt, "lsblk output: %s", out)
-	data := &LsBlk{}
-	if err := json.Unmarshal([]byte(out), &data); err != nil {
-		return "", err
-	}
-	if len(data.BlockDevices) < 1 {
-		cmd := []string{"lsblk", "-f"}
-		out, err := co.RunCmd(ctxt, cmd...)
-		if err != nil {
-			return "", err
-		}
-		co.Debugf(ctxt, "lsblk full output: %s", out)
-		return "", fmt.Errorf("No block devices returned from lsblk")
-	}
-	fs := data.BlockDevices[0].FsType
-	if fs == "" {
-		return "", fmt.Errorf("No filesystem found")
-	}
-	return fs, nil
-}
-
-func findMnt(ctxt context.Context, device string) (string, error) {
-	cmd := []string{"grep", fmt.Sprintf("'%s'", device), "/proc/mounts"}
-	out, err := co.RunCmd(ctxt, cmd...)
-	if err != nil {
-		return "", err
+		return err
 	}
-	co.Debugf(ctxt, "%s result: %s", cmd, out)
-	return out, nil
-}
-
-func isDevice(ctxt context.Context, file string) bool {
-	f, _ := os.Stat(file)
-	if !f.IsDir() && strings.HasPrefix(file, "/dev/") {
-		return true
+	if f.GrowOffline == nil {
+		return fmt.Errorf("Filesystem %s cannot be grown while unmounted", fs)
 	}
-	return false
-}
-
-func readlink(ctxt context.Context, device string) (string, error) {
-	cmd := []string{"readlink", "-f", device}
-	return co.RunCmd(ctxt, cmd...)
-}
-
-func deviceFromMount(ctxt context.Context, file string) (string, error) {
-
-	cmd :=  []string{"sh", "-c", fmt.Sprintf("grep '%s' /proc/mounts", file)}
-	out, err := co.RunCmd(ctxt, cmd...)
-	if err != nil {
-		return "", err
+	if mnt, err := v.host.FindMount(ctxt, v.DevicePath); err == nil {
+		return fmt.Errorf("Volume %s is mounted at %s, cannot grow it offline", v.Name, mnt)
 	}
-
-	components := strings.Fields(out)
-	device := components[0]
-
-	dev, err := readlink(ctxt, device)
-	// If readlink fails, we'll assume the device we pulled from /proc/mounts
-	// is correct.  Some versions of readlink won't error out and instead will
-	// return the file/directory that was passed in, in which case we'll just
-	// return that
-	if err != nil {
-		return device, nil
+	if err := checkDeviceSize(ctxt, v.host, v.Iqn, v.DevicePath, size); err != nil {
+		return err
 	}
-	return strings.TrimSpace(dev), nil
-}
-
-// Cases:
-// /dev/disk/by-path/some-ip-and-iqn /var/lib/kubelet/plugins/kubernetes.io/csi/pv/pvc-<uuid>/globalmount
-// /var/lib/kubelet/plugins/kubernetes.io/csi/pv/pvc-<uuid>/globalmount /var/lib/kubelet/plugins/kubernetes.io/csi/pv/new_mount
-
-func mount(ctxt context.Context, source, dest string, options []string, fs string) error {
-	co.Debugf(ctxt, "Mount called. source: %s, dest: %s, options: %s, fs: %s", source, dest, options, fs)
-
-	// Create destination directory if it doesn't exist
-	if _, err := os.Stat(dest); os.IsNotExist(err) {
-		err = os.MkdirAll(dest, os.ModePerm)
-		if err != nil {
+	for _, cmd := range f.GrowOffline(v.DevicePath) {
+		if err := v.host.ExpandFs(ctxt, v.DevicePath, cmd); err != nil {
 			return err
 		}
 	}
-	// Get the original device if this is a mount
-	dev, err := deviceFromMount(ctxt, source)
-
-	// If we couldn't resolve, then we're probably working with the device already
-	cmd := []string{}
-	bind := false
-
-	if err != nil {
-		dev = source
-		for _, opt := range options {
-			if opt == "--bind" {
-				bind = true
-			}
-		}
-		if bind {
-			cmd = append([]string{"mount", dev, dest}, options...)
-		} else {
-			cmd = append([]string{"mount", "-t", fs, dev, dest}, options...)
-		}
-	} else {
-		// Remove the --bind option from options array
-		for idx, opt := range options {
-			if opt == "--bind" {
-				copy(options[idx:], options[idx+1:])
-				options[len(options)-1] = ""
-				options = options[:len(options)-1]
-				break
-			}
-		}
-		cmd = append([]string{"mount", dev, dest}, options...)
-	}
-
-	_, err = co.RunCmd(ctxt, cmd...)
-	return err
+	return nil
 }
 
-func unmount(ctxt context.Context, path string) error {
-	cmd := []string{"umount", path}
-	_, err := co.RunCmd(ctxt, cmd...)
-	if err != nil {
-		co.Info(ctxt, err)
-	}
-	return os.RemoveAll(path)
+// Waits for the raw block device at path to reach size GiB.  There is no
+// filesystem to grow, the application sees the new size once the iSCSI
+// session has been rescanned
+func (v *Volume) ExpandBlock(ctxt context.Context, path string, size int64) error {
+	ctxt = v.reqCtxt(ctxt, "ExpandBlock")
+	co.Debugf(ctxt, "ExpandBlock invoked for %s", v.Name)
+	return checkDeviceSize(ctxt, v.host, v.Iqn, path, size)
 }
 
-func checkDeviceSize(ctxt context.Context, device string, expectedSize int64) error {
-	iscsiCmd := []string{"iscsiadm", "-m", "session", "-R"}
-	blockdevCmd := []string{"blockdev", "--getsize64", device}
+func checkDeviceSize(ctxt context.Context, h host.Host, iqn, device string, expectedSize int64) error {
 	timeout := 60
+	expectedSize = int64(expectedSize * units.GiB)
 	for {
-		_, err := co.RunCmd(ctxt, iscsiCmd...)
-		if err != nil {
+		if err := h.Rescan(ctxt, iqn); err != nil {
 			co.Warningf(ctxt, err.Error())
 		}
-		out, err := co.RunCmd(ctxt, blockdevCmd...)
-		if err != nil {
-			co.Warningf(ctxt, err.Error())
+		// A multipath device keeps its size until told its paths have grown
+		if dm, err := h.MultipathDevice(ctxt, device); err == nil {
+			if err = h.ResizeMultipath(ctxt, dm); err != nil {
+				co.Warningf(ctxt, "Could not resize multipath device %s: %s", dm, err)
+			}
 		}
-		out = strings.TrimSuffix(out, "\n")
-		expectedSize = int64(expectedSize * units.GiB)
-		size, err := strconv.ParseInt(out, 10, 0)
+		size, err := h.Size(ctxt, device)
 		if err != nil {
-			co.Warningf(ctxt, "Could not parse int: %s", err.Error())
+			co.Warningf(ctxt, "Could not read size of %s: %s", device, err.Error())
 		}
-		if size == expectedSize {
+		// Datera sizes are whole GiB, a device that has grown past the
+		// expected size is fine too
+		if size >= expectedSize {
 			return nil
 		} else {
-			co.Warningf(ctxt, "Blockdevice %s size did not match expected size [%s != %s]", device, size, expectedSize)
+			co.Warningf(ctxt, "Blockdevice %s size did not match expected size [%d != %d]", device, size, expectedSize)
 		}
 		timeout--
 		if timeout < 0 {
 			return fmt.Errorf("Blockdevice %s did not resolve to expected size before timeout reached", device)
 		}
+		time.Sleep(resizeRetryInterval)
 	}
-	return nil
-}
-
-// This is going to always grow the filesystem to the maximum possible size
-func expandFs(ctxt context.Context, path string, fs string) error {
-	cmd := []string{}
-	if fs == co.Ext4 {
-		cmd = []string{"resize2fs", path}
-	} else if fs == co.Xfs {
-		cmd = []string{"xfs_growfs", path}
-	}
-	_, err := co.RunCmd(ctxt, cmd...)
-	if err != nil {
-		return err
-	}
-	return nil
 }
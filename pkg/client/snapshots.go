@@ -6,7 +6,6 @@ import (
 	"sort"
 	"strings"
 	"sync"
-	"time"
 
 	uuid "github.com/google/uuid"
 
@@ -17,6 +16,9 @@ import (
 // NEVER CHANGE THIS AFTER v1.0 release
 const SnapDomainStr = "7079EAEC-2660-4A35-9A48-9C47204C01A9"
 
+// Snapshot op_state reported by the Datera system once the snapshot is usable
+const SnapshotAvailable = "available"
+
 var SnapDomain *uuid.UUID
 
 type SnapOpts struct {
@@ -25,7 +27,6 @@ type SnapOpts struct {
 }
 
 type Snapshot struct {
-	ctxt   context.Context
 	dc     *DateraClient
 	Snap   *dsdk.Snapshot
 	Vol    *Volume
@@ -52,19 +53,19 @@ func snapIdFromName(ctxt context.Context, name string) *uuid.UUID {
 	return &sid
 }
 
-func (r *DateraClient) SnapshotPathFromCsiId(csiId string) (string, error) {
-	ctxt := context.WithValue(r.ctxt, co.ReqName, "SnapshotPathFromCsiId")
+func (r *DateraClient) SnapshotPathFromCsiId(ctxt context.Context, csiId string) (string, error) {
+	ctxt = r.reqCtxt(ctxt, "SnapshotPathFromCsiId")
 	co.Debugf(ctxt, "SnapshotPathFromCsiId invoked.  csiId: %s", csiId)
 	parts := strings.Split(csiId, ":")
 	vid := parts[0]
 	snapTs := parts[1]
 	co.Debugf(ctxt, "Snapshot parts: %s, %s", vid, snapTs)
-	vol, err := r.GetVolume(vid, false, false)
+	vol, err := r.GetVolume(ctxt, vid, false, false)
 	if err != nil {
 		co.Errorf(ctxt, "Could not find volume from provided csi snapshot ID: %s, err: %s", csiId, err.Error())
 		return "", err
 	}
-	snaps, err := vol.ListSnapshots(snapTs)
+	snaps, err := vol.ListSnapshots(ctxt, snapTs)
 	if len(snaps) != 1 {
 		err = fmt.Errorf("Unexpected number of snapshots found for csi snapshot ID: %s, expected 1 found %d", csiId, len(snaps))
 		co.Error(ctxt, err)
@@ -73,8 +74,8 @@ func (r *DateraClient) SnapshotPathFromCsiId(csiId string) (string, error) {
 	return snaps[0].Path, nil
 }
 
-func (r *DateraClient) ListSnapshots(snapId, sourceVol string, maxEntries, startToken int) ([]*Snapshot, int, error) {
-	ctxt := context.WithValue(r.ctxt, co.ReqName, "ListSnapshots")
+func (r *DateraClient) ListSnapshots(ctxt context.Context, snapId, sourceVol string, maxEntries, startToken int) ([]*Snapshot, int, error) {
+	ctxt = r.reqCtxt(ctxt, "ListSnapshots")
 	co.Debugf(ctxt, "ListSnapshots invoked.  snapId = %s, sourceVol = %s, maxEntries = %d, startToken = %d\n", snapId, sourceVol, maxEntries, startToken)
 	var (
 		err   error
@@ -94,20 +95,20 @@ func (r *DateraClient) ListSnapshots(snapId, sourceVol string, maxEntries, start
 	}
 
 	if vid != "" && sid != "" {
-		vol, err := r.GetVolume(vid, false, false)
+		vol, err := r.GetVolume(ctxt, vid, false, false)
 		if err != nil {
 			return nil, 0, err
 		}
-		snaps, err = vol.ListSnapshots(sid)
+		snaps, err = vol.ListSnapshots(ctxt, sid)
 	} else {
 		// TODO: When the new Snapshots API is available, bypass this slow path
 		if sourceVol == "" {
-			vols, err = r.ListVolumes(0, 0)
+			vols, err = r.ListVolumes(ctxt, 0, 0)
 			if err != nil {
 				return nil, 0, err
 			}
 		} else {
-			vol, err := r.GetVolume(sourceVol, false, false)
+			vol, err := r.GetVolume(ctxt, sourceVol, false, false)
 			if err != nil {
 				return nil, 0, err
 			}
@@ -123,7 +124,7 @@ func (r *DateraClient) ListSnapshots(snapId, sourceVol string, maxEntries, start
 		for _, vol := range vols {
 			wg.Add(1)
 			go func(v *Volume) {
-				psnaps, err := v.ListSnapshots(sid)
+				psnaps, err := v.ListSnapshots(ctxt, sid)
 				if err != nil {
 					co.Error(ctxt, err)
 					wg.Done()
@@ -178,8 +179,8 @@ func (r *DateraClient) ListSnapshots(snapId, sourceVol string, maxEntries, start
 	return snaps[startToken:end], end, nil
 }
 
-func (r *Volume) GetSnapshotByUuid(id *uuid.UUID) (*Snapshot, error) {
-	ctxt := context.WithValue(r.ctxt, co.ReqName, "GetSnapshotByUuid")
+func (r *Volume) GetSnapshotByUuid(ctxt context.Context, id *uuid.UUID) (*Snapshot, error) {
+	ctxt = r.reqCtxt(ctxt, "GetSnapshotByUuid")
 	co.Debugf(ctxt, "GetSnapshotByUuid invoked for %s", r.Name)
 	snaps, apierr, err := r.Ai.StorageInstances[0].Volumes[0].SnapshotsEp.List(&dsdk.SnapshotsListRequest{
 		Ctxt: ctxt,
@@ -193,13 +194,12 @@ func (r *Volume) GetSnapshotByUuid(id *uuid.UUID) (*Snapshot, error) {
 	}
 	for _, snap := range snaps {
 		if snap.Uuid == id.String() {
-			v, err := aiToClientVol(ctxt, r.Ai, false, false, nil)
+			v, err := aiToClientVol(ctxt, r.Ai, false, false, r.dc)
 			if err != nil {
 				co.Error(ctxt, err)
 				return nil, err
 			}
 			return &Snapshot{
-				ctxt:   r.ctxt,
 				dc:     r.dc,
 				Snap:   snap,
 				Vol:    v,
@@ -213,10 +213,61 @@ func (r *Volume) GetSnapshotByUuid(id *uuid.UUID) (*Snapshot, error) {
 
 }
 
-func (r *Volume) CreateSnapshot(name string, snapOpts *SnapOpts) (*Snapshot, error) {
-	ctxt := context.WithValue(r.ctxt, co.ReqName, "CreateSnapshot")
+// Returns the snapshot of this volume created with the CSI name, or nil.
+// Only the snapshots loaded along with the volume are looked at, so this
+// makes no request
+func (r *Volume) GetSnapshotByName(ctxt context.Context, name string) *Snapshot {
+	ctxt = r.reqCtxt(ctxt, "GetSnapshotByName")
+	co.Debugf(ctxt, "GetSnapshotByName invoked for %s", r.Name)
+	sid := snapIdFromName(ctxt, name).String()
+	if len(r.Ai.StorageInstances) == 0 || len(r.Ai.StorageInstances[0].Volumes) == 0 {
+		return nil
+	}
+	for _, snap := range r.Ai.StorageInstances[0].Volumes[0].Snapshots {
+		if snap.Uuid == sid {
+			return &Snapshot{
+				dc:     r.dc,
+				Snap:   snap,
+				Vol:    r,
+				Id:     snap.UtcTs,
+				Path:   snap.Path,
+				Status: snap.OpState,
+			}
+		}
+	}
+	return nil
+}
+
+// Returns the snapshot created with the CSI name in the tenant of ctxt, or
+// nil.  The name is only recorded in the snapshot UUID, see snapIdFromName,
+// so this lists every volume of the tenant.  Look on a known volume first
+// with Volume.GetSnapshotByName
+func (r *DateraClient) GetSnapshotByName(ctxt context.Context, name string) (*Snapshot, error) {
+	ctxt = r.reqCtxt(ctxt, "GetSnapshotByName")
+	co.Debugf(ctxt, "GetSnapshotByName invoked for %s", name)
+	vols, err := r.ListVolumes(ctxt, 0, 0)
+	if err != nil {
+		return nil, err
+	}
+	for _, vol := range vols {
+		if snap := vol.GetSnapshotByName(ctxt, name); snap != nil {
+			return snap, nil
+		}
+	}
+	return nil, nil
+}
+
+// Creates a snapshot without waiting for it to become available.  The
+// snapshot UUID is derived from the name, so retries of the same request
+// return the existing snapshot along with its current Status
+func (r *Volume) CreateSnapshot(ctxt context.Context, name string, snapOpts *SnapOpts) (*Snapshot, error) {
+	ctxt = r.reqCtxt(ctxt, "CreateSnapshot")
 	co.Debugf(ctxt, "CreateSnapshot invoked for %s", r.Name)
 	sid := snapIdFromName(ctxt, name)
+	if csnap, err := r.GetSnapshotByUuid(ctxt, sid); err == nil {
+		co.Debugf(ctxt, "Snapshot %s already exists with status %s", sid.String(), csnap.Status)
+		return csnap, nil
+	}
 	var (
 		snap   *dsdk.Snapshot
 		apierr *dsdk.ApiErrorResponse
@@ -239,20 +290,19 @@ func (r *Volume) CreateSnapshot(name string, snapOpts *SnapOpts) (*Snapshot, err
 		co.Errorf(ctxt, "%s, %s", dsdk.Pretty(apierr), err)
 		// Duplicate found
 		if apierr.Name == "InvalidRequestError" && apierr.Code == 15 {
-			return r.GetSnapshotByUuid(sid)
+			return r.GetSnapshotByUuid(ctxt, sid)
 		}
 		return nil, co.ErrTranslator(apierr)
 	} else if err != nil {
 		co.Error(ctxt, err)
 		return nil, err
 	}
-	v, err := aiToClientVol(ctxt, r.Ai, false, false, nil)
+	v, err := aiToClientVol(ctxt, r.Ai, false, false, r.dc)
 	if err != nil {
 		co.Error(ctxt, err)
 		return nil, err
 	}
 	csnap := &Snapshot{
-		ctxt:   r.ctxt,
 		dc:     r.dc,
 		Snap:   snap,
 		Vol:    v,
@@ -260,31 +310,15 @@ func (r *Volume) CreateSnapshot(name string, snapOpts *SnapOpts) (*Snapshot, err
 		Path:   snap.Path,
 		Status: snap.OpState,
 	}
-	// Poll for availability
-	timeout := 30
-	for {
-		err = csnap.Reload()
-		if err != nil {
-			return csnap, err
-		}
-		if csnap.Status == "available" {
-			return csnap, nil
-		}
-		co.Debugf(ctxt, "Snapshot %s is not available yet", csnap.Id)
-		time.Sleep(time.Second * 1)
-		timeout--
-		if timeout <= 0 {
-			err := fmt.Errorf("Snapshot %s did not become available before timeout", csnap.Id)
-			return csnap, err
-		}
-	}
+	co.Debugf(ctxt, "Snapshot %s created with status %s", csnap.Id, csnap.Status)
+	return csnap, nil
 }
 
-func (r *Volume) DeleteSnapshot(id string) error {
-	ctxt := context.WithValue(r.ctxt, co.ReqName, "DeleteSnapshot")
+func (r *Volume) DeleteSnapshot(ctxt context.Context, id string) error {
+	ctxt = r.reqCtxt(ctxt, "DeleteSnapshot")
 	co.Debugf(ctxt, "DeleteSnapshot invoked for %s", r.Name)
 	var found *dsdk.Snapshot
-	err := r.Reload(false, false)
+	err := r.Reload(ctxt, false, false)
 	if err != nil {
 		co.Warning(ctxt, err)
 		return nil
@@ -312,22 +346,22 @@ func (r *Volume) DeleteSnapshot(id string) error {
 	return nil
 }
 
-func (r *Volume) HasSnapshots() (bool, error) {
-	ctxt := context.WithValue(r.ctxt, co.ReqName, "HasSnapshots")
+func (r *Volume) HasSnapshots(ctxt context.Context) (bool, error) {
+	ctxt = r.reqCtxt(ctxt, "HasSnapshots")
 	co.Debugf(ctxt, "Volume %s HasSnapshots invoked\n", r.Name)
-	snaps, err := r.ListSnapshots("")
+	snaps, err := r.ListSnapshots(ctxt, "")
 	if err != nil {
 		return false, err
 	}
 	return len(snaps) > 0, nil
 }
 
-func (r *Volume) ListSnapshots(snapId string) ([]*Snapshot, error) {
-	ctxt := context.WithValue(r.ctxt, co.ReqName, "ListSnapshots")
+func (r *Volume) ListSnapshots(ctxt context.Context, snapId string) ([]*Snapshot, error) {
+	ctxt = r.reqCtxt(ctxt, "ListSnapshots")
 	co.Debugf(ctxt, "Volume %s ListSnapshots invoked. snapId: %s", r.Name, snapId)
 	snaps := []*Snapshot{}
 	// Reload volume (app_instance) to ensure data is valid
-	err := r.Reload(false, false)
+	err := r.Reload(ctxt, false, false)
 	if err != nil {
 		co.Warning(ctxt, err)
 		return snaps, nil
@@ -345,13 +379,12 @@ func (r *Volume) ListSnapshots(snapId string) ([]*Snapshot, error) {
 	}
 	for _, s := range rsnaps {
 		if snapId == "" || snapId == s.UtcTs {
-			v, err := aiToClientVol(ctxt, r.Ai, false, false, nil)
+			v, err := aiToClientVol(ctxt, r.Ai, false, false, r.dc)
 			if err != nil {
 				co.Error(ctxt, err)
 				return nil, err
 			}
 			snaps = append(snaps, &Snapshot{
-				ctxt:   r.ctxt,
 				dc:     r.dc,
 				Snap:   s,
 				Vol:    v,
@@ -365,8 +398,13 @@ func (r *Volume) ListSnapshots(snapId string) ([]*Snapshot, error) {
 	return snaps, nil
 }
 
-func (s *Snapshot) Reload() error {
-	ctxt := context.WithValue(s.ctxt, co.ReqName, "Snapshot Reload")
+// Ready reports whether the snapshot can be used as a volume source
+func (s *Snapshot) Ready() bool {
+	return s.Status == SnapshotAvailable
+}
+
+func (s *Snapshot) Reload(ctxt context.Context) error {
+	ctxt = s.Vol.reqCtxt(ctxt, "Snapshot Reload")
 	co.Debugf(ctxt, "Snapshot Reload invoked: %s", s.Id)
 	snap, apierr, err := s.Snap.Reload(&dsdk.SnapshotReloadRequest{
 		Ctxt: ctxt,
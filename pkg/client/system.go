@@ -6,11 +6,11 @@ import (
 	"strconv"
 
 	co "github.com/Datera/datera-csi/pkg/common"
+	metrics "github.com/Datera/datera-csi/pkg/metrics"
 	dsdk "github.com/Datera/go-sdk/pkg/dsdk"
 )
 
 type Capacity struct {
-	ctxt              context.Context
 	dc                *DateraClient
 	Total             int
 	Provisioned       int
@@ -21,7 +21,6 @@ type Capacity struct {
 }
 
 type Manifest struct {
-	ctxt               context.Context
 	dc                 *DateraClient
 	BuildVersion       string
 	CallhomeEnabled    string
@@ -35,11 +34,11 @@ type Manifest struct {
 	Uuid               string
 }
 
-func (r *DateraClient) GetCapacity() (*Capacity, error) {
-	ctxt := context.WithValue(r.ctxt, co.ReqName, "GetCapacity")
+func (r *DateraClient) GetCapacity(ctxt context.Context) (*Capacity, error) {
+	ctxt = r.reqCtxt(ctxt, "GetCapacity")
 	co.Debugf(ctxt, "GetCapacity invoked")
 	sys, apierr, err := r.sdk.System.Get(&dsdk.SystemGetRequest{
-		Ctxt: r.ctxt,
+		Ctxt: ctxt,
 	})
 	if err != nil {
 		co.Error(ctxt, err)
@@ -50,8 +49,10 @@ func (r *DateraClient) GetCapacity() (*Capacity, error) {
 		co.Error(ctxt, err)
 		return nil, co.ErrTranslator(apierr)
 	}
+	metrics.SetCapacity("all", sys.TotalCapacity, sys.TotalProvisionedCapacity)
+	metrics.SetCapacity("flash", sys.AllFlashTotalCapacity, sys.AllFlashProvisionedCapacity)
+	metrics.SetCapacity("hybrid", sys.HybridTotalCapacity, sys.HybridProvisionedCapacity)
 	return &Capacity{
-		ctxt:              r.ctxt,
 		dc:                r,
 		Total:             sys.TotalCapacity,
 		Provisioned:       sys.TotalProvisionedCapacity,
@@ -62,11 +63,11 @@ func (r *DateraClient) GetCapacity() (*Capacity, error) {
 	}, nil
 }
 
-func (r *DateraClient) VendorVersion() (string, error) {
-	ctxt := context.WithValue(r.ctxt, co.ReqName, "VendorVersion")
+func (r *DateraClient) VendorVersion(ctxt context.Context) (string, error) {
+	ctxt = r.reqCtxt(ctxt, "VendorVersion")
 	co.Debugf(ctxt, "VendorVersion invoked")
 	sys, apierr, err := r.sdk.System.Get(&dsdk.SystemGetRequest{
-		Ctxt: r.ctxt,
+		Ctxt: ctxt,
 	})
 	if err != nil {
 		co.Error(ctxt, err)
@@ -81,11 +82,11 @@ func (r *DateraClient) VendorVersion() (string, error) {
 	return sys.SwVersion, nil
 }
 
-func (r *DateraClient) GetManifest() (*Manifest, error) {
-	ctxt := context.WithValue(r.ctxt, co.ReqName, "GetManifest")
+func (r *DateraClient) GetManifest(ctxt context.Context) (*Manifest, error) {
+	ctxt = r.reqCtxt(ctxt, "GetManifest")
 	co.Debugf(ctxt, "GetManifest invoked")
 	sys, apierr, err := r.sdk.System.Get(&dsdk.SystemGetRequest{
-		Ctxt: r.ctxt,
+		Ctxt: ctxt,
 	})
 	if err != nil {
 		co.Error(ctxt, err)
@@ -97,7 +98,6 @@ func (r *DateraClient) GetManifest() (*Manifest, error) {
 		return nil, co.ErrTranslator(apierr)
 	}
 	mf := &Manifest{
-		ctxt:               r.ctxt,
 		dc:                 r,
 		BuildVersion:       sys.BuildVersion,
 		CallhomeEnabled:    strconv.FormatBool(sys.CallhomeEnabled),
@@ -3,12 +3,14 @@ package client
 import (
 	"context"
 	"fmt"
+	"path"
 	"strconv"
 	"strings"
 
 	"encoding/json"
 
 	co "github.com/Datera/datera-csi/pkg/common"
+	host "github.com/Datera/datera-csi/pkg/host"
 	dsdk "github.com/Datera/go-sdk/pkg/dsdk"
 )
 
@@ -19,6 +21,10 @@ type VolOpts struct {
 	RemoteProvider          string   `json:"remote_provider,omitempty"`
 	FsType                  string   `json:"fs_type,omitempty"`
 	FsArgs                  []string `json:"fs_args,omitempty"`
+	FsBlockSize             int      `json:"fs_block_size,omitempty"`
+	FsInodeRatio            int      `json:"fs_inode_ratio,omitempty"`
+	FsReservedPercent       *int     `json:"fs_reserved_percent,omitempty"`
+	MountOptions            []string `json:"mount_options,omitempty"`
 	PlacementMode           string   `json:"placement,omitempty"`
 	PlacementPolicy         string   `json:"placement_policy,omitempty"`
 	CloneSrc                string   `json:"clone_src,omitempty"`
@@ -28,6 +34,10 @@ type VolOpts struct {
 	RoundRobin              bool     `json:"round_robin,omitempty"`
 	DeleteOnUnmount         bool     `json:"delete_on_unmount,omitempty"`
 	DisableTemplateOverride bool     `json:"disable_template_override,omitempty"`
+	// AppInstance description and Datera tenant, not stored in metadata.  An
+	// empty tenant is the client one
+	Descr  string `json:"descr,omitempty"`
+	Tenant string `json:"tenant,omitempty"`
 
 	// QoS IOPS
 	WriteIopsMax int `json:"write_iops_max,omitempty"`
@@ -45,18 +55,29 @@ type VolOpts struct {
 }
 
 type Volume struct {
-	ctxt           context.Context
 	dc             *DateraClient
+	host           host.Host
 	Ai             *dsdk.AppInstance
 	Name           string
+	Path           string
 	AdminState     string
 	RepairPriority string
 	Template       string
 
+	// CSI volume ID, see co.MkVolId, and Datera tenant of the app instance,
+	// "" for the client tenant
+	Id     string
+	Tenant string
+
+	// App instance op_state and volume (replica) health
+	OpState string
+	Health  string
+
 	TargetOpState string
 	Ips           []string
 	Iqn           string
-	Initiators    []string
+	// IQNs of the initiators in the ACL
+	Initiators []string
 
 	Replicas        int
 	PlacementMode   string
@@ -90,12 +111,15 @@ type VolMetadata map[string]string
 var MetadataDebug = false
 
 func (v VolOpts) ToMap() map[string]string {
-	return map[string]string{
+	m := map[string]string{
 		"size":                      strconv.FormatInt(int64(v.Size), 10),
 		"replica":                   strconv.FormatInt(int64(v.Replica), 10),
 		"template":                  v.Template,
 		"fs_type":                   v.FsType,
 		"fs_args":                   strings.Join(v.FsArgs, " "),
+		"fs_block_size":             optInt(v.FsBlockSize),
+		"fs_inode_ratio":            optInt(v.FsInodeRatio),
+		"mount_options":             strings.Join(v.MountOptions, ","),
 		"placement":                 v.PlacementMode,
 		"placement_policy":          v.PlacementPolicy,
 		"clone_src":                 v.CloneSrc,
@@ -120,6 +144,18 @@ func (v VolOpts) ToMap() map[string]string {
 		"iops_per_gb":      strconv.FormatInt(int64(v.IopsPerGb), 10),
 		"bandwidth_per_gb": strconv.FormatInt(int64(v.BandwidthPerGb), 10),
 	}
+	if v.FsReservedPercent != nil {
+		m["fs_reserved_percent"] = strconv.Itoa(*v.FsReservedPercent)
+	}
+	return m
+}
+
+// Unset optional numbers are left out of metadata as empty strings
+func optInt(i int) string {
+	if i == 0 {
+		return ""
+	}
+	return strconv.Itoa(i)
 }
 
 func aiToClientVol(ctx context.Context, ai *dsdk.AppInstance, qos, metadata bool, client *DateraClient) (*Volume, error) {
@@ -131,7 +167,12 @@ func aiToClientVol(ctx context.Context, ai *dsdk.AppInstance, qos, metadata bool
 	v := si.Volumes[0]
 	inits := []string{}
 	for _, init := range si.AclPolicy.Initiators {
-		inits = append(inits, init.Name)
+		// ACL entries are usually just a reference to /initiators/<iqn>
+		iqn := init.Id
+		if iqn == "" {
+			iqn = path.Base(init.Path)
+		}
+		inits = append(inits, iqn)
 	}
 	var pp map[string]int
 	if qos && client != nil {
@@ -154,15 +195,24 @@ func aiToClientVol(ctx context.Context, ai *dsdk.AppInstance, qos, metadata bool
 		}
 	}
 
+	var tenant string
+	if client != nil {
+		tenant = client.Tenant(ctxt)
+	}
 	vol := &Volume{
-		ctxt:           ctxt,
 		dc:             client,
 		Ai:             ai,
+		Id:             co.MkVolId(tenant, ai.Name),
+		Tenant:         tenant,
 		Name:           ai.Name,
+		Path:           v.Path,
 		AdminState:     ai.AdminState,
 		RepairPriority: ai.RepairPriority,
 		Template:       ai.AppTemplate.Path,
 
+		OpState: ai.OpState,
+		Health:  v.Health,
+
 		TargetOpState: si.OpState,
 		Ips:           si.Access.Ips,
 		Iqn:           si.Access.Iqn,
@@ -181,8 +231,12 @@ func aiToClientVol(ctx context.Context, ai *dsdk.AppInstance, qos, metadata bool
 		TotalBandwidthMax: pp["total_bandwidth_max"],
 	}
 
+	if client != nil {
+		vol.host = client.host
+	}
+
 	if metadata {
-		md, err := vol.GetMetadata()
+		md, err := vol.GetMetadata(ctxt)
 		if err != nil {
 			return nil, err
 		}
@@ -193,7 +247,7 @@ func aiToClientVol(ctx context.Context, ai *dsdk.AppInstance, qos, metadata bool
 		} else {
 			fm = true
 		}
-		fsType, fsArgs := (*md)["fs_type"], strings.Split((*md)["fs_args"], " ")
+		fsType, fsArgs := (*md)["fs_type"], strings.Fields((*md)["fs_args"])
 		vol.DevicePath = (*md)["device_path"]
 		vol.MountPath = (*md)["mount_path"]
 		vol.BindMountPaths = dsdk.NewStringSet(10, strings.Split((*md)["bind-mount-paths"], " ")...)
@@ -206,9 +260,11 @@ func aiToClientVol(ctx context.Context, ai *dsdk.AppInstance, qos, metadata bool
 	return vol, nil
 }
 
-func (r *DateraClient) GetVolume(name string, qos, metadata bool) (*Volume, error) {
-	ctxt := context.WithValue(r.ctxt, co.ReqName, "GetVolume")
-	co.Debugf(ctxt, "GetVolume invoked for %s", name)
+// GetVolume looks up a volume by CSI volume ID, in the tenant the ID names
+func (r *DateraClient) GetVolume(ctxt context.Context, volId string, qos, metadata bool) (*Volume, error) {
+	tenant, name := co.ParseVolId(volId)
+	ctxt = r.reqCtxt(co.WithTenant(ctxt, tenant), "GetVolume")
+	co.Debugf(ctxt, "GetVolume invoked for %s", volId)
 	if name == "" {
 		return nil, fmt.Errorf("Volume name cannot be an empty string")
 	}
@@ -229,8 +285,24 @@ func (r *DateraClient) GetVolume(name string, qos, metadata bool) (*Volume, erro
 	return v, nil
 }
 
-func (r *DateraClient) CreateVolume(name string, volOpts *VolOpts, qos bool, chapParams map[string]string) (*Volume, error) {
-	ctxt := context.WithValue(r.ctxt, co.ReqName, "CreateVolume")
+// NodeVolume returns a Volume for volId without requesting anything from the
+// backend.  Only the identity is filled in, nodes take the target from the
+// PublishContext or their own state
+func (r *DateraClient) NodeVolume(ctxt context.Context, volId string) *Volume {
+	tenant, name := co.ParseVolId(volId)
+	return &Volume{
+		dc:     r,
+		host:   r.host,
+		Ai:     &dsdk.AppInstance{Name: name, Path: path.Join("/app_instances", name)},
+		Id:     volId,
+		Tenant: r.Tenant(co.WithTenant(ctxt, tenant)),
+		Name:   name,
+	}
+}
+
+// CreateVolume creates the app instance name in the tenant volOpts names
+func (r *DateraClient) CreateVolume(ctxt context.Context, name string, volOpts *VolOpts, qos bool, chapParams map[string]string) (*Volume, error) {
+	ctxt = r.reqCtxt(co.WithTenant(ctxt, volOpts.Tenant), "CreateVolume")
 	co.Debugf(ctxt, "CreateVolume invoked for %s, volOpts: %#v", name, volOpts)
 	var ai dsdk.AppInstancesCreateRequest
 	var mode string = "kubernetes"
@@ -283,7 +355,7 @@ func (r *DateraClient) CreateVolume(name string, volOpts *VolOpts, qos bool, cha
 	} else {
 		// Vanilla Volume Create
 		var vol *dsdk.Volume
-                DateraVersion, err := r.VendorVersion()
+                DateraVersion, err := r.VendorVersion(ctxt)
                 if err != nil {
                         co.Error(ctxt, err)
                         return nil, err
@@ -302,10 +374,10 @@ func (r *DateraClient) CreateVolume(name string, volOpts *VolOpts, qos bool, cha
 				PerformancePolicy: &dsdk.PerformancePolicy{
 					WriteIopsMax: int(volOpts.WriteIopsMax),
 					ReadIopsMax: int(volOpts.ReadIopsMax),
-					TotalIopsMax: int(volOpts.TotalIopsMax),
+					TotalIopsMax: perGbLimit(volOpts.IopsPerGb, volOpts.Size, volOpts.TotalIopsMax),
 					WriteBandwidthMax: int(volOpts.WriteBandwidthMax),
 					ReadBandwidthMax: int(volOpts.ReadBandwidthMax),
-					TotalBandwidthMax: int(volOpts.TotalBandwidthMax),
+					TotalBandwidthMax: perGbLimit(volOpts.BandwidthPerGb, volOpts.Size, volOpts.TotalBandwidthMax),
 				},
 			}
 		} else if err != nil {
@@ -321,10 +393,10 @@ func (r *DateraClient) CreateVolume(name string, volOpts *VolOpts, qos bool, cha
 				PerformancePolicy: &dsdk.PerformancePolicy{
 					WriteIopsMax: int(volOpts.WriteIopsMax),
 					ReadIopsMax: int(volOpts.ReadIopsMax),
-					TotalIopsMax: int(volOpts.TotalIopsMax),
+					TotalIopsMax: perGbLimit(volOpts.IopsPerGb, volOpts.Size, volOpts.TotalIopsMax),
 					WriteBandwidthMax: int(volOpts.WriteBandwidthMax),
 					ReadBandwidthMax: int(volOpts.ReadBandwidthMax),
-					TotalBandwidthMax: int(volOpts.TotalBandwidthMax),
+					TotalBandwidthMax: perGbLimit(volOpts.BandwidthPerGb, volOpts.Size, volOpts.TotalBandwidthMax),
 				},
 			}
 		}
@@ -372,6 +444,7 @@ func (r *DateraClient) CreateVolume(name string, volOpts *VolOpts, qos bool, cha
 	}
 
 	// Create the App Instance
+	ai.Descr = volOpts.Descr
 	newAi, apierr, err := r.sdk.AppInstances.Create(&ai)
 	if err != nil {
 		co.Error(ctxt, err)
@@ -381,29 +454,30 @@ func (r *DateraClient) CreateVolume(name string, volOpts *VolOpts, qos bool, cha
 		return nil, co.ErrTranslator(apierr)
 	}
 	v, err := aiToClientVol(ctxt, newAi, false, false, r)
+	if err != nil {
+		co.Error(ctxt, err)
+		return nil, err
+	}
 
         // DO NOT FORMAT when volume is created from another source
-        if volOpts.CloneSrc != "" && volOpts.CloneVolSrc != "" && volOpts.CloneSnapSrc != "" {
+        if volOpts.CloneSrc != "" || volOpts.CloneVolSrc != "" || volOpts.CloneSnapSrc != "" {
                 v.Formatted = true
         } else {
 	        v.Formatted = false
         }
 
 	if qos && volOpts.Template == "" {
-		if err = v.SetPerformancePolicy(volOpts); err != nil {
+		if err = v.SetPerformancePolicy(ctxt, volOpts); err != nil {
 			return nil, err
 		}
 	}
-	if err != nil {
-		co.Error(ctxt, err)
-		return nil, err
-	}
 	return v, nil
 }
 
-func (r *DateraClient) DeleteVolume(name string, force bool) error {
-	ctxt := context.WithValue(r.ctxt, co.ReqName, "DeleteVolume")
-	co.Debugf(ctxt, "DeleteVolume invoked for %s", name)
+func (r *DateraClient) DeleteVolume(ctxt context.Context, volId string, force bool) error {
+	tenant, name := co.ParseVolId(volId)
+	ctxt = r.reqCtxt(co.WithTenant(ctxt, tenant), "DeleteVolume")
+	co.Debugf(ctxt, "DeleteVolume invoked for %s", volId)
 	ai, apierr, err := r.sdk.AppInstances.Get(&dsdk.AppInstancesGetRequest{
 		Ctxt: ctxt,
 		Id:   name,
@@ -418,7 +492,7 @@ func (r *DateraClient) DeleteVolume(name string, force bool) error {
 	}
 	// Kube doesn't perform this check for us, so we need to stop any deletion
 	// of a volume currently possessing snapshots to avoid unintentional data loss.
-	snaps, err := v.HasSnapshots()
+	snaps, err := v.HasSnapshots(ctxt)
 	if err != nil {
 		co.Error(ctxt, err)
 		return err
@@ -427,11 +501,16 @@ func (r *DateraClient) DeleteVolume(name string, force bool) error {
 		co.Error(ctxt, err)
 		return err
 	}
-	return v.Delete(force)
+	return v.Delete(ctxt, force)
+}
+
+// Requests for a volume are made in its tenant
+func (r *Volume) reqCtxt(ctxt context.Context, reqName string) context.Context {
+	return r.dc.reqCtxt(co.WithTenant(ctxt, r.Tenant), reqName)
 }
 
-func (r *Volume) Delete(force bool) error {
-	ctxt := context.WithValue(r.ctxt, co.ReqName, "Delete")
+func (r *Volume) Delete(ctxt context.Context, force bool) error {
+	ctxt = r.reqCtxt(ctxt, "Delete")
 	co.Debugf(ctxt, "Volume Delete invoked for %s", r.Name)
 	_, apierr, err := r.Ai.Set(&dsdk.AppInstanceSetRequest{
 		Ctxt:       ctxt,
@@ -459,8 +538,9 @@ func (r *Volume) Delete(force bool) error {
 	return nil
 }
 
-func (r *DateraClient) ListVolumes(maxEntries int, startToken int) ([]*Volume, error) {
-	ctxt := context.WithValue(r.ctxt, co.ReqName, "ListVolumes")
+// ListVolumes lists the volumes in the tenant of ctxt, see co.WithTenant
+func (r *DateraClient) ListVolumes(ctxt context.Context, maxEntries int, startToken int) ([]*Volume, error) {
+	ctxt = r.reqCtxt(ctxt, "ListVolumes")
 	co.Debug(ctxt, "ListVolumes invoked\n")
 	params := dsdk.ListParams{
 		Limit:  maxEntries,
@@ -489,26 +569,25 @@ func (r *DateraClient) ListVolumes(maxEntries int, startToken int) ([]*Volume, e
 	return vols, nil
 }
 
-func (r *Volume) SetPerformancePolicy(volOpts *VolOpts) error {
-	ctxt := context.WithValue(r.ctxt, co.ReqName, "SetPerformancePolicy")
-	co.Debugf(ctxt, "SetPerformancePolicy invoked for %s, volOpts: %#v", r.Name, volOpts)
-	ai := r.Ai
-	im := volOpts.TotalIopsMax
-	bm := volOpts.TotalBandwidthMax
-	if volOpts.IopsPerGb != 0 {
-		ipg := volOpts.IopsPerGb * volOpts.Size
-		// Not using zero, because zero means unlimited
-		if ipg < im {
-			im = ipg
-		}
+// Returns the limit for a dynamic per-GB value at size GiB, capped by the
+// static ceiling max.  Zero means unlimited for both perGb and max
+func perGbLimit(perGb, size, max int) int {
+	if perGb == 0 {
+		return max
 	}
-	if volOpts.BandwidthPerGb != 0 {
-		bpg := volOpts.BandwidthPerGb * volOpts.Size
-		// Not using zero, because zero means unlimited
-		if bpg < bm {
-			bm = bpg
-		}
+	l := perGb * size
+	if max != 0 && max < l {
+		return max
 	}
+	return l
+}
+
+func (r *Volume) SetPerformancePolicy(ctxt context.Context, volOpts *VolOpts) error {
+	ctxt = r.reqCtxt(ctxt, "SetPerformancePolicy")
+	co.Debugf(ctxt, "SetPerformancePolicy invoked for %s, volOpts: %#v", r.Name, volOpts)
+	ai := r.Ai
+	im := perGbLimit(volOpts.IopsPerGb, volOpts.Size, volOpts.TotalIopsMax)
+	bm := perGbLimit(volOpts.BandwidthPerGb, volOpts.Size, volOpts.TotalBandwidthMax)
 	pp := dsdk.PerformancePolicyCreateRequest{
 		Ctxt:              ctxt,
 		ReadIopsMax:       int(volOpts.ReadIopsMax),
@@ -543,8 +622,8 @@ func (r *Volume) SetPerformancePolicy(volOpts *VolOpts) error {
 	return nil
 }
 
-func (r *Volume) GetMetadata() (*VolMetadata, error) {
-	ctxt := context.WithValue(r.ctxt, co.ReqName, "GetMetadata")
+func (r *Volume) GetMetadata(ctxt context.Context) (*VolMetadata, error) {
+	ctxt = r.reqCtxt(ctxt, "GetMetadata")
 	co.Debugf(ctxt, "GetMetadata invoked for %s", r.Name)
 	resp, apierr, err := r.Ai.GetMetadata(&dsdk.AppInstanceMetadataGetRequest{
 		Ctxt: ctxt,
@@ -560,12 +639,12 @@ func (r *Volume) GetMetadata() (*VolMetadata, error) {
 	return &result, nil
 }
 
-func (r *Volume) SetMetadata(metadata *VolMetadata) (*VolMetadata, error) {
-	ctxt := context.WithValue(r.ctxt, co.ReqName, "SetMetadata")
+func (r *Volume) SetMetadata(ctxt context.Context, metadata *VolMetadata) (*VolMetadata, error) {
+	ctxt = r.reqCtxt(ctxt, "SetMetadata")
 	co.Debugf(ctxt, "SetMetadata invoked for %s", r.Name)
 	if MetadataDebug {
 		co.Debugf(ctxt, "Running size check on metadata")
-		tmd, err := r.GetMetadata()
+		tmd, err := r.GetMetadata(ctxt)
 		if err != nil {
 			co.Error(ctxt, err)
 			return nil, err
@@ -596,8 +675,8 @@ func (r *Volume) SetMetadata(metadata *VolMetadata) (*VolMetadata, error) {
 	return &result, nil
 }
 
-func (r *Volume) GetUsage() (int, int, int) {
-	ctxt := context.WithValue(r.ctxt, co.ReqName, "GetUsage")
+func (r *Volume) GetUsage(ctxt context.Context) (int, int, int) {
+	ctxt = r.reqCtxt(ctxt, "GetUsage")
 	co.Debugf(ctxt, "GetUsage invoked for %s", r.Name)
 	v := r.Ai.StorageInstances[0].Volumes[0]
 	size := v.Size
@@ -606,8 +685,8 @@ func (r *Volume) GetUsage() (int, int, int) {
 	return size, used, avail
 }
 
-func (r *Volume) Reload(qos, metadata bool) error {
-	ctxt := context.WithValue(r.ctxt, co.ReqName, "Volume Reload")
+func (r *Volume) Reload(ctxt context.Context, qos, metadata bool) error {
+	ctxt = r.reqCtxt(ctxt, "Volume Reload")
 	co.Debugf(ctxt, "Volume Reload invoked: %s", r.Name)
 	newAi, apierr, err := r.Ai.Reload(&dsdk.AppInstanceReloadRequest{
 		Ctxt: ctxt,
@@ -625,8 +704,8 @@ func (r *Volume) Reload(qos, metadata bool) error {
 	return nil
 }
 
-func (r *Volume) Resize(newSize int) error {
-	ctxt := context.WithValue(r.ctxt, co.ReqName, "Volume Resize")
+func (r *Volume) Resize(ctxt context.Context, newSize int) error {
+	ctxt = r.reqCtxt(ctxt, "Volume Resize")
 	co.Debugf(ctxt, "Volume Resize invoked: %s", r.Name)
 
 	v := r.Ai.StorageInstances[0].Volumes[0]
@@ -641,11 +720,11 @@ func (r *Volume) Resize(newSize int) error {
 		co.Errorf(ctxt, "%s, %s", dsdk.Pretty(apierr), err)
 		return co.ErrTranslator(apierr)
 	}
-	return r.Reload(false, false)
+	return r.Reload(ctxt, false, false)
 }
 
-func (r *Volume) Online() error {
-	ctxt := context.WithValue(r.ctxt, co.ReqName, "Volume Reload")
+func (r *Volume) Online(ctxt context.Context) error {
+	ctxt = r.reqCtxt(ctxt, "Volume Reload")
 	co.Debugf(ctxt, "Volume Reload invoked: %s", r.Name)
 	_, apierr, err := r.Ai.Set(&dsdk.AppInstanceSetRequest{
 		Ctxt:       ctxt,
@@ -658,5 +737,5 @@ func (r *Volume) Online() error {
 		co.Errorf(ctxt, "%s, %s", dsdk.Pretty(apierr), err)
 		return co.ErrTranslator(apierr)
 	}
-	return r.Reload(false, false)
+	return r.Reload(ctxt, false, false)
 }
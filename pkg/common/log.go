@@ -13,6 +13,7 @@ import (
 const (
 	ReqName = "req"
 	TraceId = "tid"
+	Tenant  = "tenant"
 )
 
 // DecorateRuntimeContext appends line, file and function context to the logger
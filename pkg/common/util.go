@@ -5,7 +5,6 @@ import (
 	"encoding/json"
 	"math"
 	"os"
-	"os/exec"
 	"regexp"
 	"strconv"
 	"strings"
@@ -19,14 +18,14 @@ import (
 )
 
 const (
-	Ext4 = "ext4"
-	Xfs  = "xfs"
+	Ext3  = "ext3"
+	Ext4  = "ext4"
+	Xfs   = "xfs"
+	Btrfs = "btrfs"
 )
 
 var (
-	execCommand = exec.Command
-	host        = MustS(os.Hostname())
-	topctxt     = context.WithValue(context.Background(), "host", host)
+	host = MustS(os.Hostname())
 )
 
 func MustS(s string, err error) string {
@@ -45,31 +44,28 @@ func Prettify(v interface{}) string {
 	return string(b)
 }
 
+// Returns a child of ctxt tagged with the request name and trace id used for
+// logging.  Deadlines and cancellation on ctxt are preserved
 func WithCtxt(ctxt context.Context, reqName, traceId string) context.Context {
 	if traceId == "" {
 		traceId = GenId()
 	}
-	ctxt = context.WithValue(topctxt, TraceId, traceId)
+	ctxt = context.WithValue(ctxt, "host", host)
+	ctxt = context.WithValue(ctxt, TraceId, traceId)
 	ctxt = context.WithValue(ctxt, ReqName, reqName)
 	return ctxt
 }
 
-func RunCmd(ctxt context.Context, cmd ...string) (string, error) {
-	ncmd := []string{}
-	for _, c := range cmd {
-		c = strings.TrimSpace(c)
-		if c != "" {
-			ncmd = append(ncmd, c)
-		}
-	}
-	Debugf(ctxt, "Running command: [%s]\n", strings.Join(ncmd, " "))
-	prefix := ncmd[0]
-	ncmd = ncmd[1:]
-	c := execCommand(prefix, ncmd...)
-	out, err := c.CombinedOutput()
-	sout := string(out)
-	Debug(ctxt, sout)
-	return sout, err
+// Returns a child of ctxt whose Datera requests are made in tenant.  An empty
+// tenant is the tenant the backend is configured with
+func WithTenant(ctxt context.Context, tenant string) context.Context {
+	return context.WithValue(ctxt, Tenant, tenant)
+}
+
+// Returns the tenant set with WithTenant, if any
+func GetTenant(ctxt context.Context) string {
+	t, _ := ctxt.Value(Tenant).(string)
+	return t
 }
 
 func GenName(name string) string {
@@ -89,6 +85,24 @@ func GenId() string {
 	return uuid.Must(uuid.NewRandom()).String()
 }
 
+// Volume IDs of app instances outside the backend tenant are prefixed with
+// their tenant, eg: "/root/team-a/CSI-data".  Tenants start with a slash and
+// app instance names never contain one
+func MkVolId(tenant, name string) string {
+	if tenant == "" {
+		return name
+	}
+	return tenant + "/" + name
+}
+
+func ParseVolId(volId string) (string, string) {
+	if !strings.HasPrefix(volId, "/") {
+		return "", volId
+	}
+	i := strings.LastIndex(volId, "/")
+	return volId[:i], volId[i+1:]
+}
+
 func MkSnapId(vol, snap string) string {
 	return strings.Join([]string{vol, snap}, ":")
 }
@@ -101,6 +115,20 @@ func ParseSnapId(snapId string) (string, string) {
 	return parts[0], parts[1]
 }
 
+// Node IDs are of the form "<hostname>:<initiator iqn>".  IQNs contain colons
+// themselves, so only the first colon is treated as a separator
+func MkNodeId(host, iqn string) string {
+	return strings.Join([]string{host, iqn}, ":")
+}
+
+func ParseNodeId(nodeId string) (string, string) {
+	parts := strings.SplitN(nodeId, ":", 2)
+	if len(parts) != 2 {
+		return "", ""
+	}
+	return parts[0], parts[1]
+}
+
 func GetCode(err error) codes.Code {
 	return status.Code(err)
 }
@@ -113,7 +141,7 @@ func ErrTranslator(apierr *dsdk.ApiErrorResponse) error {
 	if apierr.Name == "AuthFailedError" {
 		return status.Errorf(codes.Unauthenticated, "%s: %s", apierr.Name, apierr.Message)
 	}
-	if apierr.Name == "NotFound" {
+	if apierr.Name == "NotFound" || apierr.Name == "NotFoundError" {
 		return status.Errorf(codes.NotFound, "%s: %s", apierr.Name, apierr.Message)
 	}
 	return status.Errorf(codes.Unknown, "%s: %s", apierr.Name, apierr.Message)
@@ -0,0 +1,342 @@
+package driver
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"time"
+
+	yaml "sigs.k8s.io/yaml"
+
+	co "github.com/Datera/datera-csi/pkg/common"
+	udc "github.com/Datera/go-udc/pkg/udc"
+)
+
+// Config holds every driver setting.  It is loaded from an optional YAML or
+// JSON file, then overridden by any DAT_* environment variables that are set.
+// Example:
+//
+//	driver_name: dsp.csi.daterainc.io
+//	mode: controller
+//	heartbeat: 60
+//	storage_class_defaults:
+//	  replica_count: "2"
+//	backend:
+//	  mgmt_ip: 172.16.0.10
+//	  username: admin
+//	  password: secret
+type Config struct {
+	DriverName       string      `json:"driver_name"`
+	Socket           string      `json:"socket"`
+	Mode             string      `json:"mode"`
+	Heartbeat        int         `json:"heartbeat"`
+	VolPerNode       int         `json:"vol_per_node"`
+	DisableMultipath bool        `json:"disable_multipath"`
+	ReplicaOverride  bool        `json:"replica_override"`
+	MetadataDebug    bool        `json:"metadata_debug"`
+	LogPush          bool        `json:"log_push"`
+	LogPushInterval  int         `json:"log_push_interval"`
+	FormatTimeout    int         `json:"format_timeout"`
+	FsckOnStage      bool        `json:"fsck_on_stage"`
+	TopologyZone     string      `json:"topology_zone"`
+	TopologyMap      TopologyMap `json:"topology_map"`
+	MetricsAddress   string      `json:"metrics_address"`
+
+	// Node reconciliation of iSCSI sessions and mounts, see Reconcile.  Runs
+	// at startup, then every ReconcileInterval seconds unless it is 0
+	ReconcileInterval int    `json:"reconcile_interval"`
+	ReconcileDryRun   bool   `json:"reconcile_dry_run"`
+	KubeletDir        string `json:"kubelet_dir"`
+
+	// Where the node plugin keeps what it has staged and published, see
+	// StateStore.  Defaults to <kubelet_dir>/plugins/<driver_name>/state
+	StateDir string `json:"state_dir"`
+
+	// Parameters applied to every volume unless the StorageClass sets them
+	StorageClassDefaults map[string]string `json:"storage_class_defaults"`
+	// Reject StorageClass and VolumeSnapshotClass parameters the driver
+	// doesn't know instead of ignoring them with a warning
+	StrictParams bool `json:"strict_params"`
+	// App instance name for new volumes, eg: {namespace}-{pvc}, see
+	// volumeName.  Empty names them after the PV
+	VolumeNameTemplate string `json:"volume_name_template"`
+	// Datera tenant new volumes are created in by PVC namespace, unless the
+	// StorageClass sets a tenant.  Tenants lists any other tenants volumes
+	// are created in, so they are listed and reconciled
+	TenantMap TenantMap `json:"tenant_map"`
+	Tenants   []string  `json:"tenants"`
+
+	// The Datera system to use.  When not provided the Universal Datera
+	// Config lookup (UDC files and DAT_MGMT etc.) is used instead
+	Backend *udc.UDC `json:"backend,omitempty"`
+
+	// Derived from Mode
+	Type int `json:"-"`
+}
+
+func defaultConfig() *Config {
+	return &Config{
+		DriverName: driverNameDefault,
+		Mode:       "all",
+		Heartbeat:  60,
+		VolPerNode: 256,
+		LogPush:    true,
+		// Default is to run logpusher every 2 hours
+		LogPushInterval: int((time.Hour * 2) / time.Second),
+		FormatTimeout:   60,
+		TopologyMap:     TopologyMap{},
+		TenantMap:       TenantMap{},
+
+		ReconcileInterval: 600,
+		KubeletDir:        "/var/lib/kubelet",
+		// Only logs what it would clean up until operators opt in
+		ReconcileDryRun: true,
+	}
+}
+
+// LoadConfig reads the config file at path, if any, applies environment
+// variable overrides and validates the result
+func LoadConfig(path string) (*Config, error) {
+	conf := defaultConfig()
+	if path != "" {
+		b, err := ioutil.ReadFile(path)
+		if err != nil {
+			return nil, fmt.Errorf("Could not read config file: %s", err)
+		}
+		// YAML is a superset of JSON, so this handles both
+		if err = yaml.UnmarshalStrict(b, conf); err != nil {
+			return nil, fmt.Errorf("Could not parse config file %s: %s", path, err)
+		}
+	}
+	if err := conf.envOverride(); err != nil {
+		return nil, err
+	}
+	if err := conf.Validate(); err != nil {
+		return nil, err
+	}
+	return conf, nil
+}
+
+func (c *Config) envOverride() error {
+	str := func(env string, dest *string) {
+		if v, ok := os.LookupEnv(env); ok {
+			*dest = v
+		}
+	}
+	num := func(env string, dest *int) error {
+		if v, ok := os.LookupEnv(env); ok {
+			i, err := strconv.ParseInt(v, 0, 0)
+			if err != nil {
+				return fmt.Errorf("%s must be an integer, got %q", env, v)
+			}
+			*dest = int(i)
+		}
+		return nil
+	}
+	ctxt := co.WithCtxt(context.Background(), "LoadConfig", "")
+	// Earlier releases turned these on for any non-empty value, those are
+	// still accepted as true for now
+	flag := func(env string, dest *bool) {
+		v := os.Getenv(env)
+		if v == "" {
+			return
+		}
+		b, err := strconv.ParseBool(v)
+		if err != nil {
+			co.Warningf(ctxt, "%s=%q is deprecated and treated as true, set it to true or false instead", env, v)
+			b = true
+		}
+		*dest = b
+	}
+	str(EnvDriverName, &c.DriverName)
+	str(EnvSocket, &c.Socket)
+	str(EnvType, &c.Mode)
+	str(EnvTopologyZone, &c.TopologyZone)
+	str(EnvMetricsAddress, &c.MetricsAddress)
+	str(EnvKubeletDir, &c.KubeletDir)
+	str(EnvStateDir, &c.StateDir)
+	str(EnvVolumeNameTemplate, &c.VolumeNameTemplate)
+	for env, dest := range map[string]*int{
+		EnvHeartbeat:         &c.Heartbeat,
+		EnvVolPerNode:        &c.VolPerNode,
+		EnvLogPushInterval:   &c.LogPushInterval,
+		EnvFormatTimeout:     &c.FormatTimeout,
+		EnvReconcileInterval: &c.ReconcileInterval,
+	} {
+		if err := num(env, dest); err != nil {
+			return err
+		}
+	}
+	for env, dest := range map[string]*bool{
+		EnvDisableMultipath: &c.DisableMultipath,
+		EnvReplicaOverride:  &c.ReplicaOverride,
+		EnvMetadataDebug:    &c.MetadataDebug,
+		EnvReconcileDryRun:  &c.ReconcileDryRun,
+		EnvFsckOnStage:      &c.FsckOnStage,
+		EnvStrictParams:     &c.StrictParams,
+	} {
+		flag(env, dest)
+	}
+	disableLogPush := !c.LogPush
+	flag(EnvDisableLogPush, &disableLogPush)
+	c.LogPush = !disableLogPush
+	if v, ok := os.LookupEnv(EnvTopologyMap); ok {
+		tm, err := parseTopologyMap(v)
+		if err != nil {
+			return err
+		}
+		c.TopologyMap = tm
+	}
+	if v, ok := os.LookupEnv(EnvTenantMap); ok {
+		tm, err := parseTenantMap(v)
+		if err != nil {
+			return err
+		}
+		c.TenantMap = tm
+	}
+	if c.Backend != nil {
+		str(udc.EnvMgmt, &c.Backend.MgmtIp)
+		str(udc.EnvUser, &c.Backend.Username)
+		str(udc.EnvPass, &c.Backend.Password)
+		str(udc.EnvTenant, &c.Backend.Tenant)
+		str(udc.EnvApi, &c.Backend.ApiVersion)
+		str(udc.EnvLdap, &c.Backend.Ldap)
+	}
+	return nil
+}
+
+// Validate checks every setting, filling in Type from Mode
+func (c *Config) Validate() error {
+	t, ok := StrToType[c.Mode]
+	if !ok {
+		modes := []string{}
+		for m := range StrToType {
+			modes = append(modes, m)
+		}
+		sort.Strings(modes)
+		return fmt.Errorf("Invalid mode %q, must be one of %s", c.Mode, modes)
+	}
+	c.Type = t
+	if c.DriverName == "" {
+		return fmt.Errorf("driver_name cannot be empty")
+	}
+	if c.Heartbeat <= 0 {
+		return fmt.Errorf("heartbeat must be a positive number of seconds, got %d", c.Heartbeat)
+	}
+	if c.VolPerNode <= 0 {
+		return fmt.Errorf("vol_per_node must be positive, got %d", c.VolPerNode)
+	}
+	if c.LogPushInterval <= 0 {
+		return fmt.Errorf("log_push_interval must be a positive number of seconds, got %d", c.LogPushInterval)
+	}
+	if c.FormatTimeout < 0 {
+		return fmt.Errorf("format_timeout cannot be negative, got %d", c.FormatTimeout)
+	}
+	if c.ReconcileInterval < 0 {
+		return fmt.Errorf("reconcile_interval cannot be negative, got %d", c.ReconcileInterval)
+	}
+	if !filepath.IsAbs(c.KubeletDir) {
+		return fmt.Errorf("kubelet_dir must be an absolute path, got %q", c.KubeletDir)
+	}
+	if c.StateDir == "" {
+		c.StateDir = filepath.Join(c.KubeletDir, "plugins", c.DriverName, "state")
+	}
+	if !filepath.IsAbs(c.StateDir) {
+		return fmt.Errorf("state_dir must be an absolute path, got %q", c.StateDir)
+	}
+	if c.MetricsAddress != "" {
+		if _, _, err := net.SplitHostPort(c.MetricsAddress); err != nil {
+			return fmt.Errorf("Invalid metrics_address: %s", err)
+		}
+	}
+	if err := validateNameTemplate(c.VolumeNameTemplate); err != nil {
+		return fmt.Errorf("Invalid volume_name_template: %s", err)
+	}
+	if err := c.TenantMap.validate(); err != nil {
+		return fmt.Errorf("Invalid tenant_map: %s", err)
+	}
+	for _, t := range c.Tenants {
+		if err := validateTenant(t); err != nil {
+			return fmt.Errorf("Invalid tenants: %s", err)
+		}
+	}
+	for zone, m := range c.TopologyMap {
+		if m == nil {
+			return fmt.Errorf("Topology mapping for zone %s cannot be empty", zone)
+		}
+	}
+	ctxt := co.WithCtxt(context.Background(), "Validate", "")
+	if _, err := parseVolParams(ctxt, c.volParams(nil), c.StrictParams); err != nil {
+		return fmt.Errorf("Invalid storage_class_defaults: %s", err)
+	}
+	if c.Backend != nil {
+		if c.Backend.Tenant == "" {
+			c.Backend.Tenant = "/root"
+		}
+		if c.Backend.ApiVersion == "" {
+			c.Backend.ApiVersion = "2.2"
+		}
+		missing := []string{}
+		if c.Backend.MgmtIp == "" {
+			missing = append(missing, "mgmt_ip")
+		}
+		if c.Backend.Username == "" {
+			missing = append(missing, "username")
+		}
+		if c.Backend.Password == "" {
+			missing = append(missing, "password")
+		}
+		if len(missing) > 0 && !c.NodeOnly() {
+			return fmt.Errorf("Missing backend keys: %s", missing)
+		}
+	}
+	return nil
+}
+
+// NodeOnly is true when only the node service is exposed.  Everything a node
+// needs to stage a volume comes in the PublishContext, so it runs without
+// Datera API credentials
+func (c *Config) NodeOnly() bool {
+	return c.Type == NodeType || c.Type == NodeIdentityType
+}
+
+// HasCredentials is true when the Datera API can be used
+func (c *Config) HasCredentials() bool {
+	return c.Backend != nil && c.Backend.MgmtIp != "" && c.Backend.Username != "" && c.Backend.Password != ""
+}
+
+// Returns a copy of the StorageClass parameters with the configured defaults
+// filled in
+func (c *Config) volParams(params map[string]string) map[string]string {
+	result := make(map[string]string, len(params)+len(c.StorageClassDefaults))
+	for k, v := range c.StorageClassDefaults {
+		result[k] = v
+	}
+	for k, v := range params {
+		result[k] = v
+	}
+	return result
+}
+
+// String renders the config as JSON with secrets redacted, for logging
+func (c *Config) String() string {
+	rc := *c
+	if c.Backend != nil {
+		b := *c.Backend
+		if b.Password != "" {
+			b.Password = "******"
+		}
+		rc.Backend = &b
+	}
+	b, err := json.Marshal(rc)
+	if err != nil {
+		return fmt.Sprintf("<unprintable config: %s>", err)
+	}
+	return string(b)
+}
@@ -0,0 +1,209 @@
+package driver
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// Sets environment variables for the duration of a test
+func setEnv(t *testing.T, env map[string]string) func() {
+	old := map[string]*string{}
+	for k, v := range env {
+		if prev, ok := os.LookupEnv(k); ok {
+			old[k] = &prev
+		} else {
+			old[k] = nil
+		}
+		if err := os.Setenv(k, v); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return func() {
+		for k, v := range old {
+			if v == nil {
+				os.Unsetenv(k)
+			} else {
+				os.Setenv(k, *v)
+			}
+		}
+	}
+}
+
+func writeConfig(t *testing.T, name, contents string) (string, func()) {
+	dir, err := ioutil.TempDir("", "config-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(dir, name)
+	if err = ioutil.WriteFile(path, []byte(contents), 0600); err != nil {
+		t.Fatal(err)
+	}
+	return path, func() { os.RemoveAll(dir) }
+}
+
+func TestConfigDefaults(t *testing.T) {
+	conf, err := LoadConfig("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if conf.DriverName != driverNameDefault || conf.Heartbeat != 60 || conf.VolPerNode != 256 || !conf.LogPush || !conf.ReconcileDryRun {
+		t.Fatalf("Unexpected defaults: %s", conf)
+	}
+}
+
+func TestConfigFile(t *testing.T) {
+	path, cleanf := writeConfig(t, "config.yaml", `
+driver_name: test.csi.daterainc.io
+mode: node
+heartbeat: 30
+disable_multipath: true
+topology_map:
+  rack1:
+    placement_policy: rack1
+storage_class_defaults:
+  replica_count: "2"
+backend:
+  mgmt_ip: 172.16.0.10
+  username: admin
+  password: secret
+`)
+	defer cleanf()
+	conf, err := LoadConfig(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if conf.DriverName != "test.csi.daterainc.io" || conf.Type != NodeType || conf.Heartbeat != 30 || !conf.DisableMultipath {
+		t.Fatalf("Config file not applied: %s", conf)
+	}
+	if conf.TopologyMap["rack1"].PlacementPolicy != "rack1" {
+		t.Fatalf("Topology map not applied: %s", conf)
+	}
+	if conf.Backend.Tenant != "/root" || conf.Backend.ApiVersion != "2.2" {
+		t.Fatalf("Backend defaults not applied: %#v", conf.Backend)
+	}
+	// Values not in the file keep their defaults
+	if conf.VolPerNode != 256 {
+		t.Fatalf("Expected default vol_per_node, got %d", conf.VolPerNode)
+	}
+	params := conf.volParams(map[string]string{"ip_pool": "pool-1"})
+	if params["replica_count"] != "2" || params["ip_pool"] != "pool-1" {
+		t.Fatalf("StorageClass defaults not merged: %s", params)
+	}
+	if params = conf.volParams(map[string]string{"replica_count": "3"}); params["replica_count"] != "3" {
+		t.Fatalf("StorageClass parameter overridden by default: %s", params)
+	}
+}
+
+func TestConfigJSON(t *testing.T) {
+	path, cleanf := writeConfig(t, "config.json", `{"mode": "controller", "format_timeout": 10}`)
+	defer cleanf()
+	conf, err := LoadConfig(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if conf.Type != ControllerType || conf.FormatTimeout != 10 {
+		t.Fatalf("Config file not applied: %s", conf)
+	}
+}
+
+func TestConfigEnvOverride(t *testing.T) {
+	path, cleanf := writeConfig(t, "config.yaml", "mode: node\nvol_per_node: 10\nbackend:\n  mgmt_ip: 1.1.1.1\n  username: admin\n  password: secret\n")
+	defer cleanf()
+	defer setEnv(t, map[string]string{
+		EnvType:           "controller",
+		EnvVolPerNode:     "20",
+		EnvMetadataDebug:  "true",
+		EnvDisableLogPush: "true",
+		"DAT_MGMT":        "2.2.2.2",
+	})()
+	conf, err := LoadConfig(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if conf.Type != ControllerType || conf.VolPerNode != 20 || conf.LogPush || conf.Backend.MgmtIp != "2.2.2.2" {
+		t.Fatalf("Environment overrides not applied: %s", conf)
+	}
+	// DAT_METADATA_DEBUG must not turn on DAT_DISABLE_MULTIPATH and vice versa
+	if !conf.MetadataDebug || conf.DisableMultipath {
+		t.Fatalf("Expected only metadata_debug to be set: %s", conf)
+	}
+}
+
+func TestConfigEnvLegacyFlags(t *testing.T) {
+	path, cleanf := writeConfig(t, "config.yaml", "fsck_on_stage: true\n")
+	defer cleanf()
+	defer setEnv(t, map[string]string{
+		EnvDisableMultipath: "yes",
+		EnvReplicaOverride:  "1",
+		EnvFsckOnStage:      "false",
+		EnvDisableLogPush:   "",
+	})()
+	conf, err := LoadConfig(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !conf.DisableMultipath || !conf.ReplicaOverride || conf.FsckOnStage || !conf.LogPush {
+		t.Fatalf("Expected non-empty flags to be true and empty ones ignored: %s", conf)
+	}
+}
+
+func TestConfigNodeWithoutCredentials(t *testing.T) {
+	path, cleanf := writeConfig(t, "config.yaml", "mode: node\nbackend:\n  mgmt_ip: 1.1.1.1\n")
+	defer cleanf()
+	conf, err := LoadConfig(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !conf.NodeOnly() || conf.HasCredentials() {
+		t.Fatalf("Expected a node plugin without credentials: %s", conf)
+	}
+}
+
+func TestConfigInvalid(t *testing.T) {
+	for _, c := range []struct {
+		file, env, expected string
+	}{
+		{"mode: everything\n", "", "Invalid mode"},
+		{"heartbeat: 0\n", "", "heartbeat"},
+		{"hearbeat: 10\n", "", "unknown field"},
+		{"metrics_address: localhost\n", "", "metrics_address"},
+		{"reconcile_interval: -1\n", "", "reconcile_interval"},
+		{"kubelet_dir: var/lib/kubelet\n", "", "kubelet_dir"},
+		{"storage_class_defaults:\n  replica_count: three\n", "", "storage_class_defaults"},
+		{"volume_name_template: \"{namespace}-{claim}\"\n", "", "volume_name_template"},
+		{"tenant_map:\n  team-a: team-a\n", "", "tenant_map"},
+		{"tenants: [root/team-a]\n", "", "tenants"},
+		{"backend:\n  mgmt_ip: 1.1.1.1\n", "", "Missing backend keys"},
+		{"", "sixty", EnvHeartbeat},
+	} {
+		path, cleanf := writeConfig(t, "config.yaml", c.file)
+		restore := func() {}
+		if c.env != "" {
+			restore = setEnv(t, map[string]string{EnvHeartbeat: c.env})
+		}
+		_, err := LoadConfig(path)
+		restore()
+		cleanf()
+		if err == nil || !strings.Contains(err.Error(), c.expected) {
+			t.Fatalf("Expected an error containing %q for %q, got %v", c.expected, c.file, err)
+		}
+	}
+}
+
+func TestConfigRedacted(t *testing.T) {
+	path, cleanf := writeConfig(t, "config.yaml", "backend:\n  mgmt_ip: 1.1.1.1\n  username: admin\n  password: hunter2\n")
+	defer cleanf()
+	conf, err := LoadConfig(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if s := conf.String(); strings.Contains(s, "hunter2") || !strings.Contains(s, "admin") {
+		t.Fatalf("Expected password to be redacted: %s", s)
+	}
+	if conf.Backend.Password != "hunter2" {
+		t.Fatal("Redacting the config modified the password")
+	}
+}
@@ -4,6 +4,7 @@ import (
 	"context"
 	"fmt"
 	"math"
+	"sort"
 	"strconv"
 	"strings"
 	"time"
@@ -21,170 +22,266 @@ import (
 
 const (
 	DefaultSize = 16
+
+	// Keys returned in ControllerPublishVolumeResponse.PublishContext
+	PublishTargetIqn     = "target_iqn"
+	PublishTargetPortals = "target_portals"
+	PublishRoundRobin    = "round_robin"
+	PublishSize          = "size"
+	PublishCreatedEmpty  = "created_empty"
 )
 
-func parseVolParams(ctxt context.Context, params map[string]string) (*dc.VolOpts, error) {
-	//Golang makes something that should be simple, repetative and gross
-	if params == nil {
-		params = make(map[string]string, 16)
-	}
-	vo := &dc.VolOpts{}
-	var err error
+// Volume metadata the node needs to stage a volume.  It is passed along in the
+// PublishContext under the same keys, so nodes don't read it from the backend.
+// The PublishContext is cached in the VolumeAttachment, so only facts that
+// don't change once the volume is created belong here
+var publishMetadataKeys = []string{
+	"fs_type",
+	"fs_args",
+	"mount_options",
+	"fs_resize_pending",
+}
+
+// Parses StorageClass parameters, see volParamSchema.  With strict unknown
+// parameters are rejected rather than ignored
+func parseVolParams(ctxt context.Context, params map[string]string, strict bool) (*dc.VolOpts, error) {
 	co.Debugf(ctxt, "Volume Params: %s", params)
-	// set defaults
-	if _, ok := params["iops_per_gb"]; !ok {
-		params["iops_per_gb"] = "0"
-	}
-	if _, ok := params["bandwidth_per_gb"]; !ok {
-		params["bandwidth_per_gb"] = "0"
-	}
-	if _, ok := params["placement_mode"]; !ok {
-		params["placement_mode"] = "hybrid"
-	}
-	if _, ok := params["placement_policy"]; !ok {
-		params["placement_policy"] = "default"
-	}
-	if _, ok := params["round_robin"]; !ok {
-		params["round_robin"] = "false"
-	}
-	if _, ok := params["replica_count"]; !ok {
-		params["replica_count"] = "3"
-	}
-	if _, ok := params["ip_pool"]; !ok {
-		params["ip_pool"] = "default"
+	pv, err := volParamSchema.Parse(ctxt, params, strict)
+	if err != nil {
+		return nil, err
 	}
-	if _, ok := params["template"]; !ok {
-		params["template"] = ""
+	vo := &dc.VolOpts{
+		Replica:                 pv.getInt("replica_count"),
+		PlacementMode:           pv["placement_mode"],
+		PlacementPolicy:         pv["placement_policy"],
+		IpPool:                  pv["ip_pool"],
+		Template:                pv["template"],
+		DisableTemplateOverride: pv.getBool("disable_template_override"),
+		RoundRobin:              pv.getBool("round_robin"),
+		DeleteOnUnmount:         pv.getBool("delete_on_unmount"),
+		Tenant:                  pv["tenant"],
+
+		ReadIopsMax:       pv.getInt("read_iops_max"),
+		WriteIopsMax:      pv.getInt("write_iops_max"),
+		TotalIopsMax:      pv.getInt("total_iops_max"),
+		ReadBandwidthMax:  pv.getInt("read_bandwidth_max"),
+		WriteBandwidthMax: pv.getInt("write_bandwidth_max"),
+		TotalBandwidthMax: pv.getInt("total_bandwidth_max"),
+		IopsPerGb:         pv.getInt("iops_per_gb"),
+		BandwidthPerGb:    pv.getInt("bandwidth_per_gb"),
+
+		// Checked against the filesystem by resolveFsParams
+		FsType:       pv["fs_type"],
+		FsArgs:       strings.Fields(pv["fs_args"]),
+		FsBlockSize:  pv.getInt("fs_block_size"),
+		FsInodeRatio: pv.getInt("fs_inode_ratio"),
+		MountOptions: dc.ParseMountOptions(pv["mount_options"]),
 	}
-	if _, ok := params["disable_template_override"]; !ok {
-		params["disable_template_override"] = "false"
+	if pv["fs_reserved_percent"] != "" {
+		rp := pv.getInt("fs_reserved_percent")
+		vo.FsReservedPercent = &rp
 	}
-	if _, ok := params["read_iops_max"]; !ok {
-		params["read_iops_max"] = "0"
+	return vo, nil
+}
+
+// Settles the filesystem of a mount volume and validates the StorageClass
+// mkfs and mount options against it.  A filesystem requested in the volume
+// capability wins over the fs_type parameter.  params.FsArgs is replaced by
+// the complete mkfs arguments so every node formats the volume the same way
+func resolveFsParams(ctxt context.Context, vcs []*csi.VolumeCapability, md *dc.VolMetadata, params *dc.VolOpts) error {
+	if (*md)["access_type"] != "mount" {
+		params.FsType = ""
+		params.FsArgs = nil
+		return nil
 	}
-	if _, ok := params["write_iops_max"]; !ok {
-		params["write_iops_max"] = "0"
+	for _, vc := range vcs {
+		if fs := vc.GetMount().GetFsType(); fs != "" {
+			if params.FsType != "" && params.FsType != fs {
+				co.Warningf(ctxt, "Volume capability filesystem %s overrides fs_type parameter %s", fs, params.FsType)
+			}
+			params.FsType = fs
+			break
+		}
 	}
-	if _, ok := params["total_iops_max"]; !ok {
-		params["total_iops_max"] = "0"
+	if params.FsType == "" {
+		params.FsType = (*md)["fs_type"]
 	}
-	if _, ok := params["read_bandwidth_max"]; !ok {
-		params["read_bandwidth_max"] = "0"
+	fs, err := dc.GetFilesystem(params.FsType)
+	if err != nil {
+		return err
+	}
+	args, err := fs.Args(&dc.MkfsOpts{
+		Args:            params.FsArgs,
+		BlockSize:       params.FsBlockSize,
+		InodeRatio:      params.FsInodeRatio,
+		ReservedPercent: params.FsReservedPercent,
+	})
+	if err != nil {
+		return err
 	}
-	if _, ok := params["write_bandwidth_max"]; !ok {
-		params["write_bandwidth_max"] = "0"
+	if err = fs.CheckMountOptions(params.MountOptions); err != nil {
+		return err
 	}
-	if _, ok := params["total_bandwidth_max"]; !ok {
-		params["total_bandwidth_max"] = "0"
+	params.FsArgs = args
+	return nil
+}
+
+// Checks that params only holds valid values for the parameters
+// ControllerModifyVolume (Kubernetes VolumeAttributesClass) can change
+func validateMutableParams(ctxt context.Context, params map[string]string) error {
+	bad := []string{}
+	for k := range params {
+		if p, canonical := volParamSchema.lookup(k); p == nil || !canonical || !p.Mutable {
+			bad = append(bad, k)
+		}
 	}
-	if _, ok := params["delete_on_unmount"]; !ok {
-		params["delete_on_unmount"] = "false"
+	if len(bad) > 0 {
+		sort.Strings(bad)
+		return fmt.Errorf("Parameters %s cannot be modified", bad)
 	}
+	_, err := volParamSchema.Parse(ctxt, params, true)
+	return err
+}
 
-	val, err := strconv.ParseInt(params["iops_per_gb"], 10, 0)
-	if err != nil {
-		return nil, err
+// Returns the QoS parameters a volume was created (or last modified) with,
+// from its metadata, with overrides applied on top.  The returned map has a
+// value for every mutable parameter
+func storedQoS(ctxt context.Context, md *dc.VolMetadata, overrides map[string]string) (map[string]string, *dc.VolOpts, error) {
+	qos := map[string]string{}
+	for _, k := range volParamSchema.Mutable() {
+		if v, ok := (*md)[k]; ok {
+			qos[k] = v
+		}
 	}
-	vo.IopsPerGb = int(val)
-	val, err = strconv.ParseInt(params["bandwidth_per_gb"], 10, 0)
-	if err != nil {
-		return nil, err
+	for k, v := range overrides {
+		qos[k] = v
 	}
-	vo.BandwidthPerGb = int(val)
-	vo.PlacementMode = params["placement_mode"]
-        vo.PlacementPolicy = params["placement_policy"]
-	b, err := strconv.ParseBool(params["round_robin"])
+	params, err := parseVolParams(ctxt, qos, true)
 	if err != nil {
-		return nil, err
+		return nil, nil, err
 	}
-	vo.RoundRobin = b
-	val, err = strconv.ParseInt(params["replica_count"], 10, 0)
-	if err != nil {
-		return nil, err
-	}
-	vo.Replica = int(val)
-	vo.IpPool = params["ip_pool"]
-	vo.Template = params["template"]
-	b, err = strconv.ParseBool(params["disable_template_override"])
+	return qos, params, nil
+}
+
+// Parses VolumeSnapshotClass parameters, see snapParamSchema
+func parseSnapParams(ctxt context.Context, params map[string]string, strict bool) (*dc.SnapOpts, error) {
+	co.Debugf(ctxt, "Snapshot Params: %s", params)
+	pv, err := snapParamSchema.Parse(ctxt, params, strict)
 	if err != nil {
 		return nil, err
 	}
-	vo.DisableTemplateOverride = b
-	val, err = strconv.ParseInt(params["read_iops_max"], 10, 0)
-	if err != nil {
-		return nil, err
+	return &dc.SnapOpts{
+		RemoteProviderUuid: pv["remote_provider_uuid"],
+		Type:               pv["type"],
+	}, nil
+}
+
+func validateSnapId(snapId string) error {
+	const example = "CSI-pvc-2071cca0-3259-11e9-aba5-003048f5d94a:1550370547.151396819"
+	parts := strings.Split(snapId, ":")
+	if len(parts) != 2 {
+		return fmt.Errorf("Snapshot ID invalid.  Example: %s", example)
 	}
-	vo.ReadIopsMax = int(val)
-	val, err = strconv.ParseInt(params["write_iops_max"], 10, 0)
+	return nil
+}
+
+// Copies the filesystem metadata of a clone source into the metadata of the
+// new volume.  The clone has the exact contents of the source, so the node
+// must not reformat it, and must mount it with the source filesystem type
+func inheritSourceMetadata(ctxt context.Context, src *dc.Volume, md *dc.VolMetadata) error {
+	smd, err := src.GetMetadata(ctxt)
 	if err != nil {
-		return nil, err
+		return err
 	}
-	vo.WriteIopsMax = int(val)
-	val, err = strconv.ParseInt(params["total_iops_max"], 10, 0)
-	if err != nil {
-		return nil, err
+	if fs := (*smd)["fs_type"]; fs != "" {
+		if (*md)["fs_type"] != "" && (*md)["fs_type"] != fs {
+			co.Warningf(ctxt, "Requested filesystem %s does not match source volume %s filesystem %s, using %s", (*md)["fs_type"], src.Name, fs, fs)
+		}
+		(*md)["fs_type"] = fs
 	}
-	vo.TotalIopsMax = int(val)
-	val, err = strconv.ParseInt(params["read_bandwidth_max"], 10, 0)
-	if err != nil {
-		return nil, err
+	if fsArgs := (*smd)["fs_args"]; fsArgs != "" {
+		(*md)["fs_args"] = fsArgs
 	}
-	vo.ReadBandwidthMax = int(val)
-	val, err = strconv.ParseInt(params["write_bandwidth_max"], 10, 0)
-	if err != nil {
-		return nil, err
+	(*md)["clone_source"] = src.Name
+	return nil
+}
+
+// Returns "snapshot:<snapshot id>" or "volume:<volume id>" for a content
+// source, "" without one.  Kept in the "content_source" metadata key so
+// retried requests return the source the volume was created from
+func contentSourceKey(cs *csi.VolumeContentSource) string {
+	if snap := cs.GetSnapshot(); snap != nil {
+		return "snapshot:" + snap.SnapshotId
+	} else if vol := cs.GetVolume(); vol != nil {
+		return "volume:" + vol.VolumeId
 	}
-	vo.WriteBandwidthMax = int(val)
-	val, err = strconv.ParseInt(params["total_bandwidth_max"], 10, 0)
-	if err != nil {
-		return nil, err
+	return ""
+}
+
+func parseContentSourceKey(key string) *csi.VolumeContentSource {
+	parts := strings.SplitN(key, ":", 2)
+	if len(parts) != 2 || parts[1] == "" {
+		return nil
 	}
-	vo.TotalBandwidthMax = int(val)
-	b, err = strconv.ParseBool(params["delete_on_unmount"])
-	if err != nil {
-		return nil, err
+	switch parts[0] {
+	case "snapshot":
+		return &csi.VolumeContentSource{
+			Type: &csi.VolumeContentSource_Snapshot{
+				Snapshot: &csi.VolumeContentSource_SnapshotSource{SnapshotId: parts[1]},
+			},
+		}
+	case "volume":
+		return &csi.VolumeContentSource{
+			Type: &csi.VolumeContentSource_Volume{
+				Volume: &csi.VolumeContentSource_VolumeSource{VolumeId: parts[1]},
+			},
+		}
 	}
-	vo.DeleteOnUnmount = b
-	return vo, nil
+	return nil
 }
 
-func parseSnapParams(ctxt context.Context, params map[string]string) (*dc.SnapOpts, error) {
-	//Golang makes something that should be simple, repetative and gross
-	if params == nil {
-		params = make(map[string]string, 16)
+// Summarizes the state Datera reports for a volume.  Anything other than an
+// available app instance and target with healthy replicas is abnormal
+func volumeCondition(vol *dc.Volume) *csi.VolumeCondition {
+	problems := []string{}
+	if vol.OpState != "" && vol.OpState != "available" {
+		problems = append(problems, fmt.Sprintf("app instance op_state is %s", vol.OpState))
 	}
-	so := &dc.SnapOpts{}
-	// var err error
-	co.Debugf(ctxt, "Snapshot Params: %s", params)
-	// set defaults
-	if _, ok := params["remote_provider_uuid"]; !ok {
-		params["remote_provider_uuid"] = ""
+	if vol.TargetOpState != "" && vol.TargetOpState != "available" {
+		problems = append(problems, fmt.Sprintf("storage instance op_state is %s", vol.TargetOpState))
 	}
-	if _, ok := params["type"]; !ok {
-		params["type"] = "local"
+	if vol.Health != "" && vol.Health != "ok" {
+		problems = append(problems, fmt.Sprintf("volume health is %s", vol.Health))
 	}
-	so.RemoteProviderUuid = params["remote_provider_uuid"]
-	so.Type = params["type"]
-	return so, nil
+	if len(problems) > 0 {
+		return &csi.VolumeCondition{Abnormal: true, Message: strings.Join(problems, "; ")}
+	}
+	return &csi.VolumeCondition{Message: "Volume is healthy"}
 }
 
-func validateSnapId(snapId string) error {
-	const example = "CSI-pvc-2071cca0-3259-11e9-aba5-003048f5d94a:1550370547.151396819"
-	parts := strings.Split(snapId, ":")
-	if len(parts) != 2 {
-		return fmt.Errorf("Snapshot ID invalid.  Example: %s", example)
+// The ACL only has initiator IQNs, so the full node IDs a volume is published
+// to are kept in the "published_nodes" metadata key
+func publishedNodes(md *dc.VolMetadata) []string {
+	nodes := []string{}
+	for _, n := range strings.Split((*md)["published_nodes"], ",") {
+		if n != "" {
+			nodes = append(nodes, n)
+		}
 	}
-	return nil
+	return nodes
 }
 
-func handleTopologyRequirement(tr *csi.TopologyRequirement) error {
-	if tr == nil {
-		return nil
+func setPublishedNode(md *dc.VolMetadata, nodeId string, published bool) {
+	nodes := []string{}
+	for _, n := range publishedNodes(md) {
+		if n != nodeId {
+			nodes = append(nodes, n)
+		}
 	}
-	if len(tr.Requisite) > 0 || len(tr.Preferred) > 0 {
-		return fmt.Errorf("TopologyRequirements and Preferred Topologies are currently unsupported")
+	if published {
+		nodes = append(nodes, nodeId)
 	}
-	return nil
+	(*md)["published_nodes"] = strings.Join(nodes, ",")
 }
 
 func registerMdFromCtxt(ctxt context.Context, md *dc.VolMetadata) error {
@@ -204,16 +301,32 @@ func (d *Driver) CreateVolume(ctx context.Context, req *csi.CreateVolumeRequest)
 	chapParams := map[string]string{}
 	chapParams = co.StripSecretsAndGetChapParams(req)
 
-	ctxt, ip, clean := d.InitFunc(ctx, "controller", "CreateVolume", *req)
-	defer clean()
-	if ip {
-		return nil, status.Errorf(codes.Aborted, "Operation is still in progress")
-	}
+	ctxt := d.InitFunc(ctx, "controller", "CreateVolume", *req)
 	// Handle req.Name
 	if req.Name == "" {
 		return nil, status.Errorf(codes.InvalidArgument, "Name must be provided (currently empty string)")
 	}
-	id := co.GenName(req.Name)
+	// Handle req.Parameters and req.MutableParameters
+	pvc, reqParams := extractPvcInfo(req.Parameters)
+	if err := validateMutableParams(ctxt, req.MutableParameters); err != nil {
+		return nil, status.Errorf(codes.InvalidArgument, err.Error())
+	}
+	vp := d.conf.volParams(reqParams)
+	for k, v := range req.MutableParameters {
+		vp[k] = v
+	}
+	params, err := parseVolParams(ctxt, vp, d.conf.StrictParams)
+	if err != nil {
+		return nil, status.Errorf(codes.InvalidArgument, err.Error())
+	}
+	params.Tenant = d.volumeTenant(ctxt, params, pvc)
+	name := volumeName(ctxt, d.conf.VolumeNameTemplate, req.Name, pvc)
+	id := co.MkVolId(params.Tenant, name)
+	release, err := d.lock(ctxt, id, "CreateVolume")
+	if err != nil {
+		return nil, err
+	}
+	defer release()
 
 	cr := req.CapacityRange
 	if cr != nil && cr.LimitBytes == 0 {
@@ -221,24 +334,43 @@ func (d *Driver) CreateVolume(ctx context.Context, req *csi.CreateVolumeRequest)
 	}
 
 	// Check to see if a volume already exists with this name
-	if vol, err := d.dc.GetVolume(id, false, false); err == nil {
+	if vol, err := d.dc.GetVolume(ctxt, id, false, false); err == nil {
 		size := int64(vol.Size * units.GiB)
 		if cr != nil && (cr.LimitBytes < size || cr.RequiredBytes != size) {
 			return nil, status.Errorf(codes.AlreadyExists, "Requested volume exists, but has a different size")
 		}
+		var zone string
+		// Volumes cloned before the source was recorded can't be checked
+		src := contentSourceKey(req.VolumeContentSource)
+		if md, err := vol.GetMetadata(ctxt); err == nil {
+			zone = (*md)["topology_zone"]
+			// A name template can map different PVs to the same name, eg:
+			// after a PVC is deleted and recreated while its old PV is
+			// retained
+			if pv := (*md)["pv_name"]; pv != "" && pvc.PvName != "" && pv != pvc.PvName {
+				return nil, status.Errorf(codes.AlreadyExists, "Volume %s already exists for PV %s", id, pv)
+			}
+			if cs, ok := (*md)["content_source"]; ok && cs != src && src != "" {
+				return nil, status.Errorf(codes.AlreadyExists, "Volume %s already exists with a different content source", id)
+			} else if ok && cs != "" {
+				src = cs
+			}
+		}
 		return &csi.CreateVolumeResponse{
 			Volume: &csi.Volume{
-				CapacityBytes: size,
-				VolumeId:      vol.Name,
-				VolumeContext: map[string]string{},
+				CapacityBytes:      size,
+				VolumeId:           vol.Id,
+				VolumeContext:      map[string]string{},
+				ContentSource:      parseContentSourceKey(src),
+				AccessibleTopology: mkTopology(zone),
 			},
 		}, nil
 	}
 
-	// Handle req.AccessibilityRequirements.  Currently we just error out if a topology requirement exists
-	// TODO: Implement real topology handling.
-	if err := handleTopologyRequirement(req.AccessibilityRequirements); err != nil {
-		return nil, status.Errorf(codes.InvalidArgument, err.Error())
+	// Handle req.AccessibilityRequirements
+	zone, err := handleTopologyRequirement(ctxt, req.AccessibilityRequirements, d.topology)
+	if err != nil {
+		return nil, status.Errorf(codes.ResourceExhausted, err.Error())
 	}
 
 	md := &dc.VolMetadata{}
@@ -249,6 +381,7 @@ func (d *Driver) CreateVolume(ctx context.Context, req *csi.CreateVolumeRequest)
 	}
 	(*md)["display_name"] = req.Name
 	registerMdFromCtxt(ctxt, md)
+	pvc.register(md)
 
 	vcs := req.VolumeCapabilities
 	if vcs == nil {
@@ -260,9 +393,7 @@ func (d *Driver) CreateVolume(ctx context.Context, req *csi.CreateVolumeRequest)
 		}
 	}
 	co.Debugf(ctxt, "Metadata after registering VolumeCapabilities: %#v", *md)
-	// Handle req.Parameters
-	params, err := parseVolParams(ctxt, req.Parameters)
-	if err != nil {
+	if err = resolveFsParams(ctxt, vcs, md, params); err != nil {
 		return nil, status.Errorf(codes.InvalidArgument, err.Error())
 	}
 
@@ -272,21 +403,16 @@ func (d *Driver) CreateVolume(ctx context.Context, req *csi.CreateVolumeRequest)
 	}
 
 	// Needed for testing on single-node systems
-	if d.env.ReplicaOverride {
+	if d.conf.ReplicaOverride {
 		params.Replica = 1
 	}
 
-	// Handle req.VolumeContentSource
-	cs := req.VolumeContentSource
-	if snap := cs.GetSnapshot(); snap != nil {
-		if err = validateSnapId(snap.SnapshotId); err != nil {
-			return nil, status.Errorf(codes.InvalidArgument, err.Error())
-		}
-		src, err := d.dc.SnapshotPathFromCsiId(snap.SnapshotId)
-		if err != nil {
-			return nil, status.Errorf(codes.InvalidArgument, err.Error())
-		}
-		params.CloneSnapSrc = src
+	// Map the chosen topology zone to its placement policy and ip pool
+	if zone != "" {
+		d.topology.apply(ctxt, zone, params)
+		(*md)["topology_zone"] = zone
+		(*md)["placement_policy"] = params.PlacementPolicy
+		(*md)["ip_pool"] = params.IpPool
 	}
 
 	// Handle req.CapacityRange
@@ -306,7 +432,63 @@ func (d *Driver) CreateVolume(ctx context.Context, req *csi.CreateVolumeRequest)
 	} else {
 		size = DefaultSize
 	}
+
+	// Handle req.VolumeContentSource
+	cs := req.VolumeContentSource
+	var srcVol *dc.Volume
+	if snap := cs.GetSnapshot(); snap != nil {
+		if err = validateSnapId(snap.SnapshotId); err != nil {
+			return nil, status.Errorf(codes.InvalidArgument, err.Error())
+		}
+		src, err := d.dc.SnapshotPathFromCsiId(ctxt, snap.SnapshotId)
+		if err != nil {
+			return nil, status.Errorf(codes.NotFound, err.Error())
+		}
+		params.CloneSnapSrc = src
+		vid, _ := co.ParseSnapId(snap.SnapshotId)
+		if srcVol, err = d.dc.GetVolume(ctxt, vid, false, false); err != nil {
+			return nil, status.Errorf(codes.NotFound, err.Error())
+		}
+		// Snapshots are reported at the size of their volume, see
+		// CreateSnapshot
+		if size < srcVol.Size {
+			return nil, status.Errorf(codes.OutOfRange, "Requested size %d GiB is smaller than snapshot %s size %d GiB", size, snap.SnapshotId, srcVol.Size)
+		}
+	} else if svol := cs.GetVolume(); svol != nil {
+		if svol.VolumeId == "" {
+			return nil, status.Errorf(codes.InvalidArgument, "Source VolumeId cannot be empty")
+		}
+		if srcVol, err = d.dc.GetVolume(ctxt, svol.VolumeId, false, false); err != nil {
+			return nil, status.Errorf(codes.NotFound, err.Error())
+		}
+		if srcVol.Path == "" {
+			return nil, status.Errorf(codes.NotFound, "Could not determine volume path for source volume %s", svol.VolumeId)
+		}
+		// Clones are always created at the size of the source volume, so
+		// anything smaller can't be honored
+		if size < srcVol.Size {
+			return nil, status.Errorf(codes.OutOfRange, "Requested size %d GiB is smaller than source volume %s size %d GiB", size, srcVol.Name, srcVol.Size)
+		}
+		params.CloneVolSrc = srcVol.Path
+	}
+	if srcVol != nil {
+		// Datera clones within a tenant only
+		if srcVol.Tenant != params.Tenant {
+			return nil, status.Errorf(codes.InvalidArgument, "Volume %s must be created in the tenant of its source %s", id, srcVol.Id)
+		}
+		if err = inheritSourceMetadata(ctxt, srcVol, md); err != nil {
+			return nil, status.Errorf(codes.Unknown, err.Error())
+		}
+	}
+	// Recorded for every new volume, so retries can tell them from clones
+	(*md)["content_source"] = contentSourceKey(cs)
+	if srcVol == nil {
+		// Nothing but the driver has written to it, so the node may format
+		// over whatever signature it finds the first time it stages it
+		(*md)["created_empty"] = "true"
+	}
 	params.Size = size
+	params.Descr = pvc.descr()
 	// Create AppInstance/StorageInstance/Volume
 	// Fix for CET-312. QoS params sent along with volume creation call
 	// No need to update the performance_policy again
@@ -315,48 +497,44 @@ func (d *Driver) CreateVolume(ctx context.Context, req *csi.CreateVolumeRequest)
 	// Get the CHAP params passed from Kubernetes StorageClass
 	// Strip the credentials and get it as chapParams
 
-	vol, err := d.dc.CreateVolume(id, params, false, chapParams)
+	vol, err := d.dc.CreateVolume(ctxt, name, params, false, chapParams)
 	if err != nil {
 		return nil, status.Errorf(codes.Unknown, err.Error())
 	}
 
+	// Clones inherit the size of their source, so grow them to the requested
+	// size if necessary.  The filesystem is expanded by the node when staged
+	if vol.Size < size {
+		co.Infof(ctxt, "Resizing volume %s from %d GiB to requested size %d GiB", vol.Name, vol.Size, size)
+		if err = vol.Resize(ctxt, size); err != nil {
+			return nil, status.Errorf(codes.Unknown, err.Error())
+		}
+		(*md)["fs_resize_pending"] = "true"
+	}
+
 	// Handle req.ControllerCreateSecrets
 	// TODO: Figure out what we want to do with secrets (software encryption maybe?)
 	// handleVolSecrets(req.ControllerCreateSecrets)
 
 	//Set metadata, fail gracefully
-	if md, err = vol.SetMetadata(md); err != nil {
+	if md, err = vol.SetMetadata(ctxt, md); err != nil {
 		co.Error(ctxt, err)
 	}
 
-        // Update the ContentSource in the volume response
-        SnapSrc := &csi.VolumeContentSource_SnapshotSource{}
-        VolSrc := &csi.VolumeContentSource_VolumeSource{}
-        ContentSrc := &csi.VolumeContentSource{}
-
-        if params.CloneSrc != "" {
-                VolSrc.VolumeId = params.CloneSrc
-                ContentSrc.Type = &csi.VolumeContentSource_Volume{}
-                ContentSrc.GetType().(*csi.VolumeContentSource_Volume).Volume = VolSrc
-        } else if params.CloneVolSrc != "" {
-                VolSrc.VolumeId = params.CloneVolSrc
-                ContentSrc.Type = &csi.VolumeContentSource_Volume{}
-                ContentSrc.GetType().(*csi.VolumeContentSource_Volume).Volume = VolSrc
-        } else if params.CloneSnapSrc != "" {
-                SnapSrc.SnapshotId = params.CloneSnapSrc
-                ContentSrc.Type = &csi.VolumeContentSource_Snapshot{}
-                ContentSrc.GetType().(*csi.VolumeContentSource_Snapshot).Snapshot = SnapSrc
-        }
-
-        // Return volume response back to K8S
-        return &csi.CreateVolumeResponse{
-                Volume: &csi.Volume{
-                        CapacityBytes: int64(size * units.GiB),
-                        VolumeId:      vol.Name,
-                        VolumeContext: map[string]string{},
-                        ContentSource: ContentSrc,
-                },
-        }, nil
+	// Update the ContentSource in the volume response.  This has to be the
+	// CSI identifier of the source, not the Datera path
+	ContentSrc := parseContentSourceKey(contentSourceKey(cs))
+
+	// Return volume response back to K8S
+	return &csi.CreateVolumeResponse{
+		Volume: &csi.Volume{
+			CapacityBytes:      int64(vol.Size * units.GiB),
+			VolumeId:           vol.Id,
+			VolumeContext:      map[string]string{},
+			ContentSource:      ContentSrc,
+			AccessibleTopology: mkTopology(zone),
+		},
+	}, nil
 
 }
 
@@ -365,19 +543,20 @@ func (d *Driver) DeleteVolume(ctx context.Context, req *csi.DeleteVolumeRequest)
 	// Just strip the secrets from the GRPC request.
 	// Discard the returned chapParams since DeleteVolume doesn't need them.
 	_ = co.StripSecretsAndGetChapParams(req)
-	ctxt, ip, clean := d.InitFunc(ctx, "controller", "DeleteVolume", *req)
-	defer clean()
-	if ip {
-		return nil, status.Errorf(codes.Aborted, "Operation is still in progress")
-	}
+	ctxt := d.InitFunc(ctx, "controller", "DeleteVolume", *req)
 	vid := req.VolumeId
 	if req.VolumeId == "" {
 		return nil, status.Errorf(codes.InvalidArgument, "VolumeId cannot be empty")
 	}
+	release, err := d.lock(ctxt, vid, "DeleteVolume")
+	if err != nil {
+		return nil, err
+	}
+	defer release()
 	// Handle req.ControllerDeleteSecrets
 	// TODO: Figure out what we want to do with secrets (software encryption maybe?)
 	// sec := req.ControllerDeleteSecrets
-	if err := d.dc.DeleteVolume(req.VolumeId, true); err != nil {
+	if err := d.dc.DeleteVolume(ctxt, req.VolumeId, true); err != nil {
 		co.Errorf(ctxt, "Error deleting volume: %s.  err: %s", vid, err)
 		if strings.Contains(err.Error(), "it has snapshots") {
 			return nil, status.Errorf(codes.FailedPrecondition, "Volumes with snapshots cannot be deleted.  Delete snapshots first")
@@ -387,36 +566,147 @@ func (d *Driver) DeleteVolume(ctx context.Context, req *csi.DeleteVolumeRequest)
 }
 
 func (d *Driver) ControllerPublishVolume(ctx context.Context, req *csi.ControllerPublishVolumeRequest) (*csi.ControllerPublishVolumeResponse, error) {
-	_, ip, clean := d.InitFunc(ctx, "controller", "ControllerPublishVolume", *req)
-	defer clean()
-	if ip {
-		return nil, status.Errorf(codes.Aborted, "Operation is still in progress")
+	ctxt := d.InitFunc(ctx, "controller", "ControllerPublishVolume", *req)
+	if req.VolumeId == "" {
+		return nil, status.Errorf(codes.InvalidArgument, "VolumeId cannot be empty")
+	}
+	if req.NodeId == "" {
+		return nil, status.Errorf(codes.InvalidArgument, "NodeId cannot be empty")
+	}
+	if req.VolumeCapability == nil {
+		return nil, status.Errorf(codes.InvalidArgument, "VolumeCapability cannot be nil")
 	}
-	return nil, status.Errorf(codes.Unimplemented, "ControllerPublishVolume Not Implemented")
+	_, iqn := co.ParseNodeId(req.NodeId)
+	if iqn == "" {
+		return nil, status.Errorf(codes.NotFound, "NodeId is invalid (Not of the form hostname:initiator_iqn): %s", req.NodeId)
+	}
+	release, err := d.lock(ctxt, req.VolumeId, "ControllerPublishVolume:"+req.NodeId)
+	if err != nil {
+		return nil, err
+	}
+	defer release()
+	pc, err := d.publishVolume(ctxt, req.VolumeId, req.NodeId, iqn, req.VolumeCapability)
+	if err != nil {
+		return nil, err
+	}
+	return &csi.ControllerPublishVolumeResponse{
+		PublishContext: pc,
+	}, nil
+}
+
+// Registers the initiator iqn of nodeId with the volume ACL and returns the
+// PublishContext for the node.  The caller holds the volume lock
+func (d *Driver) publishVolume(ctxt context.Context, vid, nodeId, iqn string, vc *csi.VolumeCapability) (map[string]string, error) {
+	vol, err := d.dc.GetVolume(ctxt, vid, false, false)
+	if err != nil {
+		return nil, status.Errorf(codes.NotFound, err.Error())
+	}
+	md, err := vol.GetMetadata(ctxt)
+	if err != nil {
+		return nil, status.Errorf(codes.Unknown, err.Error())
+	}
+	if err := RegisterVolumeCapability(ctxt, md, vc); err != nil {
+		return nil, status.Errorf(codes.InvalidArgument, err.Error())
+	}
+	// Setup ACL, with an initiator of the volume's tenant
+	init, err := d.dc.CreateGetInitiatorFromIqn(co.WithTenant(ctxt, vol.Tenant), iqn)
+	if err != nil {
+		return nil, status.Errorf(codes.Unknown, err.Error())
+	}
+	if err = vol.RegisterAcl(ctxt, init); err != nil {
+		return nil, status.Errorf(codes.Unknown, err.Error())
+	}
+	setPublishedNode(md, nodeId, true)
+	// Only the first attachment may format over whatever it finds on a
+	// volume created empty, after that it may hold anything
+	createdEmpty := (*md)["created_empty"] == "true" && (*md)["attached"] != "true"
+	if _, err = vol.SetMetadata(ctxt, &dc.VolMetadata{"published_nodes": (*md)["published_nodes"], "attached": "true"}); err != nil {
+		co.Warning(ctxt, err)
+		createdEmpty = false
+	}
+	// Online AI (to ensure targets are accessible)
+	if err = vol.Online(ctxt); err != nil {
+		return nil, status.Errorf(codes.Unknown, err.Error())
+	}
+	if vol.Iqn == "" || len(vol.Ips) == 0 {
+		return nil, status.Errorf(codes.Unavailable, "Target information for volume %s is not available yet", vol.Name)
+	}
+	pc := map[string]string{
+		PublishTargetIqn:     vol.Iqn,
+		PublishTargetPortals: strings.Join(vol.Ips, ","),
+		PublishRoundRobin:    (*md)["round_robin"],
+		PublishSize:          strconv.Itoa(vol.Size),
+	}
+	for _, k := range publishMetadataKeys {
+		if v := (*md)[k]; v != "" {
+			pc[k] = v
+		}
+	}
+	if createdEmpty {
+		pc[PublishCreatedEmpty] = "true"
+	}
+	return pc, nil
 }
 
 func (d *Driver) ControllerUnpublishVolume(ctx context.Context, req *csi.ControllerUnpublishVolumeRequest) (*csi.ControllerUnpublishVolumeResponse, error) {
-	_, ip, clean := d.InitFunc(ctx, "controller", "ControllerUnpublishVolume", *req)
-	defer clean()
-	if ip {
-		return nil, status.Errorf(codes.Aborted, "Operation is still in progress")
+	ctxt := d.InitFunc(ctx, "controller", "ControllerUnpublishVolume", *req)
+	if req.VolumeId == "" {
+		return nil, status.Errorf(codes.InvalidArgument, "VolumeId cannot be empty")
+	}
+	if req.NodeId == "" {
+		return nil, status.Errorf(codes.InvalidArgument, "NodeId cannot be empty")
+	}
+	release, err := d.lock(ctxt, req.VolumeId, "ControllerUnpublishVolume:"+req.NodeId)
+	if err != nil {
+		return nil, err
 	}
-	return nil, status.Errorf(codes.Unimplemented, "ControllerUnPublishVolume Not Implemented")
+	defer release()
+	// Unpublishing a volume or node that no longer exists is considered a success
+	// since there is nothing left to detach
+	vol, err := d.dc.GetVolume(ctxt, req.VolumeId, false, false)
+	if err != nil {
+		co.Warningf(ctxt, "VolumeId is invalid: %s", req.VolumeId)
+		return &csi.ControllerUnpublishVolumeResponse{}, nil
+	}
+	_, iqn := co.ParseNodeId(req.NodeId)
+	if iqn == "" {
+		co.Warningf(ctxt, "NodeId is invalid (Not of the form hostname:initiator_iqn): %s", req.NodeId)
+		return &csi.ControllerUnpublishVolumeResponse{}, nil
+	}
+	init, err := d.dc.GetInitiator(co.WithTenant(ctxt, vol.Tenant), iqn)
+	if err != nil {
+		co.Warning(ctxt, err)
+		return &csi.ControllerUnpublishVolumeResponse{}, nil
+	}
+	if err = vol.UnregisterAcl(ctxt, init); err != nil {
+		return nil, status.Errorf(codes.Unknown, err.Error())
+	}
+	if md, err := vol.GetMetadata(ctxt); err != nil {
+		co.Warning(ctxt, err)
+	} else {
+		setPublishedNode(md, req.NodeId, false)
+		if _, err = vol.SetMetadata(ctxt, &dc.VolMetadata{"published_nodes": (*md)["published_nodes"]}); err != nil {
+			co.Warning(ctxt, err)
+		}
+		if (*md)["delete_on_unmount"] == "true" && len(publishedNodes(md)) == 0 {
+			co.Infof(ctxt, "Auto-deleting %s on unmount", vol.Name)
+			if err = vol.Delete(ctxt, false); err != nil {
+				co.Warning(ctxt, err)
+			}
+		}
+	}
+	return &csi.ControllerUnpublishVolumeResponse{}, nil
 }
 
 func (d *Driver) ValidateVolumeCapabilities(ctx context.Context, req *csi.ValidateVolumeCapabilitiesRequest) (*csi.ValidateVolumeCapabilitiesResponse, error) {
-	_, ip, clean := d.InitFunc(ctx, "controller", "ValidateVolumeCapabilities", *req)
-	defer clean()
-	if ip {
-		return nil, status.Errorf(codes.Aborted, "Operation is still in progress")
-	}
+	ctxt := d.InitFunc(ctx, "controller", "ValidateVolumeCapabilities", *req)
 	if req.VolumeId == "" {
 		return nil, status.Errorf(codes.InvalidArgument, "VolumeId cannot be empty")
 	}
 	if req.VolumeCapabilities == nil {
 		return nil, status.Errorf(codes.InvalidArgument, "VolumeCapabilities cannot be nil")
 	}
-	if _, err := d.dc.GetVolume(req.VolumeId, false, false); err != nil {
+	if _, err := d.dc.GetVolume(ctxt, req.VolumeId, false, false); err != nil {
 		return nil, status.Errorf(codes.NotFound, err.Error())
 	}
 	return &csi.ValidateVolumeCapabilitiesResponse{
@@ -431,6 +721,14 @@ func (d *Driver) ValidateVolumeCapabilities(ctx context.Context, req *csi.Valida
 						Mode: csi.VolumeCapability_AccessMode_SINGLE_NODE_WRITER,
 					},
 				},
+				{
+					AccessType: &csi.VolumeCapability_Mount{
+						Mount: &csi.VolumeCapability_MountVolume{},
+					},
+					AccessMode: &csi.VolumeCapability_AccessMode{
+						Mode: csi.VolumeCapability_AccessMode_MULTI_NODE_READER_ONLY,
+					},
+				},
 				{
 					AccessType: &csi.VolumeCapability_Block{
 						Block: &csi.VolumeCapability_BlockVolume{},
@@ -439,6 +737,14 @@ func (d *Driver) ValidateVolumeCapabilities(ctx context.Context, req *csi.Valida
 						Mode: csi.VolumeCapability_AccessMode_SINGLE_NODE_WRITER,
 					},
 				},
+				{
+					AccessType: &csi.VolumeCapability_Block{
+						Block: &csi.VolumeCapability_BlockVolume{},
+					},
+					AccessMode: &csi.VolumeCapability_AccessMode{
+						Mode: csi.VolumeCapability_AccessMode_MULTI_NODE_READER_ONLY,
+					},
+				},
 				{
 					AccessType: &csi.VolumeCapability_Block{
 						Block: &csi.VolumeCapability_BlockVolume{},
@@ -462,11 +768,7 @@ func (d *Driver) ValidateVolumeCapabilities(ctx context.Context, req *csi.Valida
 }
 
 func (d *Driver) ListVolumes(ctx context.Context, req *csi.ListVolumesRequest) (*csi.ListVolumesResponse, error) {
-	ctxt, ip, clean := d.InitFunc(ctx, "controller", "ListVolumes", *req)
-	defer clean()
-	if ip {
-		return nil, status.Errorf(codes.Aborted, "Operation is still in progress")
-	}
+	ctxt := d.InitFunc(ctx, "controller", "ListVolumes", *req)
 	var err error
 	st := int64(0)
 	if req.StartingToken != "" {
@@ -475,7 +777,22 @@ func (d *Driver) ListVolumes(ctx context.Context, req *csi.ListVolumesRequest) (
 			return nil, status.Errorf(codes.InvalidArgument, err.Error())
 		}
 	}
-	vols, err := d.dc.ListVolumes(int(req.MaxEntries), int(st))
+	var (
+		vols      []*dc.Volume
+		nextToken string
+	)
+	if tenants := d.tenants(ctxt); len(tenants) > 1 {
+		// Volumes of every tenant are paged through together
+		if vols, err = d.listVolumes(ctxt, tenants); err == nil {
+			start, end := page(len(vols), int(req.MaxEntries), int(st))
+			if end < len(vols) {
+				nextToken = strconv.Itoa(end)
+			}
+			vols = vols[start:end]
+		}
+	} else {
+		vols, err = d.dc.ListVolumes(ctxt, int(req.MaxEntries), int(st))
+	}
 	if err != nil {
 		co.Error(ctxt, err)
 		return nil, status.Errorf(codes.Unknown, err.Error())
@@ -485,28 +802,25 @@ func (d *Driver) ListVolumes(ctx context.Context, req *csi.ListVolumesRequest) (
 		rvols = append(rvols, &csi.ListVolumesResponse_Entry{
 			Volume: &csi.Volume{
 				CapacityBytes: int64(vol.Size * units.GiB),
-				VolumeId:      vol.Name,
+				VolumeId:      vol.Id,
 				VolumeContext: map[string]string{},
 				ContentSource: nil,
 			},
 		})
 	}
 	return &csi.ListVolumesResponse{
-		Entries: rvols,
+		Entries:   rvols,
+		NextToken: nextToken,
 	}, nil
 }
 
 func (d *Driver) GetCapacity(ctx context.Context, req *csi.GetCapacityRequest) (*csi.GetCapacityResponse, error) {
-	ctxt, ip, clean := d.InitFunc(ctx, "controller", "GetCapacity", *req)
-	defer clean()
-	if ip {
-		return nil, status.Errorf(codes.Aborted, "Operation is still in progress")
-	}
-	params, err := parseVolParams(ctxt, req.Parameters)
+	ctxt := d.InitFunc(ctx, "controller", "GetCapacity", *req)
+	params, err := parseVolParams(ctxt, d.conf.volParams(req.Parameters), d.conf.StrictParams)
 	if err != nil {
 		return nil, status.Errorf(codes.InvalidArgument, err.Error())
 	}
-	cap, err := d.dc.GetCapacity()
+	cap, err := d.dc.GetCapacity(ctxt)
 	if err != nil {
 		return nil, status.Errorf(codes.Unknown, err.Error())
 	}
@@ -521,11 +835,7 @@ func (d *Driver) GetCapacity(ctx context.Context, req *csi.GetCapacityRequest) (
 }
 
 func (d *Driver) ControllerGetCapabilities(ctx context.Context, req *csi.ControllerGetCapabilitiesRequest) (*csi.ControllerGetCapabilitiesResponse, error) {
-	_, ip, clean := d.InitFunc(ctx, "controller", "ControllerGetCapabilities", *req)
-	defer clean()
-	if ip {
-		return nil, status.Errorf(codes.Aborted, "Operation is still in progress")
-	}
+	d.InitFunc(ctx, "controller", "ControllerGetCapabilities", *req)
 	resp := &csi.ControllerGetCapabilitiesResponse{Capabilities: []*csi.ControllerServiceCapability{}}
 	addCap := func(t csi.ControllerServiceCapability_RPC_Type) {
 		resp.Capabilities = append(resp.Capabilities, &csi.ControllerServiceCapability{
@@ -539,11 +849,15 @@ func (d *Driver) ControllerGetCapabilities(ctx context.Context, req *csi.Control
 	for _, t := range []csi.ControllerServiceCapability_RPC_Type{
 		csi.ControllerServiceCapability_RPC_LIST_VOLUMES,
 		csi.ControllerServiceCapability_RPC_CREATE_DELETE_VOLUME,
+		csi.ControllerServiceCapability_RPC_PUBLISH_UNPUBLISH_VOLUME,
 		csi.ControllerServiceCapability_RPC_GET_CAPACITY,
 		csi.ControllerServiceCapability_RPC_CREATE_DELETE_SNAPSHOT,
 		csi.ControllerServiceCapability_RPC_LIST_SNAPSHOTS,
 		csi.ControllerServiceCapability_RPC_CLONE_VOLUME,
 		csi.ControllerServiceCapability_RPC_EXPAND_VOLUME,
+		csi.ControllerServiceCapability_RPC_MODIFY_VOLUME,
+		csi.ControllerServiceCapability_RPC_GET_VOLUME,
+		csi.ControllerServiceCapability_RPC_VOLUME_CONDITION,
 	} {
 		addCap(t)
 	}
@@ -551,26 +865,47 @@ func (d *Driver) ControllerGetCapabilities(ctx context.Context, req *csi.Control
 }
 
 func (d *Driver) CreateSnapshot(ctx context.Context, req *csi.CreateSnapshotRequest) (*csi.CreateSnapshotResponse, error) {
-	ctxt, ip, clean := d.InitFunc(ctx, "controller", "CreateSnapshot", *req)
-	defer clean()
-	if ip {
-		return nil, status.Errorf(codes.Aborted, "Operation is still in progress")
-	}
+	ctxt := d.InitFunc(ctx, "controller", "CreateSnapshot", *req)
 	if req.SourceVolumeId == "" {
 		return nil, status.Errorf(codes.InvalidArgument, "SourceVolumeId cannot be empty")
 	}
 	if req.Name == "" {
 		return nil, status.Errorf(codes.InvalidArgument, "Name field cannot be empty")
 	}
-	vol, err := d.dc.GetVolume(req.SourceVolumeId, false, false)
+	release, err := d.lock(ctxt, req.SourceVolumeId, "CreateSnapshot:"+req.Name)
+	if err != nil {
+		return nil, err
+	}
+	defer release()
+	// Snapshot names are unique across volumes, so requests for the same
+	// name on different volumes mustn't race either
+	releaseName, err := d.lock(ctxt, "snapshot-name:"+req.Name, "CreateSnapshot:"+req.SourceVolumeId)
+	if err != nil {
+		return nil, err
+	}
+	defer releaseName()
+	vol, err := d.dc.GetVolume(ctxt, req.SourceVolumeId, false, false)
 	if err != nil {
 		return nil, status.Errorf(codes.NotFound, err.Error())
 	}
-	params, err := parseSnapParams(ctxt, req.Parameters)
+	params, err := parseSnapParams(ctxt, req.Parameters, d.conf.StrictParams)
 	if err != nil {
 		return nil, status.Errorf(codes.InvalidArgument, err.Error())
 	}
-	snap, err := vol.CreateSnapshot(req.Name, params)
+	// Retries find the snapshot on the source volume, only a first create
+	// has to make sure no other volume took the name
+	if vol.GetSnapshotByName(ctxt, req.Name) == nil {
+		for _, t := range d.tenants(ctxt, vol.Tenant) {
+			snap, err := d.dc.GetSnapshotByName(co.WithTenant(ctxt, t), req.Name)
+			if err != nil {
+				return nil, status.Errorf(codes.Unknown, err.Error())
+			}
+			if snap != nil && snap.Vol.Id != vol.Id {
+				return nil, status.Errorf(codes.AlreadyExists, "Snapshot %s already exists for volume %s", req.Name, snap.Vol.Id)
+			}
+		}
+	}
+	snap, err := vol.CreateSnapshot(ctxt, req.Name, params)
 	if err != nil {
 		return nil, status.Errorf(codes.Unknown, err.Error())
 	}
@@ -583,40 +918,44 @@ func (d *Driver) CreateSnapshot(ctx context.Context, req *csi.CreateSnapshotRequ
 	if err != nil {
 		return nil, status.Errorf(codes.Unknown, err.Error())
 	}
-	//TODO Implement snapshot polling before returning
+	// Snapshot creation is asynchronous on the Datera side.  ReadyToUse reflects
+	// the current op_state and the external-snapshotter will keep polling via
+	// retries of this call until the snapshot becomes available
+	co.Debugf(ctxt, "Snapshot %s status: %s", snap.Id, snap.Status)
 	return &csi.CreateSnapshotResponse{
 		Snapshot: &csi.Snapshot{
 			// We set the id to "<volume-id>:<snapshot-id>" since during delete requests
 			// we are not given the parent volume id
-			SnapshotId:     co.MkSnapId(vol.Name, snap.Id),
-			SourceVolumeId: vol.Name,
+			SnapshotId:     co.MkSnapId(vol.Id, snap.Id),
+			SourceVolumeId: vol.Id,
 			SizeBytes:      int64(vol.Size * units.GiB),
 			CreationTime:   pts,
-			ReadyToUse:     true,
+			ReadyToUse:     snap.Ready(),
 		},
 	}, nil
 }
 
 func (d *Driver) DeleteSnapshot(ctx context.Context, req *csi.DeleteSnapshotRequest) (*csi.DeleteSnapshotResponse, error) {
-	ctxt, ip, clean := d.InitFunc(ctx, "controller", "DeleteSnapshot", *req)
-	defer clean()
-	if ip {
-		return nil, status.Errorf(codes.Aborted, "Operation is still in progress")
-	}
+	ctxt := d.InitFunc(ctx, "controller", "DeleteSnapshot", *req)
 	if req.SnapshotId == "" {
 		return nil, status.Errorf(codes.InvalidArgument, "SnapshotId is invalid (empty string)")
 	}
+	release, err := d.lock(ctxt, req.SnapshotId, "DeleteSnapshot")
+	if err != nil {
+		return nil, err
+	}
+	defer release()
 	vid, sid := co.ParseSnapId(req.SnapshotId)
 	if vid == "" || sid == "" {
 		co.Warningf(ctxt, "SnapshotId is invalid (Not of the form app_instance_id:snapshot_id): %s", req.SnapshotId)
 		return &csi.DeleteSnapshotResponse{}, nil
 	}
-	vol, err := d.dc.GetVolume(vid, false, false)
+	vol, err := d.dc.GetVolume(ctxt, vid, false, false)
 	if err != nil {
 		co.Warningf(ctxt, "VolumeId is invalid: %s", vid)
 		return &csi.DeleteSnapshotResponse{}, nil
 	}
-	if err = vol.DeleteSnapshot(sid); err != nil {
+	if err = vol.DeleteSnapshot(ctxt, sid); err != nil {
 		co.Warning(ctxt, err)
 		return &csi.DeleteSnapshotResponse{}, nil
 	}
@@ -624,11 +963,7 @@ func (d *Driver) DeleteSnapshot(ctx context.Context, req *csi.DeleteSnapshotRequ
 }
 
 func (d *Driver) ListSnapshots(ctx context.Context, req *csi.ListSnapshotsRequest) (*csi.ListSnapshotsResponse, error) {
-	ctxt, ip, clean := d.InitFunc(ctx, "controller", "ListSnapshots", *req)
-	defer clean()
-	if ip {
-		return nil, status.Errorf(codes.Aborted, "Operation is still in progress")
-	}
+	ctxt := d.InitFunc(ctx, "controller", "ListSnapshots", *req)
 	rsnaps := []*csi.ListSnapshotsResponse_Entry{}
 	var err error
 	st := int64(0)
@@ -638,7 +973,15 @@ func (d *Driver) ListSnapshots(ctx context.Context, req *csi.ListSnapshotsReques
 			return nil, status.Errorf(codes.InvalidArgument, err.Error())
 		}
 	}
-	snaps, nextToken, err := d.dc.ListSnapshots(req.SnapshotId, req.SourceVolumeId, int(req.MaxEntries), int(st))
+	var (
+		snaps     []*dc.Snapshot
+		nextToken int
+	)
+	if tenants := d.tenants(ctxt); len(tenants) > 1 && req.SnapshotId == "" && req.SourceVolumeId == "" {
+		snaps, nextToken, err = d.listSnapshots(ctxt, tenants, int(req.MaxEntries), int(st))
+	} else {
+		snaps, nextToken, err = d.dc.ListSnapshots(ctxt, req.SnapshotId, req.SourceVolumeId, int(req.MaxEntries), int(st))
+	}
 	if err != nil && req.SourceVolumeId != "" && strings.Contains(err.Error(), "NotFound") {
 		return &csi.ListSnapshotsResponse{
 			Entries: []*csi.ListSnapshotsResponse_Entry{},
@@ -663,10 +1006,11 @@ func (d *Driver) ListSnapshots(ctx context.Context, req *csi.ListSnapshotsReques
 		}
 		rsnaps = append(rsnaps, &csi.ListSnapshotsResponse_Entry{
 			Snapshot: &csi.Snapshot{
-				SnapshotId:     co.MkSnapId(snap.Vol.Name, snap.Id),
+				SnapshotId:     co.MkSnapId(snap.Vol.Id, snap.Id),
 				SizeBytes:      int64(snap.Vol.Size * units.GiB),
-				SourceVolumeId: snap.Vol.Name,
+				SourceVolumeId: snap.Vol.Id,
 				CreationTime:   pts,
+				ReadyToUse:     snap.Ready(),
 			},
 		})
 	}
@@ -682,21 +1026,32 @@ func (d *Driver) ListSnapshots(ctx context.Context, req *csi.ListSnapshotsReques
 }
 
 func (d *Driver) ControllerExpandVolume(ctx context.Context, req *csi.ControllerExpandVolumeRequest) (*csi.ControllerExpandVolumeResponse, error) {
-	ctxt, ip, clean := d.InitFunc(ctx, "controller", "ControllerExpandVolume", *req)
-	defer clean()
-	if ip {
-		return nil, status.Errorf(codes.Aborted, "Operation is still in progress")
+	ctxt := d.InitFunc(ctx, "controller", "ControllerExpandVolume", *req)
+	if req.VolumeId == "" {
+		return nil, status.Errorf(codes.InvalidArgument, "VolumeId cannot be empty")
 	}
 	cr := req.CapacityRange
-	if cr != nil && cr.LimitBytes == 0 {
+	if cr == nil {
+		return nil, status.Errorf(codes.InvalidArgument, "CapacityRange cannot be nil")
+	}
+	if cr.LimitBytes == 0 {
 		cr.LimitBytes = cr.RequiredBytes
 	}
-	vol, err := d.dc.GetVolume(req.VolumeId, false, false)
+	release, err := d.lock(ctxt, req.VolumeId, "ControllerExpandVolume")
+	if err != nil {
+		return nil, err
+	}
+	defer release()
+	vol, err := d.dc.GetVolume(ctxt, req.VolumeId, false, false)
 	if err != nil {
 		co.Warningf(ctxt, "VolumeId is invalid: %s", req.VolumeId)
 		return nil, status.Errorf(codes.InvalidArgument, err.Error())
 	}
-	if err := vol.Resize(int(cr.RequiredBytes / units.GiB)); err != nil {
+	if err := vol.Resize(ctxt, int(cr.RequiredBytes / units.GiB)); err != nil {
+		return nil, status.Errorf(codes.Unknown, err.Error())
+	}
+	if err = d.resizePerformancePolicy(ctxt, vol); err != nil {
+		co.Errorf(ctxt, "Volume %s was resized to %d GiB, but its performance policy could not be updated: %s", vol.Name, vol.Size, err)
 		return nil, status.Errorf(codes.Unknown, err.Error())
 	}
 	return &csi.ControllerExpandVolumeResponse{
@@ -704,3 +1059,112 @@ func (d *Driver) ControllerExpandVolume(ctx context.Context, req *csi.Controller
 		NodeExpansionRequired: true,
 	}, nil
 }
+
+// Reapplies per-GB dynamic QoS after a volume has changed size
+func (d *Driver) resizePerformancePolicy(ctxt context.Context, vol *dc.Volume) error {
+	md, err := vol.GetMetadata(ctxt)
+	if err != nil {
+		return err
+	}
+	_, params, err := storedQoS(ctxt, md, nil)
+	if err != nil {
+		return err
+	}
+	if params.IopsPerGb == 0 && params.BandwidthPerGb == 0 {
+		return nil
+	}
+	params.Size = vol.Size
+	if err = vol.SetPerformancePolicy(ctxt, params); err != nil {
+		return err
+	}
+	co.Infof(ctxt, "Updated performance policy for volume %s at %d GiB: %v", vol.Name, vol.Size, vol.QoS)
+	return nil
+}
+
+func (d *Driver) ControllerModifyVolume(ctx context.Context, req *csi.ControllerModifyVolumeRequest) (*csi.ControllerModifyVolumeResponse, error) {
+	ctxt := d.InitFunc(ctx, "controller", "ControllerModifyVolume", *req)
+	if req.VolumeId == "" {
+		return nil, status.Errorf(codes.InvalidArgument, "VolumeId cannot be empty")
+	}
+	if len(req.MutableParameters) == 0 {
+		return nil, status.Errorf(codes.InvalidArgument, "MutableParameters cannot be empty")
+	}
+	if err := validateMutableParams(ctxt, req.MutableParameters); err != nil {
+		return nil, status.Errorf(codes.InvalidArgument, err.Error())
+	}
+	release, err := d.lock(ctxt, req.VolumeId, "ControllerModifyVolume")
+	if err != nil {
+		return nil, err
+	}
+	defer release()
+	vol, err := d.dc.GetVolume(ctxt, req.VolumeId, false, false)
+	if err != nil {
+		return nil, status.Errorf(codes.NotFound, err.Error())
+	}
+	md, err := vol.GetMetadata(ctxt)
+	if err != nil {
+		return nil, status.Errorf(codes.Unknown, err.Error())
+	}
+	qos, params, err := storedQoS(ctxt, md, req.MutableParameters)
+	if err != nil {
+		return nil, status.Errorf(codes.InvalidArgument, err.Error())
+	}
+	params.Size = vol.Size
+	if err = vol.SetPerformancePolicy(ctxt, params); err != nil {
+		return nil, status.Errorf(codes.Unknown, err.Error())
+	}
+	co.Infof(ctxt, "Updated performance policy for volume %s: %v", vol.Name, vol.QoS)
+	nmd := dc.VolMetadata(qos)
+	if _, err = vol.SetMetadata(ctxt, &nmd); err != nil {
+		return nil, status.Errorf(codes.Unknown, err.Error())
+	}
+	return &csi.ControllerModifyVolumeResponse{}, nil
+}
+
+func (d *Driver) ControllerGetVolume(ctx context.Context, req *csi.ControllerGetVolumeRequest) (*csi.ControllerGetVolumeResponse, error) {
+	ctxt := d.InitFunc(ctx, "controller", "ControllerGetVolume", *req)
+	if req.VolumeId == "" {
+		return nil, status.Errorf(codes.InvalidArgument, "VolumeId cannot be empty")
+	}
+	vol, err := d.dc.GetVolume(ctxt, req.VolumeId, false, false)
+	if err != nil {
+		return nil, status.Errorf(codes.NotFound, err.Error())
+	}
+	md, err := vol.GetMetadata(ctxt)
+	if err != nil {
+		return nil, status.Errorf(codes.Unknown, err.Error())
+	}
+	// The ACL is authoritative, published_nodes only maps IQNs back to the
+	// node IDs they were published with
+	nodeIds := map[string]string{}
+	for _, n := range publishedNodes(md) {
+		if _, iqn := co.ParseNodeId(n); iqn != "" {
+			nodeIds[iqn] = n
+		}
+	}
+	nodes := []string{}
+	for _, iqn := range vol.Initiators {
+		if n, ok := nodeIds[iqn]; ok {
+			nodes = append(nodes, n)
+		} else {
+			co.Debugf(ctxt, "Initiator %s was not registered by the driver", iqn)
+			nodes = append(nodes, iqn)
+		}
+	}
+	cond := volumeCondition(vol)
+	if cond.Abnormal {
+		co.Warningf(ctxt, "Volume %s is abnormal: %s", vol.Name, cond.Message)
+	}
+	return &csi.ControllerGetVolumeResponse{
+		Volume: &csi.Volume{
+			CapacityBytes:      int64(vol.Size * units.GiB),
+			VolumeId:           vol.Id,
+			VolumeContext:      map[string]string{},
+			AccessibleTopology: mkTopology((*md)["topology_zone"]),
+		},
+		Status: &csi.ControllerGetVolumeResponse_VolumeStatus{
+			PublishedNodeIds: nodes,
+			VolumeCondition:  cond,
+		},
+	}, nil
+}
@@ -4,13 +4,15 @@ import (
 	"context"
 	"fmt"
 	"testing"
+	"time"
 
 	csi "github.com/container-storage-interface/spec/lib/go/csi"
 	units "github.com/docker/go-units"
+	codes "google.golang.org/grpc/codes"
 
 	co "github.com/Datera/datera-csi/pkg/common"
+	fake "github.com/Datera/datera-csi/pkg/fake"
 	dsdk "github.com/Datera/go-sdk/pkg/dsdk"
-	udc "github.com/Datera/go-udc/pkg/udc"
 )
 
 func getCtxt() context.Context {
@@ -18,15 +20,17 @@ func getCtxt() context.Context {
 }
 
 func getDriverController(t *testing.T) *Driver {
-	conf, err := udc.GetConfig()
-	if err != nil {
-		t.Fatal(err)
-	}
-	d, err := NewDateraDriver(conf)
+	d, _ := getDriverControllerFake(t)
+	return d
+}
+
+func getDriverControllerFake(t *testing.T) (*Driver, *fake.Datera) {
+	fd := fake.NewDatera()
+	d, err := NewDateraDriverWithHTTPClient(fd.UDC(), fd.HTTPClient())
 	if err != nil {
 		t.Fatal(err)
 	}
-	return d
+	return d, fd
 }
 
 func createVolume(t *testing.T, d *Driver) (string, *csi.Volume, func()) {
@@ -76,6 +80,7 @@ func createVolumeWithSnapshot(t *testing.T, d *Driver) (string, *csi.Volume, *cs
 		t.Fatal(err)
 	} else {
 		snapid := resp.Snapshot.SnapshotId
+		waitSnapshotReady(t, d, snapid)
 		cleanf2 := func() {
 			if _, err := d.DeleteSnapshot(getCtxt(), &csi.DeleteSnapshotRequest{
 				SnapshotId: snapid,
@@ -89,6 +94,26 @@ func createVolumeWithSnapshot(t *testing.T, d *Driver) (string, *csi.Volume, *cs
 	return "", nil, nil, func() {}
 }
 
+func waitSnapshotReady(t *testing.T, d *Driver, snapid string) {
+	timeout := 30
+	for {
+		resp, err := d.ListSnapshots(getCtxt(), &csi.ListSnapshotsRequest{
+			SnapshotId: snapid,
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(resp.Entries) == 1 && resp.Entries[0].Snapshot.ReadyToUse {
+			return
+		}
+		if timeout == 0 {
+			t.Fatalf("Snapshot %s was not ready within timeout", snapid)
+		}
+		timeout--
+		time.Sleep(time.Second * 1)
+	}
+}
+
 func TestControllerCreateVolumeDeleteVolume(t *testing.T) {
 	d := getDriverController(t)
 	var id string
@@ -125,6 +150,35 @@ func TestControllerCreateVolumeDeleteVolume(t *testing.T) {
 	}
 }
 
+func TestControllerCreateVolumeFsParams(t *testing.T) {
+	d := getDriverController(t)
+	for _, params := range []map[string]string{
+		{"fs_type": "zfs"},
+		{"fs_type": "xfs", "fs_inode_ratio": "16384"},
+		{"fs_block_size": "3000"},
+		{"fs_reserved_percent": "five"},
+		{"mount_options": "noatime,ro"},
+	} {
+		params["replica_count"] = "1"
+		if _, err := d.CreateVolume(getCtxt(), &csi.CreateVolumeRequest{
+			Name: "csi-controller-test-" + dsdk.RandString(5),
+			VolumeCapabilities: []*csi.VolumeCapability{
+				&csi.VolumeCapability{
+					AccessType: &csi.VolumeCapability_Mount{
+						Mount: &csi.VolumeCapability_MountVolume{},
+					},
+					AccessMode: &csi.VolumeCapability_AccessMode{
+						Mode: csi.VolumeCapability_AccessMode_SINGLE_NODE_WRITER,
+					},
+				},
+			},
+			Parameters: params,
+		}); co.GetCode(err) != codes.InvalidArgument {
+			t.Fatalf("Expected InvalidArgument for %s, got %v", params, err)
+		}
+	}
+}
+
 func TestControllerCreateDeleteSnapshot(t *testing.T) {
 	d := getDriverController(t)
 	var snapid string
@@ -146,12 +200,42 @@ func TestControllerCreateDeleteSnapshot(t *testing.T) {
 	}
 }
 
+func TestControllerCreateSnapshotNameTaken(t *testing.T) {
+	d, fd := getDriverControllerFake(t)
+	id, _, cleanf := createVolume(t, d)
+	defer cleanf()
+	id2, _, cleanf2 := createVolume(t, d)
+	defer cleanf2()
+	req := &csi.CreateSnapshotRequest{
+		SourceVolumeId: id,
+		Name:           "csi-controller-snapshot-test-" + dsdk.RandString(5),
+	}
+	resp, err := d.CreateSnapshot(getCtxt(), req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer d.DeleteSnapshot(getCtxt(), &csi.DeleteSnapshotRequest{SnapshotId: resp.Snapshot.SnapshotId})
+	reqs := len(fd.Requests())
+	if resp, err = d.CreateSnapshot(getCtxt(), req); err != nil {
+		t.Fatalf("Expected a retry to succeed, got %v", err)
+	}
+	for _, r := range fd.Requests()[reqs:] {
+		if r == "GET /app_instances" {
+			t.Fatalf("Expected a retry not to list every volume, got %v", fd.Requests()[reqs:])
+		}
+	}
+	req.SourceVolumeId = id2
+	if _, err = d.CreateSnapshot(getCtxt(), req); co.GetCode(err) != codes.AlreadyExists {
+		t.Fatalf("Expected AlreadyExists for a name taken on another volume, got %v", err)
+	}
+}
+
 func TestControllerCreateVolSnapshotVolumeSource(t *testing.T) {
 	d := getDriverController(t)
-	snapid, _, _, cleanf := createVolumeWithSnapshot(t, d)
+	snapid, src, _, cleanf := createVolumeWithSnapshot(t, d)
 	defer cleanf()
 	var volid string
-	if resp, err := d.CreateVolume(getCtxt(), &csi.CreateVolumeRequest{
+	req := &csi.CreateVolumeRequest{
 		Name: "csi-controller-test-" + dsdk.RandString(5),
 		CapacityRange: &csi.CapacityRange{
 			RequiredBytes: 10737418240,
@@ -178,10 +262,100 @@ func TestControllerCreateVolSnapshotVolumeSource(t *testing.T) {
 				},
 			},
 		},
+	}
+	if resp, err := d.CreateVolume(getCtxt(), req); err != nil {
+		t.Fatal(err)
+	} else {
+		volid = resp.Volume.VolumeId
+	}
+
+	// Retries return the source, since the provisioner deletes restored
+	// volumes without one
+	if resp, err := d.CreateVolume(getCtxt(), req); err != nil {
+		t.Fatal(err)
+	} else if resp.Volume.ContentSource.GetSnapshot().GetSnapshotId() != snapid {
+		t.Fatalf("ContentSource did not match source snapshot: [%v != %s]", resp.Volume.ContentSource, snapid)
+	}
+	req.VolumeContentSource = &csi.VolumeContentSource{
+		Type: &csi.VolumeContentSource_Volume{
+			Volume: &csi.VolumeContentSource_VolumeSource{
+				VolumeId: src.VolumeId,
+			},
+		},
+	}
+	if _, err := d.CreateVolume(getCtxt(), req); co.GetCode(err) != codes.AlreadyExists {
+		t.Fatalf("Expected AlreadyExists for a different content source, got %v", err)
+	}
+
+	// Restores can't be smaller than the snapshot
+	req.Name = "csi-controller-test-" + dsdk.RandString(5)
+	req.CapacityRange = &csi.CapacityRange{
+		RequiredBytes: src.CapacityBytes - 5*units.GiB,
+	}
+	req.VolumeContentSource = &csi.VolumeContentSource{
+		Type: &csi.VolumeContentSource_Snapshot{
+			Snapshot: &csi.VolumeContentSource_SnapshotSource{
+				SnapshotId: snapid,
+			},
+		},
+	}
+	if _, err := d.CreateVolume(getCtxt(), req); co.GetCode(err) != codes.OutOfRange {
+		t.Fatalf("Expected OutOfRange for a restore smaller than its snapshot, got %v", err)
+	}
+
+	if _, err := d.DeleteVolume(getCtxt(), &csi.DeleteVolumeRequest{
+		VolumeId: volid,
+	}); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestControllerCreateVolVolumeSource(t *testing.T) {
+	d := getDriverController(t)
+	srcid, src, cleanf := createVolume(t, d)
+	defer cleanf()
+	var volid string
+	if resp, err := d.CreateVolume(getCtxt(), &csi.CreateVolumeRequest{
+		Name: "csi-controller-test-" + dsdk.RandString(5),
+		CapacityRange: &csi.CapacityRange{
+			RequiredBytes: src.CapacityBytes + 1*units.GiB,
+		},
+		VolumeCapabilities: []*csi.VolumeCapability{
+			&csi.VolumeCapability{
+				AccessType: &csi.VolumeCapability_Mount{
+					Mount: &csi.VolumeCapability_MountVolume{
+						FsType: "ext4",
+					},
+				},
+				AccessMode: &csi.VolumeCapability_AccessMode{
+					Mode: csi.VolumeCapability_AccessMode_SINGLE_NODE_WRITER,
+				},
+			},
+		},
+		Parameters: map[string]string{
+			"replica_count": "1",
+		},
+		VolumeContentSource: &csi.VolumeContentSource{
+			Type: &csi.VolumeContentSource_Volume{
+				Volume: &csi.VolumeContentSource_VolumeSource{
+					VolumeId: srcid,
+				},
+			},
+		},
 	}); err != nil {
 		t.Fatal(err)
 	} else {
 		volid = resp.Volume.VolumeId
+		if resp.Volume.ContentSource.GetVolume().GetVolumeId() != srcid {
+			t.Fatalf("ContentSource did not match source volume: [%s != %s]", resp.Volume.ContentSource.GetVolume().GetVolumeId(), srcid)
+		}
+		vol, err := d.dc.GetVolume(getCtxt(), volid, false, false)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if int64(vol.Size*units.GiB) != resp.Volume.CapacityBytes {
+			t.Fatalf("Clone was not resized to requested size: [%d != %d]", int64(vol.Size*units.GiB), resp.Volume.CapacityBytes)
+		}
 	}
 
 	if _, err := d.DeleteVolume(getCtxt(), &csi.DeleteVolumeRequest{
@@ -229,7 +403,7 @@ func TestControllerExpandVolumes(t *testing.T) {
 	}); err != nil {
 		t.Fatal(err)
 	} else {
-		vol, err := d.dc.GetVolume(vid, false, false)
+		vol, err := d.dc.GetVolume(getCtxt(), vid, false, false)
 		if err != nil {
 			t.Fatal(err)
 		}
@@ -238,4 +412,170 @@ func TestControllerExpandVolumes(t *testing.T) {
 			t.Fatalf("CapacityBytes did not match volume size: [%d != %d]", resp.CapacityBytes, vsize)
 		}
 	}
+
+	for _, req := range []*csi.ControllerExpandVolumeRequest{
+		{CapacityRange: &csi.CapacityRange{RequiredBytes: vol.CapacityBytes + 2*units.GiB}},
+		{VolumeId: vid},
+	} {
+		if _, err := d.ControllerExpandVolume(getCtxt(), req); co.GetCode(err) != codes.InvalidArgument {
+			t.Fatalf("Expected InvalidArgument for %v, got %s", req, err)
+		}
+	}
+}
+
+func TestControllerModifyVolume(t *testing.T) {
+	d := getDriverController(t)
+	vid, _, cleanf := createVolume(t, d)
+	defer cleanf()
+	if _, err := d.ControllerModifyVolume(getCtxt(), &csi.ControllerModifyVolumeRequest{
+		VolumeId: vid,
+		MutableParameters: map[string]string{
+			"total_iops_max":     "500",
+			"read_bandwidth_max": "1024",
+		},
+	}); err != nil {
+		t.Fatal(err)
+	}
+	// Parameters not in the request keep their previous value
+	if _, err := d.ControllerModifyVolume(getCtxt(), &csi.ControllerModifyVolumeRequest{
+		VolumeId:          vid,
+		MutableParameters: map[string]string{"write_iops_max": "200"},
+	}); err != nil {
+		t.Fatal(err)
+	}
+	vol, err := d.dc.GetVolume(getCtxt(), vid, true, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if vol.TotalIopsMax != 500 || vol.ReadBandwidthMax != 1024 || vol.WriteIopsMax != 200 {
+		t.Fatalf("Performance policy was not updated: %v", vol.QoS)
+	}
+	md, err := vol.GetMetadata(getCtxt())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if (*md)["total_iops_max"] != "500" || (*md)["write_iops_max"] != "200" {
+		t.Fatalf("Metadata was not updated: %v", *md)
+	}
+
+	for _, params := range []map[string]string{
+		{},
+		{"replica_count": "2"},
+		{"total_iops_max": "lots"},
+		{"total_iops_max": "-1"},
+	} {
+		if _, err = d.ControllerModifyVolume(getCtxt(), &csi.ControllerModifyVolumeRequest{
+			VolumeId:          vid,
+			MutableParameters: params,
+		}); co.GetCode(err) != codes.InvalidArgument {
+			t.Fatalf("Expected InvalidArgument for %v, got %s", params, err)
+		}
+	}
+	if _, err = d.ControllerModifyVolume(getCtxt(), &csi.ControllerModifyVolumeRequest{
+		VolumeId:          "csi-does-not-exist",
+		MutableParameters: map[string]string{"total_iops_max": "500"},
+	}); co.GetCode(err) != codes.NotFound {
+		t.Fatalf("Expected NotFound for a missing volume, got %s", err)
+	}
+}
+
+func TestControllerExpandVolumeDynamicQoS(t *testing.T) {
+	d := getDriverController(t)
+	resp, err := d.CreateVolume(getCtxt(), &csi.CreateVolumeRequest{
+		Name:          "csi-controller-test-" + dsdk.RandString(5),
+		CapacityRange: &csi.CapacityRange{RequiredBytes: 10 * units.GiB},
+		VolumeCapabilities: []*csi.VolumeCapability{
+			&csi.VolumeCapability{
+				AccessType: &csi.VolumeCapability_Mount{
+					Mount: &csi.VolumeCapability_MountVolume{},
+				},
+				AccessMode: &csi.VolumeCapability_AccessMode{
+					Mode: csi.VolumeCapability_AccessMode_SINGLE_NODE_WRITER,
+				},
+			},
+		},
+		Parameters: map[string]string{
+			"replica_count":  "1",
+			"iops_per_gb":    "10",
+			"total_iops_max": "250",
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	vid := resp.Volume.VolumeId
+	defer d.DeleteVolume(getCtxt(), &csi.DeleteVolumeRequest{VolumeId: vid})
+	for _, tc := range []struct {
+		size int64
+		iops int
+	}{
+		{20, 200},
+		// Capped by total_iops_max
+		{30, 250},
+	} {
+		if _, err = d.ControllerExpandVolume(getCtxt(), &csi.ControllerExpandVolumeRequest{
+			VolumeId:      vid,
+			CapacityRange: &csi.CapacityRange{RequiredBytes: tc.size * units.GiB},
+		}); err != nil {
+			t.Fatal(err)
+		}
+		vol, err := d.dc.GetVolume(getCtxt(), vid, true, false)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if vol.TotalIopsMax != tc.iops {
+			t.Fatalf("Expected total_iops_max %d at %d GiB, got %d", tc.iops, tc.size, vol.TotalIopsMax)
+		}
+	}
+}
+
+func TestControllerGetVolume(t *testing.T) {
+	d, fd := getDriverControllerFake(t)
+	vid, vol, cleanf := createVolume(t, d)
+	defer cleanf()
+	nodeId := co.MkNodeId("node-1", fake.DefaultIqn)
+	if _, err := d.ControllerPublishVolume(getCtxt(), &csi.ControllerPublishVolumeRequest{
+		VolumeId:         vid,
+		NodeId:           nodeId,
+		VolumeCapability: mountCapability("ext4"),
+	}); err != nil {
+		t.Fatal(err)
+	}
+	resp, err := d.ControllerGetVolume(getCtxt(), &csi.ControllerGetVolumeRequest{VolumeId: vid})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.Volume.CapacityBytes != vol.CapacityBytes {
+		t.Fatalf("Expected capacity %d, got %d", vol.CapacityBytes, resp.Volume.CapacityBytes)
+	}
+	if nodes := resp.Status.PublishedNodeIds; len(nodes) != 1 || nodes[0] != nodeId {
+		t.Fatalf("Expected volume to be published to %s, got %s", nodeId, nodes)
+	}
+	if cond := resp.Status.VolumeCondition; cond.Abnormal {
+		t.Fatalf("Expected a healthy volume, got %s", cond.Message)
+	}
+
+	fd.SetHealth(vid, "degraded")
+	if resp, err = d.ControllerGetVolume(getCtxt(), &csi.ControllerGetVolumeRequest{VolumeId: vid}); err != nil {
+		t.Fatal(err)
+	}
+	if cond := resp.Status.VolumeCondition; !cond.Abnormal || cond.Message != "volume health is degraded" {
+		t.Fatalf("Expected a degraded volume, got %v", cond)
+	}
+
+	if _, err = d.ControllerUnpublishVolume(getCtxt(), &csi.ControllerUnpublishVolumeRequest{
+		VolumeId: vid,
+		NodeId:   nodeId,
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if resp, err = d.ControllerGetVolume(getCtxt(), &csi.ControllerGetVolumeRequest{VolumeId: vid}); err != nil {
+		t.Fatal(err)
+	}
+	if nodes := resp.Status.PublishedNodeIds; len(nodes) != 0 {
+		t.Fatalf("Expected no published nodes after unpublish, got %s", nodes)
+	}
+	if _, err = d.ControllerGetVolume(getCtxt(), &csi.ControllerGetVolumeRequest{VolumeId: "csi-does-not-exist"}); co.GetCode(err) != codes.NotFound {
+		t.Fatalf("Expected NotFound for a missing volume, got %s", err)
+	}
 }
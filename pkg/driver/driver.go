@@ -3,13 +3,12 @@ package driver
 import (
 	"context"
 	"fmt"
-	"math"
 	"net"
+	"net/http"
 	"net/url"
 	"os"
 	"path"
 	"path/filepath"
-	"strconv"
 	"strings"
 	"time"
 
@@ -18,9 +17,12 @@ import (
 	csi "github.com/container-storage-interface/spec/lib/go/csi"
 	grpc "google.golang.org/grpc"
 	gmd "google.golang.org/grpc/metadata"
+	status "google.golang.org/grpc/status"
 
 	dc "github.com/Datera/datera-csi/pkg/client"
 	co "github.com/Datera/datera-csi/pkg/common"
+	host "github.com/Datera/datera-csi/pkg/host"
+	metrics "github.com/Datera/datera-csi/pkg/metrics"
 	udc "github.com/Datera/go-udc/pkg/udc"
 )
 
@@ -28,16 +30,28 @@ const (
 	driverNameDefault = "dsp.csi.daterainc.io"
 
 	// Environment Variables
-	EnvDriverName       = "DAT_DRIVER_NAME"
-	EnvHeartbeat        = "DAT_HEARTBEAT"
-	EnvType             = "DAT_TYPE"
-	EnvVolPerNode       = "DAT_VOL_PER_NODE"
-	EnvDisableMultipath = "DAT_DISABLE_MULTIPATH"
-	EnvReplicaOverride  = "DAT_REPLICA_OVERRIDE"
-	EnvMetadataDebug    = "DAT_METADATA_DEBUG"
-	EnvDisableLogPush   = "DAT_DISABLE_LOGPUSH"
-	EnvLogPushInterval  = "DAT_LOGPUSH_INTERVAL"
-	EnvFormatTimeout    = "DAT_FORMAT_TIMEOUT"
+	EnvDriverName         = "DAT_DRIVER_NAME"
+	EnvSocket             = "DAT_SOCKET"
+	EnvHeartbeat          = "DAT_HEARTBEAT"
+	EnvType               = "DAT_TYPE"
+	EnvVolPerNode         = "DAT_VOL_PER_NODE"
+	EnvDisableMultipath   = "DAT_DISABLE_MULTIPATH"
+	EnvReplicaOverride    = "DAT_REPLICA_OVERRIDE"
+	EnvMetadataDebug      = "DAT_METADATA_DEBUG"
+	EnvDisableLogPush     = "DAT_DISABLE_LOGPUSH"
+	EnvLogPushInterval    = "DAT_LOGPUSH_INTERVAL"
+	EnvFormatTimeout      = "DAT_FORMAT_TIMEOUT"
+	EnvTopologyZone       = "DAT_TOPOLOGY_ZONE"
+	EnvTopologyMap        = "DAT_TOPOLOGY_MAP"
+	EnvTenantMap          = "DAT_TENANT_MAP"
+	EnvMetricsAddress     = "DAT_METRICS_ADDRESS"
+	EnvReconcileInterval  = "DAT_RECONCILE_INTERVAL"
+	EnvReconcileDryRun    = "DAT_RECONCILE_DRY_RUN"
+	EnvKubeletDir         = "DAT_KUBELET_DIR"
+	EnvStateDir           = "DAT_STATE_DIR"
+	EnvFsckOnStage        = "DAT_FSCK_ON_STAGE"
+	EnvStrictParams       = "DAT_STRICT_PARAMS"
+	EnvVolumeNameTemplate = "DAT_VOLUME_NAME_TEMPLATE"
 
 	IdentityType = iota + 1
 	ControllerType
@@ -64,97 +78,11 @@ var (
 		ControllerIdentityType: "controller",
 		AllType:                "controller",
 	}
-	Version          = "No Version Provided"
-	Githash          = "No Githash Provided"
-	SdkVersion       = "No SdkVersion Provided"
-	SupportedFsTypes = map[string]struct{}{
-		co.Ext4: struct{}{},
-		co.Xfs:  struct{}{},
-	}
-	DefaultFsArgs = map[string][]string{
-		co.Ext4: strings.Split("-E lazy_itable_init=0,lazy_journal_init=0,nodiscard -F", " "),
-		co.Xfs:  []string{},
-	}
+	Version    = "No Version Provided"
+	Githash    = "No Githash Provided"
+	SdkVersion = "No SdkVersion Provided"
 )
 
-type EnvVars struct {
-	DriverName       string
-	Type             int
-	VolPerNode       int
-	DisableMultipath bool
-	ReplicaOverride  bool
-	Heartbeat        int
-	MetadataDebug    bool
-	LogPush          bool
-	LogPushInterval  int
-	FormatTimeout    int
-}
-
-func readEnvVars() *EnvVars {
-	var name string
-	if name = os.Getenv(EnvDriverName); name == "" {
-		name = driverNameDefault
-	}
-	vpn, err := strconv.ParseInt(os.Getenv(EnvVolPerNode), 0, 0)
-	if err != nil {
-		vpn = int64(256)
-	}
-	var dm bool
-	if d := os.Getenv(EnvDisableMultipath); d != "" {
-		dm = true
-	}
-	var ro bool
-	if d := os.Getenv(EnvReplicaOverride); d != "" {
-		ro = true
-	}
-	hb64, err := strconv.ParseInt(os.Getenv(EnvHeartbeat), 0, 0)
-	if err != nil {
-		hb64 = int64(60)
-	}
-	var mdd bool
-	if d := os.Getenv(EnvDisableMultipath); d != "" {
-		mdd = true
-	}
-	lp := true
-	if d := os.Getenv(EnvDisableLogPush); d != "" && d != "false" {
-		lp = false
-	}
-	lpi, err := strconv.ParseInt(os.Getenv(EnvLogPushInterval), 0, 0)
-	if err != nil {
-		// Default is to run logpusher every 2 hours
-		lpi = int64((time.Hour * 2) / time.Second)
-	}
-	ft, err := strconv.ParseInt(os.Getenv(EnvFormatTimeout), 0, 0)
-	if err != nil {
-		ft = int64(60)
-	}
-	return &EnvVars{
-		VolPerNode:       int(vpn),
-		DisableMultipath: dm,
-		ReplicaOverride:  ro,
-		DriverName:       name,
-		Type:             StrToType[os.Getenv(EnvType)],
-		Heartbeat:        int(hb64),
-		MetadataDebug:    mdd,
-		LogPush:          lp,
-		LogPushInterval:  int(lpi),
-		FormatTimeout:    int(ft),
-	}
-}
-
-func isSupportedFs(fs string) bool {
-	_, ok := SupportedFsTypes[fs]
-	return ok
-}
-
-func supportedFsTypes() []string {
-	types := []string{}
-	for k := range SupportedFsTypes {
-		types = append(types, k)
-	}
-	return types
-}
-
 // Driver is a single-binary implementation of:
 //   * csi.ControllerServer
 //   * csi.IdentityServer
@@ -162,12 +90,15 @@ func supportedFsTypes() []string {
 type Driver struct {
 	gs            *grpc.Server
 	dc            *dc.DateraClient
-	env           *EnvVars
+	host          host.Host
+	conf          *Config
 	nid           string
 	healthy       bool
 	vendorVersion string
 	manifest      *dc.Manifest
-	rpcStatus     map[string]struct{}
+	locks         *OpLocks
+	topology      TopologyMap
+	state         *StateStore
 
 	sock    string
 	name    string
@@ -175,29 +106,59 @@ type Driver struct {
 }
 
 func NewDateraDriver(udc *udc.UDC) (*Driver, error) {
-	env := readEnvVars()
+	return NewDateraDriverWithHTTPClient(udc, nil)
+}
+
+// Same as NewDateraDriver, but all Datera API requests are sent through the
+// provided http.Client
+func NewDateraDriverWithHTTPClient(udc *udc.UDC, httpClient *http.Client) (*Driver, error) {
+	return NewDateraDriverWithHost(udc, httpClient, host.NewHost())
+}
+
+// Same as NewDateraDriverWithHTTPClient, but all node operations (iSCSI
+// logins, formatting, mounting) are performed through the provided Host
+func NewDateraDriverWithHost(udc *udc.UDC, httpClient *http.Client, h host.Host) (*Driver, error) {
+	conf, err := LoadConfig("")
+	if err != nil {
+		return nil, err
+	}
+	conf.Backend = udc
+	return NewDateraDriverWithConfig(conf, httpClient, h)
+}
+
+// Creates a driver from a loaded Config, see LoadConfig.  conf.Backend must
+// be set
+func NewDateraDriverWithConfig(conf *Config, httpClient *http.Client, h host.Host) (*Driver, error) {
 	v := fmt.Sprintf("datera-csi-%s-%s-gosdk-%s", Version, Githash, SdkVersion)
-	client, err := dc.NewDateraClient(udc, false, v)
+	client, err := dc.NewDateraClientWithHTTPClient(conf.Backend, false, v, httpClient)
 	if err != nil {
 		return nil, err
 	}
-	dc.MetadataDebug = env.MetadataDebug
-	t := TypeToSock[env.Type]
-	sock := fmt.Sprintf("unix:///var/lib/kubelet/plugins/%s/%s.sock", env.DriverName, t)
+	client.SetHost(h)
+	dc.MetadataDebug = conf.MetadataDebug
+	t := TypeToSock[conf.Type]
+	sock := fmt.Sprintf("unix:///var/lib/kubelet/plugins/%s/%s.sock", conf.DriverName, t)
+	if conf.Socket != "" {
+		sock = conf.Socket
+	}
 	return &Driver{
-		dc:        client,
-		name:      env.DriverName,
-		sock:      sock,
-		env:       env,
-		nid:       co.GetHost(),
-		version:   Version,
-		rpcStatus: map[string]struct{}{},
+		dc:       client,
+		host:     h,
+		name:     conf.DriverName,
+		sock:     sock,
+		conf:     conf,
+		nid:      co.GetHost(),
+		version:  Version,
+		locks:    NewOpLocks(),
+		topology: conf.TopologyMap,
+		state:    NewStateStore(conf.StateDir, co.GetHost()),
 	}, nil
 }
 
 func (d *Driver) Run() error {
 	ctxt := co.WithCtxt(context.Background(), "Run", "")
 	co.Infof(ctxt, "Starting CSI driver\n")
+	co.Infof(ctxt, "Effective configuration: %s", d.conf)
 
 	co.Infof(ctxt, "Parsing socket: %s\n", d.sock)
 	u, err := url.Parse(d.sock)
@@ -231,21 +192,27 @@ func (d *Driver) Run() error {
 		return err
 	}
 	d.gs = grpc.NewServer(grpc.UnaryInterceptor(logServerAndSetId))
-	if d.env.Type == ControllerType || d.env.Type == ControllerIdentityType || d.env.Type == AllType {
+	if d.conf.Type == ControllerType || d.conf.Type == ControllerIdentityType || d.conf.Type == AllType {
 		co.Info(ctxt, "Starting 'controller' service\n")
 		csi.RegisterControllerServer(d.gs, d)
 	}
-	if d.env.Type == IdentityType || d.env.Type == NodeIdentityType || d.env.Type == ControllerIdentityType || d.env.Type == AllType {
+	if d.conf.Type == IdentityType || d.conf.Type == NodeIdentityType || d.conf.Type == ControllerIdentityType || d.conf.Type == AllType {
 		co.Info(ctxt, "Starting 'identity' service\n")
 		csi.RegisterIdentityServer(d.gs, d)
 	}
-	if d.env.Type == NodeType || d.env.Type == NodeIdentityType || d.env.Type == AllType {
+	if d.conf.Type == NodeType || d.conf.Type == NodeIdentityType || d.conf.Type == AllType {
 		co.Info(ctxt, "Starting 'node' service\n")
 		csi.RegisterNodeServer(d.gs, d)
 	}
 	co.Infof(ctxt, "Datera CSI Driver Serving On Socket: %s\n", addr)
+	if d.conf.MetricsAddress != "" {
+		go d.ServeMetrics()
+	}
 	go d.Heartbeater()
-	if d.env.LogPush {
+	if d.conf.Type == NodeType || d.conf.Type == NodeIdentityType || d.conf.Type == AllType {
+		go d.Reconciler()
+	}
+	if d.conf.LogPush && d.conf.HasCredentials() {
 		go d.LogPusher()
 	}
 	return d.gs.Serve(listener)
@@ -259,29 +226,50 @@ func (d *Driver) Stop() {
 
 func (d *Driver) Heartbeater() {
 	ctxt := co.WithCtxt(context.Background(), "Heartbeat", "")
-	co.Infof(ctxt, "Starting heartbeat service. Interval: %d", d.env.Heartbeat)
-        if d.env.Type == NodeType || d.env.Type == NodeIdentityType || d.env.Type == AllType {
-                d.healthy = true
-                return
-        }
-	t := d.env.Heartbeat
+	co.Infof(ctxt, "Starting heartbeat service. Interval: %d", d.conf.Heartbeat)
+	if d.conf.Type == NodeType || d.conf.Type == NodeIdentityType || d.conf.Type == AllType {
+		d.healthy = true
+		metrics.SetHealthy(d.healthy)
+		return
+	}
+	t := d.conf.Heartbeat
 	for {
+		if ops := d.InFlightOperations(); len(ops) > 0 {
+			co.Debugf(ctxt, "In-flight operations: %s", ops)
+		}
 		if mf, err := d.dc.HealthCheck(ctxt); err != nil {
 			d.healthy = false
-			d.manifest = mf
-			d.vendorVersion = mf.BuildVersion
 			co.Errorf(ctxt, "Heartbeat failure: %s\n", err)
 		} else {
 			d.healthy = true
+			d.manifest = mf
+			d.vendorVersion = mf.BuildVersion
+			// Keeps the capacity gauges current between GetCapacity calls
+			if _, err = d.dc.GetCapacity(ctxt); err != nil {
+				co.Warningf(ctxt, "Could not refresh capacity: %s", err)
+			}
 		}
+		metrics.SetHealthy(d.healthy)
 		Sleeper(t)
 	}
 }
 
+// Serves Prometheus metrics over HTTP on the configured metrics address.  A
+// failure here is logged but doesn't take down the CSI services
+func (d *Driver) ServeMetrics() {
+	ctxt := co.WithCtxt(context.Background(), "ServeMetrics", "")
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", metrics.Handler())
+	co.Infof(ctxt, "Serving metrics on %s/metrics", d.conf.MetricsAddress)
+	if err := http.ListenAndServe(d.conf.MetricsAddress, mux); err != nil {
+		co.Errorf(ctxt, "Metrics listener failure: %s", err)
+	}
+}
+
 func (d *Driver) LogPusher() {
 	ctxt := co.WithCtxt(context.Background(), "LogPusher", "")
-	co.Infof(ctxt, "Starting LogPusher service. Interval: %d", d.env.LogPushInterval)
-	t := d.env.LogPushInterval
+	co.Infof(ctxt, "Starting LogPusher service. Interval: %d", d.conf.LogPushInterval)
+	t := d.conf.LogPushInterval
 	// Give the driver a chance to start before doing first log collect
 	Sleeper(10)
 	for {
@@ -299,47 +287,38 @@ func logServerAndSetId(ctx context.Context, req interface{}, info *grpc.UnarySer
 	co.Infof(ctxt, "GRPC -- request: %s -- %s -- %+v\n", info.FullMethod, id, protosanitizer.StripSecrets(req))
 	ts1 := time.Now()
 	resp, err := handler(ctxt, req)
-	ts2 := time.Now()
-	td := math.Round(float64(ts2.Sub(ts1) / time.Second))
-	co.Infof(ctxt, "GRPC -- response: %s -- %s %fs -- %+v\n", info.FullMethod, id, td, protosanitizer.StripSecrets(resp))
+	td := time.Since(ts1)
+	metrics.ObserveRPC(info.FullMethod, status.Code(err), td)
+	co.Infof(ctxt, "GRPC -- response: %s -- %s %fs -- %+v\n", info.FullMethod, id, td.Seconds(), protosanitizer.StripSecrets(resp))
 	if err != nil {
 		co.Errorf(ctxt, "GRPC -- error: %s -- %s -- %+v\n", info.FullMethod, id, err)
 	}
 	return resp, err
 }
 
-func (d *Driver) InitFunc(ctx context.Context, piece, funcName string, req interface{}) (context.Context, bool, func()) {
+func (d *Driver) InitFunc(ctx context.Context, piece, funcName string, req interface{}) context.Context {
 	id := ctx.Value(co.TraceId).(string)
-	// Sets trace id in driver
+	// Keeps the trace id set by logServerAndSetId.  ctx is the gRPC request
+	// context, so its deadline and cancellation carry through to every client
+	// call made with the returned context
 	ctxt := co.WithCtxt(ctx, fmt.Sprintf("%s.%s", piece, funcName), id)
-	// Sets trace id in client
-	ctxt = d.dc.WithContext(ctxt)
 	// We're not going to log the identity calls because they're really verbose with the
 	// liveness probe sidecar
 	if piece != "identity" {
 		co.Infof(ctxt, "%s service '%s' called\n", piece, funcName)
 		co.Debugf(ctxt, "%s: %+v\n", funcName, req)
 	}
-	// Kubernetes multi-call stupidity rectifier
-	// K8s will often call a long running function many times with the same arguments before the first one completes
-	// This creates a key with the function name and arguments, stores that in a map and only allows execution
-	// if the previous function is complete (and thus removed from the map).  This doesn't actually enforce anything,
-	// just returns a boolean and a cleaner function to clean the map when execution is done.  Enforcement is
-	// performed in the caller
-	//
-	// map[string]struct{} is just a workaround for Golang's lack of a native set datatype
-	key := strings.Join([]string{piece, funcName, fmt.Sprintf("%+v", req)}, "|")
-	inProgress := false
-	cleaner := func() {}
-	if _, ok := d.rpcStatus[key]; ok {
-		inProgress = true
-	} else {
-		d.rpcStatus[key] = struct{}{}
-		cleaner = func() {
-			delete(d.rpcStatus, key)
-		}
-	}
-	return ctxt, inProgress, cleaner
+	return ctxt
+}
+
+// Takes the operation lock for a volume or snapshot, see OpLocks
+func (d *Driver) lock(ctxt context.Context, resource, name string) (func(), error) {
+	return d.locks.Acquire(ctxt, resource, name)
+}
+
+// Returns the operations currently running or waiting on a volume or snapshot
+func (d *Driver) InFlightOperations() []Operation {
+	return d.locks.InFlight()
 }
 
 func RegisterVolumeCapability(ctxt context.Context, md *dc.VolMetadata, vc *csi.VolumeCapability) error {
@@ -366,17 +345,20 @@ func RegisterVolumeCapability(ctxt context.Context, md *dc.VolMetadata, vc *csi.
 	case *csi.VolumeCapability_Mount:
 		at = "mount"
 		fs = vc.GetMount().FsType
+		if fs == "" {
+			// Keep the filesystem chosen when the volume was created
+			fs = (*md)["fs_type"]
+		}
 		if fs == "" {
 			co.Debug(ctxt, "No filesystem type specified, defaulting to ext4")
 			fs = co.Ext4
 		}
-		if !isSupportedFs(fs) {
-			err := fmt.Errorf("Unsupported filesystem type: %s, supported types :re %s", fs, supportedFsTypes())
+		if _, err := dc.GetFilesystem(fs); err != nil {
 			co.Error(ctxt, err)
 			return err
 		}
 		co.Debugf(ctxt, "Registering Filesystem %s", fs)
-		mountArgs = strings.Join(vc.GetMount().MountFlags, "")
+		mountArgs = strings.Join(vc.GetMount().MountFlags, ",")
 		co.Debugf(ctxt, "Registering MountFlags %s", mountArgs)
 	default:
 		return fmt.Errorf("Unsupported VolumeCapability: %s.  Supported capabilities are Mount and Block", fs)
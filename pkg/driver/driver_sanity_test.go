@@ -1,46 +1,62 @@
 package driver
 
 import (
+	"flag"
 	"os"
+	"strings"
 	"testing"
 
 	sanity "github.com/kubernetes-csi/csi-test/pkg/sanity"
 
-	udc "github.com/Datera/go-udc/pkg/udc"
+	fake "github.com/Datera/datera-csi/pkg/fake"
 )
 
 const (
 	Endpoint = "unix:///tmp/test-csi.sock"
 )
 
+var sanitySkip = []string{
+	// csi-test v1.1.1 predates the VolumeExpansion plugin, EXPAND_VOLUME node
+	// and MODIFY_VOLUME controller capabilities
+	"GetPluginCapabilities should return appropriate capabilities",
+	"ControllerGetCapabilities should return appropriate capabilities",
+	"NodeGetCapabilities should return appropriate capabilities",
+}
+
 func getDriver(t *testing.T) *Driver {
-	conf, err := udc.GetConfig()
-	if err != nil {
-		t.Fatal(err)
-	}
-	if err = os.Setenv(EnvSocket, Endpoint); err != nil {
-		t.Fatal(err)
-	}
-	if err = os.Setenv(EnvType, "all"); err != nil {
-		t.Fatal(err)
+	for k, v := range map[string]string{
+		EnvSocket:         Endpoint,
+		EnvType:           "all",
+		EnvDisableLogPush: "true",
+		EnvTopologyZone:   "sanity",
+	} {
+		if err := os.Setenv(k, v); err != nil {
+			t.Fatal(err)
+		}
 	}
-	d, err := NewDateraDriver(conf)
+	fd := fake.NewDatera()
+	d, err := NewDateraDriverWithHost(fd.UDC(), fd.HTTPClient(), fake.NewHost())
 	if err != nil {
 		t.Fatal(err)
 	}
+	d.state = getStateStore(t)
 	return d
 }
 
 func TestDriverSanity(t *testing.T) {
+	d := getDriver(t)
 	go func() {
-		d := getDriver(t)
 		if err := d.Run(); err != nil {
-			t.Fatal(err)
+			t.Error(err)
 		}
 	}()
+	defer d.Stop()
+	if err := flag.Set("ginkgo.skip", strings.Join(sanitySkip, "|")); err != nil {
+		t.Fatal(err)
+	}
 	sc := &sanity.Config{
-		TargetPath:  "/mnt/my-publish",
-		StagingPath: "/mnt/my-staging",
+		TargetPath:  "/tmp/csi-sanity-publish",
+		StagingPath: "/tmp/csi-sanity-staging",
 		Address:     Endpoint,
 	}
 	sanity.Test(t, sc)
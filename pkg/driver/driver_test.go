@@ -0,0 +1,55 @@
+package driver
+
+import (
+	"context"
+	"io/ioutil"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	csi "github.com/container-storage-interface/spec/lib/go/csi"
+	grpc "google.golang.org/grpc"
+
+	metrics "github.com/Datera/datera-csi/pkg/metrics"
+)
+
+func scrapeMetrics(t *testing.T) string {
+	srv := httptest.NewServer(metrics.Handler())
+	defer srv.Close()
+	resp, err := srv.Client().Get(srv.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	b, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(b)
+}
+
+func TestRPCMetrics(t *testing.T) {
+	d := getDriverController(t)
+	info := &grpc.UnaryServerInfo{FullMethod: "/csi.v1.Controller/TestRPCMetrics"}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return d.ControllerPublishVolume(ctx, req.(*csi.ControllerPublishVolumeRequest))
+	}
+	if _, err := logServerAndSetId(context.Background(), &csi.ControllerPublishVolumeRequest{}, info, handler); err == nil {
+		t.Fatal("Expected ControllerPublishVolume to fail without a VolumeId")
+	}
+	id, _, cleanf := createVolume(t, d)
+	defer cleanf()
+	if _, err := d.ListVolumes(getCtxt(), &csi.ListVolumesRequest{}); err != nil {
+		t.Fatal(err)
+	}
+	out := scrapeMetrics(t)
+	for _, line := range []string{
+		`datera_csi_rpc_requests_total{code="InvalidArgument",method="/csi.v1.Controller/TestRPCMetrics"} 1`,
+		`datera_csi_backend_request_duration_seconds_count{method="POST",operation="CreateVolume"}`,
+		`datera_csi_backend_request_duration_seconds_count{method="GET",operation="ListVolumes"}`,
+	} {
+		if !strings.Contains(out, line) {
+			t.Fatalf("Expected %s in metrics for volume %s:\n%s", line, id, out)
+		}
+	}
+}
@@ -0,0 +1,159 @@
+package driver
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+
+	codes "google.golang.org/grpc/codes"
+	status "google.golang.org/grpc/status"
+
+	co "github.com/Datera/datera-csi/pkg/common"
+)
+
+// Operation is a request that holds, or is waiting on, the lock for a volume
+// or snapshot
+type Operation struct {
+	Resource string
+	Name     string
+	TraceId  string
+	Started  time.Time
+	Waiting  bool
+}
+
+func (op Operation) String() string {
+	state := "running"
+	if op.Waiting {
+		state = "waiting"
+	}
+	return fmt.Sprintf("%s on %s (%s for %s, trace %s)", op.Name, op.Resource, state, time.Since(op.Started).Round(time.Millisecond), op.TraceId)
+}
+
+type resourceLock struct {
+	holder  *Operation
+	waiters []*Operation
+	// Closed when the current holder releases the lock
+	done chan struct{}
+}
+
+func (rl *resourceLock) has(name string) bool {
+	if rl.holder != nil && rl.holder.Name == name {
+		return true
+	}
+	for _, w := range rl.waiters {
+		if w.Name == name {
+			return true
+		}
+	}
+	return false
+}
+
+func (rl *resourceLock) removeWaiter(op *Operation) {
+	for i, w := range rl.waiters {
+		if w == op {
+			rl.waiters = append(rl.waiters[:i], rl.waiters[i+1:]...)
+			return
+		}
+	}
+}
+
+// OpLocks serializes operations on the same volume or snapshot.
+//
+// Kubernetes will often call a long running function many times with the same
+// arguments before the first one completes.  An operation with the same name
+// as one already running or waiting on a resource is a duplicate and is
+// rejected with codes.Aborted so the caller retries later.  Operations with a
+// different name (eg: DeleteVolume while CreateSnapshot is running on the same
+// volume) wait for the resource to be released, or for ctxt to be done
+type OpLocks struct {
+	m     *sync.Mutex
+	locks map[string]*resourceLock
+}
+
+func NewOpLocks() *OpLocks {
+	return &OpLocks{
+		m:     &sync.Mutex{},
+		locks: map[string]*resourceLock{},
+	}
+}
+
+// Acquire takes the lock for resource on behalf of the operation name.  Names
+// should include whatever distinguishes two legitimate concurrent calls, eg:
+// the target path for NodePublishVolume.  The returned function releases the
+// lock and must always be called
+func (l *OpLocks) Acquire(ctxt context.Context, resource, name string) (func(), error) {
+	tid, _ := ctxt.Value(co.TraceId).(string)
+	op := &Operation{
+		Resource: resource,
+		Name:     name,
+		TraceId:  tid,
+		Started:  time.Now(),
+		Waiting:  true,
+	}
+	l.m.Lock()
+	rl, ok := l.locks[resource]
+	if !ok {
+		rl = &resourceLock{}
+		l.locks[resource] = rl
+	}
+	if rl.has(name) {
+		l.m.Unlock()
+		return nil, status.Errorf(codes.Aborted, "An operation %s is already in progress for %s", name, resource)
+	}
+	rl.waiters = append(rl.waiters, op)
+	for rl.holder != nil {
+		holder, done := *rl.holder, rl.done
+		l.m.Unlock()
+		co.Infof(ctxt, "%s on %s waiting for %s", name, resource, holder)
+		select {
+		case <-done:
+		case <-ctxt.Done():
+			l.m.Lock()
+			rl.removeWaiter(op)
+			l.cleanup(resource, rl)
+			l.m.Unlock()
+			return nil, status.Errorf(codes.Aborted, "%s on %s gave up waiting for %s: %s", name, resource, holder.Name, ctxt.Err())
+		}
+		l.m.Lock()
+	}
+	rl.removeWaiter(op)
+	op.Waiting = false
+	rl.holder = op
+	rl.done = make(chan struct{})
+	l.m.Unlock()
+	return func() {
+		l.m.Lock()
+		defer l.m.Unlock()
+		rl.holder = nil
+		close(rl.done)
+		l.cleanup(resource, rl)
+	}, nil
+}
+
+func (l *OpLocks) cleanup(resource string, rl *resourceLock) {
+	if rl.holder == nil && len(rl.waiters) == 0 {
+		delete(l.locks, resource)
+	}
+}
+
+// InFlight returns every operation currently holding or waiting on a lock,
+// oldest first
+func (l *OpLocks) InFlight() []Operation {
+	l.m.Lock()
+	defer l.m.Unlock()
+	ops := []Operation{}
+	for _, rl := range l.locks {
+		if rl.holder != nil {
+			ops = append(ops, *rl.holder)
+		}
+		for _, w := range rl.waiters {
+			ops = append(ops, *w)
+		}
+	}
+	sort.Slice(ops, func(i, j int) bool {
+		return ops[i].Started.Before(ops[j].Started)
+	})
+	return ops
+}
@@ -0,0 +1,152 @@
+package driver
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+
+	csi "github.com/container-storage-interface/spec/lib/go/csi"
+	codes "google.golang.org/grpc/codes"
+
+	co "github.com/Datera/datera-csi/pkg/common"
+)
+
+func getLockCtxt() context.Context {
+	return co.WithCtxt(context.Background(), "locks-test", "")
+}
+
+func TestOpLocksDuplicate(t *testing.T) {
+	l := NewOpLocks()
+	release, err := l.Acquire(getLockCtxt(), "vol-1", "DeleteVolume")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = l.Acquire(getLockCtxt(), "vol-1", "DeleteVolume"); co.GetCode(err) != codes.Aborted {
+		t.Fatalf("Expected Aborted for a duplicate operation, got %s", err)
+	}
+	// Other resources are unaffected
+	release2, err := l.Acquire(getLockCtxt(), "vol-2", "DeleteVolume")
+	if err != nil {
+		t.Fatal(err)
+	}
+	release2()
+	release()
+	if ops := l.InFlight(); len(ops) != 0 {
+		t.Fatalf("Expected no in-flight operations, got %s", ops)
+	}
+	release, err = l.Acquire(getLockCtxt(), "vol-1", "DeleteVolume")
+	if err != nil {
+		t.Fatal(err)
+	}
+	release()
+}
+
+func TestOpLocksSerialized(t *testing.T) {
+	l := NewOpLocks()
+	release, err := l.Acquire(getLockCtxt(), "vol-1", "CreateSnapshot:snap-1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	acquired := make(chan struct{})
+	go func() {
+		r, err := l.Acquire(getLockCtxt(), "vol-1", "DeleteVolume")
+		if err != nil {
+			t.Error(err)
+			close(acquired)
+			return
+		}
+		close(acquired)
+		r()
+	}()
+	// Wait for DeleteVolume to queue up behind CreateSnapshot
+	for {
+		if ops := l.InFlight(); len(ops) == 2 {
+			if ops[0].Waiting || !ops[1].Waiting || ops[1].Name != "DeleteVolume" {
+				t.Fatalf("Unexpected in-flight operations: %s", ops)
+			}
+			break
+		}
+		time.Sleep(time.Millisecond)
+	}
+	// A retry of the waiting operation is a duplicate too
+	if _, err = l.Acquire(getLockCtxt(), "vol-1", "DeleteVolume"); co.GetCode(err) != codes.Aborted {
+		t.Fatalf("Expected Aborted for a duplicate of a waiting operation, got %s", err)
+	}
+	select {
+	case <-acquired:
+		t.Fatal("DeleteVolume acquired the lock while CreateSnapshot held it")
+	case <-time.After(20 * time.Millisecond):
+	}
+	release()
+	select {
+	case <-acquired:
+	case <-time.After(time.Second):
+		t.Fatal("DeleteVolume did not acquire the lock after CreateSnapshot released it")
+	}
+}
+
+func TestOpLocksWaitCancelled(t *testing.T) {
+	l := NewOpLocks()
+	release, err := l.Acquire(getLockCtxt(), "vol-1", "NodeStageVolume:/staging")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer release()
+	ctxt, cancel := context.WithTimeout(getLockCtxt(), 10*time.Millisecond)
+	defer cancel()
+	if _, err = l.Acquire(ctxt, "vol-1", "NodeUnstageVolume:/staging"); co.GetCode(err) != codes.Aborted {
+		t.Fatalf("Expected Aborted once the wait was cancelled, got %s", err)
+	}
+	if ops := l.InFlight(); len(ops) != 1 {
+		t.Fatalf("Cancelled waiter still in-flight: %s", ops)
+	}
+}
+
+func TestOpLocksConcurrent(t *testing.T) {
+	l := NewOpLocks()
+	wg := &sync.WaitGroup{}
+	m := &sync.Mutex{}
+	running := 0
+	for _, name := range []string{"CreateSnapshot:a", "CreateSnapshot:b", "ControllerExpandVolume", "DeleteVolume"} {
+		wg.Add(1)
+		go func(name string) {
+			defer wg.Done()
+			release, err := l.Acquire(getLockCtxt(), "vol-1", name)
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			m.Lock()
+			running++
+			if running > 1 {
+				t.Errorf("%s running concurrently with another operation", name)
+			}
+			m.Unlock()
+			time.Sleep(time.Millisecond)
+			m.Lock()
+			running--
+			m.Unlock()
+			release()
+		}(name)
+	}
+	wg.Wait()
+}
+
+func TestDriverDuplicateOperation(t *testing.T) {
+	d := getDriverController(t)
+	id, _, cleanf := createVolume(t, d)
+	defer cleanf()
+	release, err := d.lock(getLockCtxt(), id, "ControllerExpandVolume")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer release()
+	_, err = d.ControllerExpandVolume(getCtxt(), &csi.ControllerExpandVolumeRequest{
+		VolumeId:      id,
+		CapacityRange: &csi.CapacityRange{RequiredBytes: 20 * 1024 * 1024 * 1024},
+	})
+	if co.GetCode(err) != codes.Aborted {
+		t.Fatalf("Expected Aborted while the volume is being expanded, got %s", err)
+	}
+}
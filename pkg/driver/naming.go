@@ -0,0 +1,129 @@
+package driver
+
+import (
+	"context"
+	"fmt"
+	"regexp"
+	"strings"
+
+	dc "github.com/Datera/datera-csi/pkg/client"
+	co "github.com/Datera/datera-csi/pkg/common"
+)
+
+// Parameters csi-provisioner adds with --extra-create-metadata
+const (
+	ParamPvcName      = "csi.storage.k8s.io/pvc/name"
+	ParamPvcNamespace = "csi.storage.k8s.io/pvc/namespace"
+	ParamPvName       = "csi.storage.k8s.io/pv/name"
+)
+
+var (
+	namePlaceholder = regexp.MustCompile(`\{[^}]*\}`)
+	// App instance names are kept to what the Datera UI and API handle
+	// everywhere
+	invalidNameChars = regexp.MustCompile(`[^A-Za-z0-9_.-]+`)
+)
+
+// pvcInfo is the Kubernetes identity of a volume being created
+type pvcInfo struct {
+	Name      string
+	Namespace string
+	PvName    string
+}
+
+// Splits the PVC and PV identity out of CreateVolume parameters.  The
+// returned parameters are a copy without those keys
+func extractPvcInfo(params map[string]string) (*pvcInfo, map[string]string) {
+	info := &pvcInfo{
+		Name:      params[ParamPvcName],
+		Namespace: params[ParamPvcNamespace],
+		PvName:    params[ParamPvName],
+	}
+	rest := make(map[string]string, len(params))
+	for k, v := range params {
+		switch k {
+		case ParamPvcName, ParamPvcNamespace, ParamPvName:
+		default:
+			rest[k] = v
+		}
+	}
+	return info, rest
+}
+
+// Records the identity as app instance metadata, so volumes can be looked up
+// by PVC
+func (p *pvcInfo) register(md *dc.VolMetadata) {
+	for k, v := range map[string]string{
+		"pvc_name":      p.Name,
+		"pvc_namespace": p.Namespace,
+		"pv_name":       p.PvName,
+	} {
+		if v != "" {
+			(*md)[k] = v
+		}
+	}
+}
+
+// Description of the app instance shown in the Datera UI
+func (p *pvcInfo) descr() string {
+	if p.Name == "" {
+		return ""
+	}
+	d := fmt.Sprintf("Kubernetes PVC %s/%s", p.Namespace, p.Name)
+	if p.PvName != "" {
+		d += fmt.Sprintf(" (PV %s)", p.PvName)
+	}
+	return d
+}
+
+func (p *pvcInfo) placeholders(reqName string) map[string]string {
+	pv := p.PvName
+	if pv == "" {
+		pv = reqName
+	}
+	return map[string]string{
+		"{pvc}":       p.Name,
+		"{namespace}": p.Namespace,
+		"{pv}":        pv,
+	}
+}
+
+// Checks that tmpl only uses known placeholders
+func validateNameTemplate(tmpl string) error {
+	if tmpl == "" {
+		return nil
+	}
+	known := (&pvcInfo{}).placeholders("")
+	found := namePlaceholder.FindAllString(tmpl, -1)
+	if len(found) == 0 {
+		return fmt.Errorf("Name template %q has no placeholders, every volume would get the same name", tmpl)
+	}
+	for _, ph := range found {
+		if _, ok := known[ph]; !ok {
+			return fmt.Errorf("Unknown placeholder %s in name template %q, supported placeholders are {namespace}, {pvc} and {pv}", ph, tmpl)
+		}
+	}
+	return nil
+}
+
+// Returns the app instance name for a new volume.  Without a template, or
+// when the request lacks the PVC information the template needs, the name is
+// derived from the CSI volume name as always
+func volumeName(ctxt context.Context, tmpl, reqName string, info *pvcInfo) string {
+	if tmpl == "" {
+		return co.GenName(reqName)
+	}
+	values := info.placeholders(reqName)
+	missing := false
+	name := namePlaceholder.ReplaceAllStringFunc(tmpl, func(ph string) string {
+		if values[ph] == "" {
+			missing = true
+		}
+		return values[ph]
+	})
+	if missing {
+		co.Warningf(ctxt, "Request for %s is missing PVC information for name template %q, is csi-provisioner running with --extra-create-metadata?", reqName, tmpl)
+		return co.GenName(reqName)
+	}
+	return co.GenName(strings.Trim(invalidNameChars.ReplaceAllString(name, "-"), "-"))
+}
@@ -0,0 +1,130 @@
+package driver
+
+import (
+	"context"
+	"strings"
+	"testing"
+
+	csi "github.com/container-storage-interface/spec/lib/go/csi"
+	codes "google.golang.org/grpc/codes"
+
+	co "github.com/Datera/datera-csi/pkg/common"
+	dsdk "github.com/Datera/go-sdk/pkg/dsdk"
+)
+
+func getNamingCtxt() context.Context {
+	return co.WithCtxt(context.Background(), "naming-test", "")
+}
+
+func TestExtractPvcInfo(t *testing.T) {
+	params := map[string]string{
+		ParamPvcName:      "data",
+		ParamPvcNamespace: "team-a",
+		ParamPvName:       "pvc-1234",
+		"replica_count":   "2",
+	}
+	info, rest := extractPvcInfo(params)
+	if info.Name != "data" || info.Namespace != "team-a" || info.PvName != "pvc-1234" {
+		t.Fatalf("Unexpected PVC info: %+v", *info)
+	}
+	if len(rest) != 1 || rest["replica_count"] != "2" {
+		t.Fatalf("Expected only driver parameters to remain, got %s", rest)
+	}
+	if len(params) != 4 {
+		t.Fatal("Expected the request parameters to be left alone")
+	}
+	if d := info.descr(); d != "Kubernetes PVC team-a/data (PV pvc-1234)" {
+		t.Fatalf("Unexpected description %q", d)
+	}
+	if d := (&pvcInfo{}).descr(); d != "" {
+		t.Fatalf("Expected no description without a PVC, got %q", d)
+	}
+}
+
+func TestVolumeName(t *testing.T) {
+	info := &pvcInfo{Name: "data", Namespace: "team a", PvName: "pvc-1234"}
+	for _, c := range []struct {
+		tmpl     string
+		info     *pvcInfo
+		expected string
+	}{
+		{"", info, co.GenName("pvc-req")},
+		{"{namespace}-{pvc}", info, "CSI-team-a-data"},
+		{"{pv}", &pvcInfo{}, "CSI-pvc-req"},
+		{"{namespace}/{pvc}!", info, "CSI-team-a-data"},
+		{"{namespace}-{pvc}", &pvcInfo{Name: "data"}, co.GenName("pvc-req")},
+	} {
+		if name := volumeName(getNamingCtxt(), c.tmpl, "pvc-req", c.info); name != c.expected {
+			t.Fatalf("Expected %s for template %q, got %s", c.expected, c.tmpl, name)
+		}
+	}
+	long := &pvcInfo{Name: strings.Repeat("a", 100), Namespace: "ns"}
+	if name := volumeName(getNamingCtxt(), "{namespace}-{pvc}", "pvc-req", long); name != co.GenName("ns-"+long.Name) {
+		t.Fatalf("Expected the name to be truncated, got %s", name)
+	}
+}
+
+func TestValidateNameTemplate(t *testing.T) {
+	for _, tmpl := range []string{"", "{pv}", "k8s-{namespace}-{pvc}"} {
+		if err := validateNameTemplate(tmpl); err != nil {
+			t.Fatalf("Expected %q to be valid: %s", tmpl, err)
+		}
+	}
+	for _, tmpl := range []string{"static", "{namespace}-{claim}", "{}"} {
+		if err := validateNameTemplate(tmpl); err == nil {
+			t.Fatalf("Expected %q to be invalid", tmpl)
+		}
+	}
+}
+
+func TestControllerCreateVolumePvcMetadata(t *testing.T) {
+	d := getDriverController(t)
+	d.conf.VolumeNameTemplate = "{namespace}-{pvc}"
+	// The csi.storage.k8s.io keys must never count as unknown parameters
+	d.conf.StrictParams = true
+	pvc := "data-" + dsdk.RandString(5)
+	req := &csi.CreateVolumeRequest{
+		Name:               "pvc-" + dsdk.RandString(5),
+		VolumeCapabilities: []*csi.VolumeCapability{mountCapability("ext4")},
+		Parameters: map[string]string{
+			ParamPvcName:      pvc,
+			ParamPvcNamespace: "team-a",
+			ParamPvName:       "pvc-1234",
+			"replica_count":   "1",
+		},
+	}
+	resp, err := d.CreateVolume(getCtxt(), req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	id := resp.Volume.VolumeId
+	defer d.DeleteVolume(getCtxt(), &csi.DeleteVolumeRequest{VolumeId: id})
+	if id != "CSI-team-a-"+pvc {
+		t.Fatalf("Expected the volume to be named after the PVC, got %s", id)
+	}
+	vol, err := d.dc.GetVolume(getCtxt(), id, false, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if vol.Ai.Descr != "Kubernetes PVC team-a/"+pvc+" (PV pvc-1234)" {
+		t.Fatalf("Unexpected description %q", vol.Ai.Descr)
+	}
+	md, err := vol.GetMetadata(getCtxt())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if (*md)["pvc_name"] != pvc || (*md)["pvc_namespace"] != "team-a" || (*md)["pv_name"] != "pvc-1234" {
+		t.Fatalf("Unexpected metadata: %s", *md)
+	}
+
+	// Retries for the same PV succeed, a different PV mapping to the same
+	// name doesn't
+	if _, err = d.CreateVolume(getCtxt(), req); err != nil {
+		t.Fatal(err)
+	}
+	req.Name = "pvc-" + dsdk.RandString(5)
+	req.Parameters[ParamPvName] = "pvc-5678"
+	if _, err = d.CreateVolume(getCtxt(), req); co.GetCode(err) != codes.AlreadyExists {
+		t.Fatalf("Expected AlreadyExists for a different PV, got %v", err)
+	}
+}
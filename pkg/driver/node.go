@@ -3,7 +3,9 @@ package driver
 import (
 	"context"
 	"fmt"
+	"strconv"
 	"strings"
+	"time"
 
 	csi "github.com/container-storage-interface/spec/lib/go/csi"
 	units "github.com/docker/go-units"
@@ -13,6 +15,7 @@ import (
 
 	dc "github.com/Datera/datera-csi/pkg/client"
 	co "github.com/Datera/datera-csi/pkg/common"
+	dsdk "github.com/Datera/go-sdk/pkg/dsdk"
 )
 
 func (d *Driver) NodeStageVolume(ctx context.Context, req *csi.NodeStageVolumeRequest) (*csi.NodeStageVolumeResponse, error) {
@@ -20,11 +23,7 @@ func (d *Driver) NodeStageVolume(ctx context.Context, req *csi.NodeStageVolumeRe
 	chapParams := map[string]string{}
 	chapParams = co.StripSecretsAndGetChapParams(req)
 
-	ctxt, ip, clean := d.InitFunc(ctx, "node", "NodeStageVolume", *req)
-	defer clean()
-	if ip {
-		return nil, status.Errorf(codes.Aborted, "Operation is still in progress")
-	}
+	ctxt := d.InitFunc(ctx, "node", "NodeStageVolume", *req)
 	vid := req.VolumeId
 	if vid == "" {
 		return nil, status.Errorf(codes.InvalidArgument, "VolumeId cannot be empty")
@@ -36,152 +35,306 @@ func (d *Driver) NodeStageVolume(ctx context.Context, req *csi.NodeStageVolumeRe
 	if vc == nil {
 		return nil, status.Errorf(codes.InvalidArgument, "VolumeCapability cannot be nil")
 	}
-	vol, err := d.dc.GetVolume(vid, false, true)
-	if err != nil {
-		return nil, status.Errorf(codes.NotFound, err.Error())
-	}
-	md, err := vol.GetMetadata()
+	release, err := d.lock(ctxt, vid, "NodeStageVolume:"+req.StagingTargetPath)
 	if err != nil {
-		return nil, status.Errorf(codes.Unknown, err.Error())
+		return nil, err
+	}
+	defer release()
+	// ACL registration and onlining of the AppInstance are handled by
+	// ControllerPublishVolume, which hands us the target information and
+	// volume metadata
+	pc := req.PublishContext
+	if pc[PublishTargetIqn] == "" && pc[PublishTargetPortals] == "" {
+		if pc, err = d.nodePublishContext(ctxt, vid, vc); err != nil {
+			return nil, err
+		}
 	}
-	if err := RegisterVolumeCapability(ctxt, md, vc); err != nil {
+	vol := d.dc.NodeVolume(ctxt, vid)
+	if err = applyPublishContext(vol, pc); err != nil {
 		return nil, status.Errorf(codes.InvalidArgument, err.Error())
 	}
-	// Setup ACL
-	init, err := d.dc.CreateGetInitiator()
-	if err != nil {
-		return nil, status.Errorf(codes.Unknown, err.Error())
+	md := dc.VolMetadata{}
+	for _, k := range publishMetadataKeys {
+		md[k] = pc[k]
 	}
-	if err = vol.RegisterAcl(init); err != nil {
-		return nil, status.Errorf(codes.Unknown, err.Error())
+	if err := RegisterVolumeCapability(ctxt, &md, vc); err != nil {
+		return nil, status.Errorf(codes.InvalidArgument, err.Error())
 	}
-
-	// This has been moved to volume creation time to satisfy silly requirements
-	// // Setup IpPool
-	// if vol.Template == "" {
-	// 	co.Debugf(ctxt, "Registering IP Pool: %s", (*md)["ip_pool"])
-	// 	if ipp, err := d.dc.GetIpPoolFromName((*md)["ip_pool"]); err != nil {
-	// 		return nil, status.Errorf(codes.NotFound, err.Error())
-	// 	} else {
-	// 		if err = vol.RegisterIpPool(ipp); err != nil {
-	// 			return nil, status.Errorf(codes.Unknown, err.Error())
-	// 		}
-	// 	}
-	// } else {
-	// 	co.Debug(ctxt, "Skipping IP Pool registration due to Template")
-	// }
-	// Online AI (to ensure targets are accessible)
-	if err = vol.Online(); err != nil {
-		return nil, status.Errorf(codes.Unknown, err.Error())
+	st, err := d.state.Get(ctxt, vid)
+	if err != nil {
+		return nil, status.Errorf(codes.Internal, err.Error())
 	}
+	// Whatever the PublishContext says, a volume this node already has a
+	// record of may hold data by now
+	isNew := st.Empty() && pc[PublishCreatedEmpty] == "true"
+	readOnly := isReadOnlyMode(vc)
+	rr := pc[PublishRoundRobin] == "true"
 	// Login to target
-	if err = vol.Login(!d.env.DisableMultipath, (*md)["round_robin"] == "true", chapParams); err != nil {
+	if err = vol.Login(ctxt, !d.conf.DisableMultipath, rr, chapParams); err != nil {
 		return nil, status.Errorf(codes.Unknown, err.Error())
 	}
-	(*md)["device_path"] = vol.DevicePath
+	st.DevicePath = vol.DevicePath
+	st.AccessType = md["access_type"]
+	st.TargetIqn, st.TargetPortals = vol.Iqn, vol.Ips
+	// Saved before mounting so the session is known even if we crash
+	if err = d.state.Put(ctxt, st); err != nil {
+		return nil, status.Errorf(codes.Internal, err.Error())
+	}
 	switch vc.GetAccessType().(type) {
 
 	case *csi.VolumeCapability_Mount:
 		co.Infof(ctxt, "Handling NodeStageVolume VolumeCapability_Mount")
-		fsType := (*md)["fs_type"]
+		fsType := md["fs_type"]
 		// Mount Device
 		if fsType == "" {
 			fsType = co.Ext4
 		}
-		fsArgs := strings.Split((*md)["fs_args"], " ")
-		if len(fsArgs) == 0 {
-			fsArgs = DefaultFsArgs[fsType]
+		var (
+			fs     *dc.Filesystem
+			fsArgs []string
+		)
+		if fs, err = dc.GetFilesystem(fsType); err != nil {
+			return nil, status.Errorf(codes.InvalidArgument, err.Error())
+		}
+		// fs_args holds the complete mkfs arguments resolved by CreateVolume
+		fsArgs, err = fs.Args(&dc.MkfsOpts{Args: strings.Fields(md["fs_args"])})
+		if err != nil {
+			return nil, status.Errorf(codes.InvalidArgument, err.Error())
 		}
-		if !vol.Formatted && (*md)["formatted"] != "true" {
-			err = vol.Format(fsType, fsArgs, d.env.FormatTimeout)
+		created := false
+		if !st.Formatted && readOnly {
+			// Other nodes may already be reading it, so a read-only volume
+			// has to be formatted by a writer first
+			var found string
+			if found, err = vol.Filesystem(ctxt, d.conf.FormatTimeout); err != nil {
+				return nil, status.Errorf(codes.Unknown, err.Error())
+			}
+			if found == "" {
+				return nil, status.Errorf(codes.FailedPrecondition, "Volume %s has no filesystem and cannot be formatted in read-only access mode %s", vid, vc.GetAccessMode().GetMode())
+			}
+		} else if !st.Formatted {
+			created, err = vol.Format(ctxt, fsType, fsArgs, d.conf.FormatTimeout, isNew)
 			if err != nil {
 				return nil, status.Errorf(codes.Unknown, err.Error())
 			}
-			vol.Formatted = true
-			(*md)["formatted"] = "true"
+			if created {
+				st.FormattedAt = time.Now().UTC().Format(time.RFC3339)
+				st.FormattedArgs = strings.Join(fsArgs, " ")
+				co.Infof(ctxt, "Formatted volume %s with %s %s", vol.Name, fsType, st.FormattedArgs)
+			}
+		}
+		st.Formatted = true
+		if d.conf.FsckOnStage && !created {
+			if err = vol.CheckFs(ctxt, fsType); err != nil {
+				return nil, status.Errorf(codes.Internal, err.Error())
+			}
+		}
+		// Clones larger than their source need the inherited filesystem
+		// grown, before mounting if it can't be grown online.  The flag is
+		// never cleared, growing a filesystem that fills its device is a
+		// no-op
+		resize := md["fs_resize_pending"] == "true" && !readOnly && !created
+		size, _ := strconv.ParseInt(pc[PublishSize], 10, 64)
+		if resize && !fs.CanGrowOnline() {
+			co.Infof(ctxt, "Expanding inherited filesystem on %s to %d GiB offline", vol.Name, size)
+			if err = vol.ExpandFsOffline(ctxt, fsType, size); err != nil {
+				return nil, status.Errorf(codes.Unknown, err.Error())
+			}
 		}
-		mountArgs := strings.Split((*md)["m_args"], " ")
-		err = vol.Mount(req.StagingTargetPath, mountArgs, fsType)
+		// Volume capability flags, then StorageClass and filesystem defaults
+		flags := append([]string{}, vc.GetMount().MountFlags...)
+		flags = dc.MergeMountOptions(flags, dc.ParseMountOptions(md["mount_options"]))
+		flags = dc.MergeMountOptions(flags, fs.MountOptions)
+		if readOnly {
+			flags = append(flags, "ro")
+		}
+		err = vol.Mount(ctxt, req.StagingTargetPath, mountArgs(flags), fsType)
 		if err != nil {
 			return nil, status.Errorf(codes.Unknown, err.Error())
 		}
-		(*md)["mount_path"] = vol.MountPath
+		st.StagingPath = vol.MountPath
+		st.FsType = fsType
+		if resize && fs.CanGrowOnline() {
+			co.Infof(ctxt, "Expanding inherited filesystem on %s to %d GiB", vol.Name, size)
+			if err = vol.ExpandFs(ctxt, vol.MountPath, fsType, size); err != nil {
+				return nil, status.Errorf(codes.Unknown, err.Error())
+			}
+		}
 	case *csi.VolumeCapability_Block:
-		// No formatting is needed since this is raw block
+		// No formatting or staging mount is needed since this is raw block,
+		// NodePublishVolume bind mounts the device itself
 		co.Infof(ctxt, "Handling NodeStageVolume VolumeCapability_Block")
-		(*md)["mount_path"] = vol.DevicePath
+		st.StagingPath = ""
 	default:
 		return nil, status.Errorf(codes.InvalidArgument, fmt.Sprintf("Unknown volume capability: %#v", vc))
 	}
-	if _, err = vol.SetMetadata(md); err != nil {
-		return nil, status.Errorf(codes.Unknown, err.Error())
+	if err = d.state.Put(ctxt, st); err != nil {
+		return nil, status.Errorf(codes.Internal, err.Error())
 	}
 	return &csi.NodeStageVolumeResponse{}, nil
 }
 
-func (d *Driver) NodeUnstageVolume(ctx context.Context, req *csi.NodeUnstageVolumeRequest) (*csi.NodeUnstageVolumeResponse, error) {
-	ctxt, ip, clean := d.InitFunc(ctx, "node", "NodeUnstageVolume", *req)
-	defer clean()
-	if ip {
-		return nil, status.Errorf(codes.Aborted, "Operation is still in progress")
+// Returns the PublishContext for a volume staged without one.  Before
+// ControllerPublishVolume was implemented the CSIDriver object was installed
+// with attachRequired: false, which can't be changed in place, so nodes that
+// still have Datera API credentials publish those volumes themselves the way
+// they used to
+func (d *Driver) nodePublishContext(ctxt context.Context, vid string, vc *csi.VolumeCapability) (map[string]string, error) {
+	if !d.conf.HasCredentials() {
+		return nil, status.Errorf(codes.FailedPrecondition, "No PublishContext for volume %s and no Datera API credentials to publish it from the node.  Recreate the CSIDriver object with attachRequired: true", vid)
+	}
+	co.Warningf(ctxt, "No PublishContext for volume %s, publishing it from the node.  Recreate the CSIDriver object with attachRequired: true", vid)
+	iqn, err := d.host.InitiatorName(ctxt)
+	if err != nil {
+		return nil, status.Errorf(codes.FailedPrecondition, err.Error())
 	}
-	vid := req.VolumeId
-	if vid == "" {
-		return nil, status.Errorf(codes.InvalidArgument, "VolumeId cannot be empty")
+	return d.publishVolume(ctxt, vid, co.MkNodeId(d.nid, iqn), iqn, vc)
+}
+
+// Reader-only access modes are staged and published read-only
+func isReadOnlyMode(vc *csi.VolumeCapability) bool {
+	switch vc.GetAccessMode().GetMode() {
+	case csi.VolumeCapability_AccessMode_SINGLE_NODE_READER_ONLY,
+		csi.VolumeCapability_AccessMode_MULTI_NODE_READER_ONLY:
+		return true
+	}
+	return false
+}
+
+// Turns VolumeCapability mount flags, eg: [noatime discard], into mount
+// arguments
+func mountArgs(flags []string) []string {
+	opts := []string{}
+	for _, f := range flags {
+		if f = strings.TrimSpace(f); f != "" {
+			opts = append(opts, f)
+		}
 	}
-	if req.StagingTargetPath == "" {
-		return nil, status.Errorf(codes.InvalidArgument, "StagingTargetPath cannot be empty")
+	if len(opts) == 0 {
+		return []string{}
 	}
-	vol, err := d.dc.GetVolume(vid, false, true)
+	return []string{"-o", strings.Join(opts, ",")}
+}
+
+// Fills in the target information for a volume from the PublishContext
+// returned by ControllerPublishVolume
+func applyPublishContext(vol *dc.Volume, pc map[string]string) error {
+	iqn, portals := pc[PublishTargetIqn], pc[PublishTargetPortals]
+	if iqn == "" || portals == "" {
+		return fmt.Errorf("PublishContext is missing target information: %s", pc)
+	}
+	vol.Iqn = iqn
+	vol.Ips = strings.Split(portals, ",")
+	return nil
+}
+
+// Returns the node state of a volume and a Volume to operate on it with,
+// targeting what the state recorded.  Volumes staged by older releases have
+// neither the target nor the state in the store, those are read from the
+// backend once and the state moved out of AppInstance metadata
+func (d *Driver) nodeState(ctxt context.Context, vid string) (*NodeVolumeState, *dc.Volume, error) {
+	st, err := d.state.Get(ctxt, vid)
 	if err != nil {
-		return nil, status.Errorf(codes.NotFound, err.Error())
+		return nil, nil, err
 	}
-	// Don't return an error for failures to unmount or logout (fail gracefully)
-	// We log the errors so if something did go wrong we can track it down without bringing
-	// everything to a halt
-
-	err = vol.Unmount()
+	vol := d.dc.NodeVolume(ctxt, vid)
+	if st.TargetIqn != "" {
+		vol.Iqn, vol.Ips = st.TargetIqn, st.TargetPortals
+		return st, vol, nil
+	}
+	bvol, err := d.dc.GetVolume(ctxt, vid, false, false)
 	if err != nil {
-		co.Warning(ctxt, err)
+		co.Warningf(ctxt, "No target recorded for volume %s and it could not be looked up: %s", vid, err)
+		return st, vol, nil
 	}
-	md, err := vol.GetMetadata()
+	vol.Iqn, vol.Ips = bvol.Iqn, bvol.Ips
+	md, err := bvol.GetMetadata(ctxt)
 	if err != nil {
 		co.Warning(ctxt, err)
+		return st, vol, nil
+	}
+	if st.Empty() && ((*md)["device_path"] != "" || (*md)["mount_path"] != "") {
+		co.Infof(ctxt, "Migrating node state of %s out of AppInstance metadata", vol.Name)
+		st.DevicePath = (*md)["device_path"]
+		st.StagingPath = (*md)["mount_path"]
+		st.AccessType = (*md)["access_type"]
+		st.FsType = (*md)["fs_type"]
+		st.Formatted = (*md)["formatted"] == "true"
+		for _, bm := range strings.Split((*md)["bind_mount"], ",") {
+			if bm != "" {
+				st.AddBindMount(bm)
+			}
+		}
+		legacy := dc.VolMetadata{"device_path": "", "mount_path": "", "bind_mount": ""}
+		if _, err = bvol.SetMetadata(ctxt, &legacy); err != nil {
+			co.Warning(ctxt, err)
+		}
 	}
-	if md == nil {
-		md = &dc.VolMetadata{}
+	if st.Empty() {
+		return st, vol, nil
 	}
-	(*md)["mount_path"] = ""
-	if _, err = vol.SetMetadata(md); err != nil {
-		co.Warning(ctxt, err)
+	st.TargetIqn, st.TargetPortals = vol.Iqn, vol.Ips
+	if err = d.state.Put(ctxt, st); err != nil {
+		return nil, nil, err
 	}
-	err = vol.Logout()
-	if err != nil {
-		co.Warning(ctxt, err)
+	return st, vol, nil
+}
+
+// VolumeContext keys kubelet fills in when podInfoOnMount is set, and the
+// keys they are recorded under in the node state
+var podMetadataKeys = map[string]string{
+	"csi.storage.k8s.io/pod.name":            "pod_name",
+	"csi.storage.k8s.io/pod.namespace":       "pod_namespace",
+	"csi.storage.k8s.io/pod.uid":             "pod_uid",
+	"csi.storage.k8s.io/serviceAccount.name": "k8s_service_account",
+}
+
+func (d *Driver) NodeUnstageVolume(ctx context.Context, req *csi.NodeUnstageVolumeRequest) (*csi.NodeUnstageVolumeResponse, error) {
+	ctxt := d.InitFunc(ctx, "node", "NodeUnstageVolume", *req)
+	vid := req.VolumeId
+	if vid == "" {
+		return nil, status.Errorf(codes.InvalidArgument, "VolumeId cannot be empty")
 	}
-	init, err := d.dc.CreateGetInitiator()
+	if req.StagingTargetPath == "" {
+		return nil, status.Errorf(codes.InvalidArgument, "StagingTargetPath cannot be empty")
+	}
+	release, err := d.lock(ctxt, vid, "NodeUnstageVolume:"+req.StagingTargetPath)
 	if err != nil {
-		co.Warning(ctxt, err)
+		return nil, err
 	}
-	err = vol.UnregisterAcl(init)
+	defer release()
+	// Don't return an error for failures to unmount or logout (fail gracefully)
+	// We log the errors so if something did go wrong we can track it down without bringing
+	// everything to a halt
+	st, vol, err := d.nodeState(ctxt, vid)
 	if err != nil {
-		co.Warning(ctxt, err)
+		return nil, status.Errorf(codes.Internal, err.Error())
 	}
-	if (*md)["delete_on_unmount"] == "true" {
-		co.Infof(ctxt, "Auto-deleting %s on unmount", vol.Name)
-		if err = vol.Delete(false); err != nil {
+	vol.DevicePath, vol.MountPath = st.DevicePath, st.StagingPath
+	// Block volumes staged by older releases recorded the device as their
+	// mount path, which must never be unmounted
+	if st.AccessType != "block" && vol.MountPath != vol.DevicePath {
+		err = vol.Unmount(ctxt)
+		if err != nil {
 			co.Warning(ctxt, err)
 		}
 	}
+	st.StagingPath = ""
+	if vol.Iqn == "" {
+		co.Warningf(ctxt, "No target known for volume %s, not logging out", vid)
+	} else if err = vol.Logout(ctxt); err != nil {
+		co.Warning(ctxt, err)
+	} else {
+		st.DevicePath = ""
+	}
+	if err = d.state.Put(ctxt, st); err != nil {
+		co.Warning(ctxt, err)
+	}
 	return &csi.NodeUnstageVolumeResponse{}, nil
 }
 
 func (d *Driver) NodePublishVolume(ctx context.Context, req *csi.NodePublishVolumeRequest) (*csi.NodePublishVolumeResponse, error) {
-	ctxt, ip, clean := d.InitFunc(ctx, "node", "NodePublishVolume", *req)
-	defer clean()
-	if ip {
-		return nil, status.Errorf(codes.Aborted, "Operation is still in progress")
-	}
+	ctxt := d.InitFunc(ctx, "node", "NodePublishVolume", *req)
 	vid := req.VolumeId
 	if vid == "" {
 		return nil, status.Errorf(codes.InvalidArgument, "VolumeId cannot be empty")
@@ -192,57 +345,56 @@ func (d *Driver) NodePublishVolume(ctx context.Context, req *csi.NodePublishVolu
 	if req.TargetPath == "" {
 		return nil, status.Errorf(codes.InvalidArgument, "TargetPath cannot be empty")
 	}
-	vol, err := d.dc.GetVolume(vid, false, true)
+	release, err := d.lock(ctxt, vid, "NodePublishVolume:"+req.TargetPath)
+	if err != nil {
+		return nil, err
+	}
+	defer release()
 	vc := req.VolumeCapability
 	if vc == nil {
 		return nil, status.Errorf(codes.InvalidArgument, "VolumeCapability cannot be nil")
 	}
-	md, err := vol.GetMetadata()
-	if err != nil {
-		return nil, status.Errorf(codes.Unknown, err.Error())
-	}
-	if err := RegisterVolumeCapability(ctxt, md, vc); err != nil {
+	if err := RegisterVolumeCapability(ctxt, &dc.VolMetadata{}, vc); err != nil {
 		return nil, status.Errorf(codes.InvalidArgument, err.Error())
 	}
-	for _, bm := range strings.Split((*md)["bind_mount"], ",") {
-		vol.BindMountPaths.Add(bm)
+	st, vol, err := d.nodeState(ctxt, vid)
+	if err != nil {
+		return nil, status.Errorf(codes.Internal, err.Error())
 	}
-	fsType := (*md)["fs_type"]
-	if err = vol.BindMount(req.TargetPath, fsType); err != nil {
-		return nil, status.Errorf(codes.Unknown, err.Error())
+	vol.DevicePath, vol.MountPath = st.DevicePath, st.StagingPath
+	vol.BindMountPaths = dsdk.NewStringSet(10, st.BindMounts...)
+	readOnly := req.Readonly || isReadOnlyMode(vc)
+	switch vc.GetAccessType().(type) {
+	case *csi.VolumeCapability_Mount:
+		err = vol.BindMount(ctxt, req.TargetPath, st.FsType, readOnly)
+	case *csi.VolumeCapability_Block:
+		err = vol.BindMountDevice(ctxt, req.TargetPath, readOnly)
 	}
-	(*md)["bind_mount"] = strings.Join(vol.BindMountPaths.List(), ",")
-        // Add Pod level details into App Instance metadata, if they exist in this call
-        if  req.VolumeContext != nil {
-                podName := req.VolumeContext["csi.storage.k8s.io/pod.name"]
-                podNamespace := req.VolumeContext["csi.storage.k8s.io/pod.namespace"]
-                podUid := req.VolumeContext["csi.storage.k8s.io/pod.uid"]
-                svcAcct := req.VolumeContext["csi.storage.k8s.io/serviceAccount.name"]
-                if podName != "" {
-                        (*md)["pod_name"] = podName
-                }
-                if podNamespace != "" {
-                        (*md)["pod_namespace"] = podNamespace
-                }
-                if podUid != "" {
-                        (*md)["pod_uid"] = podUid
-                }
-                if svcAcct != "" {
-                        (*md)["k8s_service_account"] = svcAcct
-                }
-        }
-	if _, err = vol.SetMetadata(md); err != nil {
+	if err != nil {
 		return nil, status.Errorf(codes.Unknown, err.Error())
 	}
+	st.AddBindMount(req.TargetPath)
+	// Record Pod level details, if they exist in this call
+	pod := map[string]string{}
+	for k, mk := range podMetadataKeys {
+		if v := req.VolumeContext[k]; v != "" {
+			pod[mk] = v
+		}
+	}
+	if len(pod) > 0 {
+		if st.Pods == nil {
+			st.Pods = map[string]map[string]string{}
+		}
+		st.Pods[req.TargetPath] = pod
+	}
+	if err = d.state.Put(ctxt, st); err != nil {
+		return nil, status.Errorf(codes.Internal, err.Error())
+	}
 	return &csi.NodePublishVolumeResponse{}, nil
 }
 
 func (d *Driver) NodeUnpublishVolume(ctx context.Context, req *csi.NodeUnpublishVolumeRequest) (*csi.NodeUnpublishVolumeResponse, error) {
-	ctxt, ip, clean := d.InitFunc(ctx, "node", "NodeUnpublishVolume", *req)
-	defer clean()
-	if ip {
-		return nil, status.Errorf(codes.Aborted, "Operation is still in progress")
-	}
+	ctxt := d.InitFunc(ctx, "node", "NodeUnpublishVolume", *req)
 	vid := req.VolumeId
 	if vid == "" {
 		return nil, status.Errorf(codes.InvalidArgument, "VolumeId cannot be empty")
@@ -250,39 +402,30 @@ func (d *Driver) NodeUnpublishVolume(ctx context.Context, req *csi.NodeUnpublish
 	if req.TargetPath == "" {
 		return nil, status.Errorf(codes.InvalidArgument, "TargetPath cannot be empty")
 	}
-	vol, err := d.dc.GetVolume(vid, false, true)
+	release, err := d.lock(ctxt, vid, "NodeUnpublishVolume:"+req.TargetPath)
 	if err != nil {
-		return nil, status.Errorf(codes.NotFound, err.Error())
+		return nil, err
 	}
-	md, err := vol.GetMetadata()
+	defer release()
+	st, vol, err := d.nodeState(ctxt, vid)
 	if err != nil {
-		return nil, status.Errorf(codes.Unknown, err.Error())
-	}
-	for _, bm := range strings.Split((*md)["bind_mount"], ",") {
-		vol.BindMountPaths.Delete(bm)
+		return nil, status.Errorf(codes.Internal, err.Error())
 	}
-	// Remove Pod level details from the Volume Metadata
-        (*md)["pod_name"] = ""
-        (*md)["pod_namespace"] = ""
-        (*md)["pod_uid"] = ""
-        (*md)["k8s_service_account"] = ""
-
-	if _, err = vol.SetMetadata(md); err != nil {
-		return nil, status.Errorf(codes.Unknown, err.Error())
-	}
-	err = vol.UnBindMount(req.TargetPath)
+	vol.BindMountPaths = dsdk.NewStringSet(10, st.BindMounts...)
+	err = vol.UnBindMount(ctxt, req.TargetPath)
 	if err != nil {
 		co.Warning(ctxt, err)
 	}
+	// Also forgets the pod
+	st.RemoveBindMount(req.TargetPath)
+	if err = d.state.Put(ctxt, st); err != nil {
+		return nil, status.Errorf(codes.Internal, err.Error())
+	}
 	return &csi.NodeUnpublishVolumeResponse{}, nil
 }
 
 func (d *Driver) NodeGetCapabilities(ctx context.Context, req *csi.NodeGetCapabilitiesRequest) (*csi.NodeGetCapabilitiesResponse, error) {
-	_, ip, clean := d.InitFunc(ctx, "node", "NodeGetVolumeStats", *req)
-	defer clean()
-	if ip {
-		return nil, status.Errorf(codes.Aborted, "Operation is still in progress")
-	}
+	d.InitFunc(ctx, "node", "NodeGetCapabilities", *req)
 	resp := &csi.NodeGetCapabilitiesResponse{Capabilities: []*csi.NodeServiceCapability{}}
 	addCap := func(t csi.NodeServiceCapability_RPC_Type) {
 		resp.Capabilities = append(resp.Capabilities, &csi.NodeServiceCapability{
@@ -297,6 +440,7 @@ func (d *Driver) NodeGetCapabilities(ctx context.Context, req *csi.NodeGetCapabi
 		csi.NodeServiceCapability_RPC_STAGE_UNSTAGE_VOLUME,
 		csi.NodeServiceCapability_RPC_GET_VOLUME_STATS,
                 csi.NodeServiceCapability_RPC_EXPAND_VOLUME,
+		csi.NodeServiceCapability_RPC_VOLUME_CONDITION,
 	} {
 		addCap(t)
 	}
@@ -304,62 +448,160 @@ func (d *Driver) NodeGetCapabilities(ctx context.Context, req *csi.NodeGetCapabi
 }
 
 func (d *Driver) NodeGetInfo(ctx context.Context, req *csi.NodeGetInfoRequest) (*csi.NodeGetInfoResponse, error) {
-	_, ip, clean := d.InitFunc(ctx, "node", "NodeGetInfo", *req)
-	defer clean()
-	if ip {
-		return nil, status.Errorf(codes.Aborted, "Operation is still in progress")
-	}
+	ctxt := d.InitFunc(ctx, "node", "NodeGetInfo", *req)
 	log.WithField("method", "node_get_info").Infof("Node server %s 'NodeGetInfo' called", d.nid)
+	// The initiator IQN is published as part of the node ID so the controller
+	// can register it with the AppInstance ACL during ControllerPublishVolume
+	iqn, err := d.host.InitiatorName(ctxt)
+	if err != nil {
+		return nil, status.Errorf(codes.FailedPrecondition, err.Error())
+	}
 	return &csi.NodeGetInfoResponse{
-		NodeId:             d.nid,
-		MaxVolumesPerNode:  int64(d.env.VolPerNode),
-		AccessibleTopology: nil,
+		NodeId:             co.MkNodeId(d.nid, iqn),
+		MaxVolumesPerNode:  int64(d.conf.VolPerNode),
+		AccessibleTopology: nodeTopology(d.conf.TopologyZone),
 	}, nil
 }
 
+// Usage is read from the node (statfs on the published path, or the device
+// size for raw block volumes) rather than the Datera system.  Backend usage
+// reflects thin provisioned allocation, not what the pod sees, and kubelet
+// polls this for every volume every minute
 func (d *Driver) NodeGetVolumeStats(ctx context.Context, req *csi.NodeGetVolumeStatsRequest) (*csi.NodeGetVolumeStatsResponse, error) {
-	_, ip, clean := d.InitFunc(ctx, "node", "NodeGetVolumeStats", *req)
-	defer clean()
-	if ip {
-		return nil, status.Errorf(codes.Aborted, "Operation is still in progress")
+	ctxt := d.InitFunc(ctx, "node", "NodeGetVolumeStats", *req)
+	if req.VolumeId == "" {
+		return nil, status.Errorf(codes.InvalidArgument, "VolumeId cannot be empty")
 	}
-	v, err := d.dc.GetVolume(req.VolumeId, false, false)
+	if req.VolumePath == "" {
+		return nil, status.Errorf(codes.InvalidArgument, "VolumePath cannot be empty")
+	}
+	block, err := d.host.IsBlockDevice(ctxt, req.VolumePath)
 	if err != nil {
-		return nil, status.Errorf(codes.NotFound, err.Error())
+		return nil, status.Errorf(codes.NotFound, "Volume %s is not published at %s: %s", req.VolumeId, req.VolumePath, err)
 	}
-	size, used, avail := v.GetUsage()
-	return &csi.NodeGetVolumeStatsResponse{
-		Usage: []*csi.VolumeUsage{
+	resp := &csi.NodeGetVolumeStatsResponse{}
+	if block {
+		size, err := d.host.Size(ctxt, req.VolumePath)
+		if err != nil {
+			return nil, status.Errorf(codes.Internal, err.Error())
+		}
+		resp.Usage = []*csi.VolumeUsage{
 			&csi.VolumeUsage{
-				Available: int64(avail * units.GiB),
-				Total:     int64(size * units.GiB),
-				Used:      int64(used * units.GiB),
+				Total: size,
+				Unit:  csi.VolumeUsage_BYTES,
+			},
+		}
+	} else {
+		st, err := d.host.Statfs(ctxt, req.VolumePath)
+		if err != nil {
+			return nil, status.Errorf(codes.NotFound, "Volume %s is not mounted at %s: %s", req.VolumeId, req.VolumePath, err)
+		}
+		resp.Usage = []*csi.VolumeUsage{
+			&csi.VolumeUsage{
+				Available: st.AvailableBytes,
+				Total:     st.TotalBytes,
+				Used:      st.UsedBytes,
 				Unit:      csi.VolumeUsage_BYTES,
 			},
-		},
-	}, nil
+			&csi.VolumeUsage{
+				Available: st.FreeInodes,
+				Total:     st.TotalInodes,
+				Used:      st.UsedInodes,
+				Unit:      csi.VolumeUsage_INODES,
+			},
+		}
+	}
+	resp.VolumeCondition = d.nodeVolumeCondition(ctxt, req.VolumePath, req.StagingTargetPath, block)
+	if resp.VolumeCondition.Abnormal {
+		co.Warningf(ctxt, "Volume %s is abnormal: %s", req.VolumeId, resp.VolumeCondition.Message)
+	}
+	return resp, nil
 }
 
-func (d *Driver) NodeExpandVolume(ctx context.Context, req *csi.NodeExpandVolumeRequest) (*csi.NodeExpandVolumeResponse, error) {
-	_, ip, clean := d.InitFunc(ctx, "node", "NodeExpandVolume", *req)
-	defer clean()
-	if ip {
-		return nil, status.Errorf(codes.Aborted, "Operation is still in progress")
+// Checks the health of a volume as seen from this node: the device behind
+// volPath still exists, its filesystem hasn't been remounted read-only after
+// an I/O error and the iSCSI sessions backing it are all still running
+func (d *Driver) nodeVolumeCondition(ctxt context.Context, volPath, stagingPath string, block bool) *csi.VolumeCondition {
+	abnormal := func(format string, args ...interface{}) *csi.VolumeCondition {
+		return &csi.VolumeCondition{Abnormal: true, Message: fmt.Sprintf(format, args...)}
+	}
+	dev := volPath
+	if !block {
+		var err error
+		if dev, err = d.host.DeviceFromMount(ctxt, volPath); err != nil {
+			return abnormal("Volume is not mounted at %s", volPath)
+		}
 	}
-	v, err := d.dc.GetVolume(req.VolumeId, false, false)
-	if err != nil {
-		return nil, status.Errorf(codes.NotFound, err.Error())
+	if _, err := d.host.Size(ctxt, dev); err != nil {
+		return abnormal("Device %s is missing: %s", dev, err)
+	}
+	// Publish mounts may legitimately be read-only, but the staging mount
+	// never is, so "ro" there means the kernel remounted it
+	if !block && stagingPath != "" {
+		if opts, err := d.host.MountOptions(ctxt, stagingPath); err == nil {
+			for _, opt := range opts {
+				if opt == "ro" {
+					return abnormal("Filesystem on %s has been remounted read-only", dev)
+				}
+			}
+		}
+	}
+	paths, perr := d.host.MultipathPaths(ctxt, dev)
+	if running := dc.RunningPaths(paths); perr == nil && running < len(paths) {
+		return abnormal("Multipath device for %s is degraded, %d of %d paths running: %s", dev, running, len(paths), paths)
 	}
-	md, err := v.GetMetadata()
+	state, err := d.host.DeviceState(ctxt, dev)
 	if err != nil {
-		return nil, status.Errorf(codes.Unknown, err.Error())
+		return abnormal("Could not determine iSCSI session state of %s: %s", dev, err)
+	}
+	if state != "running" {
+		return abnormal("iSCSI session for %s is %s", dev, state)
+	}
+	if perr == nil {
+		return &csi.VolumeCondition{Message: fmt.Sprintf("Volume is healthy, %d paths running", len(paths))}
+	}
+	return &csi.VolumeCondition{Message: "Volume is healthy"}
+}
+
+func (d *Driver) NodeExpandVolume(ctx context.Context, req *csi.NodeExpandVolumeRequest) (*csi.NodeExpandVolumeResponse, error) {
+	ctxt := d.InitFunc(ctx, "node", "NodeExpandVolume", *req)
+	if req.VolumeId == "" {
+		return nil, status.Errorf(codes.InvalidArgument, "VolumeId cannot be empty")
+	}
+	if req.VolumePath == "" {
+		return nil, status.Errorf(codes.InvalidArgument, "VolumePath cannot be empty")
 	}
 	cr := req.CapacityRange
-	if cr != nil && cr.LimitBytes == 0 {
-		cr.LimitBytes = cr.RequiredBytes
+	if cr == nil {
+		return nil, status.Errorf(codes.InvalidArgument, "CapacityRange cannot be nil")
+	}
+	release, err := d.lock(ctxt, req.VolumeId, "NodeExpandVolume")
+	if err != nil {
+		return nil, err
 	}
+	defer release()
+	st, v, err := d.nodeState(ctxt, req.VolumeId)
+	if err != nil {
+		return nil, status.Errorf(codes.Internal, err.Error())
+	}
+	accessType, fsType := st.AccessType, st.FsType
 	size := int(cr.RequiredBytes / units.GiB)
-	if err := v.ExpandFs(req.VolumePath, (*md)["fs_type"], int64(size)); err != nil {
+	if req.GetVolumeCapability().GetBlock() != nil || accessType == "block" {
+		err = v.ExpandBlock(ctxt, req.VolumePath, int64(size))
+	} else {
+		if fsType == "" {
+			fsType = co.Ext4
+		}
+		var fs *dc.Filesystem
+		if fs, err = dc.GetFilesystem(fsType); err != nil {
+			return nil, status.Errorf(codes.FailedPrecondition, err.Error())
+		}
+		if !fs.CanGrowOnline() {
+			return nil, status.Errorf(codes.FailedPrecondition, "Filesystem %s on volume %s cannot be grown while published, unpublish it and expand again", fsType, req.VolumeId)
+		}
+		err = v.ExpandFs(ctxt, req.VolumePath, fsType, int64(size))
+	}
+	if err != nil {
 		return nil, status.Errorf(codes.FailedPrecondition, err.Error())
 	}
 	resp := &csi.NodeExpandVolumeResponse{
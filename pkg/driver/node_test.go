@@ -1,31 +1,997 @@
 package driver
 
 import (
-	"context"
 	"fmt"
+	"reflect"
+	"strings"
 	"testing"
 
 	csi "github.com/container-storage-interface/spec/lib/go/csi"
 	units "github.com/docker/go-units"
+	codes "google.golang.org/grpc/codes"
 
+	dc "github.com/Datera/datera-csi/pkg/client"
 	co "github.com/Datera/datera-csi/pkg/common"
+	fake "github.com/Datera/datera-csi/pkg/fake"
+	host "github.com/Datera/datera-csi/pkg/host"
 	dsdk "github.com/Datera/go-sdk/pkg/dsdk"
-	udc "github.com/Datera/go-udc/pkg/udc"
 )
 
-func getDriverNode(t *testing.T) *Driver {
-	conf, err := udc.GetConfig()
+func getDriverNode(t *testing.T) (*Driver, *fake.Host) {
+	fd := fake.NewDatera()
+	fh := fake.NewHost()
+	d, err := NewDateraDriverWithHost(fd.UDC(), fd.HTTPClient(), fh)
 	if err != nil {
 		t.Fatal(err)
 	}
-	d, err := NewDateraDriver(conf)
+	d.state = getStateStore(t)
+	return d, fh
+}
+
+func mountCapability(fs string) *csi.VolumeCapability {
+	return &csi.VolumeCapability{
+		AccessType: &csi.VolumeCapability_Mount{
+			Mount: &csi.VolumeCapability_MountVolume{
+				FsType: fs,
+			},
+		},
+		AccessMode: &csi.VolumeCapability_AccessMode{
+			Mode: csi.VolumeCapability_AccessMode_SINGLE_NODE_WRITER,
+		},
+	}
+}
+
+func blockCapability() *csi.VolumeCapability {
+	return &csi.VolumeCapability{
+		AccessType: &csi.VolumeCapability_Block{
+			Block: &csi.VolumeCapability_BlockVolume{},
+		},
+		AccessMode: &csi.VolumeCapability_AccessMode{
+			Mode: csi.VolumeCapability_AccessMode_SINGLE_NODE_WRITER,
+		},
+	}
+}
+
+// Publishes the volume to the node and stages it at a new staging path,
+// returning the staging path and a function which unstages and unpublishes
+func stageVolume(t *testing.T, n *Driver, id string, vc *csi.VolumeCapability) (string, func()) {
+	info, err := n.NodeGetInfo(getCtxt(), &csi.NodeGetInfoRequest{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	pub, err := n.ControllerPublishVolume(getCtxt(), &csi.ControllerPublishVolumeRequest{
+		VolumeId:         id,
+		NodeId:           info.NodeId,
+		VolumeCapability: vc,
+	})
 	if err != nil {
 		t.Fatal(err)
 	}
-	return d
+	staging := "/mnt/csi-node-test-staging-" + dsdk.RandString(5)
+	if _, err = n.NodeStageVolume(getCtxt(), &csi.NodeStageVolumeRequest{
+		VolumeId:          id,
+		StagingTargetPath: staging,
+		VolumeCapability:  vc,
+		PublishContext:    pub.PublishContext,
+	}); err != nil {
+		t.Fatal(err)
+	}
+	return staging, func() {
+		if _, err := n.NodeUnstageVolume(getCtxt(), &csi.NodeUnstageVolumeRequest{
+			VolumeId:          id,
+			StagingTargetPath: staging,
+		}); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := n.ControllerUnpublishVolume(getCtxt(), &csi.ControllerUnpublishVolumeRequest{
+			VolumeId: id,
+			NodeId:   info.NodeId,
+		}); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestNodeGetInfo(t *testing.T) {
+	n, fh := getDriverNode(t)
+	fh.Iqn = "iqn.1993-08.org.debian:01:nodeinfo"
+	info, err := n.NodeGetInfo(getCtxt(), &csi.NodeGetInfoRequest{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, iqn := co.ParseNodeId(info.NodeId); iqn != fh.Iqn {
+		t.Fatalf("Expected node id to carry iqn %s, got %s", fh.Iqn, info.NodeId)
+	}
+}
+
+func TestNodeGetInfoNoInitiator(t *testing.T) {
+	n, fh := getDriverNode(t)
+	fh.Script("InitiatorName", fake.Result{Err: fmt.Errorf("open /etc/iscsi/initiatorname.iscsi: no such file or directory")})
+	if _, err := n.NodeGetInfo(getCtxt(), &csi.NodeGetInfoRequest{}); err == nil {
+		t.Fatal("Expected NodeGetInfo to fail without an initiator name")
+	}
 }
 
 func TestNodeStageVolumeUnstageVolume(t *testing.T) {
-	c := getDriverController(t)
-	n := getDriverNode(t)
+	n, fh := getDriverNode(t)
+	id, _, cleanf := createVolume(t, n)
+	defer cleanf()
+	staging, unstage := stageVolume(t, n, id, mountCapability("ext4"))
+
+	if calls := fh.CallsTo("Connect"); len(calls) != 1 {
+		t.Fatalf("Expected a single login, got %s", calls)
+	}
+	calls := fh.CallsTo("Format")
+	if len(calls) != 1 || calls[0].Args[1] != "ext4" {
+		t.Fatalf("Expected a single ext4 format, got %s", calls)
+	}
+	dev, ok := fh.Mounts()[staging]
+	if !ok {
+		t.Fatalf("Volume not mounted at staging path %s", staging)
+	}
+
+	unstage()
+	if _, ok := fh.Mounts()[staging]; ok {
+		t.Fatalf("Volume still mounted at %s after NodeUnstageVolume", staging)
+	}
+	calls = fh.CallsTo("Disconnect")
+	if len(calls) != 1 {
+		t.Fatalf("Expected a single logout, got %s", calls)
+	}
+	if _, err := fh.Size(getCtxt(), dev); err == nil {
+		t.Fatalf("Device %s still present after NodeUnstageVolume", dev)
+	}
+}
+
+func TestNodeStageVolumeFormatted(t *testing.T) {
+	n, fh := getDriverNode(t)
+	id, _, cleanf := createVolume(t, n)
+	defer cleanf()
+	_, unstage := stageVolume(t, n, id, mountCapability("ext4"))
+	unstage()
+
+	// Staging a second time must not reformat the volume
+	_, unstage = stageVolume(t, n, id, mountCapability("ext4"))
+	defer unstage()
+	if calls := fh.CallsTo("Format"); len(calls) != 1 {
+		t.Fatalf("Expected the volume to be formatted once, got %s", calls)
+	}
+}
+
+func TestNodeStageVolumeLoginFailure(t *testing.T) {
+	n, fh := getDriverNode(t)
+	id, _, cleanf := createVolume(t, n)
+	defer cleanf()
+	info, err := n.NodeGetInfo(getCtxt(), &csi.NodeGetInfoRequest{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	vc := mountCapability("ext4")
+	pub, err := n.ControllerPublishVolume(getCtxt(), &csi.ControllerPublishVolumeRequest{
+		VolumeId:         id,
+		NodeId:           info.NodeId,
+		VolumeCapability: vc,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	fh.Script("Connect", fake.Result{Err: fmt.Errorf("iscsiadm: No session found")})
+	if _, err = n.NodeStageVolume(getCtxt(), &csi.NodeStageVolumeRequest{
+		VolumeId:          id,
+		StagingTargetPath: "/mnt/csi-node-test-staging-" + dsdk.RandString(5),
+		VolumeCapability:  vc,
+		PublishContext:    pub.PublishContext,
+	}); err == nil {
+		t.Fatal("Expected NodeStageVolume to fail when login fails")
+	}
+	if calls := fh.CallsTo("Format"); len(calls) != 0 {
+		t.Fatalf("Format called after failed login: %s", calls)
+	}
+}
+
+func TestNodeStageVolumeNoPublishContext(t *testing.T) {
+	n, fh := getDriverNode(t)
+	id, _, cleanf := createVolume(t, n)
+	defer cleanf()
+	// Staged by kubelet with a CSIDriver object installed before
+	// ControllerPublishVolume was implemented, attachRequired: false
+	staging := "/mnt/csi-node-test-staging-" + dsdk.RandString(5)
+	if _, err := n.NodeStageVolume(getCtxt(), &csi.NodeStageVolumeRequest{
+		VolumeId:          id,
+		StagingTargetPath: staging,
+		VolumeCapability:  mountCapability("ext4"),
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if fh.Mounts()[staging] == "" {
+		t.Fatalf("Expected %s to be mounted", staging)
+	}
+	st, err := n.state.Get(getCtxt(), id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if st.TargetIqn == "" || len(st.TargetPortals) == 0 {
+		t.Fatalf("Expected the target to be recorded in node state, got %+v", st)
+	}
+	if _, err = n.NodeUnstageVolume(getCtxt(), &csi.NodeUnstageVolumeRequest{
+		VolumeId:          id,
+		StagingTargetPath: staging,
+	}); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestNodeStageVolumeNoPublishContextNoCredentials(t *testing.T) {
+	n, fh := getDriverNode(t)
+	id, _, cleanf := createVolume(t, n)
+	defer cleanf()
+	backend := *n.conf.Backend
+	backend.Password = ""
+	n.conf.Backend = &backend
+	if _, err := n.NodeStageVolume(getCtxt(), &csi.NodeStageVolumeRequest{
+		VolumeId:          id,
+		StagingTargetPath: "/mnt/csi-node-test-staging-" + dsdk.RandString(5),
+		VolumeCapability:  mountCapability("ext4"),
+	}); co.GetCode(err) != codes.FailedPrecondition {
+		t.Fatalf("Expected FailedPrecondition without a PublishContext or credentials, got %v", err)
+	}
+	if calls := fh.CallsTo("Connect"); len(calls) != 0 {
+		t.Fatalf("Expected no login, got %s", calls)
+	}
+}
+
+func TestNodeUnstageDeleteOnUnmount(t *testing.T) {
+	n, _ := getDriverNode(t)
+	vc := mountCapability("ext4")
+	resp, err := n.CreateVolume(getCtxt(), &csi.CreateVolumeRequest{
+		Name:               "csi-node-test-" + dsdk.RandString(5),
+		CapacityRange:      &csi.CapacityRange{RequiredBytes: 10 * units.GiB},
+		VolumeCapabilities: []*csi.VolumeCapability{vc},
+		Parameters:         map[string]string{"delete_on_unmount": "true"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	id := resp.Volume.VolumeId
+	info, err := n.NodeGetInfo(getCtxt(), &csi.NodeGetInfoRequest{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	staging, _ := stageVolume(t, n, id, vc)
+	if _, err = n.NodeUnstageVolume(getCtxt(), &csi.NodeUnstageVolumeRequest{
+		VolumeId:          id,
+		StagingTargetPath: staging,
+	}); err != nil {
+		t.Fatal(err)
+	}
+	// Deleted by the controller, not the node
+	if _, err = n.dc.GetVolume(getCtxt(), id, false, false); err != nil {
+		t.Fatalf("Expected the volume to exist until unpublished: %s", err)
+	}
+	if _, err = n.ControllerUnpublishVolume(getCtxt(), &csi.ControllerUnpublishVolumeRequest{
+		VolumeId: id,
+		NodeId:   info.NodeId,
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = n.dc.GetVolume(getCtxt(), id, false, false); err == nil {
+		t.Fatal("Expected the volume to be deleted once unpublished")
+	}
+}
+
+func TestNodeExpandVolume(t *testing.T) {
+	n, fh := getDriverNode(t)
+	id, _, cleanf := createVolume(t, n)
+	defer cleanf()
+	staging, unstage := stageVolume(t, n, id, mountCapability("ext4"))
+	defer unstage()
+
+	if _, err := n.ControllerExpandVolume(getCtxt(), &csi.ControllerExpandVolumeRequest{
+		VolumeId:      id,
+		CapacityRange: &csi.CapacityRange{RequiredBytes: 20 * units.GiB},
+	}); err != nil {
+		t.Fatal(err)
+	}
+	// The device only reports its new size after a rescan
+	fh.Script("Size", fake.Result{Out: fmt.Sprintf("%d", 10*units.GiB)})
+	fh.SetDeviceSize(fh.Mounts()[staging], 20*units.GiB)
+	resp, err := n.NodeExpandVolume(getCtxt(), &csi.NodeExpandVolumeRequest{
+		VolumeId:      id,
+		VolumePath:    staging,
+		CapacityRange: &csi.CapacityRange{RequiredBytes: 20 * units.GiB},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.CapacityBytes != 20*units.GiB {
+		t.Fatalf("Expected capacity %d, got %d", 20*units.GiB, resp.CapacityBytes)
+	}
+	if calls := fh.CallsTo("Rescan"); len(calls) != 2 {
+		t.Fatalf("Expected 2 rescans before the new size was seen, got %d", len(calls))
+	}
+	calls := fh.CallsTo("ExpandFs")
+	if len(calls) != 1 || calls[0].Args[1] != "resize2fs" {
+		t.Fatalf("Expected a single ext4 expansion, got %s", calls)
+	}
+}
+
+func TestNodeExpandVolumeInvalid(t *testing.T) {
+	n, _ := getDriverNode(t)
+	cr := &csi.CapacityRange{RequiredBytes: 20 * units.GiB}
+	for _, req := range []*csi.NodeExpandVolumeRequest{
+		{VolumePath: "/mnt/csi-node-test", CapacityRange: cr},
+		{VolumeId: "csi-node-test", CapacityRange: cr},
+		{VolumeId: "csi-node-test", VolumePath: "/mnt/csi-node-test"},
+	} {
+		if _, err := n.NodeExpandVolume(getCtxt(), req); co.GetCode(err) != codes.InvalidArgument {
+			t.Fatalf("Expected InvalidArgument for %v, got %s", req, err)
+		}
+	}
+}
+
+func TestNodeExpandVolumeOffline(t *testing.T) {
+	dc.RegisterFilesystem(&dc.Filesystem{
+		Name: "offlinefs",
+		GrowOffline: func(device string) [][]string {
+			return [][]string{{"offlinefs-grow", device}}
+		},
+	})
+	n, fh := getDriverNode(t)
+	id, _, cleanf := createVolume(t, n)
+	defer cleanf()
+	staging, unstage := stageVolume(t, n, id, mountCapability("ext4"))
+	defer unstage()
+	ctxt := co.WithCtxt(getCtxt(), "TestNodeExpandVolumeOffline", "")
+	st, err := n.state.Get(ctxt, id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Filesystems that can't grow online, or that aren't registered at all
+	for _, fs := range []string{"offlinefs", "zfs"} {
+		st.FsType = fs
+		if err = n.state.Put(ctxt, st); err != nil {
+			t.Fatal(err)
+		}
+		if _, err = n.NodeExpandVolume(getCtxt(), &csi.NodeExpandVolumeRequest{
+			VolumeId:      id,
+			VolumePath:    staging,
+			CapacityRange: &csi.CapacityRange{RequiredBytes: 20 * units.GiB},
+		}); co.GetCode(err) != codes.FailedPrecondition {
+			t.Fatalf("Expected FailedPrecondition expanding %s, got %v", fs, err)
+		}
+	}
+	if calls := fh.CallsTo("ExpandFs"); len(calls) != 0 {
+		t.Fatalf("Expected no filesystem expansion, got %s", calls)
+	}
+}
+
+func TestNodeGetVolumeStatsCondition(t *testing.T) {
+	n, fh := getDriverNode(t)
+	id, _, cleanf := createVolume(t, n)
+	defer cleanf()
+	staging, unstage := stageVolume(t, n, id, mountCapability("ext4"))
+	defer unstage()
+	dev := fh.Mounts()[staging]
+	stats := func() *csi.VolumeCondition {
+		resp, err := n.NodeGetVolumeStats(getCtxt(), &csi.NodeGetVolumeStatsRequest{
+			VolumeId:          id,
+			VolumePath:        staging,
+			StagingTargetPath: staging,
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return resp.VolumeCondition
+	}
+	if cond := stats(); cond.Abnormal {
+		t.Fatalf("Expected a healthy volume, got %s", cond.Message)
+	}
+	fh.SetDeviceState(dev, "blocked")
+	if cond := stats(); !cond.Abnormal || !strings.Contains(cond.Message, "blocked") {
+		t.Fatalf("Expected a stale session to be reported, got %v", cond)
+	}
+	fh.SetDeviceState(dev, "running")
+	fh.RemountReadOnly(dev)
+	if cond := stats(); !cond.Abnormal || !strings.Contains(cond.Message, "read-only") {
+		t.Fatalf("Expected a read-only remount to be reported, got %v", cond)
+	}
+	fh.Script("Size", fake.Result{Err: fmt.Errorf("blockdev: cannot open %s: No such device", dev)})
+	if cond := stats(); !cond.Abnormal || !strings.Contains(cond.Message, "missing") {
+		t.Fatalf("Expected a missing device to be reported, got %v", cond)
+	}
+}
+
+func TestNodeGetVolumeStats(t *testing.T) {
+	n, fh := getDriverNode(t)
+	id, _, cleanf := createVolume(t, n)
+	defer cleanf()
+	staging, unstage := stageVolume(t, n, id, mountCapability("ext4"))
+	defer unstage()
+	dev := fh.Mounts()[staging]
+	fh.SetDeviceSize(dev, 10*units.GiB)
+	fh.SetFsUsage(dev, 1*units.GiB, 100)
+	resp, err := n.NodeGetVolumeStats(getCtxt(), &csi.NodeGetVolumeStatsRequest{
+		VolumeId:   id,
+		VolumePath: staging,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(resp.Usage) != 2 {
+		t.Fatalf("Expected byte and inode usage, got %v", resp.Usage)
+	}
+	b, i := resp.Usage[0], resp.Usage[1]
+	if b.Unit != csi.VolumeUsage_BYTES || b.Total != 10*units.GiB || b.Used != 1*units.GiB || b.Available != 9*units.GiB {
+		t.Fatalf("Unexpected byte usage: %v", b)
+	}
+	if i.Unit != csi.VolumeUsage_INODES || i.Used != 100 || i.Total != i.Used+i.Available {
+		t.Fatalf("Unexpected inode usage: %v", i)
+	}
+	// Usage is node-local, the Datera system is never asked
+	if calls := fh.CallsTo("Statfs"); len(calls) != 1 || calls[0].Args[0] != staging {
+		t.Fatalf("Expected a single statfs of %s, got %s", staging, calls)
+	}
+
+	if _, err = n.NodeGetVolumeStats(getCtxt(), &csi.NodeGetVolumeStatsRequest{
+		VolumeId:   id,
+		VolumePath: "/mnt/does-not-exist",
+	}); co.GetCode(err) != codes.NotFound {
+		t.Fatalf("Expected NotFound for a path that isn't published, got %s", err)
+	}
+}
+
+func TestNodeGetVolumeStatsBlock(t *testing.T) {
+	n, fh := getDriverNode(t)
+	id, _, cleanf := createVolume(t, n)
+	defer cleanf()
+	vc := blockCapability()
+	staging, unstage := stageVolume(t, n, id, vc)
+	defer unstage()
+	target := "/mnt/csi-node-test-block-" + dsdk.RandString(5)
+	if _, err := n.NodePublishVolume(getCtxt(), &csi.NodePublishVolumeRequest{
+		VolumeId:          id,
+		StagingTargetPath: staging,
+		TargetPath:        target,
+		VolumeCapability:  vc,
+	}); err != nil {
+		t.Fatal(err)
+	}
+	fh.SetDeviceSize(fh.Mounts()[target], 10*units.GiB)
+	resp, err := n.NodeGetVolumeStats(getCtxt(), &csi.NodeGetVolumeStatsRequest{
+		VolumeId:   id,
+		VolumePath: target,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(resp.Usage) != 1 || resp.Usage[0].Total != 10*units.GiB {
+		t.Fatalf("Expected the device size as usage, got %v", resp.Usage)
+	}
+	if resp.VolumeCondition.Abnormal {
+		t.Fatalf("Expected a healthy volume, got %s", resp.VolumeCondition.Message)
+	}
+}
+
+func TestNodeStageFsParams(t *testing.T) {
+	n, fh := getDriverNode(t)
+	resp, err := n.CreateVolume(getCtxt(), &csi.CreateVolumeRequest{
+		Name:               "csi-node-test-" + dsdk.RandString(5),
+		VolumeCapabilities: []*csi.VolumeCapability{mountCapability("")},
+		Parameters: map[string]string{
+			"replica_count": "1",
+			"fs_type":       "xfs",
+			"fs_block_size": "4096",
+			"mount_options": "noatime",
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	id := resp.Volume.VolumeId
+	defer n.DeleteVolume(getCtxt(), &csi.DeleteVolumeRequest{VolumeId: id})
+	staging, unstage := stageVolume(t, n, id, mountCapability(""))
+	defer unstage()
+	calls := fh.CallsTo("Format")
+	if len(calls) != 1 || !reflect.DeepEqual(calls[0].Args[1:], []string{"xfs", "-b", "size=4096"}) {
+		t.Fatalf("Expected a single xfs format with a 4096 byte block size, got %s", calls)
+	}
+	calls = fh.CallsTo("Mount")
+	expected := []string{staging, "xfs", "-o", "noatime,nouuid"}
+	if len(calls) != 1 || !reflect.DeepEqual(calls[0].Args[1:], expected) {
+		t.Fatalf("Expected %s, got %s", expected, calls)
+	}
+}
+
+func TestNodeStageVolumeMountFlags(t *testing.T) {
+	n, fh := getDriverNode(t)
+	id, _, cleanf := createVolume(t, n)
+	defer cleanf()
+	vc := mountCapability("ext4")
+	vc.GetMount().MountFlags = []string{"noatime", "discard"}
+	staging, unstage := stageVolume(t, n, id, vc)
+	defer unstage()
+	calls := fh.CallsTo("Mount")
+	if len(calls) != 1 {
+		t.Fatalf("Expected a single mount, got %s", calls)
+	}
+	if args := calls[0].Args; args[1] != staging || strings.Join(args[3:], " ") != "-o noatime,discard" {
+		t.Fatalf("Expected mount flags to be passed to mount, got %s", calls[0])
+	}
+}
+
+func TestNodePublishVolumeReadonly(t *testing.T) {
+	n, fh := getDriverNode(t)
+	id, _, cleanf := createVolume(t, n)
+	defer cleanf()
+	vc := mountCapability("ext4")
+	staging, unstage := stageVolume(t, n, id, vc)
+	defer unstage()
+	target := "/mnt/csi-node-test-ro-" + dsdk.RandString(5)
+	if _, err := n.NodePublishVolume(getCtxt(), &csi.NodePublishVolumeRequest{
+		VolumeId:          id,
+		StagingTargetPath: staging,
+		TargetPath:        target,
+		VolumeCapability:  vc,
+		Readonly:          true,
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if opts, _ := fh.MountOptions(getCtxt(), target); opts[0] != "ro" {
+		t.Fatalf("Expected %s to be mounted read-only, got %s", target, opts)
+	}
+	if opts, _ := fh.MountOptions(getCtxt(), staging); opts[0] != "rw" {
+		t.Fatalf("Expected staging mount %s to stay writable, got %s", staging, opts)
+	}
+}
+
+func TestNodeStageVolumeMultiNodeReaderOnly(t *testing.T) {
+	n, fh := getDriverNode(t)
+	id, _, cleanf := createVolume(t, n)
+	defer cleanf()
+	ro := mountCapability("ext4")
+	ro.AccessMode.Mode = csi.VolumeCapability_AccessMode_MULTI_NODE_READER_ONLY
+
+	// Nothing can format the volume once readers have it
+	info, err := n.NodeGetInfo(getCtxt(), &csi.NodeGetInfoRequest{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	pub, err := n.ControllerPublishVolume(getCtxt(), &csi.ControllerPublishVolumeRequest{
+		VolumeId:         id,
+		NodeId:           info.NodeId,
+		VolumeCapability: ro,
+		Readonly:         true,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = n.NodeStageVolume(getCtxt(), &csi.NodeStageVolumeRequest{
+		VolumeId:          id,
+		StagingTargetPath: "/mnt/csi-node-test-staging-" + dsdk.RandString(5),
+		VolumeCapability:  ro,
+		PublishContext:    pub.PublishContext,
+	}); co.GetCode(err) != codes.FailedPrecondition {
+		t.Fatalf("Expected FailedPrecondition staging an unformatted volume read-only, got %s", err)
+	}
+
+	_, unstage := stageVolume(t, n, id, mountCapability("ext4"))
+	unstage()
+	staging, unstage := stageVolume(t, n, id, ro)
+	defer unstage()
+	if calls := fh.CallsTo("Format"); len(calls) != 1 {
+		t.Fatalf("Expected the volume to be formatted once, got %s", calls)
+	}
+	if opts, _ := fh.MountOptions(getCtxt(), staging); opts[0] != "ro" {
+		t.Fatalf("Expected %s to be mounted read-only, got %s", staging, opts)
+	}
+	target := "/mnt/csi-node-test-ro-" + dsdk.RandString(5)
+	if _, err = n.NodePublishVolume(getCtxt(), &csi.NodePublishVolumeRequest{
+		VolumeId:          id,
+		StagingTargetPath: staging,
+		TargetPath:        target,
+		VolumeCapability:  ro,
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if opts, _ := fh.MountOptions(getCtxt(), target); opts[0] != "ro" {
+		t.Fatalf("Expected %s to be mounted read-only, got %s", target, opts)
+	}
+}
+
+func TestNodePublishVolumeBlock(t *testing.T) {
+	n, fh := getDriverNode(t)
+	id, _, cleanf := createVolume(t, n)
+	defer cleanf()
+	vc := blockCapability()
+	staging, unstage := stageVolume(t, n, id, vc)
+	if calls := fh.CallsTo("Mount"); len(calls) != 0 {
+		t.Fatalf("Expected nothing to be mounted when staging a block volume, got %s", calls)
+	}
+	if calls := fh.CallsTo("Format"); len(calls) != 0 {
+		t.Fatalf("Expected a block volume not to be formatted, got %s", calls)
+	}
+	target := "/mnt/csi-node-test-block-" + dsdk.RandString(5)
+	if _, err := n.NodePublishVolume(getCtxt(), &csi.NodePublishVolumeRequest{
+		VolumeId:          id,
+		StagingTargetPath: staging,
+		TargetPath:        target,
+		VolumeCapability:  vc,
+	}); err != nil {
+		t.Fatal(err)
+	}
+	dev := fh.Mounts()[target]
+	calls := fh.CallsTo("Mount")
+	if len(calls) != 1 || calls[0].Args[0] != dev || calls[0].Args[1] != target || calls[0].Args[3] != "--bind" {
+		t.Fatalf("Expected the device to be bind mounted at %s, got %s", target, calls)
+	}
+	if block, err := fh.IsBlockDevice(getCtxt(), target); err != nil || !block {
+		t.Fatalf("Expected a block device at %s, got %v, %v", target, block, err)
+	}
+	if _, err := n.NodeUnpublishVolume(getCtxt(), &csi.NodeUnpublishVolumeRequest{
+		VolumeId:   id,
+		TargetPath: target,
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := fh.IsBlockDevice(getCtxt(), target); err == nil {
+		t.Fatalf("Expected %s to be removed", target)
+	}
+	unstage()
+	// Only the publish target is ever unmounted, never the device
+	for _, c := range fh.CallsTo("Unmount") {
+		if c.Args[0] != target {
+			t.Fatalf("Unexpected unmount of %s", c.Args[0])
+		}
+	}
+	if calls := fh.CallsTo("Disconnect"); len(calls) != 1 {
+		t.Fatalf("Expected the volume to be logged out, got %s", calls)
+	}
+}
+
+func TestNodeExpandVolumeBlock(t *testing.T) {
+	n, fh := getDriverNode(t)
+	id, _, cleanf := createVolume(t, n)
+	defer cleanf()
+	vc := blockCapability()
+	staging, unstage := stageVolume(t, n, id, vc)
+	defer unstage()
+	target := "/mnt/csi-node-test-block-" + dsdk.RandString(5)
+	if _, err := n.NodePublishVolume(getCtxt(), &csi.NodePublishVolumeRequest{
+		VolumeId:          id,
+		StagingTargetPath: staging,
+		TargetPath:        target,
+		VolumeCapability:  vc,
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := n.ControllerExpandVolume(getCtxt(), &csi.ControllerExpandVolumeRequest{
+		VolumeId:      id,
+		CapacityRange: &csi.CapacityRange{RequiredBytes: 20 * units.GiB},
+	}); err != nil {
+		t.Fatal(err)
+	}
+	fh.Script("Size", fake.Result{Out: fmt.Sprintf("%d", 10*units.GiB)})
+	fh.SetDeviceSize(fh.Mounts()[target], 20*units.GiB)
+	resp, err := n.NodeExpandVolume(getCtxt(), &csi.NodeExpandVolumeRequest{
+		VolumeId:         id,
+		VolumePath:       target,
+		CapacityRange:    &csi.CapacityRange{RequiredBytes: 20 * units.GiB},
+		VolumeCapability: vc,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.CapacityBytes != 20*units.GiB {
+		t.Fatalf("Expected capacity %d, got %d", 20*units.GiB, resp.CapacityBytes)
+	}
+	if calls := fh.CallsTo("Rescan"); len(calls) != 2 {
+		t.Fatalf("Expected 2 rescans before the new size was seen, got %d", len(calls))
+	}
+	if calls := fh.CallsTo("ExpandFs"); len(calls) != 0 {
+		t.Fatalf("Expected no filesystem expansion for a block volume, got %s", calls)
+	}
+}
+
+func TestNodeGetVolumeStatsMultipathDegraded(t *testing.T) {
+	n, fh := getDriverNode(t)
+	id, _, cleanf := createVolume(t, n)
+	defer cleanf()
+	staging, unstage := stageVolume(t, n, id, mountCapability("ext4"))
+	defer unstage()
+	stats := func() *csi.VolumeCondition {
+		resp, err := n.NodeGetVolumeStats(getCtxt(), &csi.NodeGetVolumeStatsRequest{
+			VolumeId:   id,
+			VolumePath: staging,
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return resp.VolumeCondition
+	}
+	if cond := stats(); cond.Abnormal || !strings.Contains(cond.Message, "2 paths") {
+		t.Fatalf("Expected a healthy volume with 2 paths, got %v", cond)
+	}
+	paths, err := fh.MultipathPaths(getCtxt(), fh.Mounts()[staging])
+	if err != nil {
+		t.Fatal(err)
+	}
+	for p := range paths {
+		fh.SetDeviceState(p, "transport-offline")
+		break
+	}
+	if cond := stats(); !cond.Abnormal || !strings.Contains(cond.Message, "1 of 2 paths") {
+		t.Fatalf("Expected a degraded multipath device to be reported, got %v", cond)
+	}
+}
+
+func TestNodeState(t *testing.T) {
+	n, fh := getDriverNode(t)
+	id, _, cleanf := createVolume(t, n)
+	defer cleanf()
+	vc := mountCapability("ext4")
+	staging, unstage := stageVolume(t, n, id, vc)
+	target := "/mnt/csi-node-test-state-" + dsdk.RandString(5)
+	if _, err := n.NodePublishVolume(getCtxt(), &csi.NodePublishVolumeRequest{
+		VolumeId:          id,
+		StagingTargetPath: staging,
+		TargetPath:        target,
+		VolumeCapability:  vc,
+	}); err != nil {
+		t.Fatal(err)
+	}
+	st, err := n.state.Get(getCtxt(), id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if st.TargetIqn == "" || len(st.TargetPortals) == 0 {
+		t.Fatalf("Expected the target to be recorded in node state, got %+v", st)
+	}
+	expected := &NodeVolumeState{
+		VolumeId:      id,
+		NodeId:        "test-node",
+		DevicePath:    fh.Mounts()[staging],
+		StagingPath:   staging,
+		AccessType:    "mount",
+		FsType:        "ext4",
+		Formatted:     true,
+		BindMounts:    []string{target},
+		TargetIqn:     st.TargetIqn,
+		TargetPortals: st.TargetPortals,
+		FormattedAt:   st.FormattedAt,
+		FormattedArgs: st.FormattedArgs,
+	}
+	if !reflect.DeepEqual(st, expected) {
+		t.Fatalf("Expected node state %+v, got %+v", expected, st)
+	}
+	vol, err := n.dc.GetVolume(getCtxt(), id, false, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	md, err := vol.GetMetadata(getCtxt())
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, k := range []string{"device_path", "mount_path", "bind_mount", "formatted", "formatted_by"} {
+		if (*md)[k] != "" {
+			t.Fatalf("Expected no %s in AppInstance metadata, got %s", k, (*md)[k])
+		}
+	}
+
+	if _, err = n.NodeUnpublishVolume(getCtxt(), &csi.NodeUnpublishVolumeRequest{
+		VolumeId:   id,
+		TargetPath: target,
+	}); err != nil {
+		t.Fatal(err)
+	}
+	unstage()
+	if sts, _ := n.state.List(getCtxt()); len(sts) != 0 {
+		t.Fatalf("Expected no node state left, got %+v", sts[0])
+	}
+}
+
+func TestNodeNoBackendRequests(t *testing.T) {
+	fd := fake.NewDatera()
+	fh := fake.NewHost()
+	n, err := NewDateraDriverWithHost(fd.UDC(), fd.HTTPClient(), fh)
+	if err != nil {
+		t.Fatal(err)
+	}
+	n.state = getStateStore(t)
+	id, _, cleanf := createVolume(t, n)
+	defer cleanf()
+	vc := mountCapability("ext4")
+	staging, unstage := stageVolume(t, n, id, vc)
+	reqs := len(fd.Requests())
+	target := "/mnt/csi-node-test-pod-" + dsdk.RandString(5)
+	if _, err = n.NodePublishVolume(getCtxt(), &csi.NodePublishVolumeRequest{
+		VolumeId:          id,
+		StagingTargetPath: staging,
+		TargetPath:        target,
+		VolumeCapability:  vc,
+		VolumeContext: map[string]string{
+			"csi.storage.k8s.io/pod.name":      "test-pod",
+			"csi.storage.k8s.io/pod.namespace": "default",
+		},
+	}); err != nil {
+		t.Fatal(err)
+	}
+	st, err := n.state.Get(getCtxt(), id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if pod := st.Pods[target]; pod["pod_name"] != "test-pod" || pod["pod_namespace"] != "default" {
+		t.Fatalf("Expected pod details in node state, got %+v", st.Pods)
+	}
+	if _, err = n.NodeUnpublishVolume(getCtxt(), &csi.NodeUnpublishVolumeRequest{
+		VolumeId:   id,
+		TargetPath: target,
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if st, err = n.state.Get(getCtxt(), id); err != nil {
+		t.Fatal(err)
+	}
+	if len(st.Pods) != 0 {
+		t.Fatalf("Expected pod details to be removed with the bind mount, got %+v", st.Pods)
+	}
+	if _, err = n.NodeUnstageVolume(getCtxt(), &csi.NodeUnstageVolumeRequest{
+		VolumeId:          id,
+		StagingTargetPath: staging,
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if r := fd.Requests()[reqs:]; len(r) != 0 {
+		t.Fatalf("Expected no backend requests from the node, got %v", r)
+	}
+	// Unstaging again is a no-op
+	unstage()
+}
+
+func TestNodeStateLegacy(t *testing.T) {
+	n, fh := getDriverNode(t)
+	id, _, cleanf := createVolume(t, n)
+	defer cleanf()
+	staging, unstage := stageVolume(t, n, id, mountCapability("ext4"))
+	dev := fh.Mounts()[staging]
+	// Staged by a release that kept node state in AppInstance metadata
+	if err := n.state.Delete(co.WithCtxt(getCtxt(), "TestNodeStateLegacy", ""), id); err != nil {
+		t.Fatal(err)
+	}
+	vol, err := n.dc.GetVolume(getCtxt(), id, false, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = vol.SetMetadata(getCtxt(), &dc.VolMetadata{
+		"device_path": dev,
+		"mount_path":  staging,
+		"access_type": "mount",
+	}); err != nil {
+		t.Fatal(err)
+	}
+	unstage()
+	if _, ok := fh.Mounts()[staging]; ok {
+		t.Fatalf("Volume still mounted at %s after NodeUnstageVolume", staging)
+	}
+	if calls := fh.CallsTo("FlushMultipath"); len(calls) != 1 || calls[0].Args[0] != dev {
+		t.Fatalf("Expected %s to be flushed, got %s", dev, calls)
+	}
+	md, err := vol.GetMetadata(getCtxt())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if (*md)["device_path"] != "" || (*md)["mount_path"] != "" {
+		t.Fatalf("Expected node state to be removed from AppInstance metadata: %v", *md)
+	}
+}
+
+func TestNodeStageFormatProvenance(t *testing.T) {
+	n, _ := getDriverNode(t)
+	id, _, cleanf := createVolume(t, n)
+	defer cleanf()
+	_, unstage := stageVolume(t, n, id, mountCapability("xfs"))
+	defer unstage()
+	st, err := n.state.Get(getCtxt(), id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !st.Formatted || st.FsType != "xfs" || st.FormattedAt == "" || st.FormattedArgs == "" {
+		t.Fatalf("Expected format provenance in node state: %+v", st)
+	}
+}
+
+func TestNodeStageNotNew(t *testing.T) {
+	n, fh := getDriverNode(t)
+	n.conf.DisableMultipath = true
+	id, _, cleanf := createVolume(t, n)
+	defer cleanf()
+	_, unstage := stageVolume(t, n, id, blockCapability())
+	st, err := n.state.Get(getCtxt(), id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	dev := st.DevicePath
+	unstage()
+	// Used as a raw block device since it was created, so it is no longer
+	// empty
+	fh.SetSignature(dev, host.Signature{Type: "crypto_LUKS", Usage: "crypto"})
+	info, err := n.NodeGetInfo(getCtxt(), &csi.NodeGetInfoRequest{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	vc := mountCapability("ext4")
+	pub, err := n.ControllerPublishVolume(getCtxt(), &csi.ControllerPublishVolumeRequest{
+		VolumeId:         id,
+		NodeId:           info.NodeId,
+		VolumeCapability: vc,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer n.ControllerUnpublishVolume(getCtxt(), &csi.ControllerUnpublishVolumeRequest{
+		VolumeId: id,
+		NodeId:   info.NodeId,
+	})
+	if _, ok := pub.PublishContext[PublishCreatedEmpty]; ok {
+		t.Fatalf("Expected only the first attachment to be created empty: %v", pub.PublishContext)
+	}
+	staging := "/mnt/csi-node-test-staging-" + dsdk.RandString(5)
+	if _, err = n.NodeStageVolume(getCtxt(), &csi.NodeStageVolumeRequest{
+		VolumeId:          id,
+		StagingTargetPath: staging,
+		VolumeCapability:  vc,
+		PublishContext:    pub.PublishContext,
+	}); err == nil || !strings.Contains(err.Error(), "refusing") {
+		t.Fatalf("Expected NodeStageVolume to refuse formatting over LUKS, got %v", err)
+	}
+	if calls := fh.CallsTo("Format"); len(calls) != 0 {
+		t.Fatalf("Expected no format, got %s", calls)
+	}
+	n.NodeUnstageVolume(getCtxt(), &csi.NodeUnstageVolumeRequest{
+		VolumeId:          id,
+		StagingTargetPath: staging,
+	})
+}
+
+func TestNodeStageFsck(t *testing.T) {
+	n, fh := getDriverNode(t)
+	n.conf.FsckOnStage = true
+	id, _, cleanf := createVolume(t, n)
+	defer cleanf()
+	_, unstage := stageVolume(t, n, id, mountCapability("ext4"))
+	unstage()
+	// Freshly created filesystems aren't checked
+	if calls := fh.CallsTo("CheckFs"); len(calls) != 0 {
+		t.Fatalf("Expected no filesystem check after format, got %s", calls)
+	}
+	_, unstage = stageVolume(t, n, id, mountCapability("ext4"))
+	unstage()
+	if calls := fh.CallsTo("CheckFs"); len(calls) != 1 || calls[0].Args[1] != "e2fsck" {
+		t.Fatalf("Expected a single ext4 check, got %s", calls)
+	}
+
+	info, err := n.NodeGetInfo(getCtxt(), &csi.NodeGetInfoRequest{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	pub, err := n.ControllerPublishVolume(getCtxt(), &csi.ControllerPublishVolumeRequest{
+		VolumeId:         id,
+		NodeId:           info.NodeId,
+		VolumeCapability: mountCapability("ext4"),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	fh.Script("CheckFs", fake.Result{Out: "Inode 12 has illegal blocks", Err: fmt.Errorf("exit status 4")})
+	staging := "/mnt/csi-node-test-staging-" + dsdk.RandString(5)
+	if _, err = n.NodeStageVolume(getCtxt(), &csi.NodeStageVolumeRequest{
+		VolumeId:          id,
+		StagingTargetPath: staging,
+		VolumeCapability:  mountCapability("ext4"),
+		PublishContext:    pub.PublishContext,
+	}); err == nil {
+		t.Fatal("Expected NodeStageVolume to fail the filesystem check")
+	}
+	if _, ok := fh.Mounts()[staging]; ok {
+		t.Fatalf("Volume with a corrupt filesystem was mounted at %s", staging)
+	}
 }
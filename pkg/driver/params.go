@@ -0,0 +1,236 @@
+package driver
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+
+	dc "github.com/Datera/datera-csi/pkg/client"
+	co "github.com/Datera/datera-csi/pkg/common"
+)
+
+type paramType int
+
+const (
+	paramString paramType = iota
+	paramInt
+	paramBool
+)
+
+func (t paramType) String() string {
+	switch t {
+	case paramInt:
+		return "an integer"
+	case paramBool:
+		return "true or false"
+	}
+	return "a string"
+}
+
+// Parameters under this prefix belong to the CO (external-provisioner and
+// friends) and are never driver parameters
+const reservedParamPrefix = "csi.storage.k8s.io/"
+
+// ParamSpec describes a single StorageClass or VolumeSnapshotClass parameter
+type ParamSpec struct {
+	Name string
+	Type paramType
+	// Used when the parameter isn't set.  An empty Default on an integer
+	// leaves it unset
+	Default string
+	// Inclusive bounds for integers, checked when HasRange is set
+	HasRange bool
+	Min      int64
+	Max      int64
+	// The only values accepted, when not empty
+	Allowed []string
+	// Can be changed on an existing volume through ControllerModifyVolume
+	Mutable bool
+	// Deprecated names still accepted for the parameter
+	Aliases []string
+	// Extra validation, run after the type, range and allowed values checks
+	Check func(v string) error
+}
+
+func (p *ParamSpec) validate(v string) error {
+	switch p.Type {
+	case paramInt:
+		if v == "" && p.Default == "" {
+			return nil
+		}
+		i, err := strconv.ParseInt(v, 10, 64)
+		if err != nil {
+			return fmt.Errorf("%s must be %s, got %q", p.Name, p.Type, v)
+		}
+		if p.HasRange && (i < p.Min || i > p.Max) {
+			return fmt.Errorf("%s must be between %d and %d, got %d", p.Name, p.Min, p.Max, i)
+		}
+	case paramBool:
+		if _, err := strconv.ParseBool(v); err != nil {
+			return fmt.Errorf("%s must be %s, got %q", p.Name, p.Type, v)
+		}
+	}
+	if len(p.Allowed) > 0 {
+		found := false
+		for _, a := range p.Allowed {
+			if v == a {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return fmt.Errorf("%s must be one of %s, got %q", p.Name, p.Allowed, v)
+		}
+	}
+	if p.Check != nil {
+		if err := p.Check(v); err != nil {
+			return fmt.Errorf("%s: %s", p.Name, err)
+		}
+	}
+	return nil
+}
+
+// ParamSchema is the set of parameters a request accepts
+type ParamSchema []*ParamSpec
+
+func (s ParamSchema) lookup(name string) (*ParamSpec, bool) {
+	for _, p := range s {
+		if p.Name == name {
+			return p, true
+		}
+		for _, a := range p.Aliases {
+			if a == name {
+				return p, false
+			}
+		}
+	}
+	return nil, false
+}
+
+// Parse validates params against the schema and returns them under their
+// canonical names with defaults filled in.  Every problem is reported in a
+// single error.  Unknown parameters are an error in strict mode and a
+// warning otherwise
+func (s ParamSchema) Parse(ctxt context.Context, params map[string]string, strict bool) (paramValues, error) {
+	result := paramValues{}
+	problems := []string{}
+	unknown := []string{}
+	keys := make([]string, 0, len(params))
+	for k := range params {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		if strings.HasPrefix(k, reservedParamPrefix) {
+			continue
+		}
+		p, canonical := s.lookup(k)
+		if p == nil {
+			unknown = append(unknown, k)
+			continue
+		}
+		if !canonical {
+			if _, ok := params[p.Name]; ok {
+				problems = append(problems, fmt.Sprintf("%s and its deprecated alias %s are both set", p.Name, k))
+				continue
+			}
+			co.Warningf(ctxt, "Parameter %s is deprecated, use %s instead", k, p.Name)
+		}
+		result[p.Name] = params[k]
+	}
+	if len(unknown) > 0 {
+		if strict {
+			problems = append(problems, fmt.Sprintf("unknown parameters %s", unknown))
+		} else {
+			co.Warningf(ctxt, "Ignoring unknown parameters %s", unknown)
+		}
+	}
+	for _, p := range s {
+		v, ok := result[p.Name]
+		if !ok {
+			result[p.Name] = p.Default
+			continue
+		}
+		if err := p.validate(v); err != nil {
+			problems = append(problems, err.Error())
+		}
+	}
+	if len(problems) > 0 {
+		return nil, fmt.Errorf("Invalid parameters: %s", strings.Join(problems, "; "))
+	}
+	return result, nil
+}
+
+// Mutable returns the names of the parameters ControllerModifyVolume can
+// change
+func (s ParamSchema) Mutable() []string {
+	names := []string{}
+	for _, p := range s {
+		if p.Mutable {
+			names = append(names, p.Name)
+		}
+	}
+	return names
+}
+
+// Parameters after ParamSchema.Parse, so conversions can't fail
+type paramValues map[string]string
+
+func (v paramValues) getInt(name string) int {
+	i, _ := strconv.ParseInt(v[name], 10, 0)
+	return int(i)
+}
+
+func (v paramValues) getBool(name string) bool {
+	b, _ := strconv.ParseBool(v[name])
+	return b
+}
+
+func qosParam(name string) *ParamSpec {
+	return &ParamSpec{Name: name, Type: paramInt, Default: "0", HasRange: true, Min: 0, Max: 1 << 31, Mutable: true}
+}
+
+var volParamSchema = ParamSchema{
+	{Name: "replica_count", Type: paramInt, Default: "3", HasRange: true, Min: 1, Max: 5, Aliases: []string{"replica"}},
+	{Name: "placement_mode", Type: paramString, Default: "hybrid", Allowed: []string{"hybrid", "single_flash", "all_flash"}, Aliases: []string{"placement"}},
+	{Name: "placement_policy", Type: paramString, Default: "default"},
+	{Name: "ip_pool", Type: paramString, Default: "default"},
+	{Name: "template", Type: paramString},
+	{Name: "disable_template_override", Type: paramBool, Default: "false"},
+	{Name: "round_robin", Type: paramBool, Default: "false"},
+	{Name: "delete_on_unmount", Type: paramBool, Default: "false"},
+	{Name: "tenant", Type: paramString, Check: func(v string) error {
+		if v == "" {
+			return nil
+		}
+		return validateTenant(v)
+	}},
+	qosParam("read_iops_max"),
+	qosParam("write_iops_max"),
+	qosParam("total_iops_max"),
+	qosParam("read_bandwidth_max"),
+	qosParam("write_bandwidth_max"),
+	qosParam("total_bandwidth_max"),
+	qosParam("iops_per_gb"),
+	qosParam("bandwidth_per_gb"),
+	// Checked against the chosen filesystem by resolveFsParams
+	{Name: "fs_type", Type: paramString, Check: func(v string) error {
+		if v == "" {
+			return nil
+		}
+		_, err := dc.GetFilesystem(v)
+		return err
+	}},
+	{Name: "fs_args", Type: paramString},
+	{Name: "fs_block_size", Type: paramInt, HasRange: true, Min: 512, Max: 65536},
+	{Name: "fs_inode_ratio", Type: paramInt, HasRange: true, Min: 1024, Max: 67108864},
+	{Name: "fs_reserved_percent", Type: paramInt, HasRange: true, Min: 0, Max: 50},
+	{Name: "mount_options", Type: paramString},
+}
+
+var snapParamSchema = ParamSchema{
+	{Name: "remote_provider_uuid", Type: paramString, Aliases: []string{"remote_provider"}},
+	{Name: "type", Type: paramString, Default: "local", Allowed: []string{"local", "remote", "local_and_remote"}},
+}
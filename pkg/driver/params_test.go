@@ -0,0 +1,119 @@
+package driver
+
+import (
+	"context"
+	"strings"
+	"testing"
+
+	csi "github.com/container-storage-interface/spec/lib/go/csi"
+	codes "google.golang.org/grpc/codes"
+
+	co "github.com/Datera/datera-csi/pkg/common"
+	dsdk "github.com/Datera/go-sdk/pkg/dsdk"
+)
+
+func getParamsCtxt() context.Context {
+	return co.WithCtxt(context.Background(), "params-test", "")
+}
+
+func TestParseVolParamsDefaults(t *testing.T) {
+	vo, err := parseVolParams(getParamsCtxt(), nil, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if vo.Replica != 3 || vo.PlacementMode != "hybrid" || vo.IpPool != "default" || vo.FsReservedPercent != nil {
+		t.Fatalf("Unexpected defaults: %+v", *vo)
+	}
+	vo, err = parseVolParams(getParamsCtxt(), map[string]string{
+		"replica":                   "2",
+		"round_robin":               "true",
+		"fs_reserved_percent":       "0",
+		"csi.storage.k8s.io/fstype": "xfs",
+	}, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if vo.Replica != 2 || !vo.RoundRobin || vo.FsReservedPercent == nil || *vo.FsReservedPercent != 0 {
+		t.Fatalf("Unexpected params: %+v", *vo)
+	}
+}
+
+func TestParseVolParamsErrors(t *testing.T) {
+	params := map[string]string{
+		"replica_count":  "0",
+		"placement_mode": "fast",
+		"round_robin":    "yes",
+		"write_iops_max": "-1",
+		"fs_type":        "zfs",
+		"replica_cont":   "1",
+	}
+	if _, err := parseVolParams(getParamsCtxt(), params, false); err == nil {
+		t.Fatal("Expected invalid parameters to fail")
+	} else {
+		// Every problem is reported at once, unknown keys only in strict mode
+		for _, p := range []string{"replica_count", "placement_mode", "round_robin", "write_iops_max", "fs_type"} {
+			if !strings.Contains(err.Error(), p) {
+				t.Fatalf("Expected %s in %s", p, err)
+			}
+		}
+		if strings.Contains(err.Error(), "unknown") {
+			t.Fatalf("Unknown parameters should only be warned about, got %s", err)
+		}
+	}
+	if _, err := parseVolParams(getParamsCtxt(), map[string]string{"replica_cont": "1"}, false); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := parseVolParams(getParamsCtxt(), map[string]string{"replica_cont": "1"}, true); err == nil || !strings.Contains(err.Error(), "replica_cont") {
+		t.Fatalf("Expected the unknown parameter to be rejected in strict mode, got %v", err)
+	}
+	if _, err := parseVolParams(getParamsCtxt(), map[string]string{"replica": "1", "replica_count": "2"}, false); err == nil {
+		t.Fatal("Expected an error when a parameter and its alias are both set")
+	}
+}
+
+func TestValidateMutableParams(t *testing.T) {
+	if err := validateMutableParams(getParamsCtxt(), map[string]string{"total_iops_max": "100"}); err != nil {
+		t.Fatal(err)
+	}
+	for _, params := range []map[string]string{
+		{"replica_count": "1"},
+		{"total_iops_max": "many"},
+		{"total_iops_max": "-5"},
+	} {
+		if err := validateMutableParams(getParamsCtxt(), params); err == nil {
+			t.Fatalf("Expected an error for %s", params)
+		}
+	}
+}
+
+func TestParseSnapParams(t *testing.T) {
+	so, err := parseSnapParams(getParamsCtxt(), map[string]string{"remote_provider": "c7f97223"}, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if so.RemoteProviderUuid != "c7f97223" || so.Type != "local" {
+		t.Fatalf("Unexpected snapshot params: %+v", *so)
+	}
+	if _, err = parseSnapParams(getParamsCtxt(), map[string]string{"type": "elsewhere"}, false); err == nil {
+		t.Fatal("Expected an error for an unknown snapshot type")
+	}
+}
+
+func TestControllerCreateVolumeStrictParams(t *testing.T) {
+	d := getDriverController(t)
+	d.conf.StrictParams = true
+	if _, err := d.CreateVolume(getCtxt(), &csi.CreateVolumeRequest{
+		Name:               "csi-controller-test-" + dsdk.RandString(5),
+		VolumeCapabilities: []*csi.VolumeCapability{mountCapability("ext4")},
+		Parameters: map[string]string{
+			"replica_cont": "1",
+		},
+	}); co.GetCode(err) != codes.InvalidArgument {
+		t.Fatalf("Expected InvalidArgument for an unknown parameter, got %v", err)
+	}
+	if _, err := d.GetCapacity(getCtxt(), &csi.GetCapacityRequest{
+		Parameters: map[string]string{"replica_cont": "1"},
+	}); co.GetCode(err) != codes.InvalidArgument {
+		t.Fatalf("Expected InvalidArgument for an unknown parameter, got %v", err)
+	}
+}
@@ -0,0 +1,414 @@
+package driver
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	dc "github.com/Datera/datera-csi/pkg/client"
+	co "github.com/Datera/datera-csi/pkg/common"
+	host "github.com/Datera/datera-csi/pkg/host"
+)
+
+const dateraIqnPrefix = "iqn.2013-05.com.daterainc:"
+
+// ReconcileAction is an inconsistency found by Reconcile and what was done
+// about it.  In dry-run mode nothing is done and Applied stays false
+type ReconcileAction struct {
+	// logout, flush, unmount, state or report
+	Kind    string
+	Target  string
+	Reason  string
+	Applied bool
+	Err     error
+}
+
+func (a ReconcileAction) String() string {
+	s := fmt.Sprintf("%s %s: %s", a.Kind, a.Target, a.Reason)
+	if a.Err != nil {
+		s = fmt.Sprintf("%s (failed: %s)", s, a.Err)
+	}
+	return s
+}
+
+type reconciler struct {
+	d       *Driver
+	dryRun  bool
+	actions []ReconcileAction
+}
+
+// Runs fix for an inconsistency unless this is a dry run.  Report only
+// actions pass a nil fix
+func (r *reconciler) act(ctxt context.Context, kind, target, reason string, fix func() error) {
+	a := ReconcileAction{Kind: kind, Target: target, Reason: reason}
+	switch {
+	case fix == nil:
+		co.Warningf(ctxt, "Reconcile: %s", a)
+	case r.dryRun:
+		co.Infof(ctxt, "Reconcile (dry run): would %s", a)
+	default:
+		if a.Err = fix(); a.Err == nil {
+			a.Applied = true
+			co.Infof(ctxt, "Reconcile: %s", a)
+		} else {
+			co.Errorf(ctxt, "Reconcile: %s", a)
+		}
+	}
+	r.actions = append(r.actions, a)
+}
+
+// Reconcile compares the iSCSI sessions to Datera targets, multipath devices
+// and mounts under the kubelet directory on this node with the volumes
+// published to it, cleaning up whatever a restart of the node plugin in the
+// middle of an operation left behind:
+//
+//   - Sessions to targets that no longer exist, or whose volume is no longer
+//     published to this node, are logged out unless still mounted or bind
+//     mounted into a pod.  Targets the node state records, or that can't be
+//     looked up, are only reported
+//   - Multipath devices without any paths are flushed unless still mounted
+//   - Mounts this driver made whose device has disappeared are unmounted
+//   - Node state (see StateStore) no longer matching the sessions and mounts
+//     is corrected
+//
+// With dryRun nothing is changed, the actions that would have been taken are
+// logged and returned
+func (d *Driver) Reconcile(ctxt context.Context, dryRun bool) ([]ReconcileAction, error) {
+	tid, _ := ctxt.Value(co.TraceId).(string)
+	ctxt = co.WithCtxt(ctxt, "Reconcile", tid)
+	r := &reconciler{d: d, dryRun: dryRun, actions: []ReconcileAction{}}
+	if err := d.state.Recover(ctxt); err != nil {
+		return nil, err
+	}
+	iqn, err := d.host.InitiatorName(ctxt)
+	if err != nil {
+		return nil, err
+	}
+	targets, err := d.targetSessions(ctxt)
+	if err != nil {
+		return nil, err
+	}
+	// Tenants volumes were staged from are listed even when the configuration
+	// doesn't name them, so their sessions aren't taken for orphans
+	sts, err := d.state.List(ctxt)
+	if err != nil {
+		return nil, err
+	}
+	staged := []string{}
+	for _, st := range sts {
+		tenant, _ := co.ParseVolId(st.VolumeId)
+		staged = append(staged, tenant)
+	}
+	// Without a complete listing a missing volume can't be told from one
+	// that wasn't listed, so nothing is logged out
+	listed := true
+	vols, err := d.listVolumes(ctxt, d.tenants(ctxt, staged...))
+	if err != nil {
+		co.Warningf(ctxt, "Reconcile: could not list volumes, only reporting unknown sessions: %s", err)
+		listed = false
+	}
+	byIqn := map[string]*dc.Volume{}
+	byId := map[string]*dc.Volume{}
+	for _, vol := range vols {
+		byIqn[vol.Iqn] = vol
+		byId[vol.Id] = vol
+	}
+	stByIqn := map[string]*NodeVolumeState{}
+	for _, st := range sts {
+		if st.TargetIqn != "" {
+			stByIqn[st.TargetIqn] = st
+		}
+	}
+
+	tiqns := []string{}
+	for tiqn := range targets {
+		tiqns = append(tiqns, tiqn)
+	}
+	sort.Strings(tiqns)
+	for _, tiqn := range tiqns {
+		if vol, ok := byIqn[tiqn]; ok {
+			r.volume(ctxt, vol, iqn, targets[tiqn])
+		} else if st, ok := stByIqn[tiqn]; ok {
+			r.act(ctxt, "report", tiqn, fmt.Sprintf("volume %s staged on this node was not found", st.VolumeId), nil)
+		} else if !listed {
+			r.act(ctxt, "report", tiqn, "no volume known for this target", nil)
+		} else {
+			r.orphan(ctxt, tiqn, targets[tiqn], "no volume exists for this target")
+		}
+	}
+
+	if sts, err = d.state.List(ctxt); err != nil {
+		return nil, err
+	}
+	// Some may have been logged out above
+	if targets, err = d.targetSessions(ctxt); err != nil {
+		return nil, err
+	}
+	for _, st := range sts {
+		tiqn := st.TargetIqn
+		if vol, ok := byId[st.VolumeId]; ok {
+			tiqn = vol.Iqn
+		}
+		r.state(ctxt, st.VolumeId, targets[tiqn])
+	}
+
+	// Only mounts this driver made are touched, other plugins mount under
+	// the kubelet directory too
+	if sts, err = d.state.List(ctxt); err != nil {
+		return nil, err
+	}
+	owned := map[string]bool{}
+	for _, st := range sts {
+		if st.StagingPath != "" {
+			owned[st.StagingPath] = true
+		}
+		for _, p := range st.BindMounts {
+			owned[p] = true
+		}
+	}
+	pluginDir := filepath.Join(d.conf.KubeletDir, "plugins", d.conf.DriverName) + "/"
+	mounts, err := d.host.ListMounts(ctxt, d.conf.KubeletDir)
+	if err != nil {
+		return nil, err
+	}
+	paths := []string{}
+	for path := range mounts {
+		if owned[path] || strings.HasPrefix(path, pluginDir) {
+			paths = append(paths, path)
+		}
+	}
+	sort.Strings(paths)
+	for _, path := range paths {
+		dev := mounts[path]
+		if !strings.HasPrefix(dev, "/dev/") || !d.deviceGone(ctxt, dev) {
+			continue
+		}
+		r.act(ctxt, "unmount", path, fmt.Sprintf("device %s no longer exists", dev), func() error {
+			return d.host.Unmount(ctxt, path)
+		})
+	}
+
+	maps, err := d.host.MultipathMaps(ctxt)
+	if err != nil {
+		return nil, err
+	}
+	if mounts, err = d.host.ListMounts(ctxt, "/"); err != nil {
+		return nil, err
+	}
+	for _, dm := range maps {
+		mpaths, err := d.host.MultipathPaths(ctxt, dm)
+		if err != nil || !allMissing(mpaths) {
+			continue
+		}
+		if mnt := mountOf(mounts, dm); mnt != "" {
+			r.act(ctxt, "report", dm, fmt.Sprintf("multipath device has no paths but is still mounted at %s", mnt), nil)
+			continue
+		}
+		r.act(ctxt, "flush", dm, "multipath device has no paths", func() error {
+			return d.host.FlushMultipath(ctxt, dm)
+		})
+	}
+	co.Infof(ctxt, "Reconcile found %d inconsistencies", len(r.actions))
+	return r.actions, nil
+}
+
+// Returns the iSCSI sessions to Datera targets by target IQN
+func (d *Driver) targetSessions(ctxt context.Context) (map[string][]*host.Session, error) {
+	sessions, err := d.host.Sessions(ctxt)
+	if err != nil {
+		return nil, err
+	}
+	targets := map[string][]*host.Session{}
+	for _, s := range sessions {
+		if strings.HasPrefix(s.Iqn, dateraIqnPrefix) {
+			targets[s.Iqn] = append(targets[s.Iqn], s)
+		}
+	}
+	return targets, nil
+}
+
+// Checks the sessions to a volume's target.  The volume lock is held so a
+// concurrent NodeStageVolume or NodeUnstageVolume isn't raced
+func (r *reconciler) volume(ctxt context.Context, vol *dc.Volume, iqn string, sessions []*host.Session) {
+	release, err := r.d.lock(ctxt, vol.Id, "Reconcile")
+	if err != nil {
+		co.Warningf(ctxt, "Reconcile: skipping %s: %s", vol.Id, err)
+		return
+	}
+	defer release()
+	// The ACL may have changed while waiting on the lock
+	id := vol.Id
+	if vol, err = r.d.dc.GetVolume(ctxt, id, false, false); err != nil {
+		co.Warningf(ctxt, "Reconcile: skipping %s: %s", id, err)
+		return
+	}
+	published := false
+	for _, init := range vol.Initiators {
+		published = published || init == iqn
+	}
+	if !published {
+		r.orphan(ctxt, vol.Iqn, sessions, fmt.Sprintf("volume %s is no longer published to this node", vol.Name))
+	}
+}
+
+// Corrects the recorded node state of a volume against what is actually
+// logged in and mounted
+func (r *reconciler) state(ctxt context.Context, vid string, sessions []*host.Session) {
+	release, err := r.d.lock(ctxt, vid, "Reconcile")
+	if err != nil {
+		co.Warningf(ctxt, "Reconcile: skipping %s: %s", vid, err)
+		return
+	}
+	defer release()
+	st, err := r.d.state.Get(ctxt, vid)
+	if err != nil {
+		co.Warningf(ctxt, "Reconcile: skipping %s: %s", vid, err)
+		return
+	}
+	mounts, err := r.d.host.ListMounts(ctxt, r.d.conf.KubeletDir)
+	if err != nil {
+		co.Warningf(ctxt, "Reconcile: skipping %s: %s", vid, err)
+		return
+	}
+	dev := r.device(ctxt, sessions)
+	// Logged in but the device couldn't be determined, or logged out with
+	// the multipath device still left to flush
+	if dev == "" && st.DevicePath != "" {
+		if _, err := r.d.host.Size(ctxt, st.DevicePath); len(sessions) > 0 || err == nil {
+			dev = st.DevicePath
+		}
+	}
+	fixes := []string{}
+	if st.DevicePath != dev {
+		fixes = append(fixes, fmt.Sprintf("device_path %q -> %q", st.DevicePath, dev))
+		st.DevicePath = dev
+	}
+	if st.StagingPath != "" && mounts[st.StagingPath] == "" {
+		fixes = append(fixes, fmt.Sprintf("staging_path %s is not mounted", st.StagingPath))
+		st.StagingPath = ""
+	}
+	for _, p := range st.BindMounts {
+		if _, ok := mounts[p]; !ok {
+			fixes = append(fixes, fmt.Sprintf("bind_mount %s is not mounted", p))
+			st.RemoveBindMount(p)
+		}
+	}
+	if len(fixes) == 0 {
+		return
+	}
+	r.act(ctxt, "state", st.VolumeId, strings.Join(fixes, ", "), func() error {
+		return r.d.state.Put(ctxt, st)
+	})
+}
+
+// Logs out of the sessions to a target nothing should be using, flushing
+// its multipath device first
+func (r *reconciler) orphan(ctxt context.Context, tiqn string, sessions []*host.Session, reason string) {
+	mounts, err := r.d.host.ListMounts(ctxt, "/")
+	if err != nil {
+		co.Warningf(ctxt, "Reconcile: skipping %s: %s", tiqn, err)
+		return
+	}
+	dev := r.device(ctxt, sessions)
+	for _, s := range sessions {
+		for _, d := range []string{dev, s.Device} {
+			if mnt := mountOf(mounts, d); mnt != "" {
+				r.act(ctxt, "report", tiqn, fmt.Sprintf("%s, but %s is still mounted at %s", reason, d, mnt), nil)
+				return
+			}
+		}
+	}
+	// Raw block volumes are bind mounted into pods as device nodes, which
+	// the mount table doesn't show as the device itself
+	sts, err := r.d.state.List(ctxt)
+	if err != nil {
+		co.Warningf(ctxt, "Reconcile: skipping %s: %s", tiqn, err)
+		return
+	}
+	for _, st := range sts {
+		if len(st.BindMounts) == 0 {
+			continue
+		}
+		if st.TargetIqn == tiqn || (st.DevicePath != "" && st.DevicePath == dev) {
+			r.act(ctxt, "report", tiqn, fmt.Sprintf("%s, but volume %s is still bind mounted at %s", reason, st.VolumeId, strings.Join(st.BindMounts, ", ")), nil)
+			return
+		}
+	}
+	portals := []string{}
+	for _, s := range sessions {
+		portals = append(portals, s.Portal)
+	}
+	r.act(ctxt, "logout", tiqn, reason, func() error {
+		if dm, err := r.d.host.MultipathDevice(ctxt, dev); err == nil {
+			if err = r.d.host.FlushMultipath(ctxt, dm); err != nil {
+				return err
+			}
+		}
+		return r.d.host.Disconnect(ctxt, tiqn, portals)
+	})
+}
+
+// Returns the device a volume is used through, the multipath device if
+// there is one
+func (r *reconciler) device(ctxt context.Context, sessions []*host.Session) string {
+	for _, s := range sessions {
+		if s.Device == "" {
+			continue
+		}
+		if dm, err := r.d.host.MultipathDevice(ctxt, s.Device); err == nil {
+			return dm
+		}
+		return s.Device
+	}
+	return ""
+}
+
+// A device is only gone when its node no longer exists, failing to read its
+// size may be transient
+func (d *Driver) deviceGone(ctxt context.Context, dev string) bool {
+	if _, err := d.host.Size(ctxt, dev); err == nil {
+		return false
+	}
+	_, err := d.host.IsBlockDevice(ctxt, dev)
+	return os.IsNotExist(err)
+}
+
+func mountOf(mounts map[string]string, dev string) string {
+	if dev == "" {
+		return ""
+	}
+	for path, d := range mounts {
+		if d == dev {
+			return path
+		}
+	}
+	return ""
+}
+
+func allMissing(paths map[string]string) bool {
+	for _, state := range paths {
+		if state != "missing" {
+			return false
+		}
+	}
+	return true
+}
+
+// Reconciler runs Reconcile at startup and then every reconcile_interval
+// seconds
+func (d *Driver) Reconciler() {
+	ctxt := co.WithCtxt(context.Background(), "Reconciler", "")
+	co.Infof(ctxt, "Starting node reconciler. Interval: %d, dry run: %t", d.conf.ReconcileInterval, d.conf.ReconcileDryRun)
+	for {
+		if _, err := d.Reconcile(ctxt, d.conf.ReconcileDryRun); err != nil {
+			co.Errorf(ctxt, "Reconcile failure: %s", err)
+		}
+		if d.conf.ReconcileInterval == 0 {
+			return
+		}
+		Sleeper(d.conf.ReconcileInterval)
+	}
+}
@@ -0,0 +1,301 @@
+package driver
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+
+	csi "github.com/container-storage-interface/spec/lib/go/csi"
+
+	co "github.com/Datera/datera-csi/pkg/common"
+	fake "github.com/Datera/datera-csi/pkg/fake"
+	host "github.com/Datera/datera-csi/pkg/host"
+	dsdk "github.com/Datera/go-sdk/pkg/dsdk"
+)
+
+func getDriverReconcile(t *testing.T) (*Driver, *fake.Host) {
+	n, fh := getDriverNode(t)
+	n.conf.KubeletDir = "/mnt"
+	return n, fh
+}
+
+func reconcile(t *testing.T, n *Driver, dryRun bool) []ReconcileAction {
+	actions, err := n.Reconcile(getCtxt(), dryRun)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return actions
+}
+
+func TestReconcileOrphanSession(t *testing.T) {
+	n, fh := getDriverReconcile(t)
+	// Left behind by a volume deleted while the node plugin was down
+	iqn := connectOrphan(t, fh)
+	actions := reconcile(t, n, true)
+	if len(actions) != 1 || actions[0].Kind != "logout" || actions[0].Target != iqn || actions[0].Applied {
+		t.Fatalf("Expected a single dry run logout of %s, got %s", iqn, actions)
+	}
+	if calls := fh.CallsTo("Disconnect"); len(calls) != 0 {
+		t.Fatalf("Expected no changes in a dry run, got %s", calls)
+	}
+
+	actions = reconcile(t, n, false)
+	if len(actions) != 1 || !actions[0].Applied {
+		t.Fatalf("Expected a single logout, got %s", actions)
+	}
+	ops := []string{}
+	for _, c := range fh.Calls() {
+		if c.Op == "FlushMultipath" || c.Op == "Disconnect" {
+			ops = append(ops, c.Op)
+		}
+	}
+	if strings.Join(ops, " ") != "FlushMultipath Disconnect" {
+		t.Fatalf("Expected the multipath device to be flushed before logout, got %s", ops)
+	}
+	if sessions, _ := fh.Sessions(getCtxt()); len(sessions) != 0 {
+		t.Fatalf("Expected no sessions left, got %d", len(sessions))
+	}
+	if actions = reconcile(t, n, false); len(actions) != 0 {
+		t.Fatalf("Expected nothing left to reconcile, got %s", actions)
+	}
+}
+
+func connectOrphan(t *testing.T, fh *fake.Host) string {
+	iqn := dateraIqnPrefix + "tc:01:sn:0123456789abcdef"
+	c := &host.Connector{Multipath: true}
+	for _, ip := range []string{"172.28.41.10", "172.28.41.11"} {
+		c.Targets = append(c.Targets, host.TargetInfo{Iqn: iqn, Portal: ip, Port: "3260"})
+	}
+	if _, err := fh.Connect(getCtxt(), c); err != nil {
+		t.Fatal(err)
+	}
+	return iqn
+}
+
+func TestReconcileOrphanStaged(t *testing.T) {
+	n, fh := getDriverReconcile(t)
+	iqn := connectOrphan(t, fh)
+	// Staged from a tenant this node doesn't list
+	if err := n.state.Put(co.WithCtxt(getCtxt(), "TestReconcileOrphanStaged", ""), &NodeVolumeState{
+		VolumeId:   "/root/other/csi-reconcile-test",
+		TargetIqn:  iqn,
+		DevicePath: "/dev/dm-0",
+	}); err != nil {
+		t.Fatal(err)
+	}
+	actions := reconcile(t, n, false)
+	if len(actions) == 0 || actions[0].Kind != "report" || actions[0].Target != iqn {
+		t.Fatalf("Expected the staged target to be reported, got %s", actions)
+	}
+	if calls := fh.CallsTo("Disconnect"); len(calls) != 0 {
+		t.Fatalf("Expected a staged volume not to be logged out, got %s", calls)
+	}
+}
+
+func TestReconcileOrphanListFailure(t *testing.T) {
+	fd := fake.NewDatera()
+	fh := fake.NewHost()
+	n, err := NewDateraDriverWithHost(fd.UDC(), fd.HTTPClient(), fh)
+	if err != nil {
+		t.Fatal(err)
+	}
+	n.state = getStateStore(t)
+	n.conf.KubeletDir = "/mnt"
+	iqn := connectOrphan(t, fh)
+	fd.InjectError("GET", "/app_instances", &dsdk.ApiErrorResponse{
+		Name: "InternalError",
+		Http: 500,
+	})
+	actions := reconcile(t, n, false)
+	if len(actions) != 1 || actions[0].Kind != "report" || actions[0].Target != iqn {
+		t.Fatalf("Expected the target to only be reported, got %s", actions)
+	}
+	if calls := fh.CallsTo("Disconnect"); len(calls) != 0 {
+		t.Fatalf("Expected nothing to be logged out without a volume listing, got %s", calls)
+	}
+}
+
+func TestReconcileOrphanBindMounted(t *testing.T) {
+	n, fh := getDriverReconcile(t)
+	id, _, cleanf := createVolume(t, n)
+	defer cleanf()
+	vc := blockCapability()
+	staging, unstage := stageVolume(t, n, id, vc)
+	defer unstage()
+	target := "/mnt/csi-reconcile-test-pod-" + dsdk.RandString(5)
+	if _, err := n.NodePublishVolume(getCtxt(), &csi.NodePublishVolumeRequest{
+		VolumeId:          id,
+		StagingTargetPath: staging,
+		TargetPath:        target,
+		VolumeCapability:  vc,
+	}); err != nil {
+		t.Fatal(err)
+	}
+	info, err := n.NodeGetInfo(getCtxt(), &csi.NodeGetInfoRequest{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = n.ControllerUnpublishVolume(getCtxt(), &csi.ControllerUnpublishVolumeRequest{
+		VolumeId: id,
+		NodeId:   info.NodeId,
+	}); err != nil {
+		t.Fatal(err)
+	}
+	// The mount table shows a bind mounted device node under the devtmpfs
+	// it came from, not as the device
+	if err = fh.Unmount(getCtxt(), target); err != nil {
+		t.Fatal(err)
+	}
+	actions := reconcile(t, n, false)
+	if len(actions) == 0 || actions[0].Kind != "report" || !strings.Contains(actions[0].Reason, "bind mounted") {
+		t.Fatalf("Expected the bind mounted target to be reported, got %s", actions)
+	}
+	if calls := fh.CallsTo("Disconnect"); len(calls) != 0 {
+		t.Fatalf("Expected a bind mounted volume not to be logged out, got %s", calls)
+	}
+}
+
+func TestReconcileUnpublishedInUse(t *testing.T) {
+	n, fh := getDriverReconcile(t)
+	id, _, cleanf := createVolume(t, n)
+	defer cleanf()
+	_, unstage := stageVolume(t, n, id, mountCapability("ext4"))
+	defer unstage()
+	if actions := reconcile(t, n, false); len(actions) != 0 {
+		t.Fatalf("Expected nothing to reconcile for a staged volume, got %s", actions)
+	}
+	info, err := n.NodeGetInfo(getCtxt(), &csi.NodeGetInfoRequest{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = n.ControllerUnpublishVolume(getCtxt(), &csi.ControllerUnpublishVolumeRequest{
+		VolumeId: id,
+		NodeId:   info.NodeId,
+	}); err != nil {
+		t.Fatal(err)
+	}
+	// Still mounted, so it is only reported
+	actions := reconcile(t, n, false)
+	if len(actions) != 1 || actions[0].Kind != "report" || !strings.Contains(actions[0].Reason, "no longer published") {
+		t.Fatalf("Expected the unpublished volume to be reported, got %s", actions)
+	}
+	if calls := fh.CallsTo("Disconnect"); len(calls) != 0 {
+		t.Fatalf("Expected a mounted volume not to be logged out, got %s", calls)
+	}
+}
+
+func TestReconcileState(t *testing.T) {
+	n, fh := getDriverReconcile(t)
+	id, _, cleanf := createVolume(t, n)
+	defer cleanf()
+	staging, unstage := stageVolume(t, n, id, mountCapability("ext4"))
+	defer unstage()
+	// The node plugin restarted after unmounting but before saving its state
+	if err := fh.Unmount(getCtxt(), staging); err != nil {
+		t.Fatal(err)
+	}
+	actions := reconcile(t, n, false)
+	if len(actions) != 1 || actions[0].Kind != "state" || !actions[0].Applied {
+		t.Fatalf("Expected a single node state repair, got %s", actions)
+	}
+	st, err := n.state.Get(getCtxt(), id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if st.StagingPath != "" || st.DevicePath == "" {
+		t.Fatalf("Expected only staging_path to be cleared, got %+v", st)
+	}
+}
+
+func TestReconcileDanglingMultipath(t *testing.T) {
+	n, fh := getDriverReconcile(t)
+	id, _, cleanf := createVolume(t, n)
+	defer cleanf()
+	staging, unstage := stageVolume(t, n, id, mountCapability("ext4"))
+	defer unstage()
+	dm := fh.Mounts()[staging]
+	vol, err := n.dc.GetVolume(getCtxt(), id, false, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Logged out without flushing the multipath device first
+	if err = fh.Disconnect(getCtxt(), vol.Iqn, vol.Ips); err != nil {
+		t.Fatal(err)
+	}
+	actions := reconcile(t, n, false)
+	if len(actions) != 1 || actions[0].Kind != "report" || actions[0].Target != dm {
+		t.Fatalf("Expected the mounted multipath device to be reported, got %s", actions)
+	}
+	if calls := fh.CallsTo("FlushMultipath"); len(calls) != 0 {
+		t.Fatalf("Expected a mounted multipath device not to be flushed, got %s", calls)
+	}
+
+	if err = fh.Unmount(getCtxt(), staging); err != nil {
+		t.Fatal(err)
+	}
+	// The node state still records the staging mount
+	actions = reconcile(t, n, false)
+	if len(actions) != 2 || actions[0].Kind != "state" || actions[1].Kind != "flush" || actions[1].Target != dm || !actions[1].Applied {
+		t.Fatalf("Expected %s to be flushed, got %s", dm, actions)
+	}
+}
+
+func TestReconcileStaleMount(t *testing.T) {
+	n, fh := getDriverReconcile(t)
+	id, _, cleanf := createVolume(t, n)
+	defer cleanf()
+	staging, unstage := stageVolume(t, n, id, mountCapability("ext4"))
+	defer unstage()
+	// The device was torn down underneath the mount
+	if err := fh.FlushMultipath(getCtxt(), fh.Mounts()[staging]); err != nil {
+		t.Fatal(err)
+	}
+	actions := reconcile(t, n, false)
+	found := false
+	for _, a := range actions {
+		if a.Kind == "unmount" && a.Target == staging && a.Applied {
+			found = true
+		}
+	}
+	if !found {
+		t.Fatalf("Expected %s to be unmounted, got %s", staging, actions)
+	}
+	if _, ok := fh.Mounts()[staging]; ok {
+		t.Fatalf("%s still mounted", staging)
+	}
+}
+
+func TestReconcileForeignMount(t *testing.T) {
+	n, fh := getDriverReconcile(t)
+	id, _, cleanf := createVolume(t, n)
+	defer cleanf()
+	staging, unstage := stageVolume(t, n, id, mountCapability("ext4"))
+	defer unstage()
+	// Another plugin's mount whose device is gone
+	iqn := "iqn.2004-10.com.example:foreign"
+	dev, err := fh.Connect(getCtxt(), &host.Connector{Targets: []host.TargetInfo{
+		{Iqn: iqn, Portal: "172.28.50.10", Port: "3260"},
+	}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	other := "/mnt/plugins/kubernetes.io/iscsi/iface-default/disk-" + dsdk.RandString(5)
+	if err = fh.Mount(getCtxt(), dev, other, "ext4", []string{}); err != nil {
+		t.Fatal(err)
+	}
+	if err = fh.Disconnect(getCtxt(), iqn, []string{"172.28.50.10:3260"}); err != nil {
+		t.Fatal(err)
+	}
+	// And a device that only failed to report its size
+	fh.Script("Size", fake.Result{Err: fmt.Errorf("blockdev: ioctl error")})
+	if actions := reconcile(t, n, false); len(actions) != 0 {
+		t.Fatalf("Expected nothing to reconcile, got %s", actions)
+	}
+	mounts := fh.Mounts()
+	if _, ok := mounts[other]; !ok {
+		t.Fatalf("Expected %s to stay mounted", other)
+	}
+	if _, ok := mounts[staging]; !ok {
+		t.Fatalf("Expected %s to stay mounted", staging)
+	}
+}
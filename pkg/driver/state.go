@@ -0,0 +1,225 @@
+package driver
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	co "github.com/Datera/datera-csi/pkg/common"
+)
+
+// NodeVolumeState is what a node knows about a volume it has staged or
+// published.  It used to live in AppInstance metadata, which costs API calls
+// on every stage and publish and can only describe one node at a time
+type NodeVolumeState struct {
+	VolumeId    string   `json:"volume_id"`
+	NodeId      string   `json:"node_id"`
+	DevicePath  string   `json:"device_path"`
+	StagingPath string   `json:"staging_path"`
+	AccessType  string   `json:"access_type"`
+	FsType      string   `json:"fs_type"`
+	Formatted   bool     `json:"formatted"`
+	BindMounts  []string `json:"bind_mounts"`
+
+	// Provenance of a filesystem this node created, for tracking down who
+	// formatted what
+	FormattedAt   string `json:"formatted_at,omitempty"`
+	FormattedArgs string `json:"formatted_args,omitempty"`
+
+	// Target logged in to, from the PublishContext, so unstaging doesn't
+	// need the backend
+	TargetIqn     string   `json:"target_iqn,omitempty"`
+	TargetPortals []string `json:"target_portals,omitempty"`
+	// Pod information kubelet passed to NodePublishVolume by target path,
+	// see podMetadataKeys
+	Pods map[string]map[string]string `json:"pods,omitempty"`
+}
+
+// Empty is true when nothing is staged or published on the node anymore
+func (s *NodeVolumeState) Empty() bool {
+	return s.DevicePath == "" && s.StagingPath == "" && len(s.BindMounts) == 0
+}
+
+// AddBindMount records a NodePublishVolume target path
+func (s *NodeVolumeState) AddBindMount(path string) {
+	for _, p := range s.BindMounts {
+		if p == path {
+			return
+		}
+	}
+	s.BindMounts = append(s.BindMounts, path)
+	sort.Strings(s.BindMounts)
+}
+
+// RemoveBindMount forgets a NodePublishVolume target path and the pod it
+// was published to
+func (s *NodeVolumeState) RemoveBindMount(path string) {
+	keep := []string{}
+	for _, p := range s.BindMounts {
+		if p != path {
+			keep = append(keep, p)
+		}
+	}
+	s.BindMounts = keep
+	delete(s.Pods, path)
+	if len(s.Pods) == 0 {
+		s.Pods = nil
+	}
+}
+
+// StateStore keeps a NodeVolumeState per volume as a JSON file under
+// <dir>/<node id>/.  Files are replaced atomically, so a crash leaves either
+// the old or the new state behind, never a partial one.  Callers serialize
+// access to a volume through the driver volume locks
+type StateStore struct {
+	dir  string
+	node string
+}
+
+const (
+	stateExt   = ".json"
+	tmpExt     = ".tmp"
+	corruptExt = ".corrupt"
+)
+
+func NewStateStore(dir, node string) *StateStore {
+	return &StateStore{dir: filepath.Join(dir, url.PathEscape(node)), node: node}
+}
+
+func (s *StateStore) path(vid string) string {
+	return filepath.Join(s.dir, url.PathEscape(vid)+stateExt)
+}
+
+// Get returns the state for a volume, or an empty one if there is none
+func (s *StateStore) Get(ctxt context.Context, vid string) (*NodeVolumeState, error) {
+	st, err := s.load(ctxt, s.path(vid))
+	if err != nil {
+		return nil, err
+	}
+	if st == nil {
+		st = &NodeVolumeState{VolumeId: vid, NodeId: s.node}
+	}
+	return st, nil
+}
+
+// Put saves the state for a volume, removing it once it is Empty
+func (s *StateStore) Put(ctxt context.Context, st *NodeVolumeState) error {
+	if st.Empty() {
+		return s.Delete(ctxt, st.VolumeId)
+	}
+	st.NodeId = s.node
+	b, err := json.MarshalIndent(st, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err = os.MkdirAll(s.dir, 0700); err != nil {
+		return err
+	}
+	f, err := ioutil.TempFile(s.dir, url.PathEscape(st.VolumeId)+"-*"+tmpExt)
+	if err != nil {
+		return err
+	}
+	tmp := f.Name()
+	_, err = f.Write(b)
+	if err == nil {
+		err = f.Sync()
+	}
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = os.Rename(tmp, s.path(st.VolumeId))
+	}
+	if err != nil {
+		os.Remove(tmp)
+		return fmt.Errorf("Could not save node state for volume %s: %s", st.VolumeId, err)
+	}
+	co.Debugf(ctxt, "Saved node state for volume %s: %+v", st.VolumeId, *st)
+	return s.syncDir()
+}
+
+// Delete forgets a volume
+func (s *StateStore) Delete(ctxt context.Context, vid string) error {
+	if err := os.Remove(s.path(vid)); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	co.Debugf(ctxt, "Removed node state for volume %s", vid)
+	return s.syncDir()
+}
+
+// List returns the state of every volume on this node, sorted by volume ID
+func (s *StateStore) List(ctxt context.Context) ([]*NodeVolumeState, error) {
+	files, err := filepath.Glob(filepath.Join(s.dir, "*"+stateExt))
+	if err != nil {
+		return nil, err
+	}
+	sts := []*NodeVolumeState{}
+	for _, f := range files {
+		st, err := s.load(ctxt, f)
+		if err != nil {
+			return nil, err
+		}
+		if st != nil {
+			sts = append(sts, st)
+		}
+	}
+	sort.Slice(sts, func(i, j int) bool {
+		return sts[i].VolumeId < sts[j].VolumeId
+	})
+	return sts, nil
+}
+
+// Recover cleans up after a crash in the middle of Put by removing any
+// temporary files left behind
+func (s *StateStore) Recover(ctxt context.Context) error {
+	files, err := filepath.Glob(filepath.Join(s.dir, "*"+tmpExt))
+	if err != nil {
+		return err
+	}
+	for _, f := range files {
+		co.Warningf(ctxt, "Removing incomplete node state file %s", f)
+		if err = os.Remove(f); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	return nil
+}
+
+// Files that can't be parsed are moved aside rather than failing every
+// request for the volume.  Reconcile rebuilds what it can from the node
+func (s *StateStore) load(ctxt context.Context, path string) (*NodeVolumeState, error) {
+	b, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	st := &NodeVolumeState{}
+	if err = json.Unmarshal(b, st); err != nil || st.VolumeId == "" {
+		co.Errorf(ctxt, "Discarding corrupt node state file %s: %v", path, err)
+		if err = os.Rename(path, strings.TrimSuffix(path, stateExt)+corruptExt); err != nil {
+			return nil, err
+		}
+		return nil, nil
+	}
+	return st, nil
+}
+
+func (s *StateStore) syncDir() error {
+	d, err := os.Open(s.dir)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	defer d.Close()
+	return d.Sync()
+}
@@ -0,0 +1,112 @@
+package driver
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	co "github.com/Datera/datera-csi/pkg/common"
+)
+
+var stateRoot string
+
+func TestMain(m *testing.M) {
+	var err error
+	if stateRoot, err = ioutil.TempDir("", "state-test"); err != nil {
+		panic(err)
+	}
+	code := m.Run()
+	os.RemoveAll(stateRoot)
+	os.Exit(code)
+}
+
+// Every driver under test gets its own node state
+func getStateStore(t *testing.T) *StateStore {
+	dir, err := ioutil.TempDir(stateRoot, "node")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return NewStateStore(dir, "test-node")
+}
+
+func TestStateStore(t *testing.T) {
+	ctxt := co.WithCtxt(getCtxt(), "TestStateStore", "")
+	s := getStateStore(t)
+	st, err := s.Get(ctxt, "vol-1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !st.Empty() || st.VolumeId != "vol-1" || st.NodeId != "test-node" {
+		t.Fatalf("Expected empty state for vol-1, got %+v", st)
+	}
+	st.DevicePath = "/dev/dm-0"
+	st.StagingPath = "/mnt/staging"
+	st.AddBindMount("/mnt/b")
+	st.AddBindMount("/mnt/a")
+	st.AddBindMount("/mnt/a")
+	if err = s.Put(ctxt, st); err != nil {
+		t.Fatal(err)
+	}
+	got, err := s.Get(ctxt, "vol-1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(got, st) {
+		t.Fatalf("Expected %+v, got %+v", st, got)
+	}
+	if err = s.Put(ctxt, &NodeVolumeState{VolumeId: "vol-0", DevicePath: "/dev/sdb"}); err != nil {
+		t.Fatal(err)
+	}
+	sts, err := s.List(ctxt)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(sts) != 2 || sts[0].VolumeId != "vol-0" || sts[1].VolumeId != "vol-1" {
+		t.Fatalf("Expected vol-0 and vol-1, got %+v", sts)
+	}
+
+	// Empty state isn't kept
+	st.DevicePath, st.StagingPath = "", ""
+	st.RemoveBindMount("/mnt/a")
+	st.RemoveBindMount("/mnt/b")
+	if err = s.Put(ctxt, st); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = os.Stat(s.path("vol-1")); !os.IsNotExist(err) {
+		t.Fatalf("Expected the state file for vol-1 to be removed, got %v", err)
+	}
+}
+
+func TestStateStoreRecover(t *testing.T) {
+	ctxt := co.WithCtxt(getCtxt(), "TestStateStoreRecover", "")
+	s := getStateStore(t)
+	if err := s.Put(ctxt, &NodeVolumeState{VolumeId: "vol-1", DevicePath: "/dev/dm-0"}); err != nil {
+		t.Fatal(err)
+	}
+	// A crash in the middle of Put, and a file mangled outside the driver
+	tmp := filepath.Join(s.dir, "vol-1-123"+tmpExt)
+	if err := ioutil.WriteFile(tmp, []byte(`{"volume_id": "vol-1", "dev`), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(s.path("vol-2"), []byte("garbage"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Recover(ctxt); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(tmp); !os.IsNotExist(err) {
+		t.Fatalf("Expected %s to be removed, got %v", tmp, err)
+	}
+	sts, err := s.List(ctxt)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(sts) != 1 || sts[0].DevicePath != "/dev/dm-0" {
+		t.Fatalf("Expected only the state of vol-1 to survive, got %+v", sts)
+	}
+	if _, err = os.Stat(filepath.Join(s.dir, "vol-2"+corruptExt)); err != nil {
+		t.Fatalf("Expected the corrupt state file to be kept aside: %s", err)
+	}
+}
@@ -0,0 +1,127 @@
+package driver
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"regexp"
+	"sort"
+
+	dc "github.com/Datera/datera-csi/pkg/client"
+	co "github.com/Datera/datera-csi/pkg/common"
+)
+
+// Tenants are paths below /root.  They end up in volume and snapshot IDs, so
+// the separators those use can't appear in them
+var tenantRegexp = regexp.MustCompile(`^/root(/[A-Za-z0-9_.-]+)*$`)
+
+func validateTenant(tenant string) error {
+	if !tenantRegexp.MatchString(tenant) {
+		return fmt.Errorf("Invalid tenant %q, tenants look like /root/team-a", tenant)
+	}
+	return nil
+}
+
+// TenantMap maps Kubernetes namespaces to the Datera tenant their volumes
+// are created in
+type TenantMap map[string]string
+
+func parseTenantMap(s string) (TenantMap, error) {
+	tm := TenantMap{}
+	if s == "" {
+		return tm, nil
+	}
+	if err := json.Unmarshal([]byte(s), &tm); err != nil {
+		return nil, fmt.Errorf("Could not parse %s: %s", EnvTenantMap, err)
+	}
+	return tm, nil
+}
+
+func (tm TenantMap) validate() error {
+	for ns, tenant := range tm {
+		if err := validateTenant(tenant); err != nil {
+			return fmt.Errorf("Tenant mapping for namespace %s: %s", ns, err)
+		}
+	}
+	return nil
+}
+
+// Returns the tenant a new volume is created in, "" for the backend tenant.
+// The tenant StorageClass parameter wins over the namespace mapping
+func (d *Driver) volumeTenant(ctxt context.Context, params *dc.VolOpts, pvc *pvcInfo) string {
+	tenant := params.Tenant
+	if tenant == "" && len(d.conf.TenantMap) > 0 {
+		if pvc.Namespace == "" {
+			co.Warningf(ctxt, "No namespace to map to a tenant, is csi-provisioner running with --extra-create-metadata?")
+		}
+		tenant = d.conf.TenantMap[pvc.Namespace]
+	}
+	return d.dc.Tenant(co.WithTenant(ctxt, tenant))
+}
+
+// Returns every tenant volumes may have been created in, "" for the backend
+// tenant.  Volumes created through a tenant StorageClass parameter are only
+// listed when the tenant is also in the tenants configuration
+func (d *Driver) tenants(ctxt context.Context, extra ...string) []string {
+	set := map[string]bool{"": true}
+	for _, t := range d.conf.TenantMap {
+		set[d.dc.Tenant(co.WithTenant(ctxt, t))] = true
+	}
+	for _, t := range append(d.conf.Tenants, extra...) {
+		set[d.dc.Tenant(co.WithTenant(ctxt, t))] = true
+	}
+	tenants := []string{}
+	for t := range set {
+		tenants = append(tenants, t)
+	}
+	sort.Strings(tenants)
+	return tenants
+}
+
+// Lists the volumes of every tenant
+func (d *Driver) listVolumes(ctxt context.Context, tenants []string) ([]*dc.Volume, error) {
+	vols := []*dc.Volume{}
+	for _, t := range tenants {
+		tvols, err := d.dc.ListVolumes(co.WithTenant(ctxt, t), 0, 0)
+		if err != nil {
+			return nil, err
+		}
+		vols = append(vols, tvols...)
+	}
+	return vols, nil
+}
+
+// Lists the snapshots of every tenant, sorted and paged like
+// DateraClient.ListSnapshots does for a single tenant
+func (d *Driver) listSnapshots(ctxt context.Context, tenants []string, maxEntries, startToken int) ([]*dc.Snapshot, int, error) {
+	snaps := []*dc.Snapshot{}
+	for _, t := range tenants {
+		tsnaps, _, err := d.dc.ListSnapshots(co.WithTenant(ctxt, t), "", "", 0, 0)
+		if err != nil {
+			return nil, 0, err
+		}
+		snaps = append(snaps, tsnaps...)
+	}
+	sort.Slice(snaps, func(i, j int) bool {
+		return snaps[i].Id < snaps[j].Id
+	})
+	start, end := page(len(snaps), maxEntries, startToken)
+	next := 0
+	if end < len(snaps) {
+		next = end
+	}
+	return snaps[start:end], next, nil
+}
+
+// Returns the bounds of the page of maxEntries items starting at startToken,
+// all remaining items when maxEntries is 0
+func page(total, maxEntries, startToken int) (int, int) {
+	if startToken > total {
+		startToken = total
+	}
+	end := total
+	if maxEntries > 0 && startToken+maxEntries < end {
+		end = startToken + maxEntries
+	}
+	return startToken, end
+}
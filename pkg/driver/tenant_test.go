@@ -0,0 +1,177 @@
+package driver
+
+import (
+	"strings"
+	"testing"
+
+	csi "github.com/container-storage-interface/spec/lib/go/csi"
+	codes "google.golang.org/grpc/codes"
+
+	co "github.com/Datera/datera-csi/pkg/common"
+	fake "github.com/Datera/datera-csi/pkg/fake"
+	dsdk "github.com/Datera/go-sdk/pkg/dsdk"
+)
+
+func TestValidateTenant(t *testing.T) {
+	for _, tenant := range []string{"/root", "/root/team-a", "/root/team-a/dev"} {
+		if err := validateTenant(tenant); err != nil {
+			t.Fatalf("Expected %q to be valid: %s", tenant, err)
+		}
+	}
+	for _, tenant := range []string{"", "team-a", "root/team-a", "/root/", "/root/team a", "/root/team:a"} {
+		if err := validateTenant(tenant); err == nil {
+			t.Fatalf("Expected %q to be invalid", tenant)
+		}
+	}
+}
+
+func TestParseTenantMap(t *testing.T) {
+	tm, err := parseTenantMap(`{"team-a": "/root/team-a"}`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(tm) != 1 || tm["team-a"] != "/root/team-a" {
+		t.Fatalf("Unexpected tenant map: %s", tm)
+	}
+	if err = tm.validate(); err != nil {
+		t.Fatal(err)
+	}
+	if tm, err = parseTenantMap(""); err != nil || len(tm) != 0 {
+		t.Fatalf("Expected an empty tenant map, got %s, %v", tm, err)
+	}
+	if _, err = parseTenantMap("team-a=/root/team-a"); err == nil || !strings.Contains(err.Error(), EnvTenantMap) {
+		t.Fatalf("Expected a parse error, got %v", err)
+	}
+	if err = (TenantMap{"team-a": "team-a"}).validate(); err == nil {
+		t.Fatal("Expected a tenant outside /root to be invalid")
+	}
+}
+
+func TestPage(t *testing.T) {
+	for _, c := range []struct {
+		total, max, start, expStart, expEnd int
+	}{
+		{5, 0, 0, 0, 5},
+		{5, 2, 0, 0, 2},
+		{5, 2, 4, 4, 5},
+		{5, 2, 7, 5, 5},
+	} {
+		if start, end := page(c.total, c.max, c.start); start != c.expStart || end != c.expEnd {
+			t.Fatalf("Expected [%d:%d] for %+v, got [%d:%d]", c.expStart, c.expEnd, c, start, end)
+		}
+	}
+}
+
+func TestControllerTenants(t *testing.T) {
+	d, fd := getDriverControllerFake(t)
+	fd.AddTenant("/root/team-a")
+	d.conf.TenantMap = TenantMap{"team-a": "/root/team-a"}
+
+	// Volumes of mapped namespaces go to the namespace's tenant
+	resp, err := d.CreateVolume(getCtxt(), &csi.CreateVolumeRequest{
+		Name:               "pvc-" + dsdk.RandString(5),
+		VolumeCapabilities: []*csi.VolumeCapability{mountCapability("ext4")},
+		Parameters: map[string]string{
+			ParamPvcNamespace: "team-a",
+			"replica_count":   "1",
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	vid := resp.Volume.VolumeId
+	defer d.DeleteVolume(getCtxt(), &csi.DeleteVolumeRequest{VolumeId: vid})
+	if !strings.HasPrefix(vid, "/root/team-a/") {
+		t.Fatalf("Expected a volume id in tenant /root/team-a, got %s", vid)
+	}
+	if _, name := co.ParseVolId(vid); len(fd.AppInstances("/root/team-a")) != 1 || fd.AppInstances("/root/team-a")[0] != name {
+		t.Fatalf("Expected %s in tenant /root/team-a, got %s", name, fd.AppInstances("/root/team-a"))
+	}
+
+	// Other namespaces stay in the backend tenant
+	rvid, _, cleanf := createVolume(t, d)
+	defer cleanf()
+	if strings.Contains(rvid, "/") {
+		t.Fatalf("Expected a backend tenant volume id, got %s", rvid)
+	}
+
+	nodeId := co.MkNodeId("node-1", fake.DefaultIqn)
+	if _, err = d.ControllerPublishVolume(getCtxt(), &csi.ControllerPublishVolumeRequest{
+		VolumeId:         vid,
+		NodeId:           nodeId,
+		VolumeCapability: mountCapability("ext4"),
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = d.ControllerUnpublishVolume(getCtxt(), &csi.ControllerUnpublishVolumeRequest{
+		VolumeId: vid,
+		NodeId:   nodeId,
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	sreq := &csi.CreateSnapshotRequest{
+		SourceVolumeId: vid,
+		Name:           "snap-" + dsdk.RandString(5),
+	}
+	sresp, err := d.CreateSnapshot(getCtxt(), sreq)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sid := sresp.Snapshot.SnapshotId
+	defer d.DeleteSnapshot(getCtxt(), &csi.DeleteSnapshotRequest{SnapshotId: sid})
+	if !strings.HasPrefix(sid, vid) {
+		t.Fatalf("Expected the snapshot id to carry the tenant, got %s", sid)
+	}
+	// Snapshot names are unique across tenants too
+	sreq.SourceVolumeId = rvid
+	if _, err = d.CreateSnapshot(getCtxt(), sreq); co.GetCode(err) != codes.AlreadyExists {
+		t.Fatalf("Expected AlreadyExists for a name taken in another tenant, got %v", err)
+	}
+
+	lresp, err := d.ListVolumes(getCtxt(), &csi.ListVolumesRequest{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	found := map[string]bool{}
+	for _, e := range lresp.Entries {
+		found[e.Volume.VolumeId] = true
+	}
+	if len(lresp.Entries) != 2 || !found[vid] || !found[rvid] {
+		t.Fatalf("Expected volumes of both tenants, got %v", lresp.Entries)
+	}
+	lresp, err = d.ListVolumes(getCtxt(), &csi.ListVolumesRequest{MaxEntries: 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(lresp.Entries) != 1 || lresp.NextToken != "1" {
+		t.Fatalf("Expected a page of one volume, got %v", lresp)
+	}
+	snresp, err := d.ListSnapshots(getCtxt(), &csi.ListSnapshotsRequest{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(snresp.Entries) != 1 || snresp.Entries[0].Snapshot.SnapshotId != sid {
+		t.Fatalf("Expected snapshot %s, got %v", sid, snresp.Entries)
+	}
+
+	// Clones can't cross tenants
+	if _, err = d.CreateVolume(getCtxt(), &csi.CreateVolumeRequest{
+		Name:               "pvc-" + dsdk.RandString(5),
+		VolumeCapabilities: []*csi.VolumeCapability{mountCapability("ext4")},
+		VolumeContentSource: &csi.VolumeContentSource{
+			Type: &csi.VolumeContentSource_Volume{
+				Volume: &csi.VolumeContentSource_VolumeSource{VolumeId: vid},
+			},
+		},
+	}); co.GetCode(err) != codes.InvalidArgument {
+		t.Fatalf("Expected InvalidArgument for a clone across tenants, got %v", err)
+	}
+	if _, err = d.CreateVolume(getCtxt(), &csi.CreateVolumeRequest{
+		Name:               "pvc-" + dsdk.RandString(5),
+		VolumeCapabilities: []*csi.VolumeCapability{mountCapability("ext4")},
+		Parameters:         map[string]string{"tenant": "team-a"},
+	}); co.GetCode(err) != codes.InvalidArgument {
+		t.Fatalf("Expected InvalidArgument for an invalid tenant, got %v", err)
+	}
+}
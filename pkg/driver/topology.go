@@ -0,0 +1,130 @@
+package driver
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+
+	csi "github.com/container-storage-interface/spec/lib/go/csi"
+
+	dc "github.com/Datera/datera-csi/pkg/client"
+	co "github.com/Datera/datera-csi/pkg/common"
+)
+
+const (
+	TopologyZoneKey = "topology.dsp.csi.daterainc.io/zone"
+)
+
+// TopologyMapping describes how volumes requested in a given zone should be
+// placed on the Datera system.  Empty fields leave the StorageClass value
+// untouched
+type TopologyMapping struct {
+	PlacementPolicy string `json:"placement_policy,omitempty"`
+	IpPool          string `json:"ip_pool,omitempty"`
+}
+
+type TopologyMap map[string]*TopologyMapping
+
+// The topology map is provided as a JSON object keyed by zone name.  Example:
+// {"rack1": {"placement_policy": "rack1", "ip_pool": "rack1-pool"}}
+func parseTopologyMap(s string) (TopologyMap, error) {
+	tm := TopologyMap{}
+	if s == "" {
+		return tm, nil
+	}
+	if err := json.Unmarshal([]byte(s), &tm); err != nil {
+		return nil, fmt.Errorf("Could not parse %s: %s", EnvTopologyMap, err)
+	}
+	for zone, m := range tm {
+		if m == nil {
+			return nil, fmt.Errorf("Topology mapping for zone %s cannot be empty", zone)
+		}
+	}
+	return tm, nil
+}
+
+func zoneFromTopology(t *csi.Topology) string {
+	if t == nil {
+		return ""
+	}
+	return t.Segments[TopologyZoneKey]
+}
+
+func nodeTopology(zone string) *csi.Topology {
+	if zone == "" {
+		return nil
+	}
+	return &csi.Topology{
+		Segments: map[string]string{TopologyZoneKey: zone},
+	}
+}
+
+func mkTopology(zone string) []*csi.Topology {
+	if zone == "" {
+		return nil
+	}
+	return []*csi.Topology{nodeTopology(zone)}
+}
+
+// Chooses the zone a new volume should be placed in.  Preferred topologies are
+// tried in order first, then Requisite topologies.  Only zones present in the
+// topology map are considered since those are the only ones we know how to
+// place.  An empty zone is returned if no requirement was given or no
+// topology map is configured, in which case the volume is reachable from
+// every node
+func handleTopologyRequirement(ctxt context.Context, tr *csi.TopologyRequirement, tm TopologyMap) (string, error) {
+	if tr == nil || (len(tr.Requisite) == 0 && len(tr.Preferred) == 0) {
+		return "", nil
+	}
+	if len(tm) == 0 {
+		co.Debugf(ctxt, "No topology map configured, ignoring TopologyRequirement: %s", tr)
+		return "", nil
+	}
+	requisite := map[string]struct{}{}
+	for _, t := range tr.Requisite {
+		if zone := zoneFromTopology(t); zone != "" {
+			requisite[zone] = struct{}{}
+		}
+	}
+	for _, t := range tr.Preferred {
+		zone := zoneFromTopology(t)
+		if _, ok := tm[zone]; !ok {
+			continue
+		}
+		if _, ok := requisite[zone]; len(requisite) == 0 || ok {
+			return zone, nil
+		}
+	}
+	for _, t := range tr.Requisite {
+		zone := zoneFromTopology(t)
+		if _, ok := tm[zone]; ok {
+			return zone, nil
+		}
+	}
+	return "", fmt.Errorf("None of the requested topologies can be satisfied.  Configured zones: %s", tm.zones())
+}
+
+func (tm TopologyMap) zones() []string {
+	zones := []string{}
+	for zone := range tm {
+		zones = append(zones, zone)
+	}
+	return zones
+}
+
+// Updates the placement policy and ip pool of the volume options based on
+// the mapping for the chosen zone
+func (tm TopologyMap) apply(ctxt context.Context, zone string, vo *dc.VolOpts) {
+	m, ok := tm[zone]
+	if !ok {
+		return
+	}
+	if m.PlacementPolicy != "" {
+		co.Infof(ctxt, "Topology zone %s overriding placement_policy %s with %s", zone, vo.PlacementPolicy, m.PlacementPolicy)
+		vo.PlacementPolicy = m.PlacementPolicy
+	}
+	if m.IpPool != "" {
+		co.Infof(ctxt, "Topology zone %s overriding ip_pool %s with %s", zone, vo.IpPool, m.IpPool)
+		vo.IpPool = m.IpPool
+	}
+}
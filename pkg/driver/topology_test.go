@@ -0,0 +1,84 @@
+package driver
+
+import (
+	"context"
+	"testing"
+
+	csi "github.com/container-storage-interface/spec/lib/go/csi"
+
+	dc "github.com/Datera/datera-csi/pkg/client"
+	co "github.com/Datera/datera-csi/pkg/common"
+)
+
+func testCtxt() context.Context {
+	return co.WithCtxt(context.Background(), "test", "")
+}
+
+func topoReq(requisite, preferred []string) *csi.TopologyRequirement {
+	tr := &csi.TopologyRequirement{}
+	for _, z := range requisite {
+		tr.Requisite = append(tr.Requisite, nodeTopology(z))
+	}
+	for _, z := range preferred {
+		tr.Preferred = append(tr.Preferred, nodeTopology(z))
+	}
+	return tr
+}
+
+func TestParseTopologyMap(t *testing.T) {
+	tm, err := parseTopologyMap(`{"rack1": {"placement_policy": "p1", "ip_pool": "pool1"}}`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if tm["rack1"].PlacementPolicy != "p1" || tm["rack1"].IpPool != "pool1" {
+		t.Fatalf("Unexpected topology map: %#v", tm["rack1"])
+	}
+	if _, err = parseTopologyMap(`{"rack1": null}`); err == nil {
+		t.Fatal("Expected error for empty zone mapping")
+	}
+	if _, err = parseTopologyMap(`not json`); err == nil {
+		t.Fatal("Expected error for invalid json")
+	}
+}
+
+func TestHandleTopologyRequirement(t *testing.T) {
+	tm := TopologyMap{
+		"rack1": &TopologyMapping{PlacementPolicy: "p1", IpPool: "pool1"},
+		"rack2": &TopologyMapping{PlacementPolicy: "p2"},
+	}
+	for _, tc := range []struct {
+		tr   *csi.TopologyRequirement
+		tm   TopologyMap
+		zone string
+		err  bool
+	}{
+		{tr: nil, tm: tm, zone: ""},
+		{tr: topoReq([]string{"rack1"}, nil), tm: TopologyMap{}, zone: ""},
+		{tr: topoReq([]string{"rack2"}, nil), tm: tm, zone: "rack2"},
+		{tr: topoReq([]string{"rack1", "rack2"}, []string{"rack2"}), tm: tm, zone: "rack2"},
+		{tr: topoReq([]string{"rack1"}, []string{"rack2"}), tm: tm, zone: "rack1"},
+		{tr: topoReq(nil, []string{"rack3", "rack1"}), tm: tm, zone: "rack1"},
+		{tr: topoReq([]string{"rack3"}, nil), tm: tm, err: true},
+	} {
+		zone, err := handleTopologyRequirement(testCtxt(), tc.tr, tc.tm)
+		if tc.err && err == nil {
+			t.Fatalf("Expected error for requirement %s", tc.tr)
+		} else if !tc.err && err != nil {
+			t.Fatal(err)
+		}
+		if zone != tc.zone {
+			t.Fatalf("Unexpected zone for requirement %s: [%s] != [%s]", tc.tr, zone, tc.zone)
+		}
+	}
+}
+
+func TestTopologyMapApply(t *testing.T) {
+	tm := TopologyMap{
+		"rack2": &TopologyMapping{PlacementPolicy: "p2"},
+	}
+	vo := &dc.VolOpts{PlacementPolicy: "default", IpPool: "default"}
+	tm.apply(testCtxt(), "rack2", vo)
+	if vo.PlacementPolicy != "p2" || vo.IpPool != "default" {
+		t.Fatalf("Unexpected VolOpts after applying topology: %#v", vo)
+	}
+}
@@ -0,0 +1,518 @@
+package fake
+
+import (
+	"fmt"
+	"net/http"
+	"path"
+	"strconv"
+	"strings"
+
+	dsdk "github.com/Datera/go-sdk/pkg/dsdk"
+	uuid "github.com/google/uuid"
+)
+
+const iqnPrefix = "iqn.2013-05.com.daterainc:tc:01:sn:"
+
+// Routes everything below /app_instances.  The supported tree is:
+//
+//	/app_instances/{ai}
+//	/app_instances/{ai}/metadata
+//	/app_instances/{ai}/storage_instances/{si}
+//	/app_instances/{ai}/storage_instances/{si}/acl_policy
+//	/app_instances/{ai}/storage_instances/{si}/volumes/{vol}
+//	/app_instances/{ai}/storage_instances/{si}/volumes/{vol}/performance_policy
+//	/app_instances/{ai}/storage_instances/{si}/volumes/{vol}/snapshots/{ts}
+func (d *Datera) handleAppInstances(r *http.Request, parts []string) (interface{}, *dsdk.ApiErrorResponse) {
+	if len(parts) == 0 {
+		switch r.Method {
+		case http.MethodGet:
+			items := []interface{}{}
+			for _, name := range d.aiOrder {
+				items = append(items, d.ais[name])
+			}
+			return page(r, items), nil
+		case http.MethodPost:
+			return d.createAppInstance(r)
+		}
+		return nil, unsupported(r)
+	}
+	ai, ok := d.ais[parts[0]]
+	if !ok {
+		return nil, notFound(appInstancePath(parts[0]))
+	}
+	switch {
+	case len(parts) == 1:
+		return d.handleAppInstance(r, ai)
+	case len(parts) == 2 && parts[1] == "metadata":
+		return d.handleMetadata(r, ai)
+	case len(parts) < 3 || parts[1] != "storage_instances":
+		return nil, notFound(r.URL.Path)
+	}
+	si := findStorageInstance(ai, parts[2])
+	if si == nil {
+		return nil, notFound(path.Join(ai.Path, "storage_instances", parts[2]))
+	}
+	switch {
+	case len(parts) == 3:
+		return d.handleStorageInstance(r, si)
+	case len(parts) == 4 && parts[3] == "acl_policy":
+		return d.handleAclPolicy(r, si)
+	case len(parts) < 5 || parts[3] != "volumes":
+		return nil, notFound(r.URL.Path)
+	}
+	vol := findVolume(si, parts[4])
+	if vol == nil {
+		return nil, notFound(path.Join(si.Path, "volumes", parts[4]))
+	}
+	switch {
+	case len(parts) == 5:
+		return d.handleVolume(r, vol)
+	case len(parts) == 6 && parts[5] == "performance_policy":
+		return d.handlePerformancePolicy(r, vol)
+	case len(parts) == 6 && parts[5] == "snapshots":
+		return d.handleSnapshots(r, vol)
+	case len(parts) == 7 && parts[5] == "snapshots":
+		return d.handleSnapshot(r, vol, parts[6])
+	}
+	return nil, notFound(r.URL.Path)
+}
+
+func (d *Datera) createAppInstance(r *http.Request) (interface{}, *dsdk.ApiErrorResponse) {
+	req := &dsdk.AppInstancesCreateRequest{}
+	if apierr := decode(r, req); apierr != nil {
+		return nil, apierr
+	}
+	if req.Name == "" {
+		return nil, invalidRequest(0, "name is a required field")
+	}
+	if _, ok := d.ais[req.Name]; ok {
+		return nil, conflict(fmt.Sprintf("An app_instance with name %s already exists", req.Name))
+	}
+	ai := &dsdk.AppInstance{
+		Id:             req.Name,
+		Name:           req.Name,
+		Path:           appInstancePath(req.Name),
+		Uuid:           uuid.Must(uuid.NewRandom()).String(),
+		AdminState:     "online",
+		OpState:        opAvailable,
+		CreateMode:     req.CreateMode,
+		Descr:          req.Descr,
+		RepairPriority: req.RepairPriority,
+		Health:         "ok",
+		AppTemplate:    &dsdk.AppInstanceAppTemplate{},
+	}
+	switch {
+	case req.AppTemplate != nil:
+		ai.AppTemplate.Path = req.AppTemplate.Path
+		pool, _ := d.ipPoolFromPath(ipPoolPath(DefaultIpPool))
+		si := newStorageInstance(ai, "storage-1", pool, nil)
+		si.Volumes = []*dsdk.Volume{newVolume(si, &dsdk.Volume{
+			Name:         "volume-1",
+			Size:         templateSize(req.TemplateOverride),
+			ReplicaCount: 3,
+		})}
+		ai.StorageInstances = []*dsdk.StorageInstance{si}
+	case req.CloneVolumeSrc != nil:
+		srcSi, srcVol := d.findVolumeByPath(req.CloneVolumeSrc.Path)
+		if srcVol == nil {
+			return nil, notFound(req.CloneVolumeSrc.Path)
+		}
+		ai.StorageInstances = []*dsdk.StorageInstance{d.cloneStorageInstance(ai, srcSi, srcVol)}
+	case req.CloneSnapshotSrc != nil:
+		srcSi, srcVol, snap := d.findSnapshotByPath(req.CloneSnapshotSrc.Path)
+		if snap == nil {
+			return nil, notFound(req.CloneSnapshotSrc.Path)
+		}
+		if snap.OpState != opAvailable {
+			return nil, invalidRequest(0, fmt.Sprintf("Snapshot %s is not available for cloning, op_state: %s", snap.Path, snap.OpState))
+		}
+		ai.StorageInstances = []*dsdk.StorageInstance{d.cloneStorageInstance(ai, srcSi, srcVol)}
+	default:
+		if len(req.StorageInstances) == 0 {
+			return nil, invalidRequest(0, "One of storage_instances, app_template, clone_volume_src or clone_snapshot_src is required")
+		}
+		for _, rsi := range req.StorageInstances {
+			ippath := ipPoolPath(DefaultIpPool)
+			if rsi.IpPool != nil {
+				ippath = rsi.IpPool.Path
+			}
+			pool, apierr := d.ipPoolFromPath(ippath)
+			if apierr != nil {
+				return nil, apierr
+			}
+			si := newStorageInstance(ai, rsi.Name, pool, rsi.Auth)
+			for _, rvol := range rsi.Volumes {
+				if rvol.Size <= 0 {
+					return nil, invalidRequest(0, fmt.Sprintf("Invalid size for volume %s: %d", rvol.Name, rvol.Size))
+				}
+				si.Volumes = append(si.Volumes, newVolume(si, rvol))
+			}
+			ai.StorageInstances = append(ai.StorageInstances, si)
+		}
+	}
+	d.ais[ai.Name] = ai
+	d.aiOrder = append(d.aiOrder, ai.Name)
+	d.metadata[ai.Name] = map[string]string{}
+	return ai, nil
+}
+
+func (d *Datera) handleAppInstance(r *http.Request, ai *dsdk.AppInstance) (interface{}, *dsdk.ApiErrorResponse) {
+	switch r.Method {
+	case http.MethodGet:
+		return ai, nil
+	case http.MethodPut:
+		req := &dsdk.AppInstanceSetRequest{}
+		if apierr := decode(r, req); apierr != nil {
+			return nil, apierr
+		}
+		if req.AdminState != "" {
+			if req.AdminState != "online" && req.AdminState != "offline" {
+				return nil, invalidRequest(0, fmt.Sprintf("Invalid admin_state: %s", req.AdminState))
+			}
+			setAdminState(ai, req.AdminState)
+		}
+		if req.Descr != "" {
+			ai.Descr = req.Descr
+		}
+		if req.RepairPriority != "" {
+			ai.RepairPriority = req.RepairPriority
+		}
+		return ai, nil
+	case http.MethodDelete:
+		if ai.AdminState != "offline" {
+			return nil, invalidRequest(0, fmt.Sprintf("app_instance %s must be offline before it can be deleted", ai.Name))
+		}
+		for _, si := range ai.StorageInstances {
+			for _, vol := range si.Volumes {
+				for _, snap := range vol.Snapshots {
+					delete(d.snapReads, snap.Path)
+				}
+			}
+		}
+		delete(d.ais, ai.Name)
+		delete(d.metadata, ai.Name)
+		for i, name := range d.aiOrder {
+			if name == ai.Name {
+				d.aiOrder = append(d.aiOrder[:i], d.aiOrder[i+1:]...)
+				break
+			}
+		}
+		return ai, nil
+	}
+	return nil, unsupported(r)
+}
+
+// Metadata updates are merged into the existing metadata.  Keys set to null
+// are removed
+func (d *Datera) handleMetadata(r *http.Request, ai *dsdk.AppInstance) (interface{}, *dsdk.ApiErrorResponse) {
+	md := d.metadata[ai.Name]
+	switch r.Method {
+	case http.MethodGet:
+		return md, nil
+	case http.MethodPut:
+		req := map[string]interface{}{}
+		if apierr := decode(r, &req); apierr != nil {
+			return nil, apierr
+		}
+		for k, v := range req {
+			switch t := v.(type) {
+			case nil:
+				delete(md, k)
+			case string:
+				md[k] = t
+			case bool:
+				md[k] = strconv.FormatBool(t)
+			default:
+				return nil, invalidRequest(0, fmt.Sprintf("Metadata values must be strings, key %s has value %v", k, v))
+			}
+		}
+		return md, nil
+	}
+	return nil, unsupported(r)
+}
+
+func (d *Datera) handleStorageInstance(r *http.Request, si *dsdk.StorageInstance) (interface{}, *dsdk.ApiErrorResponse) {
+	switch r.Method {
+	case http.MethodGet:
+		return si, nil
+	case http.MethodPut:
+		req := &dsdk.StorageInstanceSetRequest{}
+		if apierr := decode(r, req); apierr != nil {
+			return nil, apierr
+		}
+		if req.IpPool != nil {
+			pool, apierr := d.ipPoolFromPath(req.IpPool.Path)
+			if apierr != nil {
+				return nil, apierr
+			}
+			si.IpPool = &dsdk.AccessNetworkIpPool{Path: ipPoolPath(pool.name)}
+			si.Access.Ips = append([]string{}, pool.ips...)
+		}
+		if req.Auth != nil {
+			si.Auth = req.Auth
+			si.Auth.Path = path.Join(si.Path, "auth")
+		}
+		return si, nil
+	}
+	return nil, unsupported(r)
+}
+
+func (d *Datera) handleAclPolicy(r *http.Request, si *dsdk.StorageInstance) (interface{}, *dsdk.ApiErrorResponse) {
+	switch r.Method {
+	case http.MethodGet:
+		return si.AclPolicy, nil
+	case http.MethodPut:
+		req := &dsdk.AclPolicySetRequest{}
+		if apierr := decode(r, req); apierr != nil {
+			return nil, apierr
+		}
+		inits := []*dsdk.Initiator{}
+		for _, init := range req.Initiators {
+			if init.Tenant != "" {
+				return nil, invalidRequest(0, fmt.Sprintf("Unexpected tenant %s for acl_policy initiator %s, only path is accepted", init.Tenant, init.Path))
+			}
+			// Initiators of the root tenant are shared with subtenants and
+			// listed with their tenant
+			if _, ok := d.initiators[initiatorId(init.Path)]; ok {
+				inits = append(inits, &dsdk.Initiator{Path: init.Path})
+			} else if _, ok = d.tenants[Tenant].initiators[initiatorId(init.Path)]; ok {
+				inits = append(inits, &dsdk.Initiator{Path: init.Path, Tenant: Tenant})
+			} else {
+				return nil, notFound(init.Path)
+			}
+		}
+		si.AclPolicy.Initiators = inits
+		si.AclPolicy.InitiatorGroups = req.InitiatorGroups
+		return si.AclPolicy, nil
+	}
+	return nil, unsupported(r)
+}
+
+func (d *Datera) handleVolume(r *http.Request, vol *dsdk.Volume) (interface{}, *dsdk.ApiErrorResponse) {
+	switch r.Method {
+	case http.MethodGet:
+		return vol, nil
+	case http.MethodPut:
+		req := &dsdk.VolumeSetRequest{}
+		if apierr := decode(r, req); apierr != nil {
+			return nil, apierr
+		}
+		if req.Size != 0 {
+			if req.Size < vol.Size {
+				return nil, invalidRequest(0, fmt.Sprintf("Volumes cannot be shrunk, current size %d, requested size %d", vol.Size, req.Size))
+			}
+			vol.Size = req.Size
+		}
+		if req.ReplicaCount != 0 {
+			vol.ReplicaCount = req.ReplicaCount
+		}
+		if req.PlacementMode != "" {
+			vol.PlacementMode = req.PlacementMode
+		}
+		if req.PlacementPolicy != nil {
+			vol.PlacementPolicy = req.PlacementPolicy
+		}
+		return vol, nil
+	}
+	return nil, unsupported(r)
+}
+
+// POST replaces the performance policy, PUT only updates the provided limits
+func (d *Datera) handlePerformancePolicy(r *http.Request, vol *dsdk.Volume) (interface{}, *dsdk.ApiErrorResponse) {
+	pp := vol.PerformancePolicy
+	switch r.Method {
+	case http.MethodGet:
+		return pp, nil
+	case http.MethodPost:
+		req := &dsdk.PerformancePolicy{}
+		if apierr := decode(r, req); apierr != nil {
+			return nil, apierr
+		}
+		req.Path = pp.Path
+		vol.PerformancePolicy = req
+		return req, nil
+	case http.MethodPut:
+		req := &dsdk.PerformancePolicy{}
+		if apierr := decode(r, req); apierr != nil {
+			return nil, apierr
+		}
+		for _, f := range []struct{ from, to *int }{
+			{&req.ReadIopsMax, &pp.ReadIopsMax},
+			{&req.WriteIopsMax, &pp.WriteIopsMax},
+			{&req.TotalIopsMax, &pp.TotalIopsMax},
+			{&req.ReadBandwidthMax, &pp.ReadBandwidthMax},
+			{&req.WriteBandwidthMax, &pp.WriteBandwidthMax},
+			{&req.TotalBandwidthMax, &pp.TotalBandwidthMax},
+		} {
+			if *f.from != 0 {
+				*f.to = *f.from
+			}
+		}
+		return pp, nil
+	}
+	return nil, unsupported(r)
+}
+
+func newStorageInstance(ai *dsdk.AppInstance, name string, pool *ipPool, auth *dsdk.Auth) *dsdk.StorageInstance {
+	if name == "" {
+		name = "storage-1"
+	}
+	p := path.Join(ai.Path, "storage_instances", name)
+	if auth == nil {
+		auth = &dsdk.Auth{Type: "none"}
+	}
+	auth.Path = path.Join(p, "auth")
+	si := &dsdk.StorageInstance{
+		Path:       p,
+		Name:       name,
+		Uuid:       uuid.Must(uuid.NewRandom()).String(),
+		AdminState: ai.AdminState,
+		OpState:    opAvailable,
+		Health:     "ok",
+		Auth:       auth,
+		IpPool:     &dsdk.AccessNetworkIpPool{Path: ipPoolPath(pool.name)},
+		AclPolicy:  &dsdk.AclPolicy{Path: path.Join(p, "acl_policy")},
+		Access: &dsdk.Access{
+			Path: path.Join(p, "access"),
+			Iqn:  iqnPrefix + strings.Replace(ai.Uuid, "-", "", -1)[:16],
+			Ips:  append([]string{}, pool.ips...),
+		},
+	}
+	return si
+}
+
+func newVolume(si *dsdk.StorageInstance, req *dsdk.Volume) *dsdk.Volume {
+	name := req.Name
+	if name == "" {
+		name = "volume-1"
+	}
+	p := path.Join(si.Path, "volumes", name)
+	pp := &dsdk.PerformancePolicy{}
+	if req.PerformancePolicy != nil {
+		*pp = *req.PerformancePolicy
+	}
+	pp.Path = path.Join(p, "performance_policy")
+	replicas := req.ReplicaCount
+	if replicas == 0 {
+		replicas = 3
+	}
+	placement := req.PlacementMode
+	if placement == "" {
+		placement = "hybrid"
+	}
+	return &dsdk.Volume{
+		Path:              p,
+		Name:              name,
+		Uuid:              uuid.Must(uuid.NewRandom()).String(),
+		Size:              req.Size,
+		ReplicaCount:      replicas,
+		PlacementMode:     placement,
+		PlacementPolicy:   req.PlacementPolicy,
+		OpState:           opAvailable,
+		Health:            "ok",
+		PerformancePolicy: pp,
+	}
+}
+
+func (d *Datera) cloneStorageInstance(ai *dsdk.AppInstance, srcSi *dsdk.StorageInstance, srcVol *dsdk.Volume) *dsdk.StorageInstance {
+	pool, apierr := d.ipPoolFromPath(srcSi.IpPool.Path)
+	if apierr != nil {
+		pool, _ = d.ipPoolFromPath(ipPoolPath(DefaultIpPool))
+	}
+	si := newStorageInstance(ai, srcSi.Name, pool, nil)
+	si.Volumes = []*dsdk.Volume{newVolume(si, &dsdk.Volume{
+		Name:            srcVol.Name,
+		Size:            srcVol.Size,
+		ReplicaCount:    srcVol.ReplicaCount,
+		PlacementMode:   srcVol.PlacementMode,
+		PlacementPolicy: srcVol.PlacementPolicy,
+	})}
+	return si
+}
+
+func setAdminState(ai *dsdk.AppInstance, state string) {
+	op := opAvailable
+	if state == "offline" {
+		op = opUnavailable
+	}
+	ai.AdminState = state
+	ai.OpState = op
+	for _, si := range ai.StorageInstances {
+		si.AdminState = state
+		si.OpState = op
+	}
+}
+
+// Reads storage_instances.storage-1.volumes.volume-1.size from a
+// template_override.  Templates without an override default to 1 GiB
+func templateSize(override map[string]interface{}) int {
+	v := interface{}(override)
+	for _, k := range []string{"storage_instances", "storage-1", "volumes", "volume-1", "size"} {
+		m, ok := v.(map[string]interface{})
+		if !ok {
+			return 1
+		}
+		v = m[k]
+	}
+	switch t := v.(type) {
+	case string:
+		if size, err := strconv.Atoi(t); err == nil && size > 0 {
+			return size
+		}
+	case float64:
+		if t > 0 {
+			return int(t)
+		}
+	}
+	return 1
+}
+
+func appInstancePath(name string) string {
+	return "/app_instances/" + name
+}
+
+func findStorageInstance(ai *dsdk.AppInstance, name string) *dsdk.StorageInstance {
+	for _, si := range ai.StorageInstances {
+		if si.Name == name {
+			return si
+		}
+	}
+	return nil
+}
+
+func findVolume(si *dsdk.StorageInstance, name string) *dsdk.Volume {
+	for _, vol := range si.Volumes {
+		if vol.Name == name {
+			return vol
+		}
+	}
+	return nil
+}
+
+func (d *Datera) findVolumeByPath(p string) (*dsdk.StorageInstance, *dsdk.Volume) {
+	for _, ai := range d.ais {
+		for _, si := range ai.StorageInstances {
+			for _, vol := range si.Volumes {
+				if vol.Path == p {
+					return si, vol
+				}
+			}
+		}
+	}
+	return nil, nil
+}
+
+func (d *Datera) findSnapshotByPath(p string) (*dsdk.StorageInstance, *dsdk.Volume, *dsdk.Snapshot) {
+	for _, ai := range d.ais {
+		for _, si := range ai.StorageInstances {
+			for _, vol := range si.Volumes {
+				for _, snap := range vol.Snapshots {
+					if snap.Path == p {
+						return si, vol, snap
+					}
+				}
+			}
+		}
+	}
+	return nil, nil, nil
+}
@@ -0,0 +1,423 @@
+// Package fake implements in-process stand-ins for the Datera REST API and for
+// the node the driver runs on.  Datera models enough of the app_instance tree,
+// initiators, ip pools and system endpoints for the CSI client and driver to
+// be exercised without a cluster.  Host records node operations (logins,
+// formatting, mounting) so the node service can be exercised without root,
+// disks or iscsid.
+//
+// Point a client at them with:
+//
+//	fd := fake.NewDatera()
+//	client, err := dc.NewDateraClientWithHTTPClient(fd.UDC(), true, "test", fd.HTTPClient())
+//	client.SetHost(fake.NewHost())
+package fake
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	dsdk "github.com/Datera/go-sdk/pkg/dsdk"
+	udc "github.com/Datera/go-udc/pkg/udc"
+	uuid "github.com/google/uuid"
+)
+
+const (
+	ApiVersion = "2.2"
+	SwVersion  = "3.3.5.0"
+	MgmtIp     = "fake.datera.local"
+	Username   = "admin"
+	Password   = "password"
+	Tenant     = "/root"
+
+	DefaultIpPool = "default"
+
+	// Error names returned by the Datera REST API
+	NotFoundError       = "NotFoundError"
+	InvalidRequestError = "InvalidRequestError"
+	ConflictError       = "ConflictError"
+	AuthFailedError     = "AuthFailedError"
+
+	// InvalidRequestError code returned when a snapshot with the requested
+	// uuid already exists on the volume
+	DuplicateSnapshotCode = 15
+
+	opAvailable   = "available"
+	opUnavailable = "unavailable"
+	gib           = 1024 * 1024 * 1024
+	totalCapacity = 100 * 1024 * gib
+)
+
+type injectedError struct {
+	method string
+	path   string
+	apierr *dsdk.ApiErrorResponse
+}
+
+type list struct {
+	data  []interface{}
+	total int
+}
+
+type ipPool struct {
+	name string
+	ips  []string
+}
+
+// Datera is a fake Datera system.  All state is kept in memory and guarded by
+// a single lock, every request is handled atomically
+type Datera struct {
+	m *sync.Mutex
+
+	// Number of reads (GET on the snapshot or its parent's snapshot list) a
+	// newly created snapshot needs before its op_state transitions from
+	// "unavailable" to "available".  Zero makes snapshots available
+	// immediately
+	SnapshotReadyAfter int
+
+	apikey   string
+	lastTs   int64
+	ipPools  map[string]*ipPool
+	injected []*injectedError
+	requests []string
+
+	// The tenant of the request being handled, Tenant outside of requests
+	*tenant
+	tenants map[string]*tenant
+}
+
+// tenant holds what a Datera tenant owns.  Access network ip pools are
+// shared by every tenant
+type tenant struct {
+	name       string
+	ais        map[string]*dsdk.AppInstance
+	aiOrder    []string
+	metadata   map[string]map[string]string
+	initiators map[string]*dsdk.Initiator
+	snapReads  map[string]int
+}
+
+func newTenant(name string) *tenant {
+	return &tenant{
+		name:       name,
+		ais:        map[string]*dsdk.AppInstance{},
+		metadata:   map[string]map[string]string{},
+		initiators: map[string]*dsdk.Initiator{},
+		snapReads:  map[string]int{},
+	}
+}
+
+func NewDatera() *Datera {
+	d := &Datera{
+		m:                  &sync.Mutex{},
+		SnapshotReadyAfter: 1,
+		apikey:             uuid.Must(uuid.NewRandom()).String(),
+		ipPools:            map[string]*ipPool{},
+		tenant:             newTenant(Tenant),
+	}
+	d.tenants = map[string]*tenant{Tenant: d.tenant}
+	d.AddIpPool(DefaultIpPool, "172.28.41.10", "172.28.41.11")
+	return d
+}
+
+// AddTenant creates a subtenant, eg: "/root/team-a".  Requests for tenants
+// that weren't added fail
+func (d *Datera) AddTenant(name string) {
+	d.m.Lock()
+	defer d.m.Unlock()
+	if _, ok := d.tenants[name]; !ok {
+		d.tenants[name] = newTenant(name)
+	}
+}
+
+// AppInstances returns the names of the app instances in tenant
+func (d *Datera) AppInstances(tenant string) []string {
+	d.m.Lock()
+	defer d.m.Unlock()
+	if t, ok := d.tenants[tenant]; ok {
+		return append([]string{}, t.aiOrder...)
+	}
+	return nil
+}
+
+// UDC returns a configuration the fake will accept credentials from
+func (d *Datera) UDC() *udc.UDC {
+	return &udc.UDC{
+		Username:   Username,
+		Password:   Password,
+		MgmtIp:     MgmtIp,
+		Tenant:     Tenant,
+		ApiVersion: ApiVersion,
+	}
+}
+
+// HTTPClient returns an http.Client which hands every request directly to the
+// fake, no network connections are made
+func (d *Datera) HTTPClient() *http.Client {
+	return &http.Client{Transport: &transport{h: d}}
+}
+
+// AddIpPool registers an access network ip pool whose storage instances will
+// be given the provided portal ips
+func (d *Datera) AddIpPool(name string, ips ...string) {
+	d.m.Lock()
+	defer d.m.Unlock()
+	d.ipPools[name] = &ipPool{name: name, ips: ips}
+}
+
+// InjectError makes the next request matching method and path fail with
+// apierr.  An empty method matches any method.  Paths do not include the api
+// version, eg: "/app_instances/my-vol"
+func (d *Datera) InjectError(method, path string, apierr *dsdk.ApiErrorResponse) {
+	d.m.Lock()
+	defer d.m.Unlock()
+	d.injected = append(d.injected, &injectedError{method: method, path: path, apierr: apierr})
+}
+
+// SetHealth sets the health reported for every volume of the app instance
+// name, eg: "degraded" while a replica is being rebuilt
+func (d *Datera) SetHealth(name, health string) {
+	d.m.Lock()
+	defer d.m.Unlock()
+	ai, ok := d.ais[name]
+	if !ok {
+		return
+	}
+	ai.Health = health
+	for _, si := range ai.StorageInstances {
+		for _, vol := range si.Volumes {
+			vol.Health = health
+		}
+	}
+}
+
+// Requests returns every request received so far as "METHOD /path"
+func (d *Datera) Requests() []string {
+	d.m.Lock()
+	defer d.m.Unlock()
+	return append([]string{}, d.requests...)
+}
+
+func (d *Datera) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	parts := splitPath(r.URL.Path)
+	// Strip the api version, eg: "v2.2"
+	if len(parts) > 0 && strings.HasPrefix(parts[0], "v") {
+		parts = parts[1:]
+	}
+	path := "/" + strings.Join(parts, "/")
+
+	d.m.Lock()
+	defer d.m.Unlock()
+	d.requests = append(d.requests, fmt.Sprintf("%s %s", r.Method, path))
+
+	if path == "/login" {
+		d.login(w, r)
+		return
+	}
+	if r.Header.Get("Auth-Token") != d.apikey {
+		writeError(w, &dsdk.ApiErrorResponse{
+			Name:    AuthFailedError,
+			Http:    http.StatusUnauthorized,
+			Message: "The provided api key is invalid or has expired",
+		})
+		return
+	}
+	if apierr := d.popInjected(r.Method, path); apierr != nil {
+		writeError(w, apierr)
+		return
+	}
+	name := r.Header.Get("tenant")
+	if name == "" {
+		name = Tenant
+	}
+	t, ok := d.tenants[name]
+	if !ok {
+		writeError(w, notFound("/tenants"+name))
+		return
+	}
+	d.tenant = t
+	defer func() {
+		d.tenant = d.tenants[Tenant]
+	}()
+
+	var (
+		data   interface{}
+		apierr *dsdk.ApiErrorResponse
+	)
+	switch {
+	case len(parts) == 0:
+		apierr = notFound(path)
+	case parts[0] == "system":
+		data, apierr = d.handleSystem(r, parts[1:])
+	case parts[0] == "storage_nodes":
+		data, apierr = d.handleStorageNodes(r, parts[1:])
+	case parts[0] == "app_instances":
+		data, apierr = d.handleAppInstances(r, parts[1:])
+	case parts[0] == "initiators":
+		data, apierr = d.handleInitiators(r, parts[1:])
+	case parts[0] == "access_network_ip_pools":
+		data, apierr = d.handleIpPools(r, parts[1:])
+	default:
+		apierr = notFound(path)
+	}
+	if apierr != nil {
+		writeError(w, apierr)
+		return
+	}
+	writeData(w, path, data)
+}
+
+func (d *Datera) login(w http.ResponseWriter, r *http.Request) {
+	if err := r.ParseForm(); err != nil {
+		writeError(w, invalidRequest(0, err.Error()))
+		return
+	}
+	if r.PostForm.Get("name") != Username || r.PostForm.Get("password") != Password {
+		writeError(w, &dsdk.ApiErrorResponse{
+			Name:    AuthFailedError,
+			Http:    http.StatusUnauthorized,
+			Message: "Invalid username or password",
+		})
+		return
+	}
+	writeJSON(w, http.StatusOK, &dsdk.ApiLogin{Key: d.apikey, Version: ApiVersion})
+}
+
+func (d *Datera) popInjected(method, path string) *dsdk.ApiErrorResponse {
+	for i, ie := range d.injected {
+		if (ie.method == "" || ie.method == method) && ie.path == path {
+			d.injected = append(d.injected[:i], d.injected[i+1:]...)
+			return ie.apierr
+		}
+	}
+	return nil
+}
+
+// Timestamps are used as snapshot ids, so they must never repeat
+func (d *Datera) timestamp() string {
+	ts := time.Now().UnixNano()
+	if ts <= d.lastTs {
+		ts = d.lastTs + 1
+	}
+	d.lastTs = ts
+	return fmt.Sprintf("%d.%09d", ts/int64(time.Second), ts%int64(time.Second))
+}
+
+type transport struct {
+	h http.Handler
+}
+
+func (t *transport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if err := req.Context().Err(); err != nil {
+		return nil, err
+	}
+	rec := httptest.NewRecorder()
+	t.h.ServeHTTP(rec, req)
+	resp := rec.Result()
+	resp.Request = req
+	return resp, nil
+}
+
+func splitPath(p string) []string {
+	parts := []string{}
+	for _, s := range strings.Split(p, "/") {
+		if s != "" {
+			parts = append(parts, s)
+		}
+	}
+	return parts
+}
+
+func decode(r *http.Request, v interface{}) *dsdk.ApiErrorResponse {
+	if r.Body == nil {
+		return nil
+	}
+	defer r.Body.Close()
+	if err := json.NewDecoder(r.Body).Decode(v); err != nil && err.Error() != "EOF" {
+		return invalidRequest(0, fmt.Sprintf("Could not parse request body: %s", err))
+	}
+	return nil
+}
+
+func listParams(r *http.Request) (int, int) {
+	limit, _ := strconv.Atoi(r.URL.Query().Get("limit"))
+	offset, _ := strconv.Atoi(r.URL.Query().Get("offset"))
+	return limit, offset
+}
+
+func page(r *http.Request, items []interface{}) *list {
+	limit, offset := listParams(r)
+	total := len(items)
+	if offset > total {
+		offset = total
+	}
+	end := total
+	if limit > 0 && offset+limit < end {
+		end = offset + limit
+	}
+	return &list{data: items[offset:end], total: total}
+}
+
+func writeJSON(w http.ResponseWriter, code int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	json.NewEncoder(w).Encode(v)
+}
+
+func writeData(w http.ResponseWriter, path string, data interface{}) {
+	if l, ok := data.(*list); ok {
+		writeJSON(w, http.StatusOK, map[string]interface{}{
+			"data":     l.data,
+			"path":     path,
+			"tenant":   Tenant,
+			"version":  ApiVersion,
+			"metadata": map[string]interface{}{"total_count": l.total},
+		})
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"data":    data,
+		"path":    path,
+		"tenant":  Tenant,
+		"version": ApiVersion,
+	})
+}
+
+func writeError(w http.ResponseWriter, apierr *dsdk.ApiErrorResponse) {
+	writeJSON(w, apierr.Http, apierr)
+}
+
+func notFound(path string) *dsdk.ApiErrorResponse {
+	return &dsdk.ApiErrorResponse{
+		Name:    NotFoundError,
+		Http:    http.StatusNotFound,
+		Message: fmt.Sprintf("Resource not found: %s", path),
+		Path:    path,
+	}
+}
+
+func invalidRequest(code int, msg string) *dsdk.ApiErrorResponse {
+	return &dsdk.ApiErrorResponse{
+		Name:    InvalidRequestError,
+		Code:    code,
+		Http:    http.StatusBadRequest,
+		Message: msg,
+	}
+}
+
+func conflict(msg string) *dsdk.ApiErrorResponse {
+	return &dsdk.ApiErrorResponse{
+		Name:    ConflictError,
+		Http:    http.StatusConflict,
+		Message: msg,
+	}
+}
+
+func unsupported(r *http.Request) *dsdk.ApiErrorResponse {
+	return invalidRequest(0, fmt.Sprintf("Method %s is not supported on %s", r.Method, r.URL.Path))
+}
@@ -0,0 +1,722 @@
+package fake
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+
+	host "github.com/Datera/datera-csi/pkg/host"
+)
+
+const (
+	DefaultIqn = "iqn.1993-08.org.debian:01:fakehost"
+)
+
+var _ host.Host = &Host{}
+
+// Call is a single invocation of a Host method, eg: {"Mount", [source, dest,
+// fs, options...]}
+type Call struct {
+	Op   string
+	Args []string
+}
+
+func (c Call) String() string {
+	return fmt.Sprintf("%s(%s)", c.Op, strings.Join(c.Args, ", "))
+}
+
+// Result is a canned response for a Host method.  Out carries the returned
+// value for methods that have one (device path, filesystem type, size, ...)
+type Result struct {
+	Out string
+	Err error
+}
+
+type device struct {
+	iqn       string
+	portal    string
+	connected bool
+	fsType    string
+	// Anything other than a filesystem, eg: a partition table
+	signature host.Signature
+	size      int64
+	readOnly  bool
+	state     string
+	// Path devices of a multipath device
+	paths []string
+	// Filesystem usage reported by Statfs
+	usedBytes  int64
+	usedInodes int64
+}
+
+// Host is a fake host.Host.  It records every call made against it and keeps
+// just enough state (logged in devices, their filesystems and mounts) for
+// the node service to behave as it would on a real node.  Scripted results
+// take precedence over that behavior
+type Host struct {
+	m *sync.Mutex
+
+	// Returned by InitiatorName
+	Iqn string
+
+	calls   []Call
+	scripts map[string][]Result
+	devices map[string]*device
+	mounts  map[string]string
+	options map[string][]string
+	// Block device nodes created by MakeNode, node -> device
+	nodes map[string]string
+	// Portals no path comes up for
+	downPortals map[string]bool
+	multipaths  int
+}
+
+func NewHost() *Host {
+	return &Host{
+		m:       &sync.Mutex{},
+		Iqn:     DefaultIqn,
+		scripts: map[string][]Result{},
+		devices: map[string]*device{},
+		mounts:  map[string]string{},
+		options: map[string][]string{},
+		nodes:   map[string]string{},
+
+		downPortals: map[string]bool{},
+	}
+}
+
+// Script queues results for op, the name of a Host method.  Each call to op
+// consumes one result until the queue is empty, after which the fake goes
+// back to its default behavior
+func (h *Host) Script(op string, results ...Result) {
+	h.m.Lock()
+	defer h.m.Unlock()
+	h.scripts[op] = append(h.scripts[op], results...)
+}
+
+// Calls returns every call made so far
+func (h *Host) Calls() []Call {
+	h.m.Lock()
+	defer h.m.Unlock()
+	return append([]Call{}, h.calls...)
+}
+
+// CallsTo returns the calls made so far to op
+func (h *Host) CallsTo(op string) []Call {
+	h.m.Lock()
+	defer h.m.Unlock()
+	calls := []Call{}
+	for _, c := range h.calls {
+		if c.Op == op {
+			calls = append(calls, c)
+		}
+	}
+	return calls
+}
+
+// SetDeviceSize sets the size in bytes reported for device
+func (h *Host) SetDeviceSize(device string, size int64) {
+	h.m.Lock()
+	defer h.m.Unlock()
+	h.device(device).size = size
+}
+
+// SetFsType sets the filesystem reported for device as if it had been
+// formatted outside the driver
+func (h *Host) SetFsType(device, fsType string) {
+	h.m.Lock()
+	defer h.m.Unlock()
+	h.device(device).fsType = fsType
+	for _, p := range h.device(device).paths {
+		h.device(p).fsType = fsType
+	}
+}
+
+// SetSignature makes device report sig, eg: an LVM physical volume or a
+// partition table, instead of a filesystem
+func (h *Host) SetSignature(device string, sig host.Signature) {
+	h.m.Lock()
+	defer h.m.Unlock()
+	h.device(device).signature = sig
+	for _, p := range h.device(device).paths {
+		h.device(p).signature = sig
+	}
+}
+
+// RemountReadOnly makes every mount of device report "ro", as the kernel does
+// after an ext4 errors=remount-ro
+func (h *Host) RemountReadOnly(device string) {
+	h.m.Lock()
+	defer h.m.Unlock()
+	h.device(device).readOnly = true
+}
+
+// SetFsUsage sets the space and inodes reported as used on the filesystem
+// of device
+func (h *Host) SetFsUsage(device string, bytes, inodes int64) {
+	h.m.Lock()
+	defer h.m.Unlock()
+	d := h.device(device)
+	d.usedBytes = bytes
+	d.usedInodes = inodes
+}
+
+// SetDeviceState sets the SCSI state reported for device, eg: "blocked" or
+// "transport-offline" for a failed iSCSI session
+func (h *Host) SetDeviceState(device, state string) {
+	h.m.Lock()
+	defer h.m.Unlock()
+	h.device(device).state = state
+}
+
+// SetPortalDown makes logins through portal fail to bring up a path, as if
+// the storage node behind it was failing over
+func (h *Host) SetPortalDown(portal string, down bool) {
+	h.m.Lock()
+	defer h.m.Unlock()
+	h.downPortals[portal] = down
+}
+
+// Mounts returns the current mounts as mount point -> device
+func (h *Host) Mounts() map[string]string {
+	h.m.Lock()
+	defer h.m.Unlock()
+	mounts := map[string]string{}
+	for k, v := range h.mounts {
+		mounts[k] = v
+	}
+	return mounts
+}
+
+// DevicePath returns the path Connect hands out for a login to iqn
+func DevicePath(iqn, portal string) string {
+	return fmt.Sprintf("/dev/disk/by-path/ip-%s:3260-iscsi-%s-lun-0", portal, iqn)
+}
+
+func (h *Host) record(op string, args ...string) (Result, bool) {
+	h.calls = append(h.calls, Call{Op: op, Args: args})
+	if rs := h.scripts[op]; len(rs) > 0 {
+		h.scripts[op] = rs[1:]
+		return rs[0], true
+	}
+	return Result{}, false
+}
+
+func (h *Host) device(path string) *device {
+	dev, ok := h.devices[path]
+	if !ok {
+		dev = &device{connected: true}
+		h.devices[path] = dev
+	}
+	return dev
+}
+
+func (h *Host) Mount(ctxt context.Context, source, dest, fs string, options []string) error {
+	h.m.Lock()
+	defer h.m.Unlock()
+	if r, ok := h.record("Mount", append([]string{source, dest, fs}, options...)...); ok {
+		return r.Err
+	}
+	dev := source
+	if d, ok := h.mounts[source]; ok {
+		dev = d
+	} else if d, ok := h.devices[source]; !ok || !d.connected {
+		return fmt.Errorf("mount: special device %s does not exist", source)
+	} else {
+		// Bind mounting the device itself exposes it as a block device node
+		for _, opt := range options {
+			if opt == "--bind" {
+				h.nodes[dest] = dev
+			}
+		}
+	}
+	h.mounts[dest] = dev
+	h.options[dest] = options
+	return nil
+}
+
+func (h *Host) Unmount(ctxt context.Context, path string) error {
+	h.m.Lock()
+	defer h.m.Unlock()
+	if r, ok := h.record("Unmount", path); ok {
+		return r.Err
+	}
+	delete(h.mounts, path)
+	delete(h.options, path)
+	delete(h.nodes, path)
+	return nil
+}
+
+func (h *Host) ListMounts(ctxt context.Context, prefix string) (map[string]string, error) {
+	h.m.Lock()
+	defer h.m.Unlock()
+	if r, ok := h.record("ListMounts", prefix); ok {
+		return nil, r.Err
+	}
+	mounts := map[string]string{}
+	for path, dev := range h.mounts {
+		if strings.HasPrefix(path, prefix) {
+			mounts[path] = dev
+		}
+	}
+	return mounts, nil
+}
+
+func (h *Host) DeviceFromMount(ctxt context.Context, path string) (string, error) {
+	h.m.Lock()
+	defer h.m.Unlock()
+	if r, ok := h.record("DeviceFromMount", path); ok {
+		return r.Out, r.Err
+	}
+	if dev, ok := h.mounts[path]; ok {
+		return dev, nil
+	}
+	return "", fmt.Errorf("No device mounted at %s", path)
+}
+
+func (h *Host) FindMount(ctxt context.Context, device string) (string, error) {
+	h.m.Lock()
+	defer h.m.Unlock()
+	if r, ok := h.record("FindMount", device); ok {
+		return r.Out, r.Err
+	}
+	paths := []string{}
+	for path, dev := range h.mounts {
+		if dev == device {
+			paths = append(paths, path)
+		}
+	}
+	if len(paths) == 0 {
+		return "", fmt.Errorf("Device %s is not mounted", device)
+	}
+	sort.Strings(paths)
+	return paths[0], nil
+}
+
+func (h *Host) MountOptions(ctxt context.Context, path string) ([]string, error) {
+	h.m.Lock()
+	defer h.m.Unlock()
+	if r, ok := h.record("MountOptions", path); ok {
+		return strings.Split(r.Out, ","), r.Err
+	}
+	dev, ok := h.mounts[path]
+	if !ok {
+		return nil, fmt.Errorf("Nothing mounted at %s", path)
+	}
+	ro := false
+	if d, ok := h.devices[dev]; ok && d.readOnly {
+		ro = true
+	}
+	opts := []string{}
+	for _, arg := range h.options[path] {
+		if arg == "" || strings.HasPrefix(arg, "-") {
+			continue
+		}
+		for _, opt := range strings.Split(arg, ",") {
+			switch opt {
+			case "ro":
+				ro = true
+			case "rw":
+			default:
+				opts = append(opts, opt)
+			}
+		}
+	}
+	if ro {
+		return append([]string{"ro"}, opts...), nil
+	}
+	return append([]string{"rw"}, opts...), nil
+}
+
+func (h *Host) MakeReadOnly(ctxt context.Context, path string) error {
+	h.m.Lock()
+	defer h.m.Unlock()
+	if r, ok := h.record("MakeReadOnly", path); ok {
+		return r.Err
+	}
+	if _, ok := h.mounts[path]; !ok {
+		return fmt.Errorf("mount: %s not mounted", path)
+	}
+	h.options[path] = append(h.options[path], "ro")
+	return nil
+}
+
+// Filesystems get one inode per 16 KiB, like mkfs.ext4's default
+const bytesPerInode = 16 * 1024
+
+func (h *Host) Statfs(ctxt context.Context, path string) (*host.FsStats, error) {
+	h.m.Lock()
+	defer h.m.Unlock()
+	if r, ok := h.record("Statfs", path); ok {
+		return nil, r.Err
+	}
+	dev, ok := h.mounts[path]
+	if !ok {
+		return nil, fmt.Errorf("statfs %s: no such file or directory", path)
+	}
+	d := h.device(dev)
+	inodes := d.size / bytesPerInode
+	return &host.FsStats{
+		TotalBytes:     d.size,
+		AvailableBytes: d.size - d.usedBytes,
+		UsedBytes:      d.usedBytes,
+		TotalInodes:    inodes,
+		FreeInodes:     inodes - d.usedInodes,
+		UsedInodes:     d.usedInodes,
+	}, nil
+}
+
+func (h *Host) Format(ctxt context.Context, device, fsType string, fsArgs []string) (string, error) {
+	h.m.Lock()
+	defer h.m.Unlock()
+	if r, ok := h.record("Format", append([]string{device, fsType}, fsArgs...)...); ok {
+		return r.Out, r.Err
+	}
+	if d, ok := h.devices[device]; !ok || !d.connected {
+		return "", fmt.Errorf("The device apparently does not exist: %s", device)
+	}
+	// Written to the LUN, so its paths and any later multipath device see it
+	h.devices[device].fsType = fsType
+	for _, p := range h.devices[device].paths {
+		h.device(p).fsType = fsType
+	}
+	return "", nil
+}
+
+func (h *Host) ExpandFs(ctxt context.Context, device string, cmd []string) error {
+	h.m.Lock()
+	defer h.m.Unlock()
+	if r, ok := h.record("ExpandFs", append([]string{device}, cmd...)...); ok {
+		return r.Err
+	}
+	return nil
+}
+
+func (h *Host) Probe(ctxt context.Context, device string) (*host.Signature, error) {
+	h.m.Lock()
+	defer h.m.Unlock()
+	if r, ok := h.record("Probe", device); ok {
+		if r.Err != nil {
+			return nil, r.Err
+		}
+		return &host.Signature{Type: r.Out, Usage: "filesystem"}, nil
+	}
+	d, ok := h.devices[device]
+	if !ok || !d.connected {
+		return nil, fmt.Errorf("blkid: error: %s: No such file or directory", device)
+	}
+	if d.fsType != "" {
+		return &host.Signature{Type: d.fsType, Usage: "filesystem"}, nil
+	}
+	sig := d.signature
+	return &sig, nil
+}
+
+func (h *Host) CheckFs(ctxt context.Context, device string, cmd []string) (string, error) {
+	h.m.Lock()
+	defer h.m.Unlock()
+	if r, ok := h.record("CheckFs", append([]string{device}, cmd...)...); ok {
+		return r.Out, r.Err
+	}
+	if d, ok := h.devices[device]; !ok || !d.connected {
+		return "", fmt.Errorf("No such file or directory while trying to open %s", device)
+	}
+	return "", nil
+}
+
+func (h *Host) FsType(ctxt context.Context, device string) (string, error) {
+	h.m.Lock()
+	defer h.m.Unlock()
+	if r, ok := h.record("FsType", device); ok {
+		return r.Out, r.Err
+	}
+	if d, ok := h.devices[device]; ok && d.connected && d.fsType != "" {
+		return d.fsType, nil
+	}
+	return "", fmt.Errorf("No filesystem found")
+}
+
+func (h *Host) Size(ctxt context.Context, device string) (int64, error) {
+	h.m.Lock()
+	defer h.m.Unlock()
+	if r, ok := h.record("Size", device); ok {
+		if r.Err != nil {
+			return 0, r.Err
+		}
+		return strconv.ParseInt(r.Out, 10, 0)
+	}
+	if dev, ok := h.nodes[device]; ok {
+		device = dev
+	}
+	if d, ok := h.devices[device]; ok && d.connected {
+		return d.size, nil
+	}
+	return 0, fmt.Errorf("blockdev: cannot open %s: No such file or directory", device)
+}
+
+func (h *Host) MakeNode(ctxt context.Context, device, dest string) error {
+	h.m.Lock()
+	defer h.m.Unlock()
+	if r, ok := h.record("MakeNode", device, dest); ok {
+		return r.Err
+	}
+	h.nodes[dest] = device
+	return nil
+}
+
+func (h *Host) IsBlockDevice(ctxt context.Context, path string) (bool, error) {
+	h.m.Lock()
+	defer h.m.Unlock()
+	if r, ok := h.record("IsBlockDevice", path); ok {
+		return r.Out == "true", r.Err
+	}
+	if _, ok := h.nodes[path]; ok {
+		return true, nil
+	}
+	if _, ok := h.mounts[path]; ok {
+		return false, nil
+	}
+	if d, ok := h.devices[path]; ok && d.connected {
+		return true, nil
+	}
+	return false, &os.PathError{Op: "stat", Path: path, Err: syscall.ENOENT}
+}
+
+func (h *Host) DeviceState(ctxt context.Context, device string) (string, error) {
+	h.m.Lock()
+	defer h.m.Unlock()
+	if r, ok := h.record("DeviceState", device); ok {
+		return r.Out, r.Err
+	}
+	if dev, ok := h.nodes[device]; ok {
+		device = dev
+	}
+	d, ok := h.devices[device]
+	if !ok || !d.connected {
+		return "", fmt.Errorf("open /sys/block/%s/device/state: no such file or directory", device)
+	}
+	if d.state != "" {
+		return d.state, nil
+	}
+	for _, p := range d.paths {
+		if state := h.pathState(p); state != "running" {
+			return state, nil
+		}
+	}
+	return "running", nil
+}
+
+func (h *Host) pathState(path string) string {
+	if d, ok := h.devices[path]; !ok || !d.connected {
+		return "missing"
+	} else if d.state != "" {
+		return d.state
+	}
+	return "running"
+}
+
+// Returns the multipath device path belongs to, if any
+func (h *Host) multipathOf(path string) (string, bool) {
+	if dev, ok := h.nodes[path]; ok {
+		path = dev
+	}
+	if d, ok := h.devices[path]; ok && d.connected && len(d.paths) > 0 {
+		return path, true
+	}
+	for name, d := range h.devices {
+		if !d.connected {
+			continue
+		}
+		for _, p := range d.paths {
+			if p == path {
+				return name, true
+			}
+		}
+	}
+	return "", false
+}
+
+func (h *Host) MultipathDevice(ctxt context.Context, device string) (string, error) {
+	h.m.Lock()
+	defer h.m.Unlock()
+	if r, ok := h.record("MultipathDevice", device); ok {
+		return r.Out, r.Err
+	}
+	if dm, ok := h.multipathOf(device); ok {
+		return dm, nil
+	}
+	return "", fmt.Errorf("%s is not part of a multipath device", device)
+}
+
+func (h *Host) MultipathPaths(ctxt context.Context, device string) (map[string]string, error) {
+	h.m.Lock()
+	defer h.m.Unlock()
+	if r, ok := h.record("MultipathPaths", device); ok {
+		return nil, r.Err
+	}
+	dm, ok := h.multipathOf(device)
+	if !ok {
+		return nil, fmt.Errorf("%s is not part of a multipath device", device)
+	}
+	paths := map[string]string{}
+	for _, p := range h.devices[dm].paths {
+		paths[p] = h.pathState(p)
+	}
+	return paths, nil
+}
+
+func (h *Host) ResizeMultipath(ctxt context.Context, device string) error {
+	h.m.Lock()
+	defer h.m.Unlock()
+	if r, ok := h.record("ResizeMultipath", device); ok {
+		return r.Err
+	}
+	return nil
+}
+
+func (h *Host) MultipathMaps(ctxt context.Context) ([]string, error) {
+	h.m.Lock()
+	defer h.m.Unlock()
+	if r, ok := h.record("MultipathMaps"); ok {
+		return nil, r.Err
+	}
+	maps := []string{}
+	for name, d := range h.devices {
+		if d.connected && len(d.paths) > 0 {
+			maps = append(maps, name)
+		}
+	}
+	sort.Strings(maps)
+	return maps, nil
+}
+
+func (h *Host) FlushMultipath(ctxt context.Context, device string) error {
+	h.m.Lock()
+	defer h.m.Unlock()
+	if r, ok := h.record("FlushMultipath", device); ok {
+		return r.Err
+	}
+	if d, ok := h.devices[device]; ok {
+		d.connected = false
+	}
+	return nil
+}
+
+func (h *Host) Connect(ctxt context.Context, c *host.Connector) (string, error) {
+	h.m.Lock()
+	defer h.m.Unlock()
+	args := []string{}
+	for _, t := range c.Targets {
+		args = append(args, fmt.Sprintf("%s:%s,%s", t.Portal, t.Port, t.Iqn))
+	}
+	if r, ok := h.record("Connect", args...); ok {
+		return r.Out, r.Err
+	}
+	if len(c.Targets) == 0 {
+		return "", fmt.Errorf("No targets provided")
+	}
+	paths := []string{}
+	for _, t := range c.Targets {
+		if h.downPortals[t.Portal] {
+			continue
+		}
+		path := DevicePath(t.Iqn, t.Portal)
+		dev := h.device(path)
+		dev.iqn = t.Iqn
+		dev.portal = t.Portal
+		dev.connected = true
+		paths = append(paths, path)
+	}
+	if len(paths) == 0 {
+		return "", fmt.Errorf("Could not log in to any portal of %s", c.Targets[0].Iqn)
+	}
+	if !c.Multipath {
+		return paths[0], nil
+	}
+	// multipathd assembles a single device from every path
+	dm, ok := h.multipathOf(paths[0])
+	if !ok {
+		dm = fmt.Sprintf("/dev/dm-%d", h.multipaths)
+		h.multipaths++
+		lun := h.device(paths[0])
+		h.device(dm).fsType, h.device(dm).signature = lun.fsType, lun.signature
+	}
+	dev := h.device(dm)
+	dev.iqn = c.Targets[0].Iqn
+	dev.connected = true
+	for _, p := range paths {
+		if !dev.hasPath(p) {
+			dev.paths = append(dev.paths, p)
+		}
+	}
+	return dm, nil
+}
+
+func (d *device) hasPath(path string) bool {
+	for _, p := range d.paths {
+		if p == path {
+			return true
+		}
+	}
+	return false
+}
+
+func (h *Host) Disconnect(ctxt context.Context, iqn string, portals []string) error {
+	h.m.Lock()
+	defer h.m.Unlock()
+	if r, ok := h.record("Disconnect", append([]string{iqn}, portals...)...); ok {
+		return r.Err
+	}
+	// Multipath devices stay behind without paths until flushed
+	for _, dev := range h.devices {
+		if dev.iqn == iqn && len(dev.paths) == 0 {
+			dev.connected = false
+		}
+	}
+	return nil
+}
+
+func (h *Host) Sessions(ctxt context.Context) ([]*host.Session, error) {
+	h.m.Lock()
+	defer h.m.Unlock()
+	if r, ok := h.record("Sessions"); ok {
+		return nil, r.Err
+	}
+	sessions := []*host.Session{}
+	for path, dev := range h.devices {
+		if dev.connected && dev.portal != "" {
+			sessions = append(sessions, &host.Session{
+				Iqn:    dev.iqn,
+				Portal: dev.portal + ":3260",
+				Device: path,
+			})
+		}
+	}
+	sort.Slice(sessions, func(i, j int) bool {
+		return sessions[i].Device < sessions[j].Device
+	})
+	return sessions, nil
+}
+
+func (h *Host) Rescan(ctxt context.Context, iqn string) error {
+	h.m.Lock()
+	defer h.m.Unlock()
+	if r, ok := h.record("Rescan", iqn); ok {
+		return r.Err
+	}
+	return nil
+}
+
+func (h *Host) InitiatorName(ctxt context.Context) (string, error) {
+	h.m.Lock()
+	defer h.m.Unlock()
+	if r, ok := h.record("InitiatorName"); ok {
+		return r.Out, r.Err
+	}
+	return h.Iqn, nil
+}
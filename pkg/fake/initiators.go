@@ -0,0 +1,88 @@
+package fake
+
+import (
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+
+	dsdk "github.com/Datera/go-sdk/pkg/dsdk"
+)
+
+func (d *Datera) handleInitiators(r *http.Request, parts []string) (interface{}, *dsdk.ApiErrorResponse) {
+	if len(parts) == 0 {
+		switch r.Method {
+		case http.MethodGet:
+			ids := []string{}
+			for id := range d.initiators {
+				ids = append(ids, id)
+			}
+			sort.Strings(ids)
+			items := []interface{}{}
+			for _, id := range ids {
+				items = append(items, d.initiators[id])
+			}
+			return page(r, items), nil
+		case http.MethodPost:
+			req := &dsdk.InitiatorsCreateRequest{}
+			if apierr := decode(r, req); apierr != nil {
+				return nil, apierr
+			}
+			if req.Id == "" {
+				return nil, invalidRequest(0, "id is a required field")
+			}
+			if _, ok := d.initiators[req.Id]; ok {
+				return nil, conflict(fmt.Sprintf("An initiator with id %s already exists", req.Id))
+			}
+			init := &dsdk.Initiator{
+				Path: initiatorPath(req.Id),
+				Id:   req.Id,
+				Name: req.Name,
+			}
+			d.initiators[req.Id] = init
+			return init, nil
+		}
+		return nil, unsupported(r)
+	}
+	if len(parts) != 1 {
+		return nil, notFound(r.URL.Path)
+	}
+	init, ok := d.initiators[parts[0]]
+	if !ok {
+		return nil, notFound(initiatorPath(parts[0]))
+	}
+	switch r.Method {
+	case http.MethodGet:
+		return init, nil
+	case http.MethodDelete:
+		delete(d.initiators, init.Id)
+		// Deleting an initiator drops it from every acl_policy
+		for _, t := range d.tenants {
+			for _, ai := range t.ais {
+				for _, si := range ai.StorageInstances {
+					inits := []*dsdk.Initiator{}
+					for _, i := range si.AclPolicy.Initiators {
+						owner := i.Tenant
+						if owner == "" {
+							owner = t.name
+						}
+						if i.Path != init.Path || owner != d.tenant.name {
+							inits = append(inits, i)
+						}
+					}
+					si.AclPolicy.Initiators = inits
+				}
+			}
+		}
+		return init, nil
+	}
+	return nil, unsupported(r)
+}
+
+func initiatorPath(id string) string {
+	return "/initiators/" + id
+}
+
+func initiatorId(path string) string {
+	return strings.TrimPrefix(path, "/initiators/")
+}
@@ -0,0 +1,86 @@
+package fake
+
+import (
+	"fmt"
+	"net/http"
+	"path"
+
+	dsdk "github.com/Datera/go-sdk/pkg/dsdk"
+	uuid "github.com/google/uuid"
+)
+
+func (d *Datera) handleSnapshots(r *http.Request, vol *dsdk.Volume) (interface{}, *dsdk.ApiErrorResponse) {
+	switch r.Method {
+	case http.MethodGet:
+		items := []interface{}{}
+		for _, snap := range vol.Snapshots {
+			d.observeSnapshot(snap)
+			items = append(items, snap)
+		}
+		return page(r, items), nil
+	case http.MethodPost:
+		req := &dsdk.SnapshotsCreateRequest{}
+		if apierr := decode(r, req); apierr != nil {
+			return nil, apierr
+		}
+		if req.Uuid == "" {
+			req.Uuid = uuid.Must(uuid.NewRandom()).String()
+		}
+		for _, snap := range vol.Snapshots {
+			if snap.Uuid == req.Uuid {
+				return nil, invalidRequest(DuplicateSnapshotCode, fmt.Sprintf("A snapshot with uuid %s already exists", req.Uuid))
+			}
+		}
+		ts := d.timestamp()
+		snap := &dsdk.Snapshot{
+			Path:      path.Join(vol.Path, "snapshots", ts),
+			Timestamp: ts,
+			UtcTs:     ts,
+			Uuid:      req.Uuid,
+			OpState:   opAvailable,
+			Local:     true,
+		}
+		if d.SnapshotReadyAfter > 0 {
+			snap.OpState = opUnavailable
+			d.snapReads[snap.Path] = d.SnapshotReadyAfter
+		}
+		vol.Snapshots = append(vol.Snapshots, snap)
+		return snap, nil
+	}
+	return nil, unsupported(r)
+}
+
+func (d *Datera) handleSnapshot(r *http.Request, vol *dsdk.Volume, ts string) (interface{}, *dsdk.ApiErrorResponse) {
+	for i, snap := range vol.Snapshots {
+		if snap.Timestamp != ts {
+			continue
+		}
+		switch r.Method {
+		case http.MethodGet:
+			d.observeSnapshot(snap)
+			return snap, nil
+		case http.MethodDelete:
+			vol.Snapshots = append(vol.Snapshots[:i], vol.Snapshots[i+1:]...)
+			delete(d.snapReads, snap.Path)
+			return snap, nil
+		}
+		return nil, unsupported(r)
+	}
+	return nil, notFound(path.Join(vol.Path, "snapshots", ts))
+}
+
+// Counts a read of the snapshot, moving it to "available" once it has been
+// read SnapshotReadyAfter times
+func (d *Datera) observeSnapshot(snap *dsdk.Snapshot) {
+	left, ok := d.snapReads[snap.Path]
+	if !ok {
+		return
+	}
+	left--
+	if left <= 0 {
+		delete(d.snapReads, snap.Path)
+		snap.OpState = opAvailable
+		return
+	}
+	d.snapReads[snap.Path] = left
+}
@@ -0,0 +1,114 @@
+package fake
+
+import (
+	"net/http"
+	"sort"
+
+	dsdk "github.com/Datera/go-sdk/pkg/dsdk"
+)
+
+const storageNodeUuid = "3c0b3df6-4a8e-4a1b-9d52-4d0c4b5a6f10"
+
+func (d *Datera) handleSystem(r *http.Request, parts []string) (interface{}, *dsdk.ApiErrorResponse) {
+	if len(parts) != 0 || r.Method != http.MethodGet {
+		return nil, unsupported(r)
+	}
+	provisioned := 0
+	for _, t := range d.tenants {
+		for _, ai := range t.ais {
+			for _, si := range ai.StorageInstances {
+				for _, v := range si.Volumes {
+					provisioned += v.Size * gib
+				}
+			}
+		}
+	}
+	return &dsdk.System{
+		Path:                        "/system",
+		Name:                        "fake-datera",
+		Uuid:                        "8b2b4d0c-3c5e-4e3a-a3c4-0d1f5a8e7e21",
+		BuildVersion:                SwVersion + "-fake",
+		SwVersion:                   SwVersion,
+		Health:                      "ok",
+		OpState:                     "running",
+		Timezone:                    "UTC",
+		TotalCapacity:               totalCapacity,
+		TotalProvisionedCapacity:    provisioned,
+		AvailableCapacity:           totalCapacity - provisioned,
+		AllFlashTotalCapacity:       totalCapacity,
+		AllFlashProvisionedCapacity: provisioned,
+		AllFlashCapacity:            totalCapacity - provisioned,
+	}, nil
+}
+
+func (d *Datera) handleStorageNodes(r *http.Request, parts []string) (interface{}, *dsdk.ApiErrorResponse) {
+	if len(parts) != 0 || r.Method != http.MethodGet {
+		return nil, unsupported(r)
+	}
+	return page(r, []interface{}{&dsdk.StorageNode{
+		Path:       "/storage_nodes/" + storageNodeUuid,
+		Uuid:       storageNodeUuid,
+		AdminState: "online",
+		OpState:    "running",
+	}}), nil
+}
+
+func (d *Datera) handleIpPools(r *http.Request, parts []string) (interface{}, *dsdk.ApiErrorResponse) {
+	if r.Method != http.MethodGet {
+		return nil, unsupported(r)
+	}
+	switch len(parts) {
+	case 0:
+		names := []string{}
+		for name := range d.ipPools {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		items := []interface{}{}
+		for _, name := range names {
+			items = append(items, renderIpPool(d.ipPools[name]))
+		}
+		return page(r, items), nil
+	case 1:
+		pool, ok := d.ipPools[parts[0]]
+		if !ok {
+			return nil, notFound(ipPoolPath(parts[0]))
+		}
+		return renderIpPool(pool), nil
+	}
+	return nil, unsupported(r)
+}
+
+// Resolves an ip pool reference such as "/access_network_ip_pools/default".
+// The driver sends the bare collection path when no pool was requested, which
+// the system treats as the default pool
+func (d *Datera) ipPoolFromPath(path string) (*ipPool, *dsdk.ApiErrorResponse) {
+	parts := splitPath(path)
+	name := DefaultIpPool
+	if len(parts) == 2 {
+		name = parts[1]
+	} else if len(parts) != 1 || parts[0] != "access_network_ip_pools" {
+		return nil, notFound(path)
+	}
+	pool, ok := d.ipPools[name]
+	if !ok {
+		return nil, notFound(path)
+	}
+	return pool, nil
+}
+
+func ipPoolPath(name string) string {
+	return "/access_network_ip_pools/" + name
+}
+
+func renderIpPool(pool *ipPool) *dsdk.AccessNetworkIpPool {
+	paths := []interface{}{}
+	for _, ip := range pool.ips {
+		paths = append(paths, map[string]interface{}{"ip": ip})
+	}
+	return &dsdk.AccessNetworkIpPool{
+		Path:         ipPoolPath(pool.name),
+		Name:         pool.name,
+		NetworkPaths: paths,
+	}
+}
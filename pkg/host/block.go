@@ -0,0 +1,236 @@
+package host
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	unix "golang.org/x/sys/unix"
+
+	co "github.com/Datera/datera-csi/pkg/common"
+)
+
+var (
+	sysBlock    = "/sys/block"
+	sysDevBlock = "/sys/dev/block"
+)
+
+type LsBlk struct {
+	BlockDevices []*LsBlkEntry
+}
+
+type LsBlkEntry struct {
+	Name       string
+	FsType     string
+	Label      string
+	Uuid       string
+	MountPoint string
+}
+
+func (h *linuxHost) Format(ctxt context.Context, device, fsType string, fsArgs []string) (string, error) {
+	cmd := append(append([]string{fmt.Sprintf("mkfs.%s", fsType)}, fsArgs...), device)
+	return h.exec.Run(ctxt, cmd...)
+}
+
+// Signature is what blkid recognizes on a device
+type Signature struct {
+	// Content type, eg: ext4, xfs or LVM2_member
+	Type string
+	// Content class, eg: filesystem, raid or crypto
+	Usage string
+	// Partition table type, eg: gpt or dos
+	PtType string
+}
+
+// Empty is true when nothing was recognized on the device
+func (s *Signature) Empty() bool {
+	return s.Type == "" && s.PtType == ""
+}
+
+// IsFilesystem is true when the device holds a filesystem
+func (s *Signature) IsFilesystem() bool {
+	return s.Type != "" && s.Usage == "filesystem"
+}
+
+func (s *Signature) String() string {
+	parts := []string{}
+	if s.Type != "" {
+		parts = append(parts, fmt.Sprintf("%s %s", s.Usage, s.Type))
+	}
+	if s.PtType != "" {
+		parts = append(parts, fmt.Sprintf("%s partition table", s.PtType))
+	}
+	if len(parts) == 0 {
+		return "no signature"
+	}
+	return strings.Join(parts, ", ")
+}
+
+// blkid exits with 2 when it finds nothing on the device
+const blkidNoSignature = 2
+
+// Probes the device itself (-p) rather than trusting the blkid cache, which
+// can be stale or empty for a device that was just logged in
+func (h *linuxHost) Probe(ctxt context.Context, device string) (*Signature, error) {
+	out, err := h.exec.Run(ctxt, "blkid", "-p", "-o", "export", device)
+	if err != nil {
+		if ee, ok := err.(interface{ ExitCode() int }); ok && ee.ExitCode() == blkidNoSignature {
+			return &Signature{}, nil
+		}
+		return nil, fmt.Errorf("blkid failed for %s: %s: %s", device, err, strings.TrimSpace(out))
+	}
+	sig := &Signature{}
+	for _, line := range strings.Split(out, "\n") {
+		kv := strings.SplitN(strings.TrimSpace(line), "=", 2)
+		if len(kv) != 2 {
+			continue
+		}
+		switch kv[0] {
+		case "TYPE":
+			sig.Type = kv[1]
+		case "USAGE":
+			sig.Usage = kv[1]
+		case "PTTYPE":
+			sig.PtType = kv[1]
+		}
+	}
+	return sig, nil
+}
+
+// The commands come from the filesystem registry in the client package, the
+// host only knows how to run them
+func (h *linuxHost) CheckFs(ctxt context.Context, device string, cmd []string) (string, error) {
+	if len(cmd) == 0 {
+		return "", fmt.Errorf("No filesystem check command given for %s", device)
+	}
+	return h.exec.Run(ctxt, cmd...)
+}
+
+func (h *linuxHost) ExpandFs(ctxt context.Context, device string, cmd []string) error {
+	if len(cmd) == 0 {
+		return fmt.Errorf("No filesystem expansion command given for %s", device)
+	}
+	out, err := h.exec.Run(ctxt, cmd...)
+	if err != nil {
+		return fmt.Errorf("%s failed for %s: %s: %s", cmd[0], device, err, strings.TrimSpace(out))
+	}
+	return nil
+}
+
+func (h *linuxHost) FsType(ctxt context.Context, device string) (string, error) {
+	out, err := h.exec.Run(ctxt, "lsblk", "-f", device, "--json")
+	if err != nil {
+		return "", err
+	}
+	co.Debugf(ctxt, "lsblk output: %s", out)
+	data := &LsBlk{}
+	if err := json.Unmarshal([]byte(out), &data); err != nil {
+		return "", err
+	}
+	if len(data.BlockDevices) < 1 {
+		out, err := h.exec.Run(ctxt, "lsblk", "-f")
+		if err != nil {
+			return "", err
+		}
+		co.Debugf(ctxt, "lsblk full output: %s", out)
+		return "", fmt.Errorf("No block devices returned from lsblk")
+	}
+	fs := data.BlockDevices[0].FsType
+	if fs == "" {
+		return "", fmt.Errorf("No filesystem found")
+	}
+	return fs, nil
+}
+
+func (h *linuxHost) Size(ctxt context.Context, device string) (int64, error) {
+	out, err := h.exec.Run(ctxt, "blockdev", "--getsize64", device)
+	if err != nil {
+		return 0, err
+	}
+	return strconv.ParseInt(strings.TrimSpace(out), 10, 0)
+}
+
+func getMajorMinor(device string) (uint32, uint32, error) {
+	s := unix.Stat_t{}
+	if err := unix.Stat(device, &s); err != nil {
+		return 0, 0, err
+	}
+
+	dev := uint64(s.Rdev)
+	return unix.Major(dev), unix.Minor(dev), nil
+}
+
+func (h *linuxHost) MakeNode(ctxt context.Context, device, dest string) error {
+	major, minor, err := getMajorMinor(device)
+	if err != nil {
+		return err
+	}
+	cmd := []string{"mknod", dest, "b", strconv.FormatUint(uint64(major), 10), strconv.FormatUint(uint64(minor), 10)}
+	_, err = h.exec.Run(ctxt, cmd...)
+	return err
+}
+
+func scsiState(name string) (string, error) {
+	b, err := ioutil.ReadFile(filepath.Join(sysBlock, name, "device", "state"))
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimSpace(string(b)), nil
+}
+
+// Returns the kernel name of device, eg: sdb or dm-3
+func (h *linuxHost) kernelName(ctxt context.Context, device string) string {
+	dev, err := h.readlink(ctxt, device)
+	if err != nil || dev == "" {
+		dev = device
+	}
+	name := filepath.Base(dev)
+	// Device nodes created for raw block volumes don't carry the kernel name,
+	// so look it up by major:minor
+	if major, minor, err := getMajorMinor(dev); err == nil {
+		if p, err := filepath.EvalSymlinks(filepath.Join(sysDevBlock, fmt.Sprintf("%d:%d", major, minor))); err == nil {
+			name = filepath.Base(p)
+		}
+	}
+	return name
+}
+
+func (h *linuxHost) DeviceState(ctxt context.Context, device string) (string, error) {
+	name := h.kernelName(ctxt, device)
+	dev := device
+	if !strings.HasPrefix(name, "dm-") {
+		return scsiState(name)
+	}
+	slaves, err := ioutil.ReadDir(filepath.Join(sysBlock, name, "slaves"))
+	if err != nil {
+		return "", err
+	}
+	if len(slaves) == 0 {
+		return "", fmt.Errorf("Multipath device %s has no paths", dev)
+	}
+	for _, slave := range slaves {
+		state, err := scsiState(slave.Name())
+		if err != nil {
+			return "", err
+		}
+		if state != "running" {
+			co.Debugf(ctxt, "Path %s of %s is %s", slave.Name(), dev, state)
+			return state, nil
+		}
+	}
+	return "running", nil
+}
+
+func (h *linuxHost) IsBlockDevice(ctxt context.Context, path string) (bool, error) {
+	fi, err := os.Stat(path)
+	if err != nil {
+		return false, err
+	}
+	m := fi.Mode()
+	return m&os.ModeDevice != 0 && m&os.ModeCharDevice == 0, nil
+}
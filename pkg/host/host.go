@@ -0,0 +1,141 @@
+// Package host wraps every operation the driver performs against the local
+// node: mounting, formatting, inspecting block devices and logging in to
+// iSCSI targets.  The client and driver only talk to the node through the Host
+// interface so the node service can be exercised without root, disks or iscsid
+package host
+
+import (
+	"context"
+	"os/exec"
+	"strings"
+
+	co "github.com/Datera/datera-csi/pkg/common"
+)
+
+type Mounter interface {
+	// Mounts source at dest, creating dest if it doesn't exist.  If source
+	// is itself a mount point, the device backing it is mounted instead
+	Mount(ctxt context.Context, source, dest, fs string, options []string) error
+	// Unmounts path and removes the mount point
+	Unmount(ctxt context.Context, path string) error
+	// Remounts the mount at path read-only, leaving other mounts of the same
+	// filesystem untouched
+	MakeReadOnly(ctxt context.Context, path string) error
+	// Returns the device mounted at path
+	DeviceFromMount(ctxt context.Context, path string) (string, error)
+	// Returns the mount point of device
+	FindMount(ctxt context.Context, device string) (string, error)
+	// Returns the options path is currently mounted with, eg: [rw relatime]
+	MountOptions(ctxt context.Context, path string) ([]string, error)
+	// Returns the space and inode usage of the filesystem mounted at path
+	Statfs(ctxt context.Context, path string) (*FsStats, error)
+	// Returns every mount point under prefix and the device mounted there
+	ListMounts(ctxt context.Context, prefix string) (map[string]string, error)
+}
+
+type Formatter interface {
+	// Creates a filesystem on device.  The command output is returned even on
+	// failure so callers can decide whether a retry makes sense
+	Format(ctxt context.Context, device, fsType string, fsArgs []string) (string, error)
+	// Runs cmd to grow the filesystem on device to the size of the device
+	ExpandFs(ctxt context.Context, device string, cmd []string) error
+	// Returns the filesystem, partition table or other signature on device.
+	// An error means the device could not be inspected, not that it is empty
+	Probe(ctxt context.Context, device string) (*Signature, error)
+	// Runs cmd to check the filesystem on device.  The checker output is
+	// returned even on failure
+	CheckFs(ctxt context.Context, device string, cmd []string) (string, error)
+}
+
+type BlockDevices interface {
+	// Returns the filesystem type on device, or an error if there is none
+	FsType(ctxt context.Context, device string) (string, error)
+	// Returns the size of device in bytes
+	Size(ctxt context.Context, device string) (int64, error)
+	// Creates a block device node at dest with the same major/minor numbers
+	// as device.  This is for raw block-mode support in kubernetes
+	MakeNode(ctxt context.Context, device, dest string) error
+	// Returns the SCSI state of device, "running" when its iSCSI session is
+	// healthy.  For multipath devices the first path not running is reported
+	DeviceState(ctxt context.Context, device string) (string, error)
+	// Returns whether path is a block device node, or an error if it doesn't
+	// exist
+	IsBlockDevice(ctxt context.Context, path string) (bool, error)
+}
+
+type MultipathDevices interface {
+	// Returns the device mapper multipath device (eg: /dev/dm-3) device
+	// belongs to, or device itself if it is one
+	MultipathDevice(ctxt context.Context, device string) (string, error)
+	// Returns the SCSI state of every path of the multipath device, keyed by
+	// path name, eg: {sdb: running, sdc: transport-offline}
+	MultipathPaths(ctxt context.Context, device string) (map[string]string, error)
+	// Grows the multipath device to the size of its paths
+	ResizeMultipath(ctxt context.Context, device string) error
+	// Flushes and removes the multipath device, failing if it is still open
+	FlushMultipath(ctxt context.Context, device string) error
+	// Returns every multipath device on the node
+	MultipathMaps(ctxt context.Context) ([]string, error)
+}
+
+type IscsiConnector interface {
+	// Logs in to the targets described by c, returning the device path
+	Connect(ctxt context.Context, c *Connector) (string, error)
+	// Logs out of every session for iqn on the provided portals
+	Disconnect(ctxt context.Context, iqn string, portals []string) error
+	// Rescans the iSCSI sessions of the target iqn so size changes are picked
+	// up.  Every session is rescanned when iqn is empty
+	Rescan(ctxt context.Context, iqn string) error
+	// Returns the IQN of the local initiator
+	InitiatorName(ctxt context.Context) (string, error)
+	// Returns every iSCSI session logged in on the node
+	Sessions(ctxt context.Context) ([]*Session, error)
+}
+
+type Host interface {
+	Mounter
+	Formatter
+	BlockDevices
+	MultipathDevices
+	IscsiConnector
+}
+
+// Executor runs a command on the node and returns its combined output
+type Executor interface {
+	Run(ctxt context.Context, cmd ...string) (string, error)
+}
+
+type execExecutor struct{}
+
+func NewExecutor() Executor {
+	return &execExecutor{}
+}
+
+func (e *execExecutor) Run(ctxt context.Context, cmd ...string) (string, error) {
+	ncmd := []string{}
+	for _, c := range cmd {
+		c = strings.TrimSpace(c)
+		if c != "" {
+			ncmd = append(ncmd, c)
+		}
+	}
+	co.Debugf(ctxt, "Running command: [%s]\n", strings.Join(ncmd, " "))
+	c := exec.Command(ncmd[0], ncmd[1:]...)
+	out, err := c.CombinedOutput()
+	sout := string(out)
+	co.Debug(ctxt, sout)
+	return sout, err
+}
+
+type linuxHost struct {
+	exec Executor
+}
+
+func NewHost() Host {
+	return NewHostWithExecutor(NewExecutor())
+}
+
+// Same as NewHost, but every command is run through the provided Executor
+func NewHostWithExecutor(e Executor) Host {
+	return &linuxHost{exec: e}
+}
@@ -0,0 +1,468 @@
+package host
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	co "github.com/Datera/datera-csi/pkg/common"
+)
+
+type recorder struct {
+	cmds [][]string
+	out  map[string]string
+	errs map[string]error
+}
+
+func (r *recorder) Run(ctxt context.Context, cmd ...string) (string, error) {
+	r.cmds = append(r.cmds, cmd)
+	if out, ok := r.out[cmd[0]]; ok {
+		return out, r.errs[cmd[0]]
+	}
+	return "", fmt.Errorf("%s: command not found", cmd[0])
+}
+
+// Like exec.ExitError
+type exitError int
+
+func (e exitError) Error() string {
+	return fmt.Sprintf("exit status %d", int(e))
+}
+
+func (e exitError) ExitCode() int {
+	return int(e)
+}
+
+func getCtxt() context.Context {
+	return co.WithCtxt(context.Background(), "host-test", "")
+}
+
+func getHost(t *testing.T, mounts string) (Host, *recorder, string) {
+	dir, err := ioutil.TempDir("", "host-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	mountsFile = filepath.Join(dir, "mounts")
+	if err = ioutil.WriteFile(mountsFile, []byte(mounts), 0644); err != nil {
+		t.Fatal(err)
+	}
+	r := &recorder{out: map[string]string{"mount": "", "umount": ""}, errs: map[string]error{}}
+	return NewHostWithExecutor(r), r, dir
+}
+
+func TestMountDevice(t *testing.T) {
+	h, r, dir := getHost(t, "")
+	defer os.RemoveAll(dir)
+	dest := filepath.Join(dir, "staging")
+	if err := h.Mount(getCtxt(), "/dev/sdb", dest, "ext4", []string{"-o", "noatime"}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(dest); err != nil {
+		t.Fatalf("Mount point not created: %s", err)
+	}
+	expected := []string{"mount", "-t", "ext4", "/dev/sdb", dest, "-o", "noatime"}
+	if !reflect.DeepEqual(r.cmds[len(r.cmds)-1], expected) {
+		t.Fatalf("Expected %s, got %s", expected, r.cmds[len(r.cmds)-1])
+	}
+}
+
+func TestMountBindResolvesDevice(t *testing.T) {
+	h, r, dir := getHost(t, "/dev/sdb /globalmount ext4 rw 0 0\n")
+	defer os.RemoveAll(dir)
+	dest := filepath.Join(dir, "publish")
+	if err := h.Mount(getCtxt(), "/globalmount", dest, "ext4", []string{"--bind"}); err != nil {
+		t.Fatal(err)
+	}
+	// readlink isn't available, so the device from /proc/mounts is used as is
+	expected := []string{"mount", "/dev/sdb", dest}
+	if !reflect.DeepEqual(r.cmds[len(r.cmds)-1], expected) {
+		t.Fatalf("Expected %s, got %s", expected, r.cmds[len(r.cmds)-1])
+	}
+}
+
+func TestDeviceFromMount(t *testing.T) {
+	h, _, dir := getHost(t, "/dev/sdb /globalmount ext4 rw 0 0\n/dev/sdc /globalmount-2 xfs rw 0 0\n")
+	defer os.RemoveAll(dir)
+	dev, err := h.DeviceFromMount(getCtxt(), "/globalmount")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if dev != "/dev/sdb" {
+		t.Fatalf("Expected /dev/sdb, got %s", dev)
+	}
+	if _, err = h.DeviceFromMount(getCtxt(), "/not-mounted"); err == nil {
+		t.Fatal("Expected an error for a path that isn't mounted")
+	}
+}
+
+func TestFormat(t *testing.T) {
+	h, r, dir := getHost(t, "")
+	defer os.RemoveAll(dir)
+	r.out["mkfs.xfs"] = ""
+	if _, err := h.Format(getCtxt(), "/dev/sdb", "xfs", []string{"-f"}); err != nil {
+		t.Fatal(err)
+	}
+	expected := []string{"mkfs.xfs", "-f", "/dev/sdb"}
+	if !reflect.DeepEqual(r.cmds[0], expected) {
+		t.Fatalf("Expected %s, got %s", expected, r.cmds[0])
+	}
+}
+
+func TestFsType(t *testing.T) {
+	h, r, dir := getHost(t, "")
+	defer os.RemoveAll(dir)
+	r.out["lsblk"] = `{"blockdevices": [{"name": "sdb", "fstype": "xfs"}]}`
+	fs, err := h.FsType(getCtxt(), "/dev/sdb")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fs != "xfs" {
+		t.Fatalf("Expected xfs, got %s", fs)
+	}
+	r.out["lsblk"] = `{"blockdevices": [{"name": "sdb", "fstype": null}]}`
+	if _, err = h.FsType(getCtxt(), "/dev/sdb"); err == nil {
+		t.Fatal("Expected an error for an unformatted device")
+	}
+}
+
+func TestProbe(t *testing.T) {
+	h, r, dir := getHost(t, "")
+	defer os.RemoveAll(dir)
+	for _, c := range []struct {
+		out      string
+		err      error
+		expected *Signature
+	}{
+		{"DEVNAME=/dev/sdb\nUUID=1b4e\nTYPE=xfs\nUSAGE=filesystem\n", nil, &Signature{Type: "xfs", Usage: "filesystem"}},
+		{"DEVNAME=/dev/sdb\nTYPE=LVM2_member\nUSAGE=raid\n", nil, &Signature{Type: "LVM2_member", Usage: "raid"}},
+		{"DEVNAME=/dev/sdb\nPTUUID=5d1c\nPTTYPE=gpt\n", nil, &Signature{PtType: "gpt"}},
+		{"", exitError(2), &Signature{}},
+	} {
+		r.out["blkid"], r.errs["blkid"] = c.out, c.err
+		sig, err := h.Probe(getCtxt(), "/dev/sdb")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(sig, c.expected) {
+			t.Fatalf("Expected %+v, got %+v", c.expected, sig)
+		}
+	}
+	if last := r.cmds[len(r.cmds)-1]; !reflect.DeepEqual(last, []string{"blkid", "-p", "-o", "export", "/dev/sdb"}) {
+		t.Fatalf("Unexpected blkid command %s", last)
+	}
+	// Anything else means the device couldn't be inspected, not that it's empty
+	r.out["blkid"], r.errs["blkid"] = "", exitError(8)
+	if _, err := h.Probe(getCtxt(), "/dev/sdb"); err == nil {
+		t.Fatal("Expected an error when blkid fails")
+	}
+}
+
+func TestCheckFs(t *testing.T) {
+	h, r, dir := getHost(t, "")
+	defer os.RemoveAll(dir)
+	r.out["xfs_repair"] = ""
+	expected := []string{"xfs_repair", "-n", "/dev/sdb"}
+	if _, err := h.CheckFs(getCtxt(), "/dev/sdb", expected); err != nil {
+		t.Fatal(err)
+	}
+	if last := r.cmds[len(r.cmds)-1]; !reflect.DeepEqual(last, expected) {
+		t.Fatalf("Expected %s, got %s", expected, last)
+	}
+	if _, err := h.CheckFs(getCtxt(), "/dev/sdb", nil); err == nil {
+		t.Fatal("Expected an error without a check command")
+	}
+}
+
+func TestSize(t *testing.T) {
+	h, r, dir := getHost(t, "")
+	defer os.RemoveAll(dir)
+	r.out["blockdev"] = "10737418240\n"
+	size, err := h.Size(getCtxt(), "/dev/sdb")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if size != 10737418240 {
+		t.Fatalf("Expected 10737418240, got %d", size)
+	}
+}
+
+func TestExpandFs(t *testing.T) {
+	h, r, dir := getHost(t, "")
+	defer os.RemoveAll(dir)
+	r.out["resize2fs"] = ""
+	r.out["xfs_growfs"] = ""
+	if err := h.ExpandFs(getCtxt(), "/dev/sdb", []string{"resize2fs", "/dev/sdb"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := h.ExpandFs(getCtxt(), "/dev/sdb", []string{"xfs_growfs", "/mnt/sdb"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := h.ExpandFs(getCtxt(), "/dev/sdb", nil); err == nil {
+		t.Fatal("Expected an error without an expansion command")
+	}
+	cmds := []string{}
+	for _, c := range r.cmds {
+		cmds = append(cmds, strings.Join(c, " "))
+	}
+	expected := []string{"resize2fs /dev/sdb", "xfs_growfs /mnt/sdb"}
+	if !reflect.DeepEqual(cmds, expected) {
+		t.Fatalf("Expected %s, got %s", expected, cmds)
+	}
+}
+
+func TestMountOptions(t *testing.T) {
+	h, _, dir := getHost(t, "/dev/sdb /globalmount ext4 rw,relatime 0 0\n/dev/sdb /globalmount ext4 ro,relatime 0 0\n")
+	defer os.RemoveAll(dir)
+	opts, err := h.MountOptions(getCtxt(), "/globalmount")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The last mount on a path is the visible one
+	if !reflect.DeepEqual(opts, []string{"ro", "relatime"}) {
+		t.Fatalf("Expected [ro relatime], got %s", opts)
+	}
+	if _, err = h.MountOptions(getCtxt(), "/not-mounted"); err == nil {
+		t.Fatal("Expected an error for a path that isn't mounted")
+	}
+}
+
+func TestDeviceState(t *testing.T) {
+	h, _, dir := getHost(t, "")
+	defer os.RemoveAll(dir)
+	sysBlock = filepath.Join(dir, "block")
+	sysDevBlock = filepath.Join(dir, "dev-block")
+	for dev, state := range map[string]string{"sdb": "running", "sdc": "running", "sdd": "blocked"} {
+		p := filepath.Join(sysBlock, dev, "device")
+		if err := os.MkdirAll(p, 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(filepath.Join(p, "state"), []byte(state+"\n"), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for dm, slaves := range map[string][]string{"dm-0": {"sdb", "sdc"}, "dm-1": {"sdc", "sdd"}} {
+		for _, slave := range slaves {
+			if err := os.MkdirAll(filepath.Join(sysBlock, dm, "slaves", slave), 0755); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	// readlink isn't available, so devices are used as is
+	for dev, expected := range map[string]string{
+		"/dev/sdb":  "running",
+		"/dev/sdd":  "blocked",
+		"/dev/dm-0": "running",
+		"/dev/dm-1": "blocked",
+	} {
+		state, err := h.DeviceState(getCtxt(), dev)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if state != expected {
+			t.Fatalf("Expected %s to be %s, got %s", dev, expected, state)
+		}
+	}
+	if _, err := h.DeviceState(getCtxt(), "/dev/sde"); err == nil {
+		t.Fatal("Expected an error for a missing device")
+	}
+}
+
+func TestStatfs(t *testing.T) {
+	h, _, dir := getHost(t, "")
+	defer os.RemoveAll(dir)
+	st, err := h.Statfs(getCtxt(), dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if st.TotalBytes <= 0 || st.UsedBytes > st.TotalBytes || st.AvailableBytes > st.TotalBytes {
+		t.Fatalf("Unexpected filesystem stats: %+v", st)
+	}
+	if _, err = h.Statfs(getCtxt(), filepath.Join(dir, "missing")); err == nil {
+		t.Fatal("Expected an error for a missing path")
+	}
+}
+
+func TestIsBlockDevice(t *testing.T) {
+	h, _, dir := getHost(t, "")
+	defer os.RemoveAll(dir)
+	for _, p := range []string{dir, "/dev/null"} {
+		block, err := h.IsBlockDevice(getCtxt(), p)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if block {
+			t.Fatalf("%s reported as a block device", p)
+		}
+	}
+	if _, err := h.IsBlockDevice(getCtxt(), filepath.Join(dir, "missing")); err == nil {
+		t.Fatal("Expected an error for a missing path")
+	}
+}
+
+func TestMakeReadOnly(t *testing.T) {
+	h, r, dir := getHost(t, "")
+	defer os.RemoveAll(dir)
+	if err := h.MakeReadOnly(getCtxt(), "/publish"); err != nil {
+		t.Fatal(err)
+	}
+	expected := []string{"mount", "-o", "remount,bind,ro", "/publish"}
+	if !reflect.DeepEqual(r.cmds[len(r.cmds)-1], expected) {
+		t.Fatalf("Expected %s, got %s", expected, r.cmds[len(r.cmds)-1])
+	}
+}
+
+func TestMountBindBlockDevice(t *testing.T) {
+	h, r, dir := getHost(t, "")
+	defer os.RemoveAll(dir)
+	dev := "/dev/loop0"
+	if block, err := h.IsBlockDevice(getCtxt(), dev); err != nil || !block {
+		t.Skipf("%s is not available", dev)
+	}
+	dest := filepath.Join(dir, "publish", "pvc-1")
+	if err := h.Mount(getCtxt(), dev, dest, "", []string{"--bind"}); err != nil {
+		t.Fatal(err)
+	}
+	// The target of a raw block bind mount must be a file
+	if fi, err := os.Stat(dest); err != nil || !fi.Mode().IsRegular() {
+		t.Fatalf("Expected a file at %s, got %v, %v", dest, fi, err)
+	}
+	expected := []string{"mount", dev, dest, "--bind"}
+	if !reflect.DeepEqual(r.cmds[len(r.cmds)-1], expected) {
+		t.Fatalf("Expected %s, got %s", expected, r.cmds[len(r.cmds)-1])
+	}
+	if err := h.Unmount(getCtxt(), dest); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(dest); !os.IsNotExist(err) {
+		t.Fatalf("Expected %s to be removed, got %v", dest, err)
+	}
+}
+
+func TestMultipath(t *testing.T) {
+	h, r, dir := getHost(t, "")
+	defer os.RemoveAll(dir)
+	sysBlock = filepath.Join(dir, "block")
+	sysDevBlock = filepath.Join(dir, "dev-block")
+	write := func(path, content string) {
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(path, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	write(filepath.Join(sysBlock, "sdb", "device", "state"), "running\n")
+	write(filepath.Join(sysBlock, "sdc", "device", "state"), "transport-offline\n")
+	write(filepath.Join(sysBlock, "dm-0", "dm", "uuid"), "mpath-36001405abcdef\n")
+	write(filepath.Join(sysBlock, "dm-1", "dm", "uuid"), "LVM-abcdef\n")
+	for _, p := range []string{"dm-0/slaves/sdb", "dm-0/slaves/sdc", "sdb/holders/dm-0", "sdd/holders/dm-1"} {
+		if err := os.MkdirAll(filepath.Join(sysBlock, p), 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, dev := range []string{"/dev/sdb", "/dev/dm-0"} {
+		dm, err := h.MultipathDevice(getCtxt(), dev)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if dm != "/dev/dm-0" {
+			t.Fatalf("Expected /dev/dm-0 for %s, got %s", dev, dm)
+		}
+	}
+	// LVM is device mapper too, but not multipath
+	if _, err := h.MultipathDevice(getCtxt(), "/dev/sdd"); err == nil {
+		t.Fatal("Expected an error for a device without a multipath holder")
+	}
+	paths, err := h.MultipathPaths(getCtxt(), "/dev/sdb")
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := map[string]string{"sdb": "running", "sdc": "transport-offline"}
+	if !reflect.DeepEqual(paths, expected) {
+		t.Fatalf("Expected %s, got %s", expected, paths)
+	}
+
+	r.out["multipathd"] = "ok\n"
+	r.out["multipath"] = ""
+	if err = h.ResizeMultipath(getCtxt(), "/dev/dm-0"); err != nil {
+		t.Fatal(err)
+	}
+	if err = h.FlushMultipath(getCtxt(), "/dev/dm-0"); err != nil {
+		t.Fatal(err)
+	}
+	r.out["multipathd"] = "fail\n"
+	if err = h.ResizeMultipath(getCtxt(), "/dev/dm-0"); err == nil {
+		t.Fatal("Expected an error when multipathd fails the resize")
+	}
+	cmds := []string{}
+	for _, c := range r.cmds {
+		if c[0] != "readlink" {
+			cmds = append(cmds, strings.Join(c, " "))
+		}
+	}
+	expectedCmds := []string{"multipathd resize map dm-0", "multipath -f /dev/dm-0", "multipathd resize map dm-0"}
+	if !reflect.DeepEqual(cmds, expectedCmds) {
+		t.Fatalf("Expected %s, got %s", expectedCmds, cmds)
+	}
+}
+
+func TestRescan(t *testing.T) {
+	h, r, dir := getHost(t, "")
+	defer os.RemoveAll(dir)
+	r.out["iscsiadm"] = ""
+	if err := h.Rescan(getCtxt(), "iqn.2013-05.com.daterainc:tc:01:sn:abc"); err != nil {
+		t.Fatal(err)
+	}
+	if err := h.Rescan(getCtxt(), ""); err != nil {
+		t.Fatal(err)
+	}
+	expected := [][]string{
+		{"iscsiadm", "-m", "node", "-T", "iqn.2013-05.com.daterainc:tc:01:sn:abc", "-R"},
+		{"iscsiadm", "-m", "session", "-R"},
+	}
+	if !reflect.DeepEqual(r.cmds, expected) {
+		t.Fatalf("Expected %s, got %s", expected, r.cmds)
+	}
+}
+
+func TestSessions(t *testing.T) {
+	h, r, dir := getHost(t, "")
+	defer os.RemoveAll(dir)
+	r.out["iscsiadm"] = "tcp: [1] 172.28.41.10:3260,1 iqn.2013-05.com.daterainc:tc:01:sn:9b3b0d3b (non-flash)\n" +
+		"tcp: [2] 172.28.41.11:3260,2 iqn.2013-05.com.daterainc:tc:01:sn:9b3b0d3b (non-flash)\n"
+	sessions, err := h.Sessions(getCtxt())
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []*Session{
+		{Iqn: "iqn.2013-05.com.daterainc:tc:01:sn:9b3b0d3b", Portal: "172.28.41.10:3260"},
+		{Iqn: "iqn.2013-05.com.daterainc:tc:01:sn:9b3b0d3b", Portal: "172.28.41.11:3260"},
+	}
+	// The by-path devices don't exist here
+	if !reflect.DeepEqual(sessions, expected) {
+		t.Fatalf("Expected %+v, got %+v", expected, sessions)
+	}
+}
+
+func TestListMounts(t *testing.T) {
+	h, _, dir := getHost(t, "/dev/sdb /var/lib/kubelet/plugins/kubernetes.io/csi/pv/pvc-1/globalmount ext4 rw 0 0\n"+
+		"udev /var/lib/kubelet/plugins/kubernetes.io/csi/volumeDevices/publish/pvc-2/pod-1 devtmpfs rw 0 0\n"+
+		"/dev/sda1 / ext4 rw 0 0\n")
+	defer os.RemoveAll(dir)
+	mounts, err := h.ListMounts(getCtxt(), "/var/lib/kubelet")
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := map[string]string{
+		"/var/lib/kubelet/plugins/kubernetes.io/csi/pv/pvc-1/globalmount":              "/dev/sdb",
+		"/var/lib/kubelet/plugins/kubernetes.io/csi/volumeDevices/publish/pvc-2/pod-1": "udev",
+	}
+	if !reflect.DeepEqual(mounts, expected) {
+		t.Fatalf("Expected %s, got %s", expected, mounts)
+	}
+}
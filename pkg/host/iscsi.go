@@ -0,0 +1,108 @@
+package host
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strings"
+
+	iscsi "github.com/kubernetes-csi/csi-lib-iscsi/iscsi"
+
+	co "github.com/Datera/datera-csi/pkg/common"
+)
+
+var (
+	initiatorFile = "/etc/iscsi/initiatorname.iscsi"
+)
+
+// Connector describes the targets, multipath and CHAP settings of a login
+type Connector = iscsi.Connector
+
+// TargetInfo is a single portal of a Connector
+type TargetInfo = iscsi.TargetInfo
+
+// Session is a logged in iSCSI session
+type Session struct {
+	Iqn string
+	// ip:port
+	Portal string
+	// The disk of LUN 0, eg: /dev/sdb.  Empty if it never showed up
+	Device string
+}
+
+func (h *linuxHost) Connect(ctxt context.Context, c *Connector) (string, error) {
+	return iscsi.Connect(*c)
+}
+
+func (h *linuxHost) Disconnect(ctxt context.Context, iqn string, portals []string) error {
+	return iscsi.Disconnect(iqn, portals)
+}
+
+func (h *linuxHost) Rescan(ctxt context.Context, iqn string) error {
+	cmd := []string{"iscsiadm", "-m", "session", "-R"}
+	if iqn != "" {
+		cmd = []string{"iscsiadm", "-m", "node", "-T", iqn, "-R"}
+	}
+	_, err := h.exec.Run(ctxt, cmd...)
+	return err
+}
+
+// Parses iscsiadm -m session output, eg:
+// tcp: [1] 172.28.41.10:3260,1 iqn.2013-05.com.daterainc:tc:01:sn:9b3b0d3b (non-flash)
+func parseSessions(out string) []*Session {
+	sessions := []*Session{}
+	for _, line := range strings.Split(out, "\n") {
+		fields := strings.Fields(line)
+		if len(fields) < 4 || !strings.HasPrefix(fields[1], "[") {
+			continue
+		}
+		sessions = append(sessions, &Session{
+			Iqn:    fields[3],
+			Portal: strings.SplitN(fields[2], ",", 2)[0],
+		})
+	}
+	return sessions
+}
+
+func (h *linuxHost) Sessions(ctxt context.Context) ([]*Session, error) {
+	out, err := h.exec.Run(ctxt, "iscsiadm", "-m", "session")
+	if err != nil {
+		if strings.Contains(out, "No active sessions") {
+			return []*Session{}, nil
+		}
+		return nil, err
+	}
+	sessions := parseSessions(out)
+	for _, s := range sessions {
+		path := fmt.Sprintf("/dev/disk/by-path/ip-%s-iscsi-%s-lun-0", s.Portal, s.Iqn)
+		if _, err := os.Stat(path); err != nil {
+			continue
+		}
+		if s.Device, err = h.readlink(ctxt, path); err != nil || s.Device == "" {
+			s.Device = path
+		}
+	}
+	return sessions, nil
+}
+
+func (h *linuxHost) InitiatorName(ctxt context.Context) (string, error) {
+	// Parse InitiatorName
+	dat, err := ioutil.ReadFile(initiatorFile)
+	if err != nil {
+		co.Debugf(ctxt, "Could not read file %s", initiatorFile)
+		return "", err
+	}
+	parts := strings.SplitN(strings.TrimSpace(string(dat)), "=", 2)
+	if len(parts) != 2 {
+		return "", fmt.Errorf("Could not parse InitiatorName from %s", initiatorFile)
+	}
+	iqn := parts[1]
+	co.Debugf(ctxt, "Obtained client iqn: %s", iqn)
+
+	return iqn, nil
+}
+
+func init() {
+	iscsi.EnableDebugLogging(os.Stdout)
+}
@@ -0,0 +1,230 @@
+package host
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	unix "golang.org/x/sys/unix"
+
+	co "github.com/Datera/datera-csi/pkg/common"
+)
+
+var (
+	mountsFile = "/proc/mounts"
+)
+
+// FsStats is the usage of a mounted filesystem.  Available is what an
+// unprivileged user can still allocate, so Used + Available can be less than
+// Total
+type FsStats struct {
+	TotalBytes     int64
+	AvailableBytes int64
+	UsedBytes      int64
+	TotalInodes    int64
+	FreeInodes     int64
+	UsedInodes     int64
+}
+
+type mountEntry struct {
+	device  string
+	path    string
+	options []string
+}
+
+func readMounts() ([]mountEntry, error) {
+	f, err := os.Open(mountsFile)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	entries := []mountEntry{}
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) < 2 {
+			continue
+		}
+		e := mountEntry{device: fields[0], path: fields[1]}
+		if len(fields) > 3 {
+			e.options = strings.Split(fields[3], ",")
+		}
+		entries = append(entries, e)
+	}
+	return entries, scanner.Err()
+}
+
+func (h *linuxHost) readlink(ctxt context.Context, device string) (string, error) {
+	out, err := h.exec.Run(ctxt, "readlink", "-f", device)
+	return strings.TrimSpace(out), err
+}
+
+func (h *linuxHost) DeviceFromMount(ctxt context.Context, path string) (string, error) {
+	mounts, err := readMounts()
+	if err != nil {
+		return "", err
+	}
+	for _, m := range mounts {
+		if m.path != path {
+			continue
+		}
+		dev, err := h.readlink(ctxt, m.device)
+		// If readlink fails, we'll assume the device we pulled from /proc/mounts
+		// is correct.  Some versions of readlink won't error out and instead will
+		// return the file/directory that was passed in, in which case we'll just
+		// return that
+		if err != nil || dev == "" {
+			return m.device, nil
+		}
+		return dev, nil
+	}
+	return "", fmt.Errorf("No device mounted at %s", path)
+}
+
+func (h *linuxHost) FindMount(ctxt context.Context, device string) (string, error) {
+	mounts, err := readMounts()
+	if err != nil {
+		return "", err
+	}
+	// /proc/mounts lists the resolved device, not the by-path link
+	dev, err := h.readlink(ctxt, device)
+	if err != nil || dev == "" {
+		dev = device
+	}
+	for _, m := range mounts {
+		if m.device == device || m.device == dev {
+			return m.path, nil
+		}
+	}
+	return "", fmt.Errorf("Device %s is not mounted", device)
+}
+
+func (h *linuxHost) ListMounts(ctxt context.Context, prefix string) (map[string]string, error) {
+	mounts, err := readMounts()
+	if err != nil {
+		return nil, err
+	}
+	result := map[string]string{}
+	for _, m := range mounts {
+		if !strings.HasPrefix(m.path, prefix) {
+			continue
+		}
+		dev := m.device
+		// Bind mounted raw block devices show up as udev or devtmpfs
+		if strings.HasPrefix(dev, "/dev/") {
+			if rdev, err := h.readlink(ctxt, dev); err == nil && rdev != "" {
+				dev = rdev
+			}
+		}
+		result[m.path] = dev
+	}
+	return result, nil
+}
+
+func (h *linuxHost) MountOptions(ctxt context.Context, path string) ([]string, error) {
+	mounts, err := readMounts()
+	if err != nil {
+		return nil, err
+	}
+	// Later entries are mounted on top of earlier ones
+	for i := len(mounts) - 1; i >= 0; i-- {
+		if mounts[i].path == path {
+			return mounts[i].options, nil
+		}
+	}
+	return nil, fmt.Errorf("Nothing mounted at %s", path)
+}
+
+func (h *linuxHost) Statfs(ctxt context.Context, path string) (*FsStats, error) {
+	s := unix.Statfs_t{}
+	if err := unix.Statfs(path, &s); err != nil {
+		return nil, err
+	}
+	bsize := int64(s.Bsize)
+	return &FsStats{
+		TotalBytes:     int64(s.Blocks) * bsize,
+		AvailableBytes: int64(s.Bavail) * bsize,
+		UsedBytes:      int64(s.Blocks-s.Bfree) * bsize,
+		TotalInodes:    int64(s.Files),
+		FreeInodes:     int64(s.Ffree),
+		UsedInodes:     int64(s.Files - s.Ffree),
+	}, nil
+}
+
+// Cases:
+// /dev/disk/by-path/some-ip-and-iqn /var/lib/kubelet/plugins/kubernetes.io/csi/pv/pvc-<uuid>/globalmount
+// /var/lib/kubelet/plugins/kubernetes.io/csi/pv/pvc-<uuid>/globalmount /var/lib/kubelet/plugins/kubernetes.io/csi/pv/new_mount
+func (h *linuxHost) Mount(ctxt context.Context, source, dest, fs string, options []string) error {
+	co.Debugf(ctxt, "Mount called. source: %s, dest: %s, options: %s, fs: %s", source, dest, options, fs)
+
+	bind := false
+	for _, opt := range options {
+		if opt == "--bind" {
+			bind = true
+		}
+	}
+	// Create destination directory if it doesn't exist.  A raw block device
+	// can only be bind mounted onto a file
+	if _, err := os.Stat(dest); os.IsNotExist(err) {
+		if block, _ := h.IsBlockDevice(ctxt, source); bind && block {
+			err = createFile(dest)
+		} else {
+			err = os.MkdirAll(dest, os.ModePerm)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	// Get the original device if this is a mount
+	dev, err := h.DeviceFromMount(ctxt, source)
+
+	// If we couldn't resolve, then we're probably working with the device already
+	cmd := []string{}
+	if err != nil {
+		dev = source
+		if bind {
+			cmd = append([]string{"mount", dev, dest}, options...)
+		} else {
+			cmd = append([]string{"mount", "-t", fs, dev, dest}, options...)
+		}
+	} else {
+		// Remove the --bind option, we're mounting the device directly
+		opts := []string{}
+		for _, opt := range options {
+			if opt != "--bind" {
+				opts = append(opts, opt)
+			}
+		}
+		cmd = append([]string{"mount", dev, dest}, opts...)
+	}
+	_, err = h.exec.Run(ctxt, cmd...)
+	return err
+}
+
+func createFile(path string) error {
+	if err := os.MkdirAll(filepath.Dir(path), os.ModePerm); err != nil {
+		return err
+	}
+	f, err := os.OpenFile(path, os.O_CREATE, 0640)
+	if err != nil {
+		return err
+	}
+	return f.Close()
+}
+
+func (h *linuxHost) MakeReadOnly(ctxt context.Context, path string) error {
+	// A bind remount only changes the flags of this mount point, not the
+	// superblock shared with the staging mount
+	_, err := h.exec.Run(ctxt, "mount", "-o", "remount,bind,ro", path)
+	return err
+}
+
+func (h *linuxHost) Unmount(ctxt context.Context, path string) error {
+	if _, err := h.exec.Run(ctxt, "umount", path); err != nil {
+		co.Info(ctxt, err)
+	}
+	return os.RemoveAll(path)
+}
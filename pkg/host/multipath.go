@@ -0,0 +1,80 @@
+package host
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+)
+
+// Device mapper devices created by multipathd have a uuid of mpath-<wwid>
+func isMultipathMap(name string) bool {
+	b, err := ioutil.ReadFile(filepath.Join(sysBlock, name, "dm", "uuid"))
+	return err == nil && strings.HasPrefix(strings.TrimSpace(string(b)), "mpath-")
+}
+
+func (h *linuxHost) MultipathDevice(ctxt context.Context, device string) (string, error) {
+	name := h.kernelName(ctxt, device)
+	if isMultipathMap(name) {
+		return "/dev/" + name, nil
+	}
+	holders, err := ioutil.ReadDir(filepath.Join(sysBlock, name, "holders"))
+	if err != nil {
+		return "", err
+	}
+	for _, holder := range holders {
+		if isMultipathMap(holder.Name()) {
+			return "/dev/" + holder.Name(), nil
+		}
+	}
+	return "", fmt.Errorf("%s is not part of a multipath device", device)
+}
+
+func (h *linuxHost) MultipathPaths(ctxt context.Context, device string) (map[string]string, error) {
+	dm, err := h.MultipathDevice(ctxt, device)
+	if err != nil {
+		return nil, err
+	}
+	slaves, err := ioutil.ReadDir(filepath.Join(sysBlock, filepath.Base(dm), "slaves"))
+	if err != nil {
+		return nil, err
+	}
+	paths := map[string]string{}
+	for _, slave := range slaves {
+		state, err := scsiState(slave.Name())
+		if err != nil {
+			state = "missing"
+		}
+		paths[slave.Name()] = state
+	}
+	return paths, nil
+}
+
+func (h *linuxHost) ResizeMultipath(ctxt context.Context, device string) error {
+	// multipathd reports failures in its output with a zero exit status
+	out, err := h.exec.Run(ctxt, "multipathd", "resize", "map", filepath.Base(device))
+	if err == nil && strings.TrimSpace(out) == "fail" {
+		err = fmt.Errorf("multipathd could not resize %s", device)
+	}
+	return err
+}
+
+func (h *linuxHost) FlushMultipath(ctxt context.Context, device string) error {
+	_, err := h.exec.Run(ctxt, "multipath", "-f", device)
+	return err
+}
+
+func (h *linuxHost) MultipathMaps(ctxt context.Context) ([]string, error) {
+	dms, err := filepath.Glob(filepath.Join(sysBlock, "dm-*"))
+	if err != nil {
+		return nil, err
+	}
+	maps := []string{}
+	for _, dm := range dms {
+		if name := filepath.Base(dm); isMultipathMap(name) {
+			maps = append(maps, "/dev/"+name)
+		}
+	}
+	return maps, nil
+}
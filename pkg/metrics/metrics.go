@@ -0,0 +1,122 @@
+// Package metrics holds the Prometheus collectors exported by the driver.
+// Everything is registered with a private registry served by Handler, so the
+// driver only exposes its own metrics plus the standard process and Go
+// runtime collectors
+package metrics
+
+import (
+	"net/http"
+	"time"
+
+	prometheus "github.com/prometheus/client_golang/prometheus"
+	promhttp "github.com/prometheus/client_golang/prometheus/promhttp"
+	codes "google.golang.org/grpc/codes"
+)
+
+const namespace = "datera_csi"
+
+var (
+	registry = prometheus.NewRegistry()
+
+	rpcRequests = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "rpc_requests_total",
+		Help:      "CSI RPCs handled, by method and gRPC status code",
+	}, []string{"method", "code"})
+	rpcDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Name:      "rpc_duration_seconds",
+		Help:      "Latency of CSI RPCs, by method and gRPC status code",
+		Buckets:   prometheus.ExponentialBuckets(0.01, 2, 16),
+	}, []string{"method", "code"})
+
+	backendDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Name:      "backend_request_duration_seconds",
+		Help:      "Latency of Datera API requests, by client operation and HTTP method",
+		Buckets:   prometheus.ExponentialBuckets(0.005, 2, 14),
+	}, []string{"operation", "method"})
+	backendErrors = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "backend_request_errors_total",
+		Help:      "Datera API requests that failed or returned an error status, by client operation and HTTP method",
+	}, []string{"operation", "method"})
+
+	nodeDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Name:      "node_operation_duration_seconds",
+		Help:      "Latency of node operations (iSCSI login/logout, format, mount), by operation and result",
+		Buckets:   prometheus.ExponentialBuckets(0.01, 2, 16),
+	}, []string{"operation", "result"})
+
+	backendHealthy = prometheus.NewGauge(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "backend_healthy",
+		Help:      "1 if the last heartbeat against the Datera system succeeded, 0 otherwise",
+	})
+	backendCapacity = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "backend_capacity_bytes",
+		Help:      "Datera system capacity as of the last GetCapacity call, by media (all, flash, hybrid) and kind (total, provisioned)",
+	}, []string{"media", "kind"})
+)
+
+func init() {
+	registry.MustRegister(
+		prometheus.NewProcessCollector(prometheus.ProcessCollectorOpts{}),
+		prometheus.NewGoCollector(),
+		rpcRequests,
+		rpcDuration,
+		backendDuration,
+		backendErrors,
+		nodeDuration,
+		backendHealthy,
+		backendCapacity,
+	)
+}
+
+// Handler serves every registered metric in the Prometheus text format
+func Handler() http.Handler {
+	return promhttp.HandlerFor(registry, promhttp.HandlerOpts{})
+}
+
+// ObserveRPC records a completed CSI RPC.  method is the full gRPC method
+// name, eg: /csi.v1.Controller/CreateVolume
+func ObserveRPC(method string, code codes.Code, d time.Duration) {
+	rpcRequests.WithLabelValues(method, code.String()).Inc()
+	rpcDuration.WithLabelValues(method, code.String()).Observe(d.Seconds())
+}
+
+// ObserveBackend records a single Datera API request made on behalf of the
+// client operation op, eg: GetVolume
+func ObserveBackend(op, method string, d time.Duration, failed bool) {
+	backendDuration.WithLabelValues(op, method).Observe(d.Seconds())
+	if failed {
+		backendErrors.WithLabelValues(op, method).Inc()
+	}
+}
+
+// ObserveNode records a node operation that started at start and finished
+// with err
+func ObserveNode(op string, start time.Time, err error) {
+	result := "success"
+	if err != nil {
+		result = "error"
+	}
+	nodeDuration.WithLabelValues(op, result).Observe(time.Since(start).Seconds())
+}
+
+// SetHealthy records the result of the latest heartbeat
+func SetHealthy(healthy bool) {
+	if healthy {
+		backendHealthy.Set(1)
+	} else {
+		backendHealthy.Set(0)
+	}
+}
+
+// SetCapacity records the capacity reported by the Datera system
+func SetCapacity(media string, total, provisioned int) {
+	backendCapacity.WithLabelValues(media, "total").Set(float64(total))
+	backendCapacity.WithLabelValues(media, "provisioned").Set(float64(provisioned))
+}
@@ -0,0 +1,81 @@
+package metrics
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	testutil "github.com/prometheus/client_golang/prometheus/testutil"
+	codes "google.golang.org/grpc/codes"
+)
+
+func scrape(t *testing.T) string {
+	srv := httptest.NewServer(Handler())
+	defer srv.Close()
+	resp, err := srv.Client().Get(srv.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	b, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(b)
+}
+
+func TestObserveRPC(t *testing.T) {
+	ObserveRPC("/csi.v1.Test/ObserveRPC", codes.OK, 20*time.Millisecond)
+	ObserveRPC("/csi.v1.Test/ObserveRPC", codes.NotFound, 5*time.Millisecond)
+	ObserveRPC("/csi.v1.Test/ObserveRPC", codes.NotFound, 5*time.Millisecond)
+	if c := testutil.ToFloat64(rpcRequests.WithLabelValues("/csi.v1.Test/ObserveRPC", "NotFound")); c != 2 {
+		t.Fatalf("Expected 2 NotFound requests, got %f", c)
+	}
+	out := scrape(t)
+	for _, line := range []string{
+		`datera_csi_rpc_requests_total{code="OK",method="/csi.v1.Test/ObserveRPC"} 1`,
+		`datera_csi_rpc_duration_seconds_count{code="NotFound",method="/csi.v1.Test/ObserveRPC"} 2`,
+	} {
+		if !strings.Contains(out, line) {
+			t.Fatalf("Expected %s in:\n%s", line, out)
+		}
+	}
+}
+
+func TestObserveBackend(t *testing.T) {
+	ObserveBackend("TestObserveBackend", "GET", time.Millisecond, false)
+	ObserveBackend("TestObserveBackend", "GET", time.Millisecond, true)
+	if c := testutil.ToFloat64(backendErrors.WithLabelValues("TestObserveBackend", "GET")); c != 1 {
+		t.Fatalf("Expected 1 backend error, got %f", c)
+	}
+}
+
+func TestObserveNode(t *testing.T) {
+	ObserveNode("test-login", time.Now(), nil)
+	ObserveNode("test-login", time.Now(), fmt.Errorf("iscsiadm: No session found"))
+	out := scrape(t)
+	for _, result := range []string{"success", "error"} {
+		line := fmt.Sprintf(`datera_csi_node_operation_duration_seconds_count{operation="test-login",result="%s"} 1`, result)
+		if !strings.Contains(out, line) {
+			t.Fatalf("Expected %s in:\n%s", line, out)
+		}
+	}
+}
+
+func TestGauges(t *testing.T) {
+	SetHealthy(false)
+	if v := testutil.ToFloat64(backendHealthy); v != 0 {
+		t.Fatalf("Expected unhealthy, got %f", v)
+	}
+	SetHealthy(true)
+	if v := testutil.ToFloat64(backendHealthy); v != 1 {
+		t.Fatalf("Expected healthy, got %f", v)
+	}
+	SetCapacity("flash", 1000, 250)
+	if v := testutil.ToFloat64(backendCapacity.WithLabelValues("flash", "provisioned")); v != 250 {
+		t.Fatalf("Expected 250 provisioned bytes, got %f", v)
+	}
+}